@@ -6,13 +6,19 @@ import (
 	"go-grpc-course/blog/blogpb"
 	"io"
 	"log"
+	"os"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+// tenantId is the tenant the blog calls below act on.
+const tenantId = "default"
+
 func main() {
 	fmt.Printf("Hello  I am client\n\n")
-	cc, err := grpc.Dial("localhost:50051", grpc.WithInsecure()) //connection to server
+	cc, err := grpc.Dial("localhost:50053", grpc.WithInsecure()) //connection to server
 
 	if err != nil {
 		log.Fatalf("Could not connect: %v", err)
@@ -37,6 +43,34 @@ func main() {
 
 	//List blog
 	listBlog(c)
+
+	//Related blogs
+	// relatedBlogs(c)
+
+	//Blog stats
+	// blogStats(c)
+
+	//Translate blog
+	// translateBlog(c)
+
+	//Edit blog in a collaborative session
+	// editBlog(c)
+
+	//Provision a tenant
+	// provisionTenant(blogpb.NewBlogAdminServiceClient(cc))
+
+	//Delete every blog of an author
+	// bulkDeleteByAuthor(blogpb.NewBlogAdminServiceClient(cc))
+}
+
+// tenantContext scopes the calls made with the returned context to a tenant.
+func tenantContext(id string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", id)
+}
+
+// adminContext carries the admin token, read from BLOG_ADMIN_TOKEN, that admin calls require.
+func adminContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-admin-token", os.Getenv("BLOG_ADMIN_TOKEN"))
 }
 
 func createBlog(c blogpb.BlogServiceClient) {
@@ -47,7 +81,7 @@ func createBlog(c blogpb.BlogServiceClient) {
 		Content:  "Creating our first blog",
 	}
 
-	res, err := c.CreateBlog(context.Background(), &blogpb.CreateBlogRequest{Blog: blog})
+	res, err := c.CreateBlog(tenantContext(tenantId), &blogpb.CreateBlogRequest{Blog: blog})
 	if err != nil {
 		log.Fatal("unexected error: ", err)
 	}
@@ -59,7 +93,7 @@ func readBlog(c blogpb.BlogServiceClient) {
 	fmt.Printf("Read blog client called\n")
 
 	blogId := "60b4066e58ae45070601eb67"
-	res, err := c.ReadBlog(context.Background(), &blogpb.ReadBlogRequest{BlogId: blogId})
+	res, err := c.ReadBlog(tenantContext(tenantId), &blogpb.ReadBlogRequest{BlogId: blogId})
 	if err != nil {
 		log.Fatal("Err while calling ReadBlog: ", err)
 	}
@@ -77,7 +111,7 @@ func updateBlog(c blogpb.BlogServiceClient) {
 		Id:       "60b4066e58ae45070601eb67",
 	}
 
-	res, err := c.UpdateBlog(context.Background(), &blogpb.UpdateBlogRequest{Blog: blog})
+	res, err := c.UpdateBlog(tenantContext(tenantId), &blogpb.UpdateBlogRequest{Blog: blog})
 	if err != nil {
 		log.Fatal("Err while updating blog:\n", err)
 	}
@@ -89,7 +123,7 @@ func deleteBlog(c blogpb.BlogServiceClient) {
 	fmt.Printf("DeleteBlog called by client...\n\n")
 	blogId := "60b4066e58ae45070601eb67"
 
-	res, err := c.DeleteBlog(context.Background(), &blogpb.DeleteBlogRequest{BlogId: blogId})
+	res, err := c.DeleteBlog(tenantContext(tenantId), &blogpb.DeleteBlogRequest{BlogId: blogId})
 	if err != nil {
 		log.Fatal("Err while deleting blog :\n", err)
 	}
@@ -100,21 +134,186 @@ func deleteBlog(c blogpb.BlogServiceClient) {
 func listBlog(c blogpb.BlogServiceClient) {
 	fmt.Printf("List blog called... \n\n")
 
-	resStream, err := c.ListBlog(context.Background(), &blogpb.ListBlogRequest{})
+	// A listing cut at the server's cap goes on after the last blog received.
+	afterId := ""
+	for {
+		resStream, err := c.ListBlog(tenantContext(tenantId), &blogpb.ListBlogRequest{AfterId: afterId})
+		if err != nil {
+			log.Fatal("Err while calling ListBlog ", err)
+		}
+
+		for {
+			res, err := resStream.Recv()
+			if err == io.EOF {
+				log.Printf("We've reached the end of stream, blogs sent: %v", resStream.Trailer().Get("x-items-sent"))
+				break
+			}
+			if err != nil {
+				log.Fatal("Error while reading stream: ", err)
+			}
+
+			log.Printf("Blog: %v\n\n", res.Blog)
+		}
+
+		next := resStream.Trailer().Get("x-next-after-id")
+		if len(next) == 0 {
+			return
+		}
+		afterId = next[0]
+	}
+}
+
+func provisionTenant(c blogpb.BlogAdminServiceClient) {
+	fmt.Printf("ProvisionTenant called by client...\n\n")
+
+	res, err := c.ProvisionTenant(adminContext(), &blogpb.ProvisionTenantRequest{
+		Tenant: &blogpb.Tenant{Id: "team-a", MaxBlogs: 100},
+	})
+	if err != nil {
+		log.Fatal("Err while provisioning tenant:\n", err)
+	}
+
+	fmt.Printf("Tenant provisioned: %v\n", res.GetTenant())
+}
+
+func relatedBlogs(c blogpb.BlogServiceClient) {
+	fmt.Printf("RelatedBlogs called by client...\n\n")
+	blogId := "60b4066e58ae45070601eb67"
+
+	res, err := c.RelatedBlogs(tenantContext(tenantId), &blogpb.RelatedBlogsRequest{BlogId: blogId, Limit: 3})
 	if err != nil {
-		log.Fatal("Err while calling ListBlog ", err)
+		log.Fatal("Err while calling RelatedBlogs:\n", err)
+	}
+
+	for _, r := range res.GetRelated() {
+		fmt.Printf("%.3f %v\n", r.GetScore(), r.GetBlog().GetTitle())
+	}
+}
+
+func translateBlog(c blogpb.BlogServiceClient) {
+	fmt.Printf("AddTranslation called by client...\n\n")
+	blogId := "60b4066e58ae45070601eb67"
+
+	_, err := c.AddTranslation(tenantContext(tenantId), &blogpb.AddTranslationRequest{
+		BlogId: blogId,
+		Translation: &blogpb.Translation{
+			Language: "fr",
+			Title:    "Apprendre les blogs",
+			Content:  "Création de notre premier blog",
+		},
+	})
+	if err != nil {
+		log.Fatal("Err while calling AddTranslation:\n", err)
+	}
+
+	res, err := c.ReadBlog(tenantContext(tenantId), &blogpb.ReadBlogRequest{
+		BlogId:             blogId,
+		PreferredLanguages: []string{"fr-CA", "en"},
+	})
+	if err != nil {
+		log.Fatal("Err while calling ReadBlog:\n", err)
+	}
+
+	fmt.Printf("Blog in %v (available: %v): %v\n", res.GetBlog().GetLanguage(), res.GetAvailableLanguages(), res.GetBlog().GetTitle())
+}
+
+func editBlog(c blogpb.BlogServiceClient) {
+	fmt.Printf("EditBlog called by client...\n\n")
+	blogId := "60b4066e58ae45070601eb67"
+
+	requests := []*blogpb.EditBlogRequest{
+		{Action: &blogpb.EditBlogRequest_Join{Join: &blogpb.EditJoin{BlogId: blogId, EditorId: "Nouru"}}},
+		{Action: &blogpb.EditBlogRequest_AcquireLock{AcquireLock: blogpb.EditSection_EDIT_SECTION_TITLE}},
+		{Action: &blogpb.EditBlogRequest_Change{Change: &blogpb.EditChange{
+			Section: blogpb.EditSection_EDIT_SECTION_TITLE,
+			Text:    "Learning about Blogs, together",
+		}}},
+		{Action: &blogpb.EditBlogRequest_ReleaseLock{ReleaseLock: blogpb.EditSection_EDIT_SECTION_TITLE}},
+	}
+
+	stream, err := c.EditBlog(tenantContext(tenantId))
+	if err != nil {
+		log.Fatal("Error while creating stream: ", err)
+	}
+
+	waitChannel := make(chan struct{})
+
+	go func() {
+		for _, req := range requests {
+			fmt.Printf("Sending: %v\n", req)
+			stream.Send(req)
+			time.Sleep(1000 * time.Millisecond)
+		}
+		stream.CloseSend()
+	}()
+
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatal("Error while receiving: ", err)
+			}
+			fmt.Printf("Received: %v\n", res)
+		}
+		close(waitChannel)
+	}()
+
+	<-waitChannel
+}
+
+func bulkDeleteByAuthor(c blogpb.BlogAdminServiceClient) {
+	fmt.Printf("PreviewBulkAction called by client...\n\n")
+
+	action := &blogpb.BulkAction{
+		Filter:    &blogpb.BlogFilter{TenantId: tenantId, AuthorId: "Nouru"},
+		Operation: &blogpb.BulkAction_Delete{Delete: &blogpb.BulkDelete{}},
+	}
+
+	preview, err := c.PreviewBulkAction(adminContext(), &blogpb.PreviewBulkActionRequest{Action: action})
+	if err != nil {
+		log.Fatal("Err while calling PreviewBulkAction:\n", err)
+	}
+	fmt.Printf("%d blogs will be deleted\n", preview.GetMatched())
+
+	stream, err := c.RunBulkAction(adminContext(), &blogpb.RunBulkActionRequest{
+		Action:            action,
+		ConfirmationToken: preview.GetConfirmationToken(),
+	})
+	if err != nil {
+		log.Fatal("Err while calling RunBulkAction:\n", err)
 	}
 
 	for {
-		res, err := resStream.Recv()
+		res, err := stream.Recv()
 		if err == io.EOF {
-			log.Printf("We've reached the end of stream ")
 			break
 		}
 		if err != nil {
-			log.Fatal("Error while reading stream: ", err)
+			log.Fatal("Err while receiving progress:\n", err)
 		}
+		fmt.Printf("%d/%d blogs deleted\n", res.GetProcessed(), res.GetTotal())
+	}
+}
+
+func blogStats(c blogpb.BlogServiceClient) {
+	fmt.Printf("GetBlogStats called by client...\n\n")
 
-		log.Printf("Blog: %v\n\n", res.Blog)
+	res, err := c.GetBlogStats(tenantContext(tenantId), &blogpb.GetBlogStatsRequest{
+		CreatedAfter: "2021-01-01T00:00:00Z",
+		TopTagsLimit: 5,
+	})
+	if err != nil {
+		log.Fatal("Err while calling GetBlogStats:\n", err)
+	}
+
+	fmt.Printf("%d posts, %.0f characters on average\n", res.GetTotalPosts(), res.GetAverageContentLength())
+	for _, am := range res.GetPostsPerAuthorMonth() {
+		fmt.Printf("%v %v: %d\n", am.GetMonth(), am.GetAuthorId(), am.GetPosts())
+	}
+	for _, t := range res.GetTopTags() {
+		fmt.Printf("#%v: %d\n", t.GetTag(), t.GetPosts())
 	}
 }
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// bulkBatchSize is the number of blogs handled between two progress reports.
+	bulkBatchSize = 100
+	// bulkTokenTTL is how long a confirmation token of PreviewBulkAction stays valid.
+	bulkTokenTTL = 5 * time.Minute
+)
+
+// bulkPreviews holds the confirmation tokens issued by PreviewBulkAction until they are used
+// or expire. Tokens are single use.
+var bulkPreviews = struct {
+	sync.Mutex
+	tokens map[string]*bulkPreview
+}{tokens: map[string]*bulkPreview{}}
+
+type bulkPreview struct {
+	action  *blogpb.BulkAction
+	matched int64
+	expires time.Time
+}
+
+// bulkFilter turns a BlogFilter into a MongoDB filter.
+func bulkFilter(f *blogpb.BlogFilter) (bson.M, error) {
+	filter := bson.M{}
+	if f.GetTenantId() != "" {
+		filter["tenant_id"] = f.GetTenantId()
+	}
+
+	criteria := 0
+	if f.GetAuthorId() != "" {
+		filter["author_id"] = f.GetAuthorId()
+		criteria++
+	}
+	if tag := strings.ToLower(strings.TrimSpace(f.GetTag())); tag != "" {
+		filter["tags"] = tag
+		criteria++
+	}
+
+	created, err := createdRange(f.GetCreatedAfter(), f.GetCreatedBefore())
+	if err != nil {
+		return nil, err
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+		criteria++
+	}
+
+	if criteria == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "A bulk action needs an author, a tag or a date range")
+	}
+	return filter, nil
+}
+
+// createdRange parses an RFC 3339 date range into a created_at condition, empty when both ends
+// are open.
+func createdRange(after, before string) (bson.M, error) {
+	created := bson.M{}
+	for op, value := range map[string]string{"$gte": after, "$lt": before} {
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Cannot parse date %q, expected RFC 3339", value),
+			)
+		}
+		created[op] = t.UTC()
+	}
+	return created, nil
+}
+
+// validateBulkAction checks an action and returns the filter of the blogs it applies to.
+func validateBulkAction(action *blogpb.BulkAction) (bson.M, error) {
+	filter, err := bulkFilter(action.GetFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := action.GetOperation().(type) {
+	case *blogpb.BulkAction_Delete:
+	case *blogpb.BulkAction_Retag:
+		add, err := normalizeTags(op.Retag.GetAddTags())
+		if err != nil {
+			return nil, err
+		}
+		remove, _ := normalizeTags(op.Retag.GetRemoveTags())
+		if len(add)+len(remove) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Retagging needs tags to add or remove")
+		}
+	case *blogpb.BulkAction_Reassign:
+		if op.Reassign.GetAuthorId() == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Reassigning needs an author")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "A bulk action needs an operation")
+	}
+
+	return filter, nil
+}
+
+// takePreview returns and forgets the preview of a token, nil when it is unknown or expired.
+func takePreview(token string) *bulkPreview {
+	bulkPreviews.Lock()
+	defer bulkPreviews.Unlock()
+
+	preview, ok := bulkPreviews.tokens[token]
+	delete(bulkPreviews.tokens, token)
+	if !ok || time.Now().After(preview.expires) {
+		return nil
+	}
+	return preview
+}
+
+// retag returns tags with add and without remove.
+func retag(tags, add, remove []string) []string {
+	removed := map[string]bool{}
+	for _, t := range remove {
+		removed[t] = true
+	}
+
+	var result []string
+	seen := map[string]bool{}
+	for _, t := range append(append([]string{}, tags...), add...) {
+		if !removed[t] && !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// runBulkBatch applies an action to the blogs of one batch still matching filter. It returns
+// the number of blogs handled and, among them, the number left unchanged.
+func runBulkBatch(ctx context.Context, action *blogpb.BulkAction, filter bson.M, ids []primitive.ObjectID) (int64, int64, error) {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	batchFilter := bson.M{"_id": bson.M{"$in": ids}}
+	for k, v := range filter {
+		batchFilter[k] = v
+	}
+
+	var blogs []*blogItem
+	err := forEach(ctx, collection, batchFilter, func(cur *mongo.Cursor) error {
+		data := &blogItem{}
+		if err := cur.Decode(data); err != nil {
+			return err
+		}
+		blogs = append(blogs, data)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, ok := action.GetOperation().(*blogpb.BulkAction_Delete); ok {
+		// Blogs are deleted one by one so that only those really deleted get an event; a blog
+		// deleted or changed to miss the filter since it was read is counted as skipped.
+		var processed, skipped int64
+		for _, data := range blogs {
+			processed++
+			events := &stagedEvents{}
+			if err := events.stage(context.Background(), &blogItem{ID: data.ID, TenantID: data.TenantID}, blogpb.WebhookEvent_WEBHOOK_EVENT_DELETED); err != nil {
+				events.abort(context.Background())
+				return processed, skipped, fmt.Errorf("cannot queue webhook events: %v", err)
+			}
+
+			blogFilter := bson.M{}
+			for k, v := range filter {
+				blogFilter[k] = v
+			}
+			blogFilter["_id"] = data.ID
+			blogFilter["tenant_id"] = data.TenantID
+			deleteResult, err := collection.DeleteOne(ctx, blogFilter)
+			if err != nil {
+				events.abort(context.Background())
+				return processed, skipped, err
+			}
+			if deleteResult.DeletedCount == 0 {
+				events.abort(context.Background())
+				skipped++
+				continue
+			}
+
+			if err := removeFromSeries(context.Background(), data.TenantID, data.ID); err != nil {
+				fmt.Printf("Cannot remove blog %v from its series: %v\n", data.ID.Hex(), err)
+			}
+			if _, err := translations.DeleteMany(context.Background(), bson.M{"tenant_id": data.TenantID, "blog_id": data.ID}); err != nil {
+				fmt.Printf("Cannot delete translations of blog %v: %v\n", data.ID.Hex(), err)
+			}
+			related.remove(data.ID.Hex())
+			releaseBlogs(context.Background(), data.TenantID, 1)
+			changes.record("blog", data.TenantID, data.ID)
+			events.commit(context.Background())
+		}
+		return processed, skipped, nil
+	}
+
+	var processed, skipped int64
+	for _, data := range blogs {
+		processed++
+		previousUpdatedAt := data.UpdatedAt
+		set := bson.M{"updated_at": nextUpdatedAt(previousUpdatedAt)}
+
+		switch op := action.GetOperation().(type) {
+		case *blogpb.BulkAction_Retag:
+			add, _ := normalizeTags(op.Retag.GetAddTags())
+			remove, _ := normalizeTags(op.Retag.GetRemoveTags())
+			tags := retag(data.Tags, add, remove)
+			if len(tags) > maxTags {
+				skipped++
+				continue
+			}
+			data.Tags = tags
+			set["tags"] = tags
+		case *blogpb.BulkAction_Reassign:
+			data.AuthorID = op.Reassign.GetAuthorId()
+			set["author_id"] = data.AuthorID
+		}
+
+		data.UpdatedAt = set["updated_at"].(time.Time)
+		events := &stagedEvents{}
+		if err := events.stage(context.Background(), data, blogpb.WebhookEvent_WEBHOOK_EVENT_UPDATED); err != nil {
+			events.abort(context.Background())
+			return processed, skipped, fmt.Errorf("cannot queue webhook events: %v", err)
+		}
+		// A blog written since it was read is left to its other writer and counted as skipped.
+		updateResult, err := collection.UpdateOne(ctx, bson.M{"_id": data.ID, "updated_at": previousUpdatedAt}, bson.M{"$set": set})
+		if err != nil {
+			events.abort(context.Background())
+			return processed, skipped, err
+		}
+		if updateResult.MatchedCount == 0 {
+			events.abort(context.Background())
+			skipped++
+			continue
+		}
+		changes.record("blog", data.TenantID, data.ID)
+		events.commit(context.Background())
+	}
+
+	return processed, skipped, nil
+}
+
+func (*adminServer) PreviewBulkAction(ctx context.Context, req *blogpb.PreviewBulkActionRequest) (*blogpb.PreviewBulkActionResponse, error) {
+	fmt.Printf("PreviewBulkAction called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	filter, err := validateBulkAction(req.GetAction())
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot generate confirmation token: %v", err),
+		)
+	}
+	token := hex.EncodeToString(raw)
+
+	bulkPreviews.Lock()
+	now := time.Now()
+	for t, p := range bulkPreviews.tokens {
+		if now.After(p.expires) {
+			delete(bulkPreviews.tokens, t)
+		}
+	}
+	bulkPreviews.tokens[token] = &bulkPreview{
+		action:  proto.Clone(req.GetAction()).(*blogpb.BulkAction),
+		matched: matched,
+		expires: now.Add(bulkTokenTTL),
+	}
+	bulkPreviews.Unlock()
+
+	return &blogpb.PreviewBulkActionResponse{
+		Matched:           matched,
+		ConfirmationToken: token,
+		ExpiresInSeconds:  int64(bulkTokenTTL.Seconds()),
+	}, nil
+}
+
+func (*adminServer) RunBulkAction(req *blogpb.RunBulkActionRequest, stream blogpb.BlogAdminService_RunBulkActionServer) error {
+	fmt.Printf("RunBulkAction called...\n")
+	ctx := stream.Context()
+	if err := authorizeAdmin(ctx); err != nil {
+		return err
+	}
+
+	filter, err := validateBulkAction(req.GetAction())
+	if err != nil {
+		return err
+	}
+
+	preview := takePreview(req.GetConfirmationToken())
+	if preview == nil {
+		return status.Errorf(codes.FailedPrecondition, "Unknown or expired confirmation token, preview the action again")
+	}
+	if !proto.Equal(preview.action, req.GetAction()) {
+		return status.Errorf(codes.InvalidArgument, "Confirmation token was issued for another action")
+	}
+
+	var ids []primitive.ObjectID
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	for cur.Next(ctx) {
+		data := &blogItem{}
+		if err := cur.Decode(data); err != nil {
+			cur.Close(ctx)
+			return status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Error while decoding data from MongoDB: %v", err),
+			)
+		}
+		ids = append(ids, data.ID)
+	}
+	err = cur.Err()
+	cur.Close(ctx)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	total := int64(len(ids))
+	if total != preview.matched {
+		return status.Errorf(
+			codes.Aborted,
+			fmt.Sprintf("Filter matches %d blogs, %d were previewed, preview the action again", total, preview.matched),
+		)
+	}
+
+	progress := &blogpb.BulkActionProgress{Total: total}
+	if err := stream.Send(progress); err != nil {
+		return err
+	}
+	for start := 0; start < len(ids); start += bulkBatchSize {
+		if ctx.Err() != nil {
+			return status.Errorf(
+				codes.Canceled,
+				fmt.Sprintf("Bulk action cancelled after %d of %d blogs", progress.Processed, total),
+			)
+		}
+
+		end := start + bulkBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		processed, skipped, err := runBulkBatch(ctx, req.GetAction(), filter, ids[start:end])
+		progress.Processed += processed
+		progress.Skipped += skipped
+		if err != nil {
+			return status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Bulk action failed after %d of %d blogs: %v", progress.Processed, total, err),
+			)
+		}
+
+		if err := stream.Send(progress); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Bulk action done: %d of %d blogs processed, %d skipped\n", progress.Processed, total, progress.Skipped)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-grpc-course/blog/blogpb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTakePreview(t *testing.T) {
+	bulkPreviews.Lock()
+	bulkPreviews.tokens["valid"] = &bulkPreview{matched: 3, expires: time.Now().Add(time.Minute)}
+	bulkPreviews.tokens["expired"] = &bulkPreview{matched: 3, expires: time.Now().Add(-time.Second)}
+	bulkPreviews.Unlock()
+
+	if preview := takePreview("valid"); preview == nil || preview.matched != 3 {
+		t.Errorf("takePreview(valid) = %+v, want the preview", preview)
+	}
+	if preview := takePreview("valid"); preview != nil {
+		t.Errorf("takePreview(valid) again = %+v, want nil", preview)
+	}
+	if preview := takePreview("expired"); preview != nil {
+		t.Errorf("takePreview(expired) = %+v, want nil", preview)
+	}
+	if preview := takePreview("unknown"); preview != nil {
+		t.Errorf("takePreview(unknown) = %+v, want nil", preview)
+	}
+
+	bulkPreviews.Lock()
+	defer bulkPreviews.Unlock()
+	if len(bulkPreviews.tokens) != 0 {
+		t.Errorf("tokens left: %v", bulkPreviews.tokens)
+	}
+}
+
+func TestRetag(t *testing.T) {
+	tests := []struct {
+		tags, add, remove []string
+		want              []string
+	}{
+		{[]string{"go"}, []string{"grpc"}, nil, []string{"go", "grpc"}},
+		{[]string{"go", "grpc"}, nil, []string{"go"}, []string{"grpc"}},
+		{[]string{"go"}, []string{"go", "mongo"}, nil, []string{"go", "mongo"}},
+		{[]string{"go"}, []string{"go"}, []string{"go"}, nil},
+		{nil, nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		if got := retag(tt.tags, tt.add, tt.remove); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("retag(%q, %q, %q) = %q, want %q", tt.tags, tt.add, tt.remove, got, tt.want)
+		}
+	}
+}
+
+func TestValidateBulkAction(t *testing.T) {
+	del := &blogpb.BulkAction_Delete{Delete: &blogpb.BulkDelete{}}
+	tests := []struct {
+		name   string
+		action *blogpb.BulkAction
+		want   bson.M
+		code   codes.Code
+	}{
+		{
+			"delete by author",
+			&blogpb.BulkAction{Filter: &blogpb.BlogFilter{TenantId: "acme", AuthorId: "ann"}, Operation: del},
+			bson.M{"tenant_id": "acme", "author_id": "ann"}, codes.OK,
+		},
+		{
+			"tag is normalized",
+			&blogpb.BulkAction{Filter: &blogpb.BlogFilter{Tag: " Go "}, Operation: del},
+			bson.M{"tags": "go"}, codes.OK,
+		},
+		{
+			"date range",
+			&blogpb.BulkAction{Filter: &blogpb.BlogFilter{CreatedAfter: "2024-01-01T00:00:00+01:00"}, Operation: del},
+			bson.M{"created_at": bson.M{"$gte": time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)}}, codes.OK,
+		},
+		{
+			"tenant alone is not a criterion",
+			&blogpb.BulkAction{Filter: &blogpb.BlogFilter{TenantId: "acme"}, Operation: del},
+			nil, codes.InvalidArgument,
+		},
+		{
+			"bad date",
+			&blogpb.BulkAction{Filter: &blogpb.BlogFilter{CreatedBefore: "yesterday"}, Operation: del},
+			nil, codes.InvalidArgument,
+		},
+		{
+			"retag without tags",
+			&blogpb.BulkAction{
+				Filter:    &blogpb.BlogFilter{AuthorId: "ann"},
+				Operation: &blogpb.BulkAction_Retag{Retag: &blogpb.BulkRetag{}},
+			},
+			nil, codes.InvalidArgument,
+		},
+		{
+			"reassign without author",
+			&blogpb.BulkAction{
+				Filter:    &blogpb.BlogFilter{AuthorId: "ann"},
+				Operation: &blogpb.BulkAction_Reassign{Reassign: &blogpb.BulkReassign{}},
+			},
+			nil, codes.InvalidArgument,
+		},
+		{
+			"no operation",
+			&blogpb.BulkAction{Filter: &blogpb.BlogFilter{AuthorId: "ann"}},
+			nil, codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateBulkAction(tt.action)
+			if status.Code(err) != tt.code {
+				t.Fatalf("validateBulkAction = %v, want %v", err, tt.code)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateBulkAction = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// bulkStream collects the progress sent by RunBulkAction.
+type bulkStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	progress []*blogpb.BulkActionProgress
+}
+
+func (s *bulkStream) Context() context.Context { return s.ctx }
+
+func (s *bulkStream) Send(p *blogpb.BulkActionProgress) error {
+	s.progress = append(s.progress, &blogpb.BulkActionProgress{Total: p.Total, Processed: p.Processed, Skipped: p.Skipped})
+	return nil
+}
+
+func TestRunBulkAction(t *testing.T) {
+	ctx := testStore(t)
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(adminMetadataKey, "secret"))
+
+	insert := func(authorID string) {
+		blog := blogItem{ID: primitive.NewObjectID(), TenantID: "acme", AuthorID: authorID}
+		if _, err := collection.InsertOne(ctx, blog); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("ann")
+	insert("ann")
+	insert("bob")
+
+	action := &blogpb.BulkAction{
+		Filter:    &blogpb.BlogFilter{TenantId: "acme", AuthorId: "ann"},
+		Operation: &blogpb.BulkAction_Delete{Delete: &blogpb.BulkDelete{}},
+	}
+	preview := func(want int64) string {
+		res, err := (&adminServer{}).PreviewBulkAction(ctx, &blogpb.PreviewBulkActionRequest{Action: action})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetMatched() != want {
+			t.Fatalf("PreviewBulkAction matched %d blogs, want %d", res.GetMatched(), want)
+		}
+		return res.GetConfirmationToken()
+	}
+
+	// A blog matching the filter since the preview aborts the action.
+	token := preview(2)
+	insert("ann")
+	stream := &bulkStream{ctx: ctx}
+	err := (&adminServer{}).RunBulkAction(&blogpb.RunBulkActionRequest{Action: action, ConfirmationToken: token}, stream)
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("RunBulkAction after a change = %v, want Aborted", err)
+	}
+
+	stream = &bulkStream{ctx: ctx}
+	err = (&adminServer{}).RunBulkAction(&blogpb.RunBulkActionRequest{Action: action, ConfirmationToken: preview(3)}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := stream.progress[len(stream.progress)-1]
+	if last.Total != 3 || last.Processed != 3 || last.Skipped != 0 {
+		t.Errorf("final progress = %+v, want 3 of 3 processed", last)
+	}
+	if count, err := collection.CountDocuments(ctx, bson.M{"tenant_id": "acme"}); err != nil || count != 1 {
+		t.Errorf("blogs left = %v, %v, want 1", count, err)
+	}
+
+	// The token was used up.
+	err = (&adminServer{}).RunBulkAction(&blogpb.RunBulkActionRequest{Action: action, ConfirmationToken: token}, &bulkStream{ctx: ctx})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("RunBulkAction with a used token = %v, want FailedPrecondition", err)
+	}
+}
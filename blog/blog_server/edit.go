@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"io"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// editorBuffer is the number of events queued for an editor before it is dropped as too slow.
+const editorBuffer = 64
+
+// editSessions tracks the open EditBlog sessions, one per blog being edited.
+var editSessions = &editHub{sessions: map[primitive.ObjectID]*editSession{}}
+
+type editHub struct {
+	mu       sync.Mutex
+	sessions map[primitive.ObjectID]*editSession
+}
+
+// editSession is the shared state of the editors of one blog. Fields other than writeMu are
+// guarded by editHub.mu.
+type editSession struct {
+	blogID   primitive.ObjectID
+	tenantID string
+	editors  []*editor
+	// joining counts editors between join and their first event, the session is kept meanwhile.
+	joining int
+	// locks maps the title and content sections to the editor holding them.
+	locks map[blogpb.EditSection]*editor
+	// writeMu serializes changes, so editors of different sections do not overwrite each other.
+	writeMu sync.Mutex
+}
+
+type editor struct {
+	id  string
+	out chan *blogpb.EditBlogResponse
+	// dropped is closed when the editor did not read its events fast enough.
+	dropped  chan struct{}
+	dropOnce sync.Once
+}
+
+func newEditor(id string) *editor {
+	return &editor{
+		id:      id,
+		out:     make(chan *blogpb.EditBlogResponse, editorBuffer),
+		dropped: make(chan struct{}),
+	}
+}
+
+// send queues an event without blocking, dropping the editor when its queue is full.
+func (ed *editor) send(res *blogpb.EditBlogResponse) {
+	select {
+	case ed.out <- res:
+	default:
+		ed.dropOnce.Do(func() { close(ed.dropped) })
+	}
+}
+
+func (ed *editor) reject(reason string) {
+	ed.send(&blogpb.EditBlogResponse{
+		Event: &blogpb.EditBlogResponse_Rejected{Rejected: &blogpb.EditRejected{Reason: reason}},
+	})
+}
+
+// lockSections returns the lockable sections covered by a section, nil when it is invalid.
+func lockSections(section blogpb.EditSection) []blogpb.EditSection {
+	switch section {
+	case blogpb.EditSection_EDIT_SECTION_TITLE, blogpb.EditSection_EDIT_SECTION_CONTENT:
+		return []blogpb.EditSection{section}
+	case blogpb.EditSection_EDIT_SECTION_ALL:
+		return []blogpb.EditSection{blogpb.EditSection_EDIT_SECTION_TITLE, blogpb.EditSection_EDIT_SECTION_CONTENT}
+	}
+	return nil
+}
+
+// broadcast sends an event to every editor of a session but except. Must be called with mu held.
+func (h *editHub) broadcast(sess *editSession, res *blogpb.EditBlogResponse, except *editor) {
+	for _, ed := range sess.editors {
+		if ed != except {
+			ed.send(res)
+		}
+	}
+}
+
+// member reports whether ed is still part of sess. Must be called with mu held.
+func (sess *editSession) member(ed *editor) bool {
+	for _, other := range sess.editors {
+		if other == ed {
+			return true
+		}
+	}
+	return false
+}
+
+// join adds ed to the session of a blog, creating it when needed. load returns the blog sent in
+// the editor's first event. It runs under the session's writeMu, so no change can slip between
+// that snapshot and the events that follow it.
+func (h *editHub) join(tenantID string, blogID primitive.ObjectID, ed *editor, load func() (*blogpb.Blog, error)) (*editSession, error) {
+	h.mu.Lock()
+	sess, ok := h.sessions[blogID]
+	if !ok {
+		sess = &editSession{
+			blogID:   blogID,
+			tenantID: tenantID,
+			locks:    map[blogpb.EditSection]*editor{},
+		}
+		h.sessions[blogID] = sess
+	}
+	sess.joining++
+	h.mu.Unlock()
+
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	blog, err := load()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sess.joining--
+
+	if err == nil {
+		for _, other := range sess.editors {
+			if other.id == ed.id {
+				err = status.Errorf(
+					codes.AlreadyExists,
+					fmt.Sprintf("Editor %v is already editing this blog", ed.id),
+				)
+			}
+		}
+	}
+	if err != nil {
+		h.removeIfEmpty(sess)
+		return nil, err
+	}
+
+	joined := &blogpb.EditJoined{Blog: blog, Editors: []string{ed.id}}
+	for _, other := range sess.editors {
+		joined.Editors = append(joined.Editors, other.id)
+	}
+	for _, section := range lockSections(blogpb.EditSection_EDIT_SECTION_ALL) {
+		if holder := sess.locks[section]; holder != nil {
+			joined.Locks = append(joined.Locks, &blogpb.EditLock{EditorId: holder.id, Section: section})
+		}
+	}
+	ed.send(&blogpb.EditBlogResponse{Event: &blogpb.EditBlogResponse_Joined{Joined: joined}})
+
+	h.broadcast(sess, &blogpb.EditBlogResponse{
+		Event: &blogpb.EditBlogResponse_Presence{Presence: &blogpb.EditPresence{EditorId: ed.id, Joined: true}},
+	}, nil)
+	sess.editors = append(sess.editors, ed)
+
+	return sess, nil
+}
+
+// leave removes ed from its session and releases every lock it holds.
+func (h *editHub) leave(sess *editSession, ed *editor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, other := range sess.editors {
+		if other == ed {
+			sess.editors = append(sess.editors[:i], sess.editors[i+1:]...)
+			break
+		}
+	}
+
+	for _, section := range lockSections(blogpb.EditSection_EDIT_SECTION_ALL) {
+		if sess.locks[section] != ed {
+			continue
+		}
+		delete(sess.locks, section)
+		h.broadcast(sess, &blogpb.EditBlogResponse{
+			Event: &blogpb.EditBlogResponse_Unlocked{Unlocked: &blogpb.EditLock{EditorId: ed.id, Section: section}},
+		}, nil)
+	}
+
+	h.broadcast(sess, &blogpb.EditBlogResponse{
+		Event: &blogpb.EditBlogResponse_Presence{Presence: &blogpb.EditPresence{EditorId: ed.id}},
+	}, nil)
+	h.removeIfEmpty(sess)
+}
+
+// removeIfEmpty forgets a session without editors. Must be called with mu held.
+func (h *editHub) removeIfEmpty(sess *editSession) {
+	if len(sess.editors) == 0 && sess.joining == 0 && h.sessions[sess.blogID] == sess {
+		delete(h.sessions, sess.blogID)
+	}
+}
+
+// acquire gives ed the lock of a section, or of both sections for EDIT_SECTION_ALL.
+func (h *editHub) acquire(sess *editSession, ed *editor, section blogpb.EditSection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sections := lockSections(section)
+	if len(sections) == 0 || !sess.member(ed) {
+		ed.reject(fmt.Sprintf("Cannot lock section %v", section))
+		return
+	}
+	for _, s := range sections {
+		if holder := sess.locks[s]; holder != nil && holder != ed {
+			ed.reject(fmt.Sprintf("Section %v is locked by %v", s, holder.id))
+			return
+		}
+	}
+
+	for _, s := range sections {
+		sess.locks[s] = ed
+	}
+	h.broadcast(sess, &blogpb.EditBlogResponse{
+		Event: &blogpb.EditBlogResponse_Locked{Locked: &blogpb.EditLock{EditorId: ed.id, Section: section}},
+	}, nil)
+}
+
+// release gives up the locks ed holds on a section, or on both sections for EDIT_SECTION_ALL.
+func (h *editHub) release(sess *editSession, ed *editor, section blogpb.EditSection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	released := false
+	for _, s := range lockSections(section) {
+		if sess.locks[s] == ed {
+			delete(sess.locks, s)
+			released = true
+		}
+	}
+	if !released {
+		ed.reject(fmt.Sprintf("Section %v is not locked by %v", section, ed.id))
+		return
+	}
+
+	h.broadcast(sess, &blogpb.EditBlogResponse{
+		Event: &blogpb.EditBlogResponse_Unlocked{Unlocked: &blogpb.EditLock{EditorId: ed.id, Section: section}},
+	}, nil)
+}
+
+// holds reports whether ed holds the lock of a section.
+func (h *editHub) holds(sess *editSession, ed *editor, section blogpb.EditSection) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return sess.locks[section] == ed
+}
+
+// locked reports whether any section of a blog is locked by an editor.
+func (h *editHub) locked(blogID primitive.ObjectID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sess, ok := h.sessions[blogID]
+	return ok && len(sess.locks) > 0
+}
+
+// loadEditedBlog reads the current state of a blog for its editors.
+func loadEditedBlog(ctx context.Context, tenantID string, blogID primitive.ObjectID) (*blogItem, error) {
+	data := &blogItem{}
+	if err := collection.FindOne(ctx, bson.M{"_id": blogID, "tenant_id": tenantID}).Decode(data); err != nil {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Cannot find blog with specified ID: %v", err),
+		)
+	}
+	return data, nil
+}
+
+// apply stores a change of ed and broadcasts the result to every editor, ed included.
+func (sess *editSession) apply(ctx context.Context, ed *editor, change *blogpb.EditChange) {
+	section := change.GetSection()
+	if section != blogpb.EditSection_EDIT_SECTION_TITLE && section != blogpb.EditSection_EDIT_SECTION_CONTENT {
+		ed.reject(fmt.Sprintf("Cannot change section %v", section))
+		return
+	}
+
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+
+	if !editSessions.holds(sess, ed, section) {
+		ed.reject(fmt.Sprintf("Lock section %v before changing it", section))
+		return
+	}
+
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	current, err := loadEditedBlog(ctx, sess.tenantID, sess.blogID)
+	if err != nil {
+		ed.reject(status.Convert(err).Message())
+		return
+	}
+	blog := mapDataToBlog(current)
+	if section == blogpb.EditSection_EDIT_SECTION_TITLE {
+		blog.Title = change.GetText()
+	} else {
+		blog.Content = change.GetText()
+	}
+
+	data, err := updateBlog(ctx, sess.tenantID, sess.blogID, blog, current.UpdatedAt)
+	if err != nil {
+		ed.reject(status.Convert(err).Message())
+		return
+	}
+
+	editSessions.mu.Lock()
+	defer editSessions.mu.Unlock()
+	editSessions.broadcast(sess, &blogpb.EditBlogResponse{
+		Event: &blogpb.EditBlogResponse_Changed{Changed: &blogpb.EditChanged{
+			EditorId: ed.id,
+			Section:  section,
+			Blog:     mapDataToBlog(data),
+		}},
+	}, nil)
+}
+
+// handle runs one action of an editor. Failures are reported to the editor, not to the stream.
+func (sess *editSession) handle(ctx context.Context, ed *editor, req *blogpb.EditBlogRequest) {
+	switch action := req.GetAction().(type) {
+	case *blogpb.EditBlogRequest_AcquireLock:
+		editSessions.acquire(sess, ed, action.AcquireLock)
+	case *blogpb.EditBlogRequest_ReleaseLock:
+		editSessions.release(sess, ed, action.ReleaseLock)
+	case *blogpb.EditBlogRequest_Change:
+		sess.apply(ctx, ed, action.Change)
+	default:
+		ed.reject("Unexpected action, an editor joins a session only once")
+	}
+}
+
+func (*server) EditBlog(stream blogpb.BlogService_EditBlogServer) error {
+	fmt.Println("EditBlog was invoked with a bidirectional stream...")
+	ctx := stream.Context()
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	join := req.GetJoin()
+	if join == nil {
+		return status.Errorf(codes.InvalidArgument, "The first message of an edit session must join a blog")
+	}
+	if join.GetEditorId() == "" {
+		return status.Errorf(codes.InvalidArgument, "An editor needs an ID")
+	}
+	oid, err := primitive.ObjectIDFromHex(join.GetBlogId())
+	if err != nil {
+		return status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	ed := newEditor(join.GetEditorId())
+	sess, err := editSessions.join(tenant.ID, oid, ed, func() (*blogpb.Blog, error) {
+		data, err := loadEditedBlog(ctx, tenant.ID, oid)
+		if err != nil {
+			return nil, err
+		}
+		return mapDataToBlog(data), nil
+	})
+	if err != nil {
+		return err
+	}
+	// Locks are released whichever way the stream ends.
+	defer editSessions.leave(sess, ed)
+	fmt.Printf("Editor %v joined blog %v\n", ed.id, oid.Hex())
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			sess.handle(ctx, ed, req)
+		}
+	}()
+
+	for {
+		select {
+		case res := <-ed.out:
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			fmt.Printf("Editor %v left blog %v\n", ed.id, oid.Hex())
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ed.dropped:
+			return status.Errorf(
+				codes.ResourceExhausted,
+				fmt.Sprintf("Editor %v does not read its events fast enough", ed.id),
+			)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"testing"
+
+	"go-grpc-course/blog/blogpb"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// drain returns the events queued for an editor.
+func drain(ed *editor) []*blogpb.EditBlogResponse {
+	var events []*blogpb.EditBlogResponse
+	for {
+		select {
+		case res := <-ed.out:
+			events = append(events, res)
+		default:
+			return events
+		}
+	}
+}
+
+// rejected reports whether one of events is a rejection.
+func rejected(events []*blogpb.EditBlogResponse) bool {
+	for _, res := range events {
+		if res.GetRejected() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// joinEditors opens a session of a new blog in h with an editor per id.
+func joinEditors(t *testing.T, h *editHub, ids ...string) (*editSession, []*editor) {
+	blogID := primitive.NewObjectID()
+	var sess *editSession
+	var editors []*editor
+	for _, id := range ids {
+		ed := newEditor(id)
+		var err error
+		sess, err = h.join("acme", blogID, ed, func() (*blogpb.Blog, error) {
+			return &blogpb.Blog{Id: blogID.Hex()}, nil
+		})
+		if err != nil {
+			t.Fatalf("join(%v): %v", id, err)
+		}
+		editors = append(editors, ed)
+	}
+	for _, ed := range editors {
+		drain(ed)
+	}
+	return sess, editors
+}
+
+func TestEditLocks(t *testing.T) {
+	title, content, all := blogpb.EditSection_EDIT_SECTION_TITLE, blogpb.EditSection_EDIT_SECTION_CONTENT, blogpb.EditSection_EDIT_SECTION_ALL
+	type step struct {
+		editor   int
+		release  bool
+		section  blogpb.EditSection
+		rejected bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// holders maps the title and content sections to the editor left holding them, -1 for none.
+		holders [2]int
+	}{
+		{"lock", []step{{0, false, title, false}}, [2]int{0, -1}},
+		{"relock own section", []step{{0, false, title, false}, {0, false, title, false}}, [2]int{0, -1}},
+		{"other section", []step{{0, false, title, false}, {1, false, content, false}}, [2]int{0, 1}},
+		{"conflict", []step{{0, false, title, false}, {1, false, title, true}}, [2]int{0, -1}},
+		{"all locks both", []step{{0, false, all, false}}, [2]int{0, 0}},
+		{"all conflicts with one", []step{{0, false, content, false}, {1, false, all, true}}, [2]int{-1, 0}},
+		{"all over own section", []step{{0, false, content, false}, {0, false, all, false}}, [2]int{0, 0}},
+		{"unspecified section", []step{{0, false, blogpb.EditSection_EDIT_SECTION_UNSPECIFIED, true}}, [2]int{-1, -1}},
+		{"release", []step{{0, false, all, false}, {0, true, title, false}}, [2]int{-1, 0}},
+		{"release all", []step{{0, false, all, false}, {0, true, all, false}}, [2]int{-1, -1}},
+		{"release other's lock", []step{{0, false, title, false}, {1, true, title, true}}, [2]int{0, -1}},
+		{"release unlocked", []step{{0, true, content, true}}, [2]int{-1, -1}},
+		{"lock after release", []step{{0, false, title, false}, {0, true, title, false}, {1, false, title, false}}, [2]int{1, -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &editHub{sessions: map[primitive.ObjectID]*editSession{}}
+			sess, editors := joinEditors(t, h, "ann", "bob")
+
+			for i, s := range tt.steps {
+				ed := editors[s.editor]
+				if s.release {
+					h.release(sess, ed, s.section)
+				} else {
+					h.acquire(sess, ed, s.section)
+				}
+				if got := rejected(drain(ed)); got != s.rejected {
+					t.Errorf("step %d: rejected = %v, want %v", i, got, s.rejected)
+				}
+			}
+
+			for i, section := range []blogpb.EditSection{title, content} {
+				var want *editor
+				if tt.holders[i] >= 0 {
+					want = editors[tt.holders[i]]
+				}
+				if got := sess.locks[section]; got != want {
+					t.Errorf("%v held by %v, want %v", section, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEditLeave(t *testing.T) {
+	h := &editHub{sessions: map[primitive.ObjectID]*editSession{}}
+	sess, editors := joinEditors(t, h, "ann", "bob")
+	ann, bob := editors[0], editors[1]
+
+	h.acquire(sess, ann, blogpb.EditSection_EDIT_SECTION_ALL)
+	drain(bob)
+	if !h.locked(sess.blogID) {
+		t.Fatal("blog is not locked")
+	}
+
+	h.leave(sess, ann)
+	unlocked, left := 0, false
+	for _, res := range drain(bob) {
+		if res.GetUnlocked().GetEditorId() == "ann" {
+			unlocked++
+		}
+		if p := res.GetPresence(); p.GetEditorId() == "ann" && !p.GetJoined() {
+			left = true
+		}
+	}
+	if unlocked != 2 || !left {
+		t.Errorf("bob saw %d sections unlocked and left = %v, want 2 and true", unlocked, left)
+	}
+	if h.locked(sess.blogID) {
+		t.Error("blog is still locked after its editor left")
+	}
+
+	// The section is free for the remaining editor, and the session goes with the last one.
+	h.acquire(sess, bob, blogpb.EditSection_EDIT_SECTION_TITLE)
+	if rejected(drain(bob)) {
+		t.Error("bob cannot lock a section released by leave")
+	}
+	h.leave(sess, bob)
+	if _, ok := h.sessions[sess.blogID]; ok {
+		t.Error("session kept without editors")
+	}
+}
+
+func TestUpdateBlogWhileLocked(t *testing.T) {
+	ctx := testStore(t)
+	if _, err := tenants.InsertOne(ctx, tenantItem{ID: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(tenantMetadataKey, "acme"))
+	blog := blogItem{ID: primitive.NewObjectID(), TenantID: "acme", Title: "draft"}
+	if _, err := collection.InsertOne(ctx, blog); err != nil {
+		t.Fatal(err)
+	}
+
+	ed := newEditor("ann")
+	sess, err := editSessions.join("acme", blog.ID, ed, func() (*blogpb.Blog, error) { return mapDataToBlog(&blog), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer editSessions.leave(sess, ed)
+	editSessions.acquire(sess, ed, blogpb.EditSection_EDIT_SECTION_CONTENT)
+
+	req := &blogpb.UpdateBlogRequest{Blog: &blogpb.Blog{Id: blog.ID.Hex(), Title: "final"}}
+	if _, err := (&server{}).UpdateBlog(ctx, req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("UpdateBlog while locked = %v, want FailedPrecondition", err)
+	}
+
+	editSessions.release(sess, ed, blogpb.EditSection_EDIT_SECTION_CONTENT)
+	if _, err := (&server{}).UpdateBlog(ctx, req); err != nil {
+		t.Errorf("UpdateBlog after release = %v", err)
+	}
+}
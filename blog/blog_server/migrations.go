@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// currentSchemaVersion is the schema_version written on every blog document. It is the version
+// of the last migration: runMigrations raises every stored blog to the version of each migration
+// it applies. Add a migration whenever blogItem changes shape, and set this to its version.
+const currentSchemaVersion = 8
+
+// migration upgrades the blog collection by one step.
+type migration struct {
+	Version int
+	Name    string
+	// Affected counts the documents the migration would touch, used by dry runs. May be nil.
+	Affected func(ctx context.Context, coll *mongo.Collection) (int64, error)
+	Up       func(ctx context.Context, coll *mongo.Collection) error
+}
+
+// appliedMigration is the record stored for each migration that ran.
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// migrations must be kept in ascending version order.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "add_schema_version",
+		Affected: func(ctx context.Context, coll *mongo.Collection) (int64, error) {
+			return coll.CountDocuments(ctx, bson.M{"schema_version": bson.M{"$exists": false}})
+		},
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := coll.UpdateMany(ctx,
+				bson.M{"schema_version": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"schema_version": 1}},
+			)
+			return err
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add_timestamps_and_author_index",
+		Affected: func(ctx context.Context, coll *mongo.Collection) (int64, error) {
+			return coll.CountDocuments(ctx, bson.M{"created_at": bson.M{"$exists": false}})
+		},
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "author_id", Value: 1}}},
+				{Keys: bson.D{{Key: "created_at", Value: -1}}},
+			})
+			if err != nil {
+				return err
+			}
+
+			// The ObjectID embeds the insertion time, which is the best creation date we have.
+			_, err = coll.UpdateMany(ctx,
+				bson.M{"created_at": bson.M{"$exists": false}},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{
+					"created_at":     bson.M{"$toDate": "$_id"},
+					"updated_at":     bson.M{"$toDate": "$_id"},
+					"schema_version": 2,
+				}}}},
+			)
+			return err
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add_tenants",
+		Affected: func(ctx context.Context, coll *mongo.Collection) (int64, error) {
+			return coll.CountDocuments(ctx, bson.M{"tenant_id": bson.M{"$exists": false}})
+		},
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "created_at", Value: -1}},
+			})
+			if err != nil {
+				return err
+			}
+
+			// Blogs written before tenants existed belong to the default tenant.
+			_, err = coll.UpdateMany(ctx,
+				bson.M{"tenant_id": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"tenant_id": defaultTenant, "schema_version": 3}},
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = tenantsCollection(coll).UpdateOne(ctx,
+				bson.M{"_id": defaultTenant},
+				bson.M{"$setOnInsert": bson.M{"max_blogs": 0, "created_at": time.Now().UTC()}},
+				options.Update().SetUpsert(true),
+			)
+			return err
+		},
+	},
+	{
+		Version: 4,
+		Name:    "index_moderation_queue",
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			// Blogs without a moderation status are published, so nothing needs a backfill.
+			_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "moderation_status", Value: 1}, {Key: "updated_at", Value: 1}},
+				Options: options.Index().SetSparse(true),
+			})
+			return err
+		},
+	},
+	{
+		Version: 5,
+		Name:    "index_webhook_outbox",
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := outboxCollection(coll).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+				{Keys: bson.D{{Key: "webhook_id", Value: 1}}},
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = webhooksCollection(coll).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "tenant_id", Value: 1}},
+			})
+			return err
+		},
+	},
+	{
+		Version: 6,
+		Name:    "index_series",
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := seriesCollection(coll).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "author_id", Value: 1}}},
+				// A blog belongs to at most one series.
+				{
+					Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "blog_ids", Value: 1}},
+					Options: options.Index().SetUnique(true),
+				},
+			})
+			return err
+		},
+	},
+	{
+		Version: 7,
+		Name:    "index_translations",
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := translationsCollection(coll).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{
+					Keys:    bson.D{{Key: "blog_id", Value: 1}, {Key: "language", Value: 1}},
+					Options: options.Index().SetUnique(true),
+				},
+				{Keys: bson.D{{Key: "tenant_id", Value: 1}}},
+			})
+			return err
+		},
+	},
+	{
+		Version: 8,
+		Name:    "index_tags",
+		Up: func(ctx context.Context, coll *mongo.Collection) error {
+			_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "tags", Value: 1}},
+			})
+			return err
+		},
+	},
+}
+
+// migrationsCollection returns the collection recording applied migrations of coll.
+func migrationsCollection(coll *mongo.Collection) *mongo.Collection {
+	return coll.Database().Collection(coll.Name() + "_migrations")
+}
+
+// runMigrations applies every pending migration to coll in order. With dryRun set, pending
+// migrations are only reported.
+func runMigrations(ctx context.Context, coll *mongo.Collection, dryRun bool) error {
+	applied := map[int]bool{}
+
+	cur, err := migrationsCollection(coll).Find(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("cannot read applied migrations: %v", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		rec := &appliedMigration{}
+		if err := cur.Decode(rec); err != nil {
+			return fmt.Errorf("cannot decode applied migration: %v", err)
+		}
+		applied[rec.Version] = true
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("cannot read applied migrations: %v", err)
+	}
+
+	pending := 0
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		pending++
+
+		if dryRun {
+			affected := int64(-1)
+			if m.Affected != nil {
+				if affected, err = m.Affected(ctx, coll); err != nil {
+					return fmt.Errorf("migration %d (%v): %v", m.Version, m.Name, err)
+				}
+			}
+			fmt.Printf("Would apply migration %d (%v), documents affected: %d\n", m.Version, m.Name, affected)
+			continue
+		}
+
+		fmt.Printf("Applying migration %d (%v)...\n", m.Version, m.Name)
+		if err := m.Up(ctx, coll); err != nil {
+			return fmt.Errorf("migration %d (%v) failed: %v", m.Version, m.Name, err)
+		}
+		if err := raiseSchemaVersion(ctx, coll, m.Version); err != nil {
+			return fmt.Errorf("migration %d (%v) failed: %v", m.Version, m.Name, err)
+		}
+
+		_, err := migrationsCollection(coll).InsertOne(ctx, appliedMigration{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot record migration %d: %v", m.Version, err)
+		}
+	}
+
+	if pending == 0 {
+		fmt.Println("Blog schema is up to date")
+	}
+	if dryRun {
+		return nil
+	}
+	// Stores migrated before migrations raised the version of every blog catch up here.
+	if err := raiseSchemaVersion(ctx, coll, currentSchemaVersion); err != nil {
+		return fmt.Errorf("cannot update blog schema version: %v", err)
+	}
+
+	return nil
+}
+
+// raiseSchemaVersion sets the schema_version of every blog below version to version.
+func raiseSchemaVersion(ctx context.Context, coll *mongo.Collection, version int) error {
+	_, err := coll.UpdateMany(ctx,
+		bson.M{"schema_version": bson.M{"$lt": version}},
+		bson.M{"$set": bson.M{"schema_version": version}},
+	)
+	return err
+}
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %v has version %d, want %d", m.Name, m.Version, i+1)
+		}
+	}
+	if last := migrations[len(migrations)-1].Version; currentSchemaVersion != last {
+		t.Errorf("currentSchemaVersion = %d, want the version of the last migration (%d)", currentSchemaVersion, last)
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Moderation statuses as stored in MongoDB. Blogs without a status are published.
+const (
+	moderationFlagged  = "flagged"
+	moderationPending  = "pending"
+	moderationRejected = "rejected"
+	moderationApproved = "approved"
+)
+
+// visibleFilter matches the blogs readers are allowed to see.
+var visibleFilter = bson.M{"$nin": bson.A{moderationPending, moderationRejected}}
+
+var moderationStatuses = map[string]blogpb.ModerationStatus{
+	"":                 blogpb.ModerationStatus_MODERATION_STATUS_UNSPECIFIED,
+	moderationFlagged:  blogpb.ModerationStatus_MODERATION_STATUS_FLAGGED,
+	moderationPending:  blogpb.ModerationStatus_MODERATION_STATUS_PENDING,
+	moderationRejected: blogpb.ModerationStatus_MODERATION_STATUS_REJECTED,
+	moderationApproved: blogpb.ModerationStatus_MODERATION_STATUS_APPROVED,
+}
+
+// moderationAction is what happens to a post matching a rule. Higher actions win.
+type moderationAction int
+
+const (
+	actionAllow moderationAction = iota
+	actionFlag
+	actionQueue
+	actionReject
+)
+
+var moderationActions = map[string]moderationAction{
+	"flag":   actionFlag,
+	"queue":  actionQueue,
+	"reject": actionReject,
+}
+
+// moderationRule inspects a post and explains why it matched.
+type moderationRule interface {
+	Check(title, content string) (reason string, matched bool)
+}
+
+// ruleConfig is one entry of the moderation config file. Only the fields used by Type are read.
+type ruleConfig struct {
+	Type     string   `yaml:"type"`
+	Action   string   `yaml:"action"`
+	Words    []string `yaml:"words"`
+	Max      int      `yaml:"max"`
+	MaxRatio float64  `yaml:"max_ratio"`
+}
+
+// moderationRuleTypes builds rules from their config. Register new rule types here.
+var moderationRuleTypes = map[string]func(c ruleConfig) (moderationRule, error){
+	"banned_words": func(c ruleConfig) (moderationRule, error) {
+		if len(c.Words) == 0 {
+			return nil, fmt.Errorf("banned_words needs words")
+		}
+		words := map[string]bool{}
+		for _, w := range c.Words {
+			words[strings.ToLower(w)] = true
+		}
+		return bannedWordsRule{words: words}, nil
+	},
+	"max_links": func(c ruleConfig) (moderationRule, error) {
+		return maxLinksRule{max: c.Max}, nil
+	},
+	"caps_ratio": func(c ruleConfig) (moderationRule, error) {
+		if c.MaxRatio <= 0 || c.MaxRatio > 1 {
+			return nil, fmt.Errorf("caps_ratio needs max_ratio in (0, 1]")
+		}
+		return capsRatioRule{maxRatio: c.MaxRatio}, nil
+	},
+	"repeated_chars": func(c ruleConfig) (moderationRule, error) {
+		if c.Max <= 0 {
+			return nil, fmt.Errorf("repeated_chars needs max")
+		}
+		return repeatedCharsRule{max: c.Max}, nil
+	},
+}
+
+type configuredRule struct {
+	name   string
+	action moderationAction
+	rule   moderationRule
+}
+
+// moderator runs every configured rule against a post.
+type moderator struct {
+	rules []configuredRule
+}
+
+// defaultModerationRules are used when no moderation config file is given.
+var defaultModerationRules = []ruleConfig{
+	{Type: "max_links", Action: "queue", Max: 5},
+	{Type: "caps_ratio", Action: "flag", MaxRatio: 0.7},
+	{Type: "repeated_chars", Action: "flag", Max: 10},
+}
+
+// blogModerator checks every created and updated blog.
+var blogModerator *moderator
+
+// loadModerator reads the rules from a YAML file, or uses the defaults when path is empty.
+func loadModerator(path string) (*moderator, error) {
+	configs := defaultModerationRules
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file := struct {
+			Rules []ruleConfig `yaml:"rules"`
+		}{}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("cannot parse %v: %v", path, err)
+		}
+		configs = file.Rules
+	}
+
+	m := &moderator{}
+	for i, c := range configs {
+		newRule, ok := moderationRuleTypes[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unknown type %q", i, c.Type)
+		}
+		action, ok := moderationActions[c.Action]
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unknown action %q", i, c.Action)
+		}
+		rule, err := newRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		m.rules = append(m.rules, configuredRule{name: c.Type, action: action, rule: rule})
+	}
+
+	return m, nil
+}
+
+// review returns the strongest action of all matching rules and their reasons.
+func (m *moderator) review(title, content string) (moderationAction, []string) {
+	action := actionAllow
+	var reasons []string
+	for _, r := range m.rules {
+		reason, matched := r.rule.Check(title, content)
+		if !matched {
+			continue
+		}
+		reasons = append(reasons, r.name+": "+reason)
+		if r.action > action {
+			action = r.action
+		}
+	}
+	return action, reasons
+}
+
+// moderate reviews a blog about to be stored and returns its moderation status and reasons,
+// or an InvalidArgument error when the blog is rejected.
+func moderate(title, content string) (string, []string, error) {
+	return moderatePost("Blog", title, content)
+}
+
+// moderatePost reviews a post of the given kind, a blog or a translation, like moderate.
+func moderatePost(kind, title, content string) (string, []string, error) {
+	action, reasons := blogModerator.review(title, content)
+	switch action {
+	case actionReject:
+		return "", nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("%v rejected by moderation: %v", kind, strings.Join(reasons, "; ")),
+		)
+	case actionQueue:
+		return moderationPending, reasons, nil
+	case actionFlag:
+		return moderationFlagged, reasons, nil
+	}
+	return "", nil, nil
+}
+
+// isVisible reports whether a blog with the given moderation status is published.
+func isVisible(moderationStatus string) bool {
+	return moderationStatus != moderationPending && moderationStatus != moderationRejected
+}
+
+type bannedWordsRule struct {
+	words map[string]bool
+}
+
+func (r bannedWordsRule) Check(title, content string) (string, bool) {
+	var found []string
+	for _, t := range strings.FieldsFunc(strings.ToLower(title+" "+content), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	}) {
+		if r.words[t] {
+			found = append(found, t)
+		}
+	}
+	if len(found) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("contains banned words %v", found), true
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+type maxLinksRule struct {
+	max int
+}
+
+func (r maxLinksRule) Check(title, content string) (string, bool) {
+	links := len(linkPattern.FindAllString(title+" "+content, -1))
+	if links <= r.max {
+		return "", false
+	}
+	return fmt.Sprintf("%d links, at most %d allowed", links, r.max), true
+}
+
+// capsRatioRule matches shouting: texts where most letters are upper case.
+type capsRatioRule struct {
+	maxRatio float64
+}
+
+func (r capsRatioRule) Check(title, content string) (string, bool) {
+	letters, upper := 0, 0
+	for _, c := range title + content {
+		if unicode.IsLetter(c) {
+			letters++
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		}
+	}
+	// Short texts such as acronyms are not worth flagging.
+	if letters < 20 {
+		return "", false
+	}
+	ratio := float64(upper) / float64(letters)
+	if ratio <= r.maxRatio {
+		return "", false
+	}
+	return fmt.Sprintf("%.0f%% upper case letters", ratio*100), true
+}
+
+// repeatedCharsRule matches runs of the same character such as "!!!!!!!!!!!!".
+type repeatedCharsRule struct {
+	max int
+}
+
+func (r repeatedCharsRule) Check(title, content string) (string, bool) {
+	var prev rune
+	run := 0
+	for _, c := range title + "\n" + content {
+		if c == prev && !unicode.IsSpace(c) {
+			run++
+		} else {
+			prev, run = c, 1
+		}
+		if run > r.max {
+			return fmt.Sprintf("character %q repeated more than %d times", c, r.max), true
+		}
+	}
+	return "", false
+}
+
+func (*adminServer) ListModerationQueue(ctx context.Context, req *blogpb.ListModerationQueueRequest) (*blogpb.ListModerationQueueResponse, error) {
+	fmt.Printf("ListModerationQueue called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	statuses := bson.A{moderationPending}
+	if req.GetIncludeFlagged() {
+		statuses = append(statuses, moderationFlagged)
+	}
+	filter := bson.M{"moderation_status": bson.M{"$in": statuses}}
+	if req.GetTenantId() != "" {
+		filter["tenant_id"] = req.GetTenantId()
+	}
+
+	cur, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "updated_at", Value: 1}}))
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	defer cur.Close(ctx)
+
+	res := &blogpb.ListModerationQueueResponse{}
+	for cur.Next(ctx) {
+		data := &blogItem{}
+		if err := cur.Decode(data); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Error while decoding data from MongoDB: %v", err),
+			)
+		}
+		res.Entries = append(res.Entries, &blogpb.ModerationEntry{
+			Blog:     mapDataToBlog(data),
+			TenantId: data.TenantID,
+			Reasons:  data.ModerationReasons,
+		})
+	}
+	if err := cur.Err(); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	// Translations awaiting review follow the blogs, each with its source blog.
+	var queued []*translationItem
+	err = forEach(ctx, translations, filter, func(cur *mongo.Cursor) error {
+		item := &translationItem{}
+		if err := cur.Decode(item); err != nil {
+			return err
+		}
+		queued = append(queued, item)
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	for _, item := range queued {
+		data := &blogItem{}
+		if err := collection.FindOne(ctx, bson.M{"_id": item.BlogID}).Decode(data); err != nil {
+			continue
+		}
+		res.Entries = append(res.Entries, &blogpb.ModerationEntry{
+			Blog:        mapDataToBlog(data),
+			TenantId:    item.TenantID,
+			Reasons:     item.ModerationReasons,
+			Translation: mapTranslation(item),
+		})
+	}
+
+	return res, nil
+}
+
+// reviewTranslation applies a moderator's decision to the translation of a blog and returns the
+// blog as read in that language.
+func reviewTranslation(ctx context.Context, blogID primitive.ObjectID, language, decision string) (*blogItem, error) {
+	lang, err := normalizeLanguage(language)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &translationItem{}
+	err = translations.FindOneAndUpdate(ctx,
+		bson.M{"blog_id": blogID, "language": lang, "moderation_status": bson.M{"$in": bson.A{moderationPending, moderationFlagged}}},
+		bson.M{"$set": bson.M{"moderation_status": decision}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(item)
+	if err == mongo.ErrNoDocuments {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Cannot find %v translation awaiting review of blog: %v", lang, blogID.Hex()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot update object in MongoDB: %v", err),
+		)
+	}
+	changes.record("translation", item.TenantID, item.ID)
+
+	data := &blogItem{}
+	if err := collection.FindOne(ctx, bson.M{"_id": blogID}).Decode(data); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot read blog of translation: %v", err),
+		)
+	}
+	data.Language, data.Title, data.Content = item.Language, item.Title, item.Content
+	return data, nil
+}
+
+func (*adminServer) ReviewBlog(ctx context.Context, req *blogpb.ReviewBlogRequest) (*blogpb.ReviewBlogResponse, error) {
+	fmt.Printf("ReviewBlog called...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(req.GetBlogId())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	decision := moderationRejected
+	if req.GetApprove() {
+		decision = moderationApproved
+	}
+
+	if req.GetLanguage() != "" {
+		data, err := reviewTranslation(ctx, oid, req.GetLanguage(), decision)
+		if err != nil {
+			return nil, err
+		}
+		return &blogpb.ReviewBlogResponse{
+			Blog: mapDataToBlog(data),
+		}, nil
+	}
+
+	data := &blogItem{}
+	err = collection.FindOne(ctx,
+		bson.M{"_id": oid, "moderation_status": bson.M{"$in": bson.A{moderationPending, moderationFlagged}}},
+	).Decode(data)
+	if err == mongo.ErrNoDocuments {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Cannot find blog awaiting review with specified ID: %v", oid.Hex()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot read object from MongoDB: %v", err),
+		)
+	}
+	previous, previousUpdatedAt := data.ModerationStatus, data.UpdatedAt
+	data.ModerationStatus = decision
+	data.UpdatedAt = nextUpdatedAt(previousUpdatedAt)
+
+	// A flagged blog is already visible, approving it publishes nothing new.
+	events := &stagedEvents{}
+	if isVisible(decision) && !isVisible(previous) {
+		if err := events.stage(context.Background(), data, blogpb.WebhookEvent_WEBHOOK_EVENT_PUBLISHED); err != nil {
+			events.abort(context.Background())
+			return nil, stagedEventsError(err)
+		}
+	}
+
+	updateResult, err := collection.UpdateOne(ctx,
+		bson.M{"_id": oid, "moderation_status": previous, "updated_at": previousUpdatedAt},
+		bson.M{"$set": bson.M{"moderation_status": decision, "updated_at": data.UpdatedAt}},
+	)
+	if err != nil {
+		events.abort(context.Background())
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot update object in MongoDB: %v", err),
+		)
+	}
+	if updateResult.MatchedCount == 0 {
+		events.abort(context.Background())
+		return nil, status.Errorf(
+			codes.Aborted,
+			fmt.Sprintf("Blog changed while it was reviewed, try again: %v", oid.Hex()),
+		)
+	}
+
+	changes.record("blog", data.TenantID, oid)
+	events.commit(context.Background())
+	if req.GetApprove() {
+		related.put(oid.Hex(), data.TenantID, data.Title, data.Content)
+	} else {
+		related.remove(oid.Hex())
+	}
+
+	return &blogpb.ReviewBlogResponse{
+		Blog: mapDataToBlog(data),
+	}, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRelatedLimit = 5
+	maxRelatedLimit     = 50
+)
+
+// related is the in-process similarity index behind RelatedBlogs.
+var related = newRelatedIndex()
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "from": true, "has": true, "have": true, "in": true, "is": true, "it": true,
+	"its": true, "of": true, "on": true, "or": true, "our": true, "that": true, "the": true, "this": true,
+	"to": true, "was": true, "we": true, "were": true, "will": true, "with": true, "you": true, "your": true,
+}
+
+// relatedIndex keeps term frequencies of every blog and, per tenant, an inverted index from
+// terms to the blogs containing them. TF-IDF vectors are built at query time from document
+// frequencies, so updates stay incremental, and a query only scores blogs sharing a term.
+type relatedIndex struct {
+	mu      sync.RWMutex
+	docs    map[string]*indexedDoc
+	tenants map[string]*tenantTerms
+}
+
+type indexedDoc struct {
+	tenant string
+	terms  map[string]int
+}
+
+// tenantTerms is the inverted index of the blogs of a tenant.
+type tenantTerms struct {
+	// size is the number of documents of the tenant.
+	size int
+	// postings holds the ids of the documents containing each term. Its length is the document
+	// frequency of the term.
+	postings map[string]map[string]bool
+}
+
+func newRelatedIndex() *relatedIndex {
+	return &relatedIndex{
+		docs:    map[string]*indexedDoc{},
+		tenants: map[string]*tenantTerms{},
+	}
+}
+
+// tokenize splits text into lower-cased terms, dropping stop words and single characters.
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := fields[:0]
+	for _, f := range fields {
+		if len([]rune(f)) > 1 && !stopWords[f] {
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// put adds or replaces a blog in the index. Title terms count twice.
+func (idx *relatedIndex) put(id, tenant, title, content string) {
+	terms := map[string]int{}
+	for _, t := range tokenize(title) {
+		terms[t] += 2
+	}
+	for _, t := range tokenize(content) {
+		terms[t]++
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(id)
+	idx.docs[id] = &indexedDoc{tenant: tenant, terms: terms}
+	tt := idx.tenants[tenant]
+	if tt == nil {
+		tt = &tenantTerms{postings: map[string]map[string]bool{}}
+		idx.tenants[tenant] = tt
+	}
+	for t := range terms {
+		if tt.postings[t] == nil {
+			tt.postings[t] = map[string]bool{}
+		}
+		tt.postings[t][id] = true
+	}
+	tt.size++
+}
+
+// remove drops a blog from the index.
+func (idx *relatedIndex) remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(id)
+}
+
+func (idx *relatedIndex) removeLocked(id string) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	delete(idx.docs, id)
+
+	tt := idx.tenants[doc.tenant]
+	for t := range doc.terms {
+		if delete(tt.postings[t], id); len(tt.postings[t]) == 0 {
+			delete(tt.postings, t)
+		}
+	}
+	if tt.size--; tt.size <= 0 {
+		delete(idx.tenants, doc.tenant)
+	}
+}
+
+// removeTenant drops every blog of a tenant from the index.
+func (idx *relatedIndex) removeTenant(tenant string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for id, doc := range idx.docs {
+		if doc.tenant == tenant {
+			delete(idx.docs, id)
+		}
+	}
+	delete(idx.tenants, tenant)
+}
+
+// vector returns the L2-normalized TF-IDF vector of a document. Must be called with mu held.
+func (idx *relatedIndex) vector(doc *indexedDoc) map[string]float64 {
+	tt := idx.tenants[doc.tenant]
+	vec := make(map[string]float64, len(doc.terms))
+	if tt == nil {
+		return vec
+	}
+	n := float64(tt.size)
+
+	norm := 0.0
+	for t, tf := range doc.terms {
+		w := (1 + math.Log(float64(tf))) * math.Log(1+n/float64(len(tt.postings[t])))
+		vec[t] = w
+		norm += w * w
+	}
+	if norm == 0 {
+		return vec
+	}
+
+	norm = math.Sqrt(norm)
+	for t := range vec {
+		vec[t] /= norm
+	}
+	return vec
+}
+
+type scoredDoc struct {
+	id    string
+	score float64
+}
+
+// similar returns up to limit blogs of the same tenant most similar to id, best first.
+// ok is false when id is not indexed.
+func (idx *relatedIndex) similar(id string, limit int) (results []scoredDoc, ok bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	doc, ok := idx.docs[id]
+	if !ok {
+		return nil, false
+	}
+	target := idx.vector(doc)
+
+	// Only blogs sharing a term with the target can score above zero.
+	tt := idx.tenants[doc.tenant]
+	candidates := map[string]bool{}
+	for t := range doc.terms {
+		for otherID := range tt.postings[t] {
+			if otherID != id {
+				candidates[otherID] = true
+			}
+		}
+	}
+
+	for otherID := range candidates {
+		score := 0.0
+		for t, w := range idx.vector(idx.docs[otherID]) {
+			score += w * target[t]
+		}
+		if score > 0 {
+			results = append(results, scoredDoc{id: otherID, score: score})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].id < results[j].id
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, true
+}
+
+// rebuild replaces the index with the current content of the store.
+func (idx *relatedIndex) rebuild(ctx context.Context) error {
+	fresh := newRelatedIndex()
+
+	opts := options.Find().SetProjection(bson.M{"tenant_id": 1, "title": 1, "content": 1})
+	cur, err := collection.Find(ctx, bson.M{"moderation_status": visibleFilter}, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		data := &blogItem{}
+		if err := cur.Decode(data); err != nil {
+			return err
+		}
+		fresh.put(data.ID.Hex(), data.TenantID, data.Title, data.Content)
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.docs, idx.tenants = fresh.docs, fresh.tenants
+
+	return nil
+}
+
+func (*server) RelatedBlogs(ctx context.Context, req *blogpb.RelatedBlogsRequest) (*blogpb.RelatedBlogsResponse, error) {
+	fmt.Printf("RelatedBlogs called by client...\n")
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(req.GetBlogId())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = defaultRelatedLimit
+	}
+	if limit > maxRelatedLimit {
+		limit = maxRelatedLimit
+	}
+
+	scored, ok := related.similar(oid.Hex(), limit)
+	if ok {
+		// The index spans all tenants, make sure the blog belongs to the caller.
+		count, err := collection.CountDocuments(ctx, bson.M{"_id": oid, "tenant_id": tenant.ID})
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Unknown internal error: %v", err),
+			)
+		}
+		ok = count > 0
+	}
+	if !ok {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Cannot find blog with specified ID: %v", oid.Hex()),
+		)
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(scored))
+	for _, s := range scored {
+		id, _ := primitive.ObjectIDFromHex(s.id)
+		ids = append(ids, id)
+	}
+
+	blogs := map[string]*blogpb.Blog{}
+	if len(ids) > 0 {
+		opts := options.Find().SetProjection(blogProjection(blogpb.BlogView_BLOG_VIEW_BASIC))
+		filter := bson.M{"_id": bson.M{"$in": ids}, "tenant_id": tenant.ID, "moderation_status": visibleFilter}
+		cur, err := collection.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Unknown internal error: %v", err),
+			)
+		}
+		defer cur.Close(ctx)
+
+		for cur.Next(ctx) {
+			data := &blogItem{}
+			if err := cur.Decode(data); err != nil {
+				return nil, status.Errorf(
+					codes.Internal,
+					fmt.Sprintf("Error while decoding data from MongoDB: %v", err),
+				)
+			}
+			blogs[data.ID.Hex()] = mapDataToBlog(data)
+		}
+		if err := cur.Err(); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Unknown internal error: %v", err),
+			)
+		}
+	}
+
+	res := &blogpb.RelatedBlogsResponse{}
+	for _, s := range scored {
+		if blog, ok := blogs[s.id]; ok {
+			res.Related = append(res.Related, &blogpb.RelatedBlog{Blog: blog, Score: s.score})
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"The Go blog", []string{"go", "blog"}},
+		{"gRPC-streams, and HTTP/2!", []string{"grpc", "streams", "http"}},
+		{"a b c 42 x1", []string{"42", "x1"}},
+		{"Élan café", []string{"élan", "café"}},
+	}
+
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRelatedVector(t *testing.T) {
+	idx := newRelatedIndex()
+	idx.put("1", "acme", "grpc", "grpc streams")
+	idx.put("2", "acme", "mongo", "streams")
+
+	// Doc 1 has tf(grpc)=3 (title counts twice) and tf(streams)=1, over 2 documents where grpc
+	// appears once and streams twice.
+	grpc := (1 + math.Log(3)) * math.Log(1+2.0/1)
+	streams := (1 + math.Log(1)) * math.Log(1+2.0/2)
+	norm := math.Sqrt(grpc*grpc + streams*streams)
+
+	vec := idx.vector(idx.docs["1"])
+	want := map[string]float64{"grpc": grpc / norm, "streams": streams / norm}
+	for term, w := range want {
+		if math.Abs(vec[term]-w) > 1e-9 {
+			t.Errorf("weight of %q = %v, want %v", term, vec[term], w)
+		}
+	}
+	if len(vec) != len(want) {
+		t.Errorf("vector = %v, want terms %v", vec, want)
+	}
+
+	if got := idx.vector(&indexedDoc{tenant: "acme", terms: map[string]int{}}); len(got) != 0 {
+		t.Errorf("vector of an empty document = %v, want empty", got)
+	}
+}
+
+func TestRelatedSimilar(t *testing.T) {
+	idx := newRelatedIndex()
+	idx.put("go1", "acme", "Go channels", "Channels and goroutines in Go")
+	idx.put("go2", "acme", "Go goroutines", "Goroutines scheduling in Go")
+	idx.put("go3", "acme", "Go modules", "Versioning Go modules")
+	idx.put("cook", "acme", "Pasta", "Boil water and add salt")
+	idx.put("other", "globex", "Go channels", "Channels and goroutines in Go")
+
+	tests := []struct {
+		name  string
+		id    string
+		limit int
+		want  []string
+		ok    bool
+	}{
+		{"ranked by similarity", "go1", 5, []string{"go2", "go3"}, true},
+		{"limited", "go1", 1, []string{"go2"}, true},
+		{"nothing in common", "cook", 5, nil, true},
+		{"other tenant only", "other", 5, nil, true},
+		{"not indexed", "missing", 5, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, ok := idx.similar(tt.id, tt.limit)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			var got []string
+			for i, r := range results {
+				got = append(got, r.id)
+				if i > 0 && r.score > results[i-1].score {
+					t.Errorf("results not sorted by score: %v", results)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("similar(%q, %d) = %v, want %v", tt.id, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelatedRemove(t *testing.T) {
+	idx := newRelatedIndex()
+	idx.put("1", "acme", "grpc", "streams")
+	idx.put("2", "acme", "grpc", "unary")
+	idx.put("2", "acme", "mongo", "unary")
+	idx.put("3", "globex", "grpc", "")
+
+	postings := func(tenant, term string) []string {
+		var ids []string
+		if tt := idx.tenants[tenant]; tt != nil {
+			for id := range tt.postings[term] {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	tests := []struct {
+		tenant, term string
+		want         []string
+	}{
+		{"acme", "grpc", []string{"1"}},
+		{"acme", "mongo", []string{"2"}},
+		{"acme", "unary", []string{"2"}},
+		{"globex", "grpc", []string{"3"}},
+	}
+	for _, tt := range tests {
+		if got := postings(tt.tenant, tt.term); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("after replacing doc 2, postings of %v/%v = %v, want %v", tt.tenant, tt.term, got, tt.want)
+		}
+	}
+	if idx.tenants["acme"].size != 2 {
+		t.Errorf("acme size = %d, want 2", idx.tenants["acme"].size)
+	}
+
+	idx.remove("1")
+	if got := postings("acme", "grpc"); got != nil || idx.tenants["acme"].size != 1 {
+		t.Errorf("after removing doc 1: grpc postings %v, size %d", got, idx.tenants["acme"].size)
+	}
+
+	idx.removeTenant("acme")
+	if _, ok := idx.docs["2"]; ok || idx.tenants["acme"] != nil {
+		t.Errorf("tenant acme still indexed: %v", idx.docs)
+	}
+	if got := postings("globex", "grpc"); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("removing acme changed globex postings: %v", got)
+	}
+
+	idx.remove("3")
+	if len(idx.docs) != 0 || len(idx.tenants) != 0 {
+		t.Errorf("empty index holds %v, %v", idx.docs, idx.tenants)
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"io"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// changeLogSize is the number of changes kept for mirrors catching up. Mirrors further
+	// behind get a full sync.
+	changeLogSize = 10000
+	// replicationHeartbeat is how often an idle WatchChanges stream reports the primary's head.
+	replicationHeartbeat = 5 * time.Second
+	// maxMirrorBackoff caps the delay between two attempts of a mirror to reach its primary.
+	maxMirrorBackoff = 30 * time.Second
+	// mirrorPositionInterval is how many changes a mirror applies between two saves of its
+	// position. Replaying changes is harmless, so a position a little behind is fine.
+	mirrorPositionInterval = 100
+	// leftoverBatch is the number of records a mirror removes at once after a full sync.
+	leftoverBatch = 1000
+)
+
+// replicatedKinds are the snapshot record kinds mirrors copy. Webhooks and their outbox stay on
+// the primary, mirrors do not deliver events.
+var replicatedKinds = map[string]bool{"tenant": true, "blog": true, "translation": true, "series": true}
+
+// changes records every write of the primary for WatchChanges.
+var changes = newChangeFeed()
+
+// change names a record that was written. Mirrors are sent the record as it is when the change
+// is streamed, or a delete when it is gone, so replaying a change twice is harmless.
+type change struct {
+	seq      int64
+	kind     string
+	tenantID string
+	id       interface{}
+}
+
+// changeFeed keeps the latest changes in memory. Its epoch changes whenever the log cannot be
+// trusted to continue the previous one, on start and after a snapshot restore.
+type changeFeed struct {
+	mu    sync.Mutex
+	epoch string
+	head  int64
+	log   []change
+	// pins counts the full syncs in flight per position. The log keeps every change after the
+	// oldest of them, beyond changeLogSize if need be, so that a sync can always be followed by
+	// the changes written during it.
+	pins map[int64]int
+	// wake is closed and replaced on every change.
+	wake chan struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	f := &changeFeed{}
+	f.reset()
+	return f
+}
+
+func (f *changeFeed) reset() {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.epoch = hex.EncodeToString(raw)
+	f.head = 0
+	f.log = nil
+	f.pins = map[int64]int{}
+	if f.wake != nil {
+		close(f.wake)
+	}
+	f.wake = make(chan struct{})
+}
+
+// record adds a write of the record kind/id to the feed.
+func (f *changeFeed) record(kind, tenantID string, id interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.head++
+	f.log = append(f.log, change{seq: f.head, kind: kind, tenantID: tenantID, id: id})
+	trim := len(f.log) - changeLogSize
+	first := f.head - int64(len(f.log)) + 1
+	for seq := range f.pins {
+		if kept := int(seq + 1 - first); kept < trim {
+			trim = kept
+		}
+	}
+	if trim > 0 {
+		f.log = f.log[trim:]
+	}
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// position returns the current epoch and head sequence.
+func (f *changeFeed) position() (string, int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.epoch, f.head
+}
+
+// pin returns the current epoch and head, and keeps the changes after them in the log until
+// unpin is called. unpin can be called more than once.
+func (f *changeFeed) pin() (epoch string, head int64, unpin func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	epoch, head = f.epoch, f.head
+	f.pins[head]++
+	var once sync.Once
+	return epoch, head, func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			// A reset dropped the pins of the previous epoch.
+			if f.epoch != epoch {
+				return
+			}
+			f.pins[head]--
+			if f.pins[head] == 0 {
+				delete(f.pins, head)
+			}
+		})
+	}
+}
+
+// since returns the changes after a position, the head and a channel closed on the next change.
+// ok is false when the position is not covered by the log anymore.
+func (f *changeFeed) since(epoch string, after int64) (pending []change, head int64, wake <-chan struct{}, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if epoch != f.epoch || after > f.head {
+		return nil, f.head, f.wake, false
+	}
+	first := f.head - int64(len(f.log)) + 1
+	if after < first-1 {
+		return nil, f.head, f.wake, false
+	}
+	pending = append(pending, f.log[after-first+1:]...)
+	return pending, f.head, f.wake, true
+}
+
+// idString formats a record id for the wire.
+func idString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// findSection returns the snapshot section of a record kind.
+func findSection(kind string) (snapshotSection, bool) {
+	for _, section := range snapshotSections() {
+		if section.Kind == kind {
+			return section, true
+		}
+	}
+	return snapshotSection{}, false
+}
+
+// changeEvent loads the current state of a changed record.
+func changeEvent(ctx context.Context, c change) (*blogpb.ReplicationEvent, error) {
+	section, _ := findSection(c.kind)
+
+	var data []byte
+	err := section.Dump(ctx, bson.M{"_id": c.id}, func(v interface{}) error {
+		var err error
+		data, err = json.Marshal(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &blogpb.ReplicationEvent{Sequence: c.seq}
+	if data == nil {
+		ev.Event = &blogpb.ReplicationEvent_Delete{Delete: &blogpb.ReplicationDelete{
+			Kind:     c.kind,
+			Id:       idString(c.id),
+			TenantId: c.tenantID,
+		}}
+	} else {
+		ev.Event = &blogpb.ReplicationEvent_Record{Record: &blogpb.ReplicationRecord{Kind: c.kind, Data: data}}
+	}
+	return ev, nil
+}
+
+// sendFullSync streams every replicated record and returns the position to continue after.
+// Writes during the sync are in the log after that position, so the mirror converges; the
+// position stays pinned in the log until unpin is called, however long the sync took.
+func sendFullSync(ctx context.Context, stream blogpb.BlogAdminService_WatchChangesServer) (string, int64, func(), error) {
+	epoch, head, unpin := changes.pin()
+
+	err := stream.Send(&blogpb.ReplicationEvent{
+		Epoch:        epoch,
+		HeadSequence: head,
+		Event:        &blogpb.ReplicationEvent_Reset_{Reset_: true},
+	})
+	if err != nil {
+		unpin()
+		return "", 0, nil, err
+	}
+
+	for _, section := range snapshotSections() {
+		if !replicatedKinds[section.Kind] {
+			continue
+		}
+		kind := section.Kind
+		err := section.Dump(ctx, bson.M{}, func(v interface{}) error {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			return stream.Send(&blogpb.ReplicationEvent{
+				Epoch:        epoch,
+				HeadSequence: head,
+				Event:        &blogpb.ReplicationEvent_Record{Record: &blogpb.ReplicationRecord{Kind: kind, Data: data}},
+			})
+		})
+		if err != nil {
+			unpin()
+			return "", 0, nil, err
+		}
+	}
+
+	err = stream.Send(&blogpb.ReplicationEvent{
+		Epoch:        epoch,
+		Sequence:     head,
+		HeadSequence: head,
+		Event:        &blogpb.ReplicationEvent_Synced{Synced: true},
+	})
+	if err != nil {
+		unpin()
+		return "", 0, nil, err
+	}
+	return epoch, head, unpin, nil
+}
+
+func (*adminServer) WatchChanges(req *blogpb.WatchChangesRequest, stream blogpb.BlogAdminService_WatchChangesServer) error {
+	fmt.Printf("WatchChanges called...\n")
+	ctx := stream.Context()
+	if err := authorizeAdmin(ctx); err != nil {
+		return err
+	}
+
+	epoch, after := req.GetEpoch(), req.GetAfterSequence()
+	unpin := func() {}
+	if _, _, _, ok := changes.since(epoch, after); !ok {
+		var err error
+		if epoch, after, unpin, err = sendFullSync(ctx, stream); err != nil {
+			return status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Full sync failed: %v", err),
+			)
+		}
+	}
+	defer unpin()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		pending, head, wake, ok := changes.since(epoch, after)
+		// Once the changes written during a full sync are taken, the log may be trimmed again.
+		unpin()
+		if !ok {
+			return status.Errorf(codes.Aborted, "The change feed was reset, reconnect for a full sync")
+		}
+
+		for _, c := range pending {
+			ev, err := changeEvent(ctx, c)
+			if err != nil {
+				return status.Errorf(
+					codes.Internal,
+					fmt.Sprintf("Cannot load changed %v: %v", c.kind, err),
+				)
+			}
+			ev.Epoch, ev.HeadSequence = epoch, head
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+			after = c.seq
+		}
+		if len(pending) > 0 {
+			continue
+		}
+
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			err := stream.Send(&blogpb.ReplicationEvent{
+				Epoch:        epoch,
+				Sequence:     after,
+				HeadSequence: head,
+				Event:        &blogpb.ReplicationEvent_Heartbeat{Heartbeat: true},
+			})
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return status.Errorf(codes.Canceled, "Mirror disconnected")
+		}
+	}
+}
+
+// mirrorState is the replication progress of a mirror.
+type mirrorState struct {
+	mu        sync.Mutex
+	primary   string
+	connected bool
+	epoch     string
+	applied   int64
+	head      int64
+	// behindSince is when the mirror fell behind the primary, zero while caught up.
+	behindSince time.Time
+	lastError   string
+}
+
+// mirror is set when the server runs as a read-only mirror.
+var mirror *mirrorState
+
+// mirrorPositions keeps the feed position of a mirror next to its data, so a restarted mirror
+// resumes where it stopped instead of syncing everything again.
+var mirrorPositions *mongo.Collection
+
+func mirrorPositionsCollection(coll *mongo.Collection) *mongo.Collection {
+	return coll.Database().Collection(coll.Name() + "_mirror")
+}
+
+type mirrorPosition struct {
+	ID      string `bson:"_id"`
+	Epoch   string `bson:"epoch"`
+	Applied int64  `bson:"applied"`
+}
+
+// loadMirrorPosition returns the saved feed position, empty when there is none.
+func loadMirrorPosition(ctx context.Context) (string, int64, error) {
+	pos := &mirrorPosition{}
+	err := mirrorPositions.FindOne(ctx, bson.M{"_id": "position"}).Decode(pos)
+	if err == mongo.ErrNoDocuments {
+		return "", 0, nil
+	}
+	return pos.Epoch, pos.Applied, err
+}
+
+// saveMirrorPosition stores the current feed position of the mirror.
+func saveMirrorPosition(ctx context.Context) error {
+	mirror.mu.Lock()
+	pos := mirrorPosition{ID: "position", Epoch: mirror.epoch, Applied: mirror.applied}
+	mirror.mu.Unlock()
+
+	_, err := mirrorPositions.ReplaceOne(ctx, bson.M{"_id": pos.ID}, pos, options.Replace().SetUpsert(true))
+	return err
+}
+
+// resync holds the ids of the records received per kind during a full sync, nil otherwise.
+// Guarded by storeLock.
+var resync map[string]map[interface{}]bool
+
+// progress records an applied event.
+func (m *mirrorState) progress(ev *blogpb.ReplicationEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connected = true
+	m.head = ev.GetHeadSequence()
+	switch ev.GetEvent().(type) {
+	case *blogpb.ReplicationEvent_Reset_:
+		// Until the sync completes the local data is partial, a reconnect must sync again.
+		m.epoch, m.applied = "", 0
+	case *blogpb.ReplicationEvent_Synced:
+		m.epoch, m.applied = ev.GetEpoch(), ev.GetSequence()
+	case *blogpb.ReplicationEvent_Record, *blogpb.ReplicationEvent_Delete:
+		// Records of a full sync carry no sequence.
+		if ev.GetSequence() > 0 {
+			m.applied = ev.GetSequence()
+		}
+	}
+	if m.epoch == ev.GetEpoch() && m.applied >= m.head {
+		m.behindSince = time.Time{}
+	} else if m.behindSince.IsZero() {
+		m.behindSince = time.Now()
+	}
+}
+
+// disconnected records a lost connection to the primary.
+func (m *mirrorState) disconnected(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connected = false
+	m.lastError = err.Error()
+	// Without a connection the mirror cannot know it is up to date.
+	if m.behindSince.IsZero() {
+		m.behindSince = time.Now()
+	}
+}
+
+// applyDelete removes a replicated record and what the primary removed along with it.
+func applyDelete(ctx context.Context, del *blogpb.ReplicationDelete) error {
+	if del.GetKind() == "tenant" {
+		if _, err := tenants.DeleteOne(ctx, bson.M{"_id": del.GetId()}); err != nil {
+			return err
+		}
+		filter := bson.M{"tenant_id": del.GetId()}
+		if _, err := collection.DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+		if _, err := series.DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+		if _, err := translations.DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+		related.removeTenant(del.GetId())
+		return nil
+	}
+
+	oid, err := primitive.ObjectIDFromHex(del.GetId())
+	if err != nil {
+		return fmt.Errorf("invalid %v id %q", del.GetKind(), del.GetId())
+	}
+
+	switch del.GetKind() {
+	case "blog":
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": oid}); err != nil {
+			return err
+		}
+		if err := removeFromSeries(ctx, del.GetTenantId(), oid); err != nil {
+			return err
+		}
+		if _, err := translations.DeleteMany(ctx, bson.M{"blog_id": oid}); err != nil {
+			return err
+		}
+		related.remove(oid.Hex())
+	case "series":
+		_, err = series.DeleteOne(ctx, bson.M{"_id": oid})
+	case "translation":
+		_, err = translations.DeleteOne(ctx, bson.M{"_id": oid})
+	default:
+		err = fmt.Errorf("unknown record kind %q", del.GetKind())
+	}
+	return err
+}
+
+// applyRecord stores a replicated record.
+func applyRecord(ctx context.Context, rec *blogpb.ReplicationRecord) error {
+	section, ok := findSection(rec.GetKind())
+	if !ok || !replicatedKinds[rec.GetKind()] {
+		return fmt.Errorf("unknown record kind %q", rec.GetKind())
+	}
+	doc, err := section.Decode(rec.GetData())
+	if err != nil {
+		return err
+	}
+	if err := section.store(ctx, doc); err != nil {
+		return err
+	}
+	if resync != nil {
+		resync[rec.GetKind()][doc.ID] = true
+	}
+
+	if rec.GetKind() == "blog" {
+		b := snapshotBlog{}
+		if err := json.Unmarshal(rec.GetData(), &b); err != nil {
+			return err
+		}
+		if isVisible(b.ModerationStatus) {
+			related.put(b.ID, b.TenantID, b.Title, b.Content)
+		} else {
+			related.remove(b.ID)
+		}
+	}
+	return nil
+}
+
+// removeLeftovers deletes the replicated records that were not received during the full sync.
+func removeLeftovers(ctx context.Context) error {
+	for _, section := range snapshotSections() {
+		seen, ok := resync[section.Kind]
+		if !ok {
+			continue
+		}
+
+		var leftovers []interface{}
+		opts := options.Find().SetProjection(bson.M{"_id": 1})
+		cur, err := section.Collection.Find(ctx, bson.M{}, opts)
+		if err != nil {
+			return err
+		}
+		for cur.Next(ctx) {
+			doc := struct {
+				ID interface{} `bson:"_id"`
+			}{}
+			if err := cur.Decode(&doc); err != nil {
+				cur.Close(ctx)
+				return err
+			}
+			if !seen[doc.ID] {
+				leftovers = append(leftovers, doc.ID)
+			}
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return err
+		}
+
+		for len(leftovers) > 0 {
+			batch := leftovers
+			if len(batch) > leftoverBatch {
+				batch = batch[:leftoverBatch]
+			}
+			if _, err := section.Collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": batch}}); err != nil {
+				return err
+			}
+			leftovers = leftovers[len(batch):]
+		}
+	}
+	return nil
+}
+
+// applyEvent applies one event of the primary to the local store.
+func applyEvent(ctx context.Context, ev *blogpb.ReplicationEvent) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	switch e := ev.GetEvent().(type) {
+	case *blogpb.ReplicationEvent_Reset_:
+		// The local data keeps being served during the sync. Records are overwritten as they
+		// arrive and those the primary does not have anymore are removed once it is done.
+		fmt.Println("Mirror: full sync from primary...")
+		resync = map[string]map[interface{}]bool{}
+		for kind := range replicatedKinds {
+			resync[kind] = map[interface{}]bool{}
+		}
+	case *blogpb.ReplicationEvent_Record:
+		return applyRecord(ctx, e.Record)
+	case *blogpb.ReplicationEvent_Delete:
+		return applyDelete(ctx, e.Delete)
+	case *blogpb.ReplicationEvent_Synced:
+		if resync != nil {
+			if err := removeLeftovers(ctx); err != nil {
+				return err
+			}
+			resync = nil
+		}
+		fmt.Printf("Mirror: full sync done at sequence %d\n", ev.GetSequence())
+		return related.rebuild(ctx)
+	}
+	return nil
+}
+
+// followPrimary streams changes from the primary until the stream fails.
+func followPrimary(ctx context.Context, client blogpb.BlogAdminServiceClient, token string) error {
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, adminMetadataKey, token)
+	}
+
+	mirror.mu.Lock()
+	req := &blogpb.WatchChangesRequest{Epoch: mirror.epoch, AfterSequence: mirror.applied}
+	mirror.mu.Unlock()
+
+	stream, err := client.WatchChanges(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("primary closed the stream")
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := applyEvent(ctx, ev); err != nil {
+			return fmt.Errorf("cannot apply change %d: %v", ev.GetSequence(), err)
+		}
+		mirror.progress(ev)
+
+		save := ev.GetSequence() > 0 && ev.GetSequence()%mirrorPositionInterval == 0
+		switch ev.GetEvent().(type) {
+		case *blogpb.ReplicationEvent_Reset_, *blogpb.ReplicationEvent_Synced, *blogpb.ReplicationEvent_Heartbeat:
+			save = true
+		}
+		if save {
+			if err := saveMirrorPosition(ctx); err != nil {
+				fmt.Printf("Mirror: cannot save feed position: %v\n", err)
+			}
+		}
+	}
+}
+
+// runMirror keeps the local store in sync with the primary until ctx is done, reconnecting
+// with exponential backoff.
+func runMirror(ctx context.Context, cc *grpc.ClientConn, token string) {
+	client := blogpb.NewBlogAdminServiceClient(cc)
+	backoff := time.Second
+
+	for {
+		start := time.Now()
+		err := followPrimary(ctx, client, token)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("Mirror: lost primary %v: %v\n", mirror.primary, err)
+		mirror.disconnected(err)
+
+		if time.Since(start) > maxMirrorBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxMirrorBackoff {
+			backoff = maxMirrorBackoff
+		}
+	}
+}
+
+// mirrorReadMethods are the calls a mirror serves, every other call is a write for the primary.
+var mirrorReadMethods = map[string]bool{
+	"/blog.BlogService/ReadBlog":                  true,
+	"/blog.BlogService/ListBlog":                  true,
+	"/blog.BlogService/RelatedBlogs":              true,
+	"/blog.BlogService/ListSeries":                true,
+	"/blog.BlogService/ListTranslations":          true,
+	"/blog.BlogService/GetBlogStats":              true,
+	"/blog.BlogAdminService/CreateSnapshot":       true,
+	"/blog.BlogAdminService/GetReplicationStatus": true,
+}
+
+func mirrorReadOnly(method string) error {
+	if mirrorReadMethods[method] {
+		return nil
+	}
+	return status.Errorf(
+		codes.FailedPrecondition,
+		fmt.Sprintf("This server is a read-only mirror of %v, send %v to the primary", mirror.primary, method),
+	)
+}
+
+// mirrorUnaryInterceptor rejects writes on a mirror.
+func mirrorUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := mirrorReadOnly(info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// mirrorStreamInterceptor rejects streaming writes on a mirror.
+func mirrorStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := mirrorReadOnly(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (*adminServer) GetReplicationStatus(ctx context.Context, req *blogpb.GetReplicationStatusRequest) (*blogpb.GetReplicationStatusResponse, error) {
+	fmt.Printf("GetReplicationStatus called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if mirror == nil {
+		epoch, head := changes.position()
+		return &blogpb.GetReplicationStatusResponse{
+			Epoch:           epoch,
+			AppliedSequence: head,
+			HeadSequence:    head,
+		}, nil
+	}
+
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+
+	res := &blogpb.GetReplicationStatusResponse{
+		Mirror:          true,
+		Primary:         mirror.primary,
+		Connected:       mirror.connected,
+		Epoch:           mirror.epoch,
+		AppliedSequence: mirror.applied,
+		HeadSequence:    mirror.head,
+		LastError:       mirror.lastError,
+	}
+	if !mirror.behindSince.IsZero() {
+		res.LagSeconds = time.Since(mirror.behindSince).Seconds()
+	}
+	return res, nil
+}
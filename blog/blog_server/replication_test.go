@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestChangeFeedPin(t *testing.T) {
+	f := newChangeFeed()
+	for i := 0; i < changeLogSize+10; i++ {
+		f.record("blog", "acme", i)
+	}
+	epoch, _ := f.position()
+	if _, _, _, ok := f.since(epoch, 0); ok {
+		t.Fatal("since(0) is covered beyond changeLogSize")
+	}
+
+	_, head, unpin := f.pin()
+	_, _, unpinTwice := f.pin()
+	for i := 0; i < changeLogSize+10; i++ {
+		f.record("blog", "acme", i)
+	}
+	pending, _, _, ok := f.since(epoch, head)
+	if !ok || len(pending) != changeLogSize+10 {
+		t.Fatalf("since(pinned head) = %d changes, %v, want every change after the pin", len(pending), ok)
+	}
+
+	// The log is trimmed again once the last pin of a position is released.
+	unpin()
+	unpin()
+	f.record("blog", "acme", 0)
+	if _, _, _, ok := f.since(epoch, head); !ok {
+		t.Fatal("since(pinned head) is not covered while pinned twice")
+	}
+	unpinTwice()
+	f.record("blog", "acme", 0)
+	if _, _, _, ok := f.since(epoch, head); ok {
+		t.Fatal("since(pinned head) is still covered after unpinning")
+	}
+	if len(f.log) != changeLogSize {
+		t.Errorf("log holds %d changes, want %d", len(f.log), changeLogSize)
+	}
+
+	// A reset drops the pins; releasing one afterwards is harmless.
+	_, _, unpin = f.pin()
+	f.reset()
+	f.pin()
+	unpin()
+	if len(f.pins) != 1 {
+		t.Errorf("pins after reset = %v, want the one taken since", f.pins)
+	}
+}
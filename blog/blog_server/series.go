@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// series holds one seriesItem per series of blogs.
+var series *mongo.Collection
+
+type seriesItem struct {
+	ID        primitive.ObjectID   `bson:"_id,omitempty"`
+	TenantID  string               `bson:"tenant_id"`
+	Title     string               `bson:"title"`
+	AuthorID  string               `bson:"author_id"`
+	BlogIDs   []primitive.ObjectID `bson:"blog_ids"`
+	CreatedAt time.Time            `bson:"created_at"`
+	UpdatedAt time.Time            `bson:"updated_at"`
+}
+
+func seriesCollection(coll *mongo.Collection) *mongo.Collection {
+	return coll.Database().Collection(coll.Name() + "_series")
+}
+
+func mapSeries(item *seriesItem) *blogpb.Series {
+	ids := make([]string, 0, len(item.BlogIDs))
+	for _, id := range item.BlogIDs {
+		ids = append(ids, id.Hex())
+	}
+
+	return &blogpb.Series{
+		Id:       item.ID.Hex(),
+		Title:    item.Title,
+		AuthorId: item.AuthorID,
+		BlogIds:  ids,
+	}
+}
+
+// seriesNavigation returns the position of a blog in its series, or nil when it has none.
+// Members readers cannot see are left out of the position, the neighbours and the total.
+func seriesNavigation(ctx context.Context, tenantID string, blogID primitive.ObjectID) (*blogpb.SeriesNavigation, error) {
+	item := &seriesItem{}
+	err := series.FindOne(ctx, bson.M{"tenant_id": tenantID, "blog_ids": blogID}).Decode(item)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	visible, err := blogIDSet(ctx, bson.M{
+		"_id":               bson.M{"$in": item.BlogIDs},
+		"tenant_id":         tenantID,
+		"moderation_status": visibleFilter,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return navigateSeries(item, blogID, visible), nil
+}
+
+// navigateSeries places blogID among the visible members of a series; blogID itself always counts.
+func navigateSeries(item *seriesItem, blogID primitive.ObjectID, visible map[primitive.ObjectID]bool) *blogpb.SeriesNavigation {
+	members := make([]primitive.ObjectID, 0, len(item.BlogIDs))
+	for _, id := range item.BlogIDs {
+		if id == blogID || visible[id] {
+			members = append(members, id)
+		}
+	}
+
+	nav := &blogpb.SeriesNavigation{
+		SeriesId:    item.ID.Hex(),
+		SeriesTitle: item.Title,
+		Total:       int32(len(members)),
+	}
+	for i, id := range members {
+		if id != blogID {
+			continue
+		}
+		nav.Position = int32(i + 1)
+		if i > 0 {
+			nav.PreviousBlogId = members[i-1].Hex()
+		}
+		if i < len(members)-1 {
+			nav.NextBlogId = members[i+1].Hex()
+		}
+	}
+
+	return nav
+}
+
+// removeFromSeries drops a deleted blog from its series and deletes the series if it was the
+// last blog. The series is deleted first: the unique blog_ids index admits a single empty
+// series per tenant.
+func removeFromSeries(ctx context.Context, tenantID string, blogID primitive.ObjectID) error {
+	_, err := series.DeleteMany(ctx, bson.M{"tenant_id": tenantID, "blog_ids": bson.A{blogID}})
+	if err != nil {
+		return err
+	}
+
+	_, err = series.UpdateMany(ctx,
+		bson.M{"tenant_id": tenantID, "blog_ids": blogID},
+		bson.M{
+			"$pull": bson.M{"blog_ids": blogID},
+			"$set":  bson.M{"updated_at": time.Now().UTC()},
+		},
+	)
+	return err
+}
+
+// blogIDSet returns the ids of the blogs matching filter.
+func blogIDSet(ctx context.Context, filter bson.M) (map[primitive.ObjectID]bool, error) {
+	cur, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	ids := map[primitive.ObjectID]bool{}
+	for cur.Next(ctx) {
+		data := &blogItem{}
+		if err := cur.Decode(data); err != nil {
+			return nil, err
+		}
+		ids[data.ID] = true
+	}
+	return ids, cur.Err()
+}
+
+// missingSeriesMembers returns the blogs of oids that no longer exist in the tenant. It runs
+// after a series is written, since a member can be deleted once validateSeriesMembers passed.
+func missingSeriesMembers(ctx context.Context, tenantID string, oids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	found, err := blogIDSet(ctx, bson.M{"tenant_id": tenantID, "_id": bson.M{"$in": oids}})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []primitive.ObjectID
+	for _, oid := range oids {
+		if !found[oid] {
+			missing = append(missing, oid)
+		}
+	}
+	return missing, nil
+}
+
+// validateSeriesMembers parses blog ids and checks that they are distinct, exist in the tenant
+// and are not part of another series than seriesID.
+func validateSeriesMembers(ctx context.Context, tenantID string, seriesID primitive.ObjectID, blogIDs []string) ([]primitive.ObjectID, error) {
+	if len(blogIDs) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "A series needs at least one blog")
+	}
+
+	oids := make([]primitive.ObjectID, 0, len(blogIDs))
+	seen := map[primitive.ObjectID]bool{}
+	for _, id := range blogIDs {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Cannot parse blog ID: %v", id),
+			)
+		}
+		if seen[oid] {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Blog listed twice: %v", id),
+			)
+		}
+		seen[oid] = true
+		oids = append(oids, oid)
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"tenant_id": tenantID, "_id": bson.M{"$in": oids}})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	if count != int64(len(oids)) {
+		return nil, status.Errorf(codes.NotFound, "Some blogs of the series do not exist")
+	}
+
+	other := &seriesItem{}
+	err = series.FindOne(ctx, bson.M{
+		"tenant_id": tenantID,
+		"_id":       bson.M{"$ne": seriesID},
+		"blog_ids":  bson.M{"$in": oids},
+	}).Decode(other)
+	if err == nil {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			fmt.Sprintf("A blog is already part of series %v", other.ID.Hex()),
+		)
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	return oids, nil
+}
+
+// errSeriesMemberTaken reports a write rejected by the unique blog_ids index because another
+// series took one of the blogs after validateSeriesMembers.
+func errSeriesMemberTaken() error {
+	return status.Errorf(codes.FailedPrecondition, "A blog is already part of another series")
+}
+
+func (*server) CreateSeries(ctx context.Context, req *blogpb.CreateSeriesRequest) (*blogpb.CreateSeriesResponse, error) {
+	fmt.Printf("CreateSeries called by client...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := req.GetSeries()
+	if s.GetTitle() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A series needs a title")
+	}
+
+	oids, err := validateSeriesMembers(ctx, tenant.ID, primitive.NilObjectID, s.GetBlogIds())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	item := &seriesItem{
+		TenantID:  tenant.ID,
+		Title:     s.GetTitle(),
+		AuthorID:  s.GetAuthorId(),
+		BlogIDs:   oids,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	res, err := series.InsertOne(ctx, item)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errSeriesMemberTaken()
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Internal error: %v", err),
+		)
+	}
+	item.ID = res.InsertedID.(primitive.ObjectID)
+
+	// A blog deleted since validateSeriesMembers was not pulled from a series that did not
+	// exist yet, so the series is dropped again.
+	missing, err := missingSeriesMembers(ctx, tenant.ID, oids)
+	if err == nil && len(missing) > 0 {
+		_, err = series.DeleteOne(ctx, bson.M{"_id": item.ID})
+		if err == nil {
+			return nil, status.Errorf(codes.NotFound, "Some blogs of the series do not exist")
+		}
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	changes.record("series", tenant.ID, item.ID)
+
+	return &blogpb.CreateSeriesResponse{
+		Series: mapSeries(item),
+	}, nil
+}
+
+func (*server) ReorderSeries(ctx context.Context, req *blogpb.ReorderSeriesRequest) (*blogpb.ReorderSeriesResponse, error) {
+	fmt.Printf("ReorderSeries called by client...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seriesID, err := primitive.ObjectIDFromHex(req.GetSeriesId())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	oids, err := validateSeriesMembers(ctx, tenant.ID, seriesID, req.GetBlogIds())
+	if err != nil {
+		return nil, err
+	}
+
+	item := &seriesItem{}
+	err = series.FindOneAndUpdate(ctx,
+		bson.M{"_id": seriesID, "tenant_id": tenant.ID},
+		bson.M{"$set": bson.M{"blog_ids": oids, "updated_at": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(item)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, errSeriesMemberTaken()
+	}
+	if err == mongo.ErrNoDocuments {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Cannot find series with specified ID: %v", seriesID.Hex()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot update object in MongoDB: %v", err),
+		)
+	}
+	changes.record("series", tenant.ID, seriesID)
+
+	// The new order may bring back a blog deleted since validateSeriesMembers.
+	missing, err := missingSeriesMembers(ctx, tenant.ID, oids)
+	for _, oid := range missing {
+		if err == nil {
+			err = removeFromSeries(ctx, tenant.ID, oid)
+		}
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	if len(missing) > 0 {
+		return nil, status.Errorf(codes.NotFound, "Some blogs of the series do not exist")
+	}
+
+	return &blogpb.ReorderSeriesResponse{
+		Series: mapSeries(item),
+	}, nil
+}
+
+func (*server) ListSeries(ctx context.Context, req *blogpb.ListSeriesRequest) (*blogpb.ListSeriesResponse, error) {
+	fmt.Printf("ListSeries called by client...\n")
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"tenant_id": tenant.ID}
+	if req.GetAuthorId() != "" {
+		filter["author_id"] = req.GetAuthorId()
+	}
+
+	res := &blogpb.ListSeriesResponse{}
+	err = forEach(ctx, series, filter, func(cur *mongo.Cursor) error {
+		item := &seriesItem{}
+		if err := cur.Decode(item); err != nil {
+			return err
+		}
+		res.Series = append(res.Series, mapSeries(item))
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	return res, nil
+}
+
+func (*server) DeleteSeries(ctx context.Context, req *blogpb.DeleteSeriesRequest) (*blogpb.DeleteSeriesResponse, error) {
+	fmt.Printf("DeleteSeries called by client...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seriesID, err := primitive.ObjectIDFromHex(req.GetSeriesId())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	deleteResult, err := series.DeleteOne(ctx, bson.M{"_id": seriesID, "tenant_id": tenant.ID})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot delete object in MongoDB: %v", err),
+		)
+	}
+	if deleteResult.DeletedCount == 0 {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Series to be deleted is not found: %v", seriesID.Hex()),
+		)
+	}
+	changes.record("series", tenant.ID, seriesID)
+
+	return &blogpb.DeleteSeriesResponse{
+		SeriesId: seriesID.Hex(),
+	}, nil
+}
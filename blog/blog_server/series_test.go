@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"go-grpc-course/blog/blogpb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNavigateSeries(t *testing.T) {
+	a, b, c, d := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	item := &seriesItem{ID: primitive.NewObjectID(), Title: "Go", BlogIDs: []primitive.ObjectID{a, b, c, d}}
+	nav := func(position, total int32, previous, next string) *blogpb.SeriesNavigation {
+		return &blogpb.SeriesNavigation{
+			SeriesId:       item.ID.Hex(),
+			SeriesTitle:    "Go",
+			Position:       position,
+			Total:          total,
+			PreviousBlogId: previous,
+			NextBlogId:     next,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		blogID  primitive.ObjectID
+		visible []primitive.ObjectID
+		want    *blogpb.SeriesNavigation
+	}{
+		{"first", a, []primitive.ObjectID{a, b, c, d}, nav(1, 4, "", b.Hex())},
+		{"middle", c, []primitive.ObjectID{a, b, c, d}, nav(3, 4, b.Hex(), d.Hex())},
+		{"last", d, []primitive.ObjectID{a, b, c, d}, nav(4, 4, c.Hex(), "")},
+		{"hidden neighbour skipped", c, []primitive.ObjectID{a, c, d}, nav(2, 3, a.Hex(), d.Hex())},
+		{"hidden members before", c, []primitive.ObjectID{c, d}, nav(1, 2, "", d.Hex())},
+		{"only visible member", b, nil, nav(1, 1, "", "")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visible := map[primitive.ObjectID]bool{}
+			for _, id := range tt.visible {
+				visible[id] = true
+			}
+			if got := navigateSeries(item, tt.blogID, visible); !proto.Equal(got, tt.want) {
+				t.Errorf("navigateSeries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeriesMembers(t *testing.T) {
+	ctx := testStore(t)
+
+	var ids []primitive.ObjectID
+	for _, moderationStatus := range []string{"", moderationPending, "", ""} {
+		blog := blogItem{ID: primitive.NewObjectID(), TenantID: "acme", ModerationStatus: moderationStatus}
+		if _, err := collection.InsertOne(ctx, blog); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, blog.ID)
+	}
+	first := seriesItem{ID: primitive.NewObjectID(), TenantID: "acme", Title: "first", BlogIDs: ids[:3]}
+	if _, err := series.InsertOne(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	taken := seriesItem{TenantID: "acme", Title: "taken", BlogIDs: ids[2:]}
+	if _, err := series.InsertOne(ctx, taken); !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("InsertOne of a series sharing a blog = %v, want a duplicate key error", err)
+	}
+	other := seriesItem{TenantID: "globex", Title: "other tenant", BlogIDs: ids[2:]}
+	if _, err := series.InsertOne(ctx, other); err != nil {
+		t.Fatalf("InsertOne in another tenant: %v", err)
+	}
+
+	nav, err := seriesNavigation(ctx, "acme", ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nav.GetPosition() != 2 || nav.GetTotal() != 2 || nav.GetPreviousBlogId() != ids[0].Hex() {
+		t.Errorf("seriesNavigation = %v, want position 2 of 2 after %v", nav, ids[0].Hex())
+	}
+
+	// Series losing their last blog are deleted rather than left empty, which the unique index
+	// admits once per tenant.
+	last := seriesItem{TenantID: "acme", Title: "last", BlogIDs: ids[3:]}
+	if _, err := series.InsertOne(ctx, last); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err := removeFromSeries(ctx, "acme", id); err != nil {
+			t.Fatalf("removeFromSeries(%v): %v", id.Hex(), err)
+		}
+	}
+	if count, err := series.CountDocuments(ctx, bson.M{"tenant_id": "acme"}); err != nil || count != 0 {
+		t.Errorf("series left in tenant = %v, %v, want 0", count, err)
+	}
+}
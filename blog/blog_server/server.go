@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"go-grpc-course/blog/blogpb"
+	"go-grpc-course/config"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,6 +20,8 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -24,39 +30,173 @@ var collection *mongo.Collection
 type server struct{}
 
 type blogItem struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty"`
-	AuthorID string             `bson:"author_id"`
-	Content  string             `bson:"content"`
-	Title    string             `bson:"title"`
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	TenantID      string             `bson:"tenant_id"`
+	AuthorID      string             `bson:"author_id"`
+	Content       string             `bson:"content"`
+	Title         string             `bson:"title"`
+	CreatedAt     time.Time          `bson:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at"`
+	SchemaVersion int                `bson:"schema_version"`
+	// Language is the BCP 47 tag the blog is written in, empty when unknown.
+	Language string   `bson:"language,omitempty"`
+	Tags     []string `bson:"tags,omitempty"`
+
+	ModerationStatus  string   `bson:"moderation_status,omitempty"`
+	ModerationReasons []string `bson:"moderation_reasons,omitempty"`
+
+	// Excerpt is never stored, it is computed by the BLOG_VIEW_BASIC projection.
+	Excerpt string `bson:"excerpt,omitempty"`
+}
+
+// excerptLength is the number of characters of content returned as excerpt.
+const excerptLength = 200
+
+// blogProjection returns the MongoDB projection for a view, or nil to fetch whole documents.
+// The BASIC view computes the excerpt in the database so the content never leaves it.
+func blogProjection(view blogpb.BlogView) interface{} {
+	if view != blogpb.BlogView_BLOG_VIEW_BASIC {
+		return nil
+	}
+
+	return bson.M{
+		"_id":               1,
+		"tenant_id":         1,
+		"author_id":         1,
+		"title":             1,
+		"moderation_status": 1,
+		"language":          1,
+		"tags":              1,
+		"excerpt":           bson.M{"$substrCP": bson.A{"$content", 0, excerptLength}},
+	}
+}
+
+// maxTags is the number of tags a blog can carry.
+const maxTags = 20
+
+// normalizeTags lower-cases tags and drops blanks and duplicates.
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		normalized = append(normalized, t)
+	}
+	if len(normalized) > maxTags {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("A blog can have at most %d tags", maxTags),
+		)
+	}
+	return normalized, nil
+}
+
+// excerpt returns the beginning of content, the same way the BASIC projection does.
+func excerpt(content string) string {
+	runes := []rune(content)
+	if len(runes) <= excerptLength {
+		return content
+	}
+	return string(runes[:excerptLength])
 }
 
 func mapDataToBlog(data *blogItem) *blogpb.Blog {
 
-	return &blogpb.Blog{
+	blog := &blogpb.Blog{
 		Id:       data.ID.Hex(),
 		AuthorId: data.AuthorID,
 		Content:  data.Content,
 		Title:    data.Title,
+		Excerpt:  data.Excerpt,
+		Language: data.Language,
+		Tags:     data.Tags,
+
+		ModerationStatus: moderationStatuses[data.ModerationStatus],
 	}
+	if blog.Excerpt == "" {
+		blog.Excerpt = excerpt(data.Content)
+	}
+
+	return blog
 }
 
 func (*server) CreateBlog(ctx context.Context, req *blogpb.CreateBlogRequest) (*blogpb.CreateBlogResponse, error) {
 	fmt.Printf("CreateBlog called by client....\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
 	blog := req.GetBlog()
 
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := tenant.reserveBlog(ctx); err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() {
+		if !created {
+			releaseBlogs(context.Background(), tenant.ID, 1)
+		}
+	}()
+
+	language := ""
+	if blog.GetLanguage() != "" {
+		if language, err = normalizeLanguage(blog.GetLanguage()); err != nil {
+			return nil, err
+		}
+	}
+	tags, err := normalizeTags(blog.GetTags())
+	if err != nil {
+		return nil, err
+	}
+
+	moderationStatus, moderationReasons, err := moderate(blog.GetTitle(), blog.GetContent())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
 	data := blogItem{
-		AuthorID: blog.GetAuthorId(),
-		Title:    blog.GetTitle(),
-		Content:  blog.GetContent(),
+		ID:            primitive.NewObjectID(),
+		TenantID:      tenant.ID,
+		AuthorID:      blog.GetAuthorId(),
+		Title:         blog.GetTitle(),
+		Content:       blog.GetContent(),
+		Language:      language,
+		Tags:          tags,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		SchemaVersion: currentSchemaVersion,
+
+		ModerationStatus:  moderationStatus,
+		ModerationReasons: moderationReasons,
+	}
+
+	// The events are queued first so they cannot be lost, and released once the blog is stored.
+	createdEvents := []blogpb.WebhookEvent{blogpb.WebhookEvent_WEBHOOK_EVENT_CREATED}
+	if isVisible(data.ModerationStatus) {
+		createdEvents = append(createdEvents, blogpb.WebhookEvent_WEBHOOK_EVENT_PUBLISHED)
+	}
+	events := &stagedEvents{}
+	if err := events.stage(context.Background(), &data, createdEvents...); err != nil {
+		events.abort(context.Background())
+		return nil, stagedEventsError(err)
 	}
 
 	res, err := collection.InsertOne(context.Background(), data)
 
 	if err != nil {
+		events.abort(context.Background())
 		return nil, status.Errorf(
 			codes.Internal, fmt.Sprintf("Internal error: %v", err),
 		)
 	}
+	created = true
 
 	objectId, ok := res.InsertedID.(primitive.ObjectID)
 	fmt.Printf("OID: %v", objectId)
@@ -67,18 +207,25 @@ func (*server) CreateBlog(ctx context.Context, req *blogpb.CreateBlogRequest) (*
 		)
 	}
 
+	changes.record("blog", tenant.ID, objectId)
+	events.commit(context.Background())
+	if isVisible(data.ModerationStatus) {
+		related.put(objectId.Hex(), tenant.ID, data.Title, data.Content)
+	}
+
 	return &blogpb.CreateBlogResponse{
-		Blog: &blogpb.Blog{
-			Id:       objectId.Hex(),
-			AuthorId: blog.GetAuthorId(),
-			Content:  blog.GetContent(),
-		},
+		Blog: mapDataToBlog(&data),
 	}, nil
 }
 
 func (*server) ReadBlog(ctx context.Context, req *blogpb.ReadBlogRequest) (*blogpb.ReadBlogResponse, error) {
 	fmt.Printf("ReadBlog called by client....\n")
 
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	blogId := req.GetBlogId()
 	oid, err := primitive.ObjectIDFromHex(blogId)
 	if err != nil {
@@ -91,7 +238,9 @@ func (*server) ReadBlog(ctx context.Context, req *blogpb.ReadBlogRequest) (*blog
 	//create an empty struct
 	data := &blogItem{}
 
-	res := collection.FindOne(context.Background(), bson.M{"_id": oid})
+	opts := options.FindOne().SetProjection(blogProjection(req.GetView()))
+	filter := bson.M{"_id": oid, "tenant_id": tenant.ID, "moderation_status": visibleFilter}
+	res := collection.FindOne(context.Background(), filter, opts)
 	if err := res.Decode(data); err != nil {
 		return nil, status.Errorf(
 			codes.NotFound,
@@ -99,20 +248,45 @@ func (*server) ReadBlog(ctx context.Context, req *blogpb.ReadBlogRequest) (*blog
 		)
 	}
 
+	nav, err := seriesNavigation(ctx, tenant.ID, oid)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot load series of blog: %v", err),
+		)
+	}
+
+	languages, translation, err := translateBlog(ctx, data, req.GetPreferredLanguages(), req.GetView())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot load translations of blog: %v", err),
+		)
+	}
+
+	blog := mapDataToBlog(data)
+	if translation != nil {
+		blog.TranslationStale = translation.Stale
+	}
+
 	return &blogpb.ReadBlogResponse{
-		Blog: &blogpb.Blog{
-			Id:       data.ID.Hex(),
-			AuthorId: data.AuthorID,
-			Title:    data.Title,
-			Content:  data.Content,
-		},
+		Blog:               blog,
+		Series:             nav,
+		AvailableLanguages: languages,
 	}, nil
 }
 
 func (*server) UpdateBlog(ctx context.Context, req *blogpb.UpdateBlogRequest) (*blogpb.UpdateBlogResponse, error) {
 	fmt.Printf("UpdateBlog called by client...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
 	blog := req.GetBlog()
 
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	oid, err := primitive.ObjectIDFromHex(blog.GetId())
 	if err != nil {
 		return nil, status.Errorf(
@@ -121,37 +295,157 @@ func (*server) UpdateBlog(ctx context.Context, req *blogpb.UpdateBlogRequest) (*
 		)
 	}
 
+	// Blogs with edit locks are changed through their EditBlog session only.
+	if editSessions.locked(oid) {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			fmt.Sprintf("Blog is being edited in an EditBlog session: %v", oid.Hex()),
+		)
+	}
+
+	data, err := updateBlog(ctx, tenant.ID, oid, blog, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &blogpb.UpdateBlogResponse{
+		Blog: mapDataToBlog(data),
+	}, nil
+}
+
+// nextUpdatedAt returns the updated_at of a blog changed now, always after its previous one at
+// the millisecond precision of the store, so it can serve as a write precondition.
+func nextUpdatedAt(previous time.Time) time.Time {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if !now.After(previous) {
+		now = previous.UTC().Truncate(time.Millisecond).Add(time.Millisecond)
+	}
+	return now
+}
+
+// updateBlog replaces a stored blog with the fields of blog. The blog must not change between
+// the read and the write, nor since expectedUpdatedAt unless it is zero: concurrent writers get
+// Aborted instead of overwriting each other. Callers hold storeLock.
+func updateBlog(ctx context.Context, tenantID string, oid primitive.ObjectID, blog *blogpb.Blog, expectedUpdatedAt time.Time) (*blogItem, error) {
 	//create and empty struct
 	data := &blogItem{}
 
-	res := collection.FindOne(context.Background(), bson.M{"_id": oid})
+	res := collection.FindOne(context.Background(), bson.M{"_id": oid, "tenant_id": tenantID})
 	if err := res.Decode(data); err != nil {
 		return nil, status.Errorf(
 			codes.NotFound,
 			fmt.Sprintf("Cannot find blog with specified ID: %v", err),
 		)
 	}
+	if !expectedUpdatedAt.IsZero() && !data.UpdatedAt.Equal(expectedUpdatedAt) {
+		return nil, errBlogChanged(oid)
+	}
+	previousUpdatedAt := data.UpdatedAt
+
+	if data.ModerationStatus == moderationRejected {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			fmt.Sprintf("Blog was rejected by a moderator: %v", oid.Hex()),
+		)
+	}
+
+	moderationStatus, moderationReasons, err := moderate(blog.GetTitle(), blog.GetContent())
+	if err != nil {
+		return nil, err
+	}
+
+	language := ""
+	if blog.GetLanguage() != "" {
+		if language, err = normalizeLanguage(blog.GetLanguage()); err != nil {
+			return nil, err
+		}
+	}
+
+	tags, err := normalizeTags(blog.GetTags())
+	if err != nil {
+		return nil, err
+	}
+
+	wasVisible := isVisible(data.ModerationStatus)
+	sourceChanged := data.Title != blog.GetTitle() || data.Content != blog.GetContent() || data.Language != language
 
 	//Update stored values
+	data.ModerationStatus = moderationStatus
+	data.ModerationReasons = moderationReasons
 	data.AuthorID = blog.GetAuthorId()
 	data.Content = blog.GetContent()
 	data.Title = blog.GetTitle()
+	data.Language = language
+	data.Tags = tags
+	data.UpdatedAt = nextUpdatedAt(previousUpdatedAt)
+	data.SchemaVersion = currentSchemaVersion
+
+	updated := []blogpb.WebhookEvent{blogpb.WebhookEvent_WEBHOOK_EVENT_UPDATED}
+	if isVisible(data.ModerationStatus) && !wasVisible {
+		updated = append(updated, blogpb.WebhookEvent_WEBHOOK_EVENT_PUBLISHED)
+	}
+	events := &stagedEvents{}
+	if err := events.stage(context.Background(), data, updated...); err != nil {
+		events.abort(context.Background())
+		return nil, stagedEventsError(err)
+	}
 
-	_, updatedErr := collection.ReplaceOne(context.Background(), bson.M{"_id": oid}, data)
+	filter := bson.M{"_id": oid, "tenant_id": tenantID, "updated_at": previousUpdatedAt}
+	updateResult, updatedErr := collection.ReplaceOne(context.Background(), filter, data)
 	if updatedErr != nil {
+		events.abort(context.Background())
 		return nil, status.Errorf(
 			codes.Internal,
 			fmt.Sprintf("Cannot update object in MongoDB: %v", updatedErr),
 		)
 	}
+	if updateResult.MatchedCount == 0 {
+		// Deleted or changed by another writer since it was read.
+		events.abort(context.Background())
+		count, err := collection.CountDocuments(context.Background(), bson.M{"_id": oid, "tenant_id": tenantID})
+		if err == nil && count == 0 {
+			return nil, status.Errorf(
+				codes.NotFound,
+				fmt.Sprintf("Cannot find blog with specified ID: %v", oid.Hex()),
+			)
+		}
+		return nil, errBlogChanged(oid)
+	}
 
-	return &blogpb.UpdateBlogResponse{
-		Blog: mapDataToBlog(data),
-	}, nil
+	changes.record("blog", tenantID, oid)
+	if sourceChanged {
+		if err := markTranslationsStale(context.Background(), tenantID, oid); err != nil {
+			fmt.Printf("Cannot mark translations of blog %v stale: %v\n", oid.Hex(), err)
+		}
+	}
+
+	events.commit(context.Background())
+	if isVisible(data.ModerationStatus) {
+		related.put(oid.Hex(), data.TenantID, data.Title, data.Content)
+	} else {
+		related.remove(oid.Hex())
+	}
+
+	return data, nil
+}
+
+// errBlogChanged reports a blog written by someone else while it was being updated.
+func errBlogChanged(oid primitive.ObjectID) error {
+	return status.Errorf(
+		codes.Aborted,
+		fmt.Sprintf("Blog %v was changed concurrently, read it again and retry", oid.Hex()),
+	)
 }
 
 func (*server) DeleteBlog(ctx context.Context, req *blogpb.DeleteBlogRequest) (*blogpb.DeleteBlogResponse, error) {
 	fmt.Printf("DeleteBlog called ...\n\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	oid, err := primitive.ObjectIDFromHex(req.GetBlogId())
 	if err != nil {
@@ -161,8 +455,15 @@ func (*server) DeleteBlog(ctx context.Context, req *blogpb.DeleteBlogRequest) (*
 		)
 	}
 
-	deleteResult, deleteErr := collection.DeleteOne(context.Background(), bson.M{"_id": oid})
+	events := &stagedEvents{}
+	if err := events.stage(context.Background(), &blogItem{ID: oid, TenantID: tenant.ID}, blogpb.WebhookEvent_WEBHOOK_EVENT_DELETED); err != nil {
+		events.abort(context.Background())
+		return nil, stagedEventsError(err)
+	}
+
+	deleteResult, deleteErr := collection.DeleteOne(context.Background(), bson.M{"_id": oid, "tenant_id": tenant.ID})
 	if deleteErr != nil {
+		events.abort(context.Background())
 		return nil, status.Errorf(
 			codes.Internal,
 			fmt.Sprintf("Cannot delete object in MongoDB: %v", deleteErr),
@@ -170,49 +471,169 @@ func (*server) DeleteBlog(ctx context.Context, req *blogpb.DeleteBlogRequest) (*
 	}
 
 	if deleteResult.DeletedCount == 0 {
+		events.abort(context.Background())
 		return nil, status.Errorf(
 			codes.NotFound,
 			fmt.Sprintf("ObjectId to be deleted is not found: %v", oid.Hex()),
 		)
 	}
 
+	// Keep series consistent, a deleted blog must not be navigated to.
+	if err := removeFromSeries(context.Background(), tenant.ID, oid); err != nil {
+		fmt.Printf("Cannot remove blog %v from its series: %v\n", oid.Hex(), err)
+	}
+	if _, err := translations.DeleteMany(context.Background(), bson.M{"tenant_id": tenant.ID, "blog_id": oid}); err != nil {
+		fmt.Printf("Cannot delete translations of blog %v: %v\n", oid.Hex(), err)
+	}
+
+	related.remove(oid.Hex())
+	releaseBlogs(context.Background(), tenant.ID, 1)
+	changes.record("blog", tenant.ID, oid)
+	events.commit(context.Background())
+
 	return &blogpb.DeleteBlogResponse{
 		BlogId: oid.Hex(),
 	}, nil
 }
 
+// Trailers set on every ListBlog response.
+const (
+	listItemsSentTrailer = "x-items-sent"
+	listTruncatedTrailer = "x-items-truncated"
+	// listNextTrailer holds the after_id resuming a truncated listing.
+	listNextTrailer = "x-next-after-id"
+)
+
+var (
+	// listTimeout bounds how long a single ListBlog stream may run.
+	listTimeout time.Duration
+	// listMaxItems caps the number of blogs sent by a single ListBlog stream.
+	listMaxItems int
+)
+
 func (*server) ListBlog(req *blogpb.ListBlogRequest, stream blogpb.BlogService_ListBlogServer) error {
 	fmt.Printf("ListBlog called...\n")
 
-	cur, err := collection.Find(context.Background(), bson.D{})
+	// The stream context is cancelled when the client goes away, so the cursor stops with it.
+	ctx, cancel := context.WithTimeout(stream.Context(), listTimeout)
+	defer cancel()
+
+	sent, truncated := 0, false
+	var last primitive.ObjectID
+	defer func() {
+		trailer := metadata.Pairs(listItemsSentTrailer, strconv.Itoa(sent))
+		if truncated {
+			trailer.Set(listTruncatedTrailer, "true")
+			trailer.Set(listNextTrailer, last.Hex())
+		}
+		stream.SetTrailer(trailer)
+	}()
+
+	tenant, err := requireTenant(ctx)
 	if err != nil {
-		return status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("Unknown internal error: %v", err),
-		)
+		return err
+	}
+
+	filter := bson.M{"tenant_id": tenant.ID, "moderation_status": visibleFilter}
+	if req.GetAfterId() != "" {
+		after, err := primitive.ObjectIDFromHex(req.GetAfterId())
+		if err != nil {
+			return status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Cannot parse after_id: %v", req.GetAfterId()),
+			)
+		}
+		filter["_id"] = bson.M{"$gt": after}
+	}
+
+	// Blogs come in _id order so that a truncated listing resumes after the last blog sent.
+	// One more than the cap tells whether the result was truncated.
+	opts := options.Find().
+		SetProjection(blogProjection(req.GetView())).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(listMaxItems) + 1)
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return listError(ctx, sent, err)
 	}
 	defer cur.Close(context.Background())
 
-	for cur.Next(context.Background()) {
-		data := &blogItem{}
+	for cur.Next(ctx) {
+		if sent == listMaxItems {
+			truncated = true
+			break
+		}
 
+		data := &blogItem{}
 		if err := cur.Decode(data); err != nil {
 			return status.Errorf(
 				codes.Internal,
 				fmt.Sprintf("Error while decoding data from MongoDB: %v", err),
 			)
 		}
-		stream.Send(&blogpb.ListBlogResponse{Blog: mapDataToBlog(data)})
+		// Send blocks while the client's flow control window is full, a slow reader slows
+		// the cursor down instead of piling up messages.
+		if err := stream.Send(&blogpb.ListBlogResponse{Blog: mapDataToBlog(data)}); err != nil {
+			return err
+		}
+		sent++
+		last = data.ID
 	}
 
 	if err := cur.Err(); err != nil {
+		return listError(ctx, sent, err)
+	}
+
+	return nil
+}
+
+// listError maps a cursor error of ListBlog to a status, telling a cancelled or timed out
+// stream apart from a database failure.
+func listError(ctx context.Context, sent int, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
 		return status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("Unknown internal error: %v", err),
+			codes.DeadlineExceeded,
+			fmt.Sprintf("ListBlog stopped after %d blogs, the stream ran longer than %v", sent, listTimeout),
 		)
+	case context.Canceled:
+		return status.Errorf(
+			codes.Canceled,
+			fmt.Sprintf("ListBlog cancelled after %d blogs", sent),
+		)
+	}
+	return status.Errorf(
+		codes.Internal,
+		fmt.Sprintf("Unknown internal error: %v", err),
+	)
+}
+
+// runSnapshotCommand implements the --backup and --restore command line options.
+func runSnapshotCommand(backupFile, restoreFile, restoreMode string) {
+	if backupFile != "" {
+		counts, err := writeSnapshot(context.Background(), backupFile)
+		if err != nil {
+			log.Fatalf("Failed to write snapshot: %v", err)
+		}
+		fmt.Printf("Snapshot written to %v: %v\n", backupFile, counts)
+		return
 	}
 
-	return nil
+	modes := map[string]blogpb.RestoreMode{
+		"empty-only": blogpb.RestoreMode_RESTORE_MODE_EMPTY_ONLY,
+		"merge":      blogpb.RestoreMode_RESTORE_MODE_MERGE,
+		"replace":    blogpb.RestoreMode_RESTORE_MODE_REPLACE,
+	}
+	mode, ok := modes[restoreMode]
+	if !ok {
+		log.Fatalf("Unknown restore mode: %v", restoreMode)
+	}
+
+	counts, err := restoreSnapshot(context.Background(), restoreFile, mode)
+	if err != nil {
+		log.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	fmt.Printf("Snapshot %v restored: %v\n", restoreFile, counts)
 }
 
 func main() {
@@ -220,27 +641,142 @@ func main() {
 	// If server crashes, we get the file name and line number in terminal
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	fs := flag.NewFlagSet("blog", flag.ContinueOnError)
+	migrateOnly := fs.Bool("migrate-only", false, "apply pending schema migrations and exit")
+	fs.StringVar(&adminToken, "admin-token", os.Getenv("BLOG_ADMIN_TOKEN"), "token required by BlogAdminService calls")
+	moderationConfig := fs.String("moderation-config", "", "YAML file with the moderation rules, built-in rules are used when empty")
+	dryRun := fs.Bool("dry-run", false, "report pending schema migrations without applying them, then exit")
+	fs.StringVar(&snapshotDir, "snapshot-dir", "snapshots", "directory for snapshots created through BlogAdminService")
+	backupFile := fs.String("backup", "", "write a snapshot of the store to this file and exit")
+	restoreFile := fs.String("restore", "", "restore the snapshot in this file and exit")
+	restoreMode := fs.String("restore-mode", "empty-only", "how --restore treats existing data: empty-only, merge or replace")
+	fs.DurationVar(&listTimeout, "list-timeout", 30*time.Second, "longest time a ListBlog stream may run")
+	fs.IntVar(&listMaxItems, "list-max-items", 1000, "most blogs sent by a ListBlog stream")
+	statsEngineName := fs.String("stats-engine", "mongo", "how GetBlogStats computes reports: mongo (aggregation pipelines) or memory")
+	mirrorOf := fs.String("mirror-of", "", "address of a primary blog server to follow as a read-only mirror")
+	mirrorToken := fs.String("mirror-token", os.Getenv("BLOG_MIRROR_TOKEN"), "admin token of the primary followed with --mirror-of")
+	mirrorTLS := fs.Bool("mirror-tls", false, "connect to the primary with TLS")
+
+	cfg, err := config.LoadFlags(fs, "blog", config.Config{
+		ListenAddr: "0.0.0.0:50053",
+		Storage: config.Storage{
+			URI:        "mongodb://localhost:27017",
+			Database:   "mydb",
+			Collection: "blog",
+		},
+		Timeouts: config.Timeouts{
+			Connect:  10 * time.Second,
+			Shutdown: 10 * time.Second,
+		},
+	}, os.Args[1:])
+	if err == config.ErrPrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Cannot print configuration: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if listTimeout <= 0 || listMaxItems <= 0 {
+		log.Fatalf("Invalid configuration: --list-timeout and --list-max-items must be positive")
+	}
+	engine, ok := statsEngines[*statsEngineName]
+	if !ok {
+		log.Fatalf("Invalid configuration: unknown stats engine %q", *statsEngineName)
+	}
+	blogStats = engine
+
+	blogModerator, err = loadModerator(*moderationConfig)
+	if err != nil {
+		log.Fatalf("Invalid moderation config: %v", err)
+	}
+
 	// Connect to mongoDB
 	fmt.Println("Connecting to mongoDB")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Connect)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.Storage.URI))
 	if err != nil {
 		log.Fatal("Failed to conntect mongodb: ", err)
 	}
 
-	collection = client.Database("mydb").Collection("blog")
+	collection = client.Database(cfg.Storage.Database).Collection(cfg.Storage.Collection)
+	tenants = tenantsCollection(collection)
+	webhooks = webhooksCollection(collection)
+	outbox = outboxCollection(collection)
+	series = seriesCollection(collection)
+	translations = translationsCollection(collection)
+
+	// Bring the stored documents up to the current schema before serving them.
+	if err := runMigrations(context.Background(), collection, *dryRun); err != nil {
+		log.Fatalf("Failed to migrate blog schema: %v", err)
+	}
+	if *migrateOnly || *dryRun {
+		client.Disconnect(context.Background())
+		return
+	}
+
+	if *backupFile != "" || *restoreFile != "" {
+		runSnapshotCommand(*backupFile, *restoreFile, *restoreMode)
+		client.Disconnect(context.Background())
+		return
+	}
+
+	// Blog counters drift when the server stops between counting a blog and storing it.
+	if err := recountTenantBlogs(context.Background()); err != nil {
+		log.Fatalf("Failed to count blogs of tenants: %v", err)
+	}
 
-	lis, err := net.Listen("tcp", "0.0.0.0:50051")
+	fmt.Println("Building related blogs index...")
+	if err := related.rebuild(context.Background()); err != nil {
+		log.Fatalf("Failed to build related blogs index: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 
 	}
 	//Create a GRPC server
-	opt := []grpc.ServerOption{}
+	opt, err := cfg.ServerOptions()
+	if err != nil {
+		log.Fatalf("Failed to build server options: %v", err)
+	}
+	if *mirrorOf != "" {
+		mirror = &mirrorState{primary: *mirrorOf, behindSince: time.Now()}
+		mirrorPositions = mirrorPositionsCollection(collection)
+		if mirror.epoch, mirror.applied, err = loadMirrorPosition(context.Background()); err != nil {
+			log.Fatalf("Failed to load mirror position: %v", err)
+		}
+		opt = append(opt, grpc.UnaryInterceptor(mirrorUnaryInterceptor), grpc.StreamInterceptor(mirrorStreamInterceptor))
+	}
 	s := grpc.NewServer(opt...)
 	blogpb.RegisterBlogServiceServer(s, &server{})
+	blogpb.RegisterBlogAdminServiceServer(s, &adminServer{})
+	if adminToken == "" {
+		fmt.Println("Warning: no admin token configured, BlogAdminService calls are refused")
+	}
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	if mirror != nil {
+		// A mirror only copies the primary, webhooks are delivered by the primary.
+		creds := grpc.WithInsecure()
+		if *mirrorTLS {
+			creds = grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))
+		}
+		cc, err := grpc.Dial(*mirrorOf, creds)
+		if err != nil {
+			log.Fatalf("Failed to connect to primary: %v", err)
+		}
+		defer cc.Close()
+		fmt.Printf("Mirroring primary %v, writes are rejected\n", *mirrorOf)
+		go runMirror(workersCtx, cc, *mirrorToken)
+	} else {
+		go runWebhookDispatcher(workersCtx)
+	}
 
 	go func() {
 		fmt.Println("Starting server... ")
@@ -255,9 +791,12 @@ func main() {
 
 	// Block main thread untill signal is relayed to ch by signal.Notify
 	<-ch
+	stopWorkers()
 
 	fmt.Println("\nClosing mongodb connection...")
-	if err = client.Disconnect(ctx); err != nil {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer shutdownCancel()
+	if err = client.Disconnect(shutdownCtx); err != nil {
 		panic(err)
 	}
 
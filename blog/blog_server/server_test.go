@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-grpc-course/blog/blogpb"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestNextUpdatedAt(t *testing.T) {
+	now := time.Now().UTC()
+	future := now.Add(time.Hour).Truncate(time.Millisecond)
+
+	tests := []struct {
+		name     string
+		previous time.Time
+		min      time.Time
+		max      time.Time
+	}{
+		{"never updated", time.Time{}, now.Truncate(time.Millisecond), now.Add(time.Minute)},
+		{"updated before", now.Add(-time.Hour), now.Truncate(time.Millisecond), now.Add(time.Minute)},
+		{"clock behind the store", future, future.Add(time.Millisecond), future.Add(time.Millisecond)},
+		{"sub-millisecond previous", future.Add(500 * time.Microsecond), future.Add(time.Millisecond), future.Add(time.Millisecond)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nextUpdatedAt(tt.previous)
+			if got.Before(tt.min) || got.After(tt.max) {
+				t.Errorf("nextUpdatedAt(%v) = %v, want between %v and %v", tt.previous, got, tt.min, tt.max)
+			}
+			if !got.Equal(got.Truncate(time.Millisecond)) || got.Location() != time.UTC {
+				t.Errorf("nextUpdatedAt(%v) = %v, want a UTC time in whole milliseconds", tt.previous, got)
+			}
+		})
+	}
+}
+
+// listStream collects the blogs and the trailer of a ListBlog stream.
+type listStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	ids     []string
+	trailer metadata.MD
+}
+
+func (s *listStream) Context() context.Context { return s.ctx }
+
+func (s *listStream) Send(res *blogpb.ListBlogResponse) error {
+	s.ids = append(s.ids, res.GetBlog().GetId())
+	return nil
+}
+
+func (s *listStream) SetTrailer(md metadata.MD) { s.trailer = md }
+
+func TestListBlogResumes(t *testing.T) {
+	ctx := testStore(t)
+	defer func(timeout time.Duration, maxItems int) { listTimeout, listMaxItems = timeout, maxItems }(listTimeout, listMaxItems)
+	listTimeout, listMaxItems = time.Minute, 2
+	if _, err := tenants.InsertOne(ctx, tenantItem{ID: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(tenantMetadataKey, "acme"))
+
+	var want []string
+	for _, moderationStatus := range []string{"", moderationPending, "", "", ""} {
+		blog := blogItem{ID: primitive.NewObjectID(), TenantID: "acme", ModerationStatus: moderationStatus}
+		if _, err := collection.InsertOne(ctx, blog); err != nil {
+			t.Fatal(err)
+		}
+		if isVisible(moderationStatus) {
+			want = append(want, blog.ID.Hex())
+		}
+	}
+
+	var got []string
+	afterID := ""
+	for pages := 1; ; pages++ {
+		stream := &listStream{ctx: ctx}
+		if err := (&server{}).ListBlog(&blogpb.ListBlogRequest{AfterId: afterID}, stream); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, stream.ids...)
+		next := stream.trailer.Get(listNextTrailer)
+		if len(next) == 0 {
+			if pages != 2 {
+				t.Errorf("listing took %d pages, want 2", pages)
+			}
+			break
+		}
+		if pages == 2 {
+			t.Fatalf("page %d still truncated", pages)
+		}
+		afterID = next[0]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+
+	err := (&server{}).ListBlog(&blogpb.ListBlogRequest{AfterId: "nope"}, &listStream{ctx: ctx})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListBlog with a bad after_id = %v, want InvalidArgument", err)
+	}
+}
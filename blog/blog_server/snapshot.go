@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Snapshots are gzip-compressed JSON lines: a snapshotHeader followed by one snapshotRecord per
+// stored object. The records use their own JSON shapes so the format does not depend on MongoDB.
+const (
+	snapshotFormat  = "blog-snapshot"
+	snapshotVersion = 1
+)
+
+// storeLock is held for reading by every mutation and for writing while a snapshot is taken or
+// restored, so snapshots are consistent without requiring MongoDB transactions.
+var storeLock sync.RWMutex
+
+// snapshotDir is the directory admin RPCs read and write snapshots in.
+var snapshotDir string
+
+type snapshotHeader struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type snapshotRecord struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+type snapshotTenant struct {
+	ID        string    `json:"id"`
+	MaxBlogs  int64     `json:"max_blogs"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type snapshotWebhook struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	URL       string    `json:"url"`
+	Events    []int32   `json:"events"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type snapshotSeries struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	Title     string    `json:"title"`
+	AuthorID  string    `json:"author_id"`
+	BlogIDs   []string  `json:"blog_ids"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type snapshotTranslation struct {
+	ID        string    `json:"id"`
+	BlogID    string    `json:"blog_id"`
+	TenantID  string    `json:"tenant_id"`
+	Language  string    `json:"language"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Stale     bool      `json:"stale,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ModerationStatus  string   `json:"moderation_status,omitempty"`
+	ModerationReasons []string `json:"moderation_reasons,omitempty"`
+}
+
+type snapshotBlog struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	AuthorID  string    `json:"author_id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Language  string    `json:"language,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ModerationStatus  string   `json:"moderation_status,omitempty"`
+	ModerationReasons []string `json:"moderation_reasons,omitempty"`
+}
+
+// snapshotSection dumps and restores one kind of record.
+type snapshotSection struct {
+	Kind       string
+	Collection *mongo.Collection
+	// Dump calls emit once per stored record matching filter.
+	Dump func(ctx context.Context, filter interface{}, emit func(v interface{}) error) error
+	// Decode checks a record and converts it to the document stored in Collection.
+	Decode func(data json.RawMessage) (snapshotDoc, error)
+	Count  func(ctx context.Context) (int64, error)
+	Clear  func(ctx context.Context) error
+}
+
+// snapshotDoc is a decoded record ready to be stored.
+type snapshotDoc struct {
+	ID   interface{}
+	Item interface{}
+}
+
+// store upserts a decoded record.
+func (s snapshotSection) store(ctx context.Context, doc snapshotDoc) error {
+	_, err := s.Collection.ReplaceOne(ctx, bson.M{"_id": doc.ID}, doc.Item, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Restore decodes and upserts a single record.
+func (s snapshotSection) Restore(ctx context.Context, data json.RawMessage) error {
+	doc, err := s.Decode(data)
+	if err != nil {
+		return err
+	}
+	return s.store(ctx, doc)
+}
+
+// snapshotSections lists every kind of record in a snapshot, in restore order.
+func snapshotSections() []snapshotSection {
+	return []snapshotSection{
+		{
+			Kind:       "tenant",
+			Collection: tenants,
+			Dump: func(ctx context.Context, filter interface{}, emit func(v interface{}) error) error {
+				return forEach(ctx, tenants, filter, func(cur *mongo.Cursor) error {
+					t := &tenantItem{}
+					if err := cur.Decode(t); err != nil {
+						return err
+					}
+					return emit(snapshotTenant{ID: t.ID, MaxBlogs: t.MaxBlogs, CreatedAt: t.CreatedAt})
+				})
+			},
+			Decode: func(data json.RawMessage) (snapshotDoc, error) {
+				t := snapshotTenant{}
+				if err := json.Unmarshal(data, &t); err != nil {
+					return snapshotDoc{}, err
+				}
+				item := tenantItem{ID: t.ID, MaxBlogs: t.MaxBlogs, CreatedAt: t.CreatedAt}
+				return snapshotDoc{ID: t.ID, Item: item}, nil
+			},
+			Count: func(ctx context.Context) (int64, error) {
+				// The default tenant is created by migrations and does not make a store non-empty.
+				return tenants.CountDocuments(ctx, bson.M{"_id": bson.M{"$ne": defaultTenant}})
+			},
+			Clear: func(ctx context.Context) error {
+				_, err := tenants.DeleteMany(ctx, bson.M{})
+				return err
+			},
+		},
+		{
+			Kind:       "blog",
+			Collection: collection,
+			Dump: func(ctx context.Context, filter interface{}, emit func(v interface{}) error) error {
+				return forEach(ctx, collection, filter, func(cur *mongo.Cursor) error {
+					b := &blogItem{}
+					if err := cur.Decode(b); err != nil {
+						return err
+					}
+					return emit(snapshotBlog{
+						ID:        b.ID.Hex(),
+						TenantID:  b.TenantID,
+						AuthorID:  b.AuthorID,
+						Title:     b.Title,
+						Content:   b.Content,
+						Language:  b.Language,
+						Tags:      b.Tags,
+						CreatedAt: b.CreatedAt,
+						UpdatedAt: b.UpdatedAt,
+
+						ModerationStatus:  b.ModerationStatus,
+						ModerationReasons: b.ModerationReasons,
+					})
+				})
+			},
+			Decode: func(data json.RawMessage) (snapshotDoc, error) {
+				b := snapshotBlog{}
+				if err := json.Unmarshal(data, &b); err != nil {
+					return snapshotDoc{}, err
+				}
+				oid, err := primitive.ObjectIDFromHex(b.ID)
+				if err != nil {
+					return snapshotDoc{}, fmt.Errorf("invalid blog id %q", b.ID)
+				}
+				item := blogItem{
+					ID:            oid,
+					TenantID:      b.TenantID,
+					AuthorID:      b.AuthorID,
+					Title:         b.Title,
+					Content:       b.Content,
+					Language:      b.Language,
+					Tags:          b.Tags,
+					CreatedAt:     b.CreatedAt,
+					UpdatedAt:     b.UpdatedAt,
+					SchemaVersion: currentSchemaVersion,
+
+					ModerationStatus:  b.ModerationStatus,
+					ModerationReasons: b.ModerationReasons,
+				}
+				return snapshotDoc{ID: oid, Item: item}, nil
+			},
+			Count: func(ctx context.Context) (int64, error) {
+				return collection.CountDocuments(ctx, bson.M{})
+			},
+			Clear: func(ctx context.Context) error {
+				_, err := collection.DeleteMany(ctx, bson.M{})
+				return err
+			},
+		},
+		{
+			Kind:       "translation",
+			Collection: translations,
+			Dump: func(ctx context.Context, filter interface{}, emit func(v interface{}) error) error {
+				return forEach(ctx, translations, filter, func(cur *mongo.Cursor) error {
+					t := &translationItem{}
+					if err := cur.Decode(t); err != nil {
+						return err
+					}
+					return emit(snapshotTranslation{
+						ID:        t.ID.Hex(),
+						BlogID:    t.BlogID.Hex(),
+						TenantID:  t.TenantID,
+						Language:  t.Language,
+						Title:     t.Title,
+						Content:   t.Content,
+						Stale:     t.Stale,
+						CreatedAt: t.CreatedAt,
+						UpdatedAt: t.UpdatedAt,
+
+						ModerationStatus:  t.ModerationStatus,
+						ModerationReasons: t.ModerationReasons,
+					})
+				})
+			},
+			Decode: func(data json.RawMessage) (snapshotDoc, error) {
+				t := snapshotTranslation{}
+				if err := json.Unmarshal(data, &t); err != nil {
+					return snapshotDoc{}, err
+				}
+				oid, err := primitive.ObjectIDFromHex(t.ID)
+				if err != nil {
+					return snapshotDoc{}, fmt.Errorf("invalid translation id %q", t.ID)
+				}
+				blogID, err := primitive.ObjectIDFromHex(t.BlogID)
+				if err != nil {
+					return snapshotDoc{}, fmt.Errorf("invalid blog id %q in translation %v", t.BlogID, t.ID)
+				}
+				item := translationItem{
+					ID:        oid,
+					BlogID:    blogID,
+					TenantID:  t.TenantID,
+					Language:  t.Language,
+					Title:     t.Title,
+					Content:   t.Content,
+					Stale:     t.Stale,
+					CreatedAt: t.CreatedAt,
+					UpdatedAt: t.UpdatedAt,
+
+					ModerationStatus:  t.ModerationStatus,
+					ModerationReasons: t.ModerationReasons,
+				}
+				return snapshotDoc{ID: oid, Item: item}, nil
+			},
+			Count: func(ctx context.Context) (int64, error) {
+				return translations.CountDocuments(ctx, bson.M{})
+			},
+			Clear: func(ctx context.Context) error {
+				_, err := translations.DeleteMany(ctx, bson.M{})
+				return err
+			},
+		},
+		{
+			Kind:       "series",
+			Collection: series,
+			Dump: func(ctx context.Context, filter interface{}, emit func(v interface{}) error) error {
+				return forEach(ctx, series, filter, func(cur *mongo.Cursor) error {
+					item := &seriesItem{}
+					if err := cur.Decode(item); err != nil {
+						return err
+					}
+					rec := snapshotSeries{
+						ID:        item.ID.Hex(),
+						TenantID:  item.TenantID,
+						Title:     item.Title,
+						AuthorID:  item.AuthorID,
+						CreatedAt: item.CreatedAt,
+						UpdatedAt: item.UpdatedAt,
+					}
+					for _, id := range item.BlogIDs {
+						rec.BlogIDs = append(rec.BlogIDs, id.Hex())
+					}
+					return emit(rec)
+				})
+			},
+			Decode: func(data json.RawMessage) (snapshotDoc, error) {
+				rec := snapshotSeries{}
+				if err := json.Unmarshal(data, &rec); err != nil {
+					return snapshotDoc{}, err
+				}
+				oid, err := primitive.ObjectIDFromHex(rec.ID)
+				if err != nil {
+					return snapshotDoc{}, fmt.Errorf("invalid series id %q", rec.ID)
+				}
+				item := seriesItem{
+					ID:        oid,
+					TenantID:  rec.TenantID,
+					Title:     rec.Title,
+					AuthorID:  rec.AuthorID,
+					BlogIDs:   []primitive.ObjectID{},
+					CreatedAt: rec.CreatedAt,
+					UpdatedAt: rec.UpdatedAt,
+				}
+				for _, id := range rec.BlogIDs {
+					blogID, err := primitive.ObjectIDFromHex(id)
+					if err != nil {
+						return snapshotDoc{}, fmt.Errorf("invalid blog id %q in series %v", id, rec.ID)
+					}
+					item.BlogIDs = append(item.BlogIDs, blogID)
+				}
+				return snapshotDoc{ID: oid, Item: item}, nil
+			},
+			Count: func(ctx context.Context) (int64, error) {
+				return series.CountDocuments(ctx, bson.M{})
+			},
+			Clear: func(ctx context.Context) error {
+				_, err := series.DeleteMany(ctx, bson.M{})
+				return err
+			},
+		},
+		{
+			Kind:       "webhook",
+			Collection: webhooks,
+			Dump: func(ctx context.Context, filter interface{}, emit func(v interface{}) error) error {
+				return forEach(ctx, webhooks, filter, func(cur *mongo.Cursor) error {
+					w := &webhookItem{}
+					if err := cur.Decode(w); err != nil {
+						return err
+					}
+					return emit(snapshotWebhook{
+						ID:        w.ID.Hex(),
+						TenantID:  w.TenantID,
+						URL:       w.URL,
+						Events:    w.Events,
+						Secret:    w.Secret,
+						CreatedAt: w.CreatedAt,
+					})
+				})
+			},
+			Decode: func(data json.RawMessage) (snapshotDoc, error) {
+				w := snapshotWebhook{}
+				if err := json.Unmarshal(data, &w); err != nil {
+					return snapshotDoc{}, err
+				}
+				oid, err := primitive.ObjectIDFromHex(w.ID)
+				if err != nil {
+					return snapshotDoc{}, fmt.Errorf("invalid webhook id %q", w.ID)
+				}
+				if w.Events == nil {
+					w.Events = []int32{}
+				}
+				item := webhookItem{
+					ID:        oid,
+					TenantID:  w.TenantID,
+					URL:       w.URL,
+					Events:    w.Events,
+					Secret:    w.Secret,
+					CreatedAt: w.CreatedAt,
+				}
+				return snapshotDoc{ID: oid, Item: item}, nil
+			},
+			Count: func(ctx context.Context) (int64, error) {
+				return webhooks.CountDocuments(ctx, bson.M{})
+			},
+			Clear: func(ctx context.Context) error {
+				_, err := webhooks.DeleteMany(ctx, bson.M{})
+				return err
+			},
+		},
+	}
+}
+
+// forEach calls fn for every document of coll matching filter.
+func forEach(ctx context.Context, coll *mongo.Collection, filter interface{}, fn func(cur *mongo.Cursor) error) error {
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		if err := fn(cur); err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+// writeSnapshot writes a snapshot of the whole store to path and returns the records written per kind.
+func writeSnapshot(ctx context.Context, path string) (map[string]int64, error) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	// Write to a temporary file first so a failed snapshot never replaces a good one.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(zw)
+
+	header := snapshotHeader{
+		Format:        snapshotFormat,
+		Version:       snapshotVersion,
+		SchemaVersion: currentSchemaVersion,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	for _, section := range snapshotSections() {
+		kind := section.Kind
+		err := section.Dump(ctx, bson.M{}, func(v interface{}) error {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			counts[kind]++
+			return enc.Encode(snapshotRecord{Kind: kind, Data: data})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot dump %v records: %v", kind, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// errStoreNotEmpty is returned when restoring with RESTORE_MODE_EMPTY_ONLY into a store with data.
+var errStoreNotEmpty = fmt.Errorf("store is not empty")
+
+// readSnapshot decodes every record of the snapshot at path, calls fn with each one and returns
+// the records read per kind.
+func readSnapshot(path string, sections map[string]snapshotSection, fn func(section snapshotSection, doc snapshotDoc) error) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("not a snapshot file: %v", err)
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(zr)
+
+	header := snapshotHeader{}
+	if err := dec.Decode(&header); err != nil || header.Format != snapshotFormat {
+		return nil, fmt.Errorf("not a snapshot file")
+	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	if header.SchemaVersion > currentSchemaVersion {
+		return nil, fmt.Errorf("snapshot schema version %d is newer than this server (%d)", header.SchemaVersion, currentSchemaVersion)
+	}
+
+	counts := map[string]int64{}
+	for {
+		rec := snapshotRecord{}
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return counts, fmt.Errorf("corrupt snapshot: %v", err)
+		}
+
+		section, ok := sections[rec.Kind]
+		if !ok {
+			return counts, fmt.Errorf("unknown record kind %q in snapshot", rec.Kind)
+		}
+		doc, err := section.Decode(rec.Data)
+		if err != nil {
+			return counts, fmt.Errorf("invalid %v record: %v", rec.Kind, err)
+		}
+		if err := fn(section, doc); err != nil {
+			return counts, fmt.Errorf("cannot restore %v record: %v", rec.Kind, err)
+		}
+		counts[rec.Kind]++
+	}
+
+	return counts, nil
+}
+
+// restoreSnapshot loads the snapshot at path into the store and returns the records restored per kind.
+// The whole snapshot is read and checked before the store is touched, so a corrupt or invalid
+// snapshot leaves the data as it was, even with RESTORE_MODE_REPLACE.
+func restoreSnapshot(ctx context.Context, path string, mode blogpb.RestoreMode) (map[string]int64, error) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	sections := map[string]snapshotSection{}
+	for _, section := range snapshotSections() {
+		sections[section.Kind] = section
+	}
+
+	check := func(section snapshotSection, doc snapshotDoc) error { return nil }
+	if _, err := readSnapshot(path, sections, check); err != nil {
+		return nil, err
+	}
+
+	for _, section := range snapshotSections() {
+		switch mode {
+		case blogpb.RestoreMode_RESTORE_MODE_REPLACE:
+			if err := section.Clear(ctx); err != nil {
+				return nil, fmt.Errorf("cannot clear %v records: %v", section.Kind, err)
+			}
+		case blogpb.RestoreMode_RESTORE_MODE_MERGE:
+		default:
+			count, err := section.Count(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				return nil, errStoreNotEmpty
+			}
+		}
+	}
+
+	// Whatever got restored, the related blogs index and the tenant blog counters must reflect
+	// the store again and mirrors have to sync from scratch.
+	defer func() {
+		if err := related.rebuild(ctx); err != nil {
+			fmt.Printf("Cannot rebuild related blogs index: %v\n", err)
+		}
+		if err := recountTenantBlogs(ctx); err != nil {
+			fmt.Printf("Cannot count blogs of tenants: %v\n", err)
+		}
+		changes.reset()
+	}()
+
+	return readSnapshot(path, sections, func(section snapshotSection, doc snapshotDoc) error {
+		return section.store(ctx, doc)
+	})
+}
+
+// snapshotPath resolves a snapshot file name inside snapshotDir.
+func snapshotPath(fileName string) (string, error) {
+	if fileName == "" || fileName != filepath.Base(fileName) || strings.HasPrefix(fileName, ".") {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid snapshot file name: %q", fileName),
+		)
+	}
+
+	return filepath.Join(snapshotDir, fileName), nil
+}
+
+func (*adminServer) CreateSnapshot(ctx context.Context, req *blogpb.CreateSnapshotRequest) (*blogpb.CreateSnapshotResponse, error) {
+	fmt.Printf("CreateSnapshot called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	fileName := req.GetFileName()
+	if fileName == "" {
+		fileName = fmt.Sprintf("blog-%v.jsonl.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	path, err := snapshotPath(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot create snapshot directory: %v", err),
+		)
+	}
+
+	counts, err := writeSnapshot(ctx, path)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot write snapshot: %v", err),
+		)
+	}
+
+	return &blogpb.CreateSnapshotResponse{
+		FileName:     fileName,
+		RecordCounts: counts,
+	}, nil
+}
+
+func (*adminServer) RestoreSnapshot(ctx context.Context, req *blogpb.RestoreSnapshotRequest) (*blogpb.RestoreSnapshotResponse, error) {
+	fmt.Printf("RestoreSnapshot called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	path, err := snapshotPath(req.GetFileName())
+	if err != nil {
+		return nil, err
+	}
+
+	// The restore must not stop halfway because the client went away.
+	counts, err := restoreSnapshot(context.Background(), path, req.GetMode())
+	if err == errStoreNotEmpty {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"The store is not empty, use RESTORE_MODE_MERGE or RESTORE_MODE_REPLACE",
+		)
+	}
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Snapshot not found: %v", req.GetFileName()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot restore snapshot: %v", err),
+		)
+	}
+
+	return &blogpb.RestoreSnapshotResponse{
+		RecordCounts: counts,
+	}, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go-grpc-course/blog/blogpb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// writeTestSnapshot writes a snapshot file made of the given JSON lines after a header.
+func writeTestSnapshot(t *testing.T, header snapshotHeader, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "test.jsonl.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	data, _ := json.Marshal(header)
+	zw.Write(append(data, '\n'))
+	for _, line := range lines {
+		zw.Write([]byte(line + "\n"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRestoreSnapshotChecksBeforeWriting(t *testing.T) {
+	header := snapshotHeader{Format: snapshotFormat, Version: snapshotVersion, SchemaVersion: currentSchemaVersion}
+	tenant := `{"kind":"tenant","data":{"id":"acme","max_blogs":10}}`
+
+	tests := []struct {
+		name   string
+		header snapshotHeader
+		lines  []string
+		want   string
+	}{
+		{"bad blog id", header, []string{tenant, `{"kind":"blog","data":{"id":"xyz"}}`}, "invalid blog id"},
+		{"bad series blog", header, []string{`{"kind":"series","data":{"id":"5f1d7a3e9b1e8a3f4c2b1a00","blog_ids":["x"]}}`}, "invalid blog id"},
+		{"unknown kind", header, []string{tenant, `{"kind":"comment","data":{}}`}, "unknown record kind"},
+		{"corrupt line", header, []string{tenant, `{"kind":`}, "corrupt snapshot"},
+		{"newer schema", snapshotHeader{Format: snapshotFormat, Version: snapshotVersion, SchemaVersion: currentSchemaVersion + 1}, nil, "newer than this server"},
+		{"not a snapshot", snapshotHeader{Format: "other"}, nil, "not a snapshot"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestSnapshot(t, tt.header, tt.lines...)
+			// No store is configured: touching it would panic, so the snapshot must be
+			// rejected before anything is cleared or written.
+			_, err := restoreSnapshot(context.Background(), path, blogpb.RestoreMode_RESTORE_MODE_REPLACE)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("restoreSnapshot = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := testStore(t)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	blogID := primitive.NewObjectID()
+	if _, err := tenants.InsertOne(ctx, tenantItem{ID: "acme", MaxBlogs: 5, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	blog := blogItem{
+		ID: blogID, TenantID: "acme", AuthorID: "ann", Title: "Hello", Content: "Hello world",
+		Language: "en", Tags: []string{"go"}, CreatedAt: now, UpdatedAt: now,
+		SchemaVersion: currentSchemaVersion, ModerationStatus: "flagged", ModerationReasons: []string{"link"},
+	}
+	if _, err := collection.InsertOne(ctx, blog); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := translations.InsertOne(ctx, translationItem{
+		ID: primitive.NewObjectID(), BlogID: blogID, TenantID: "acme", Language: "fr",
+		Title: "Bonjour", Content: "Bonjour le monde", Stale: true, CreatedAt: now, UpdatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := series.InsertOne(ctx, seriesItem{
+		ID: primitive.NewObjectID(), TenantID: "acme", Title: "Intro", AuthorID: "ann",
+		BlogIDs: []primitive.ObjectID{blogID}, CreatedAt: now, UpdatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhooks.InsertOne(ctx, webhookItem{
+		ID: primitive.NewObjectID(), TenantID: "acme", URL: "https://example.com/hook",
+		Events: []int32{1, 2}, Secret: "s3cret", CreatedAt: now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	before := dumpStore(t, ctx)
+
+	path := filepath.Join(t.TempDir(), "round-trip.jsonl.gz")
+	written, err := writeSnapshot(ctx, path)
+	if err != nil {
+		t.Fatalf("writeSnapshot: %v", err)
+	}
+
+	// Change the store, then replace it with the snapshot.
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": blogID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.InsertOne(ctx, blogItem{ID: primitive.NewObjectID(), TenantID: "acme", Title: "Extra"}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := restoreSnapshot(ctx, path, blogpb.RestoreMode_RESTORE_MODE_REPLACE)
+	if err != nil {
+		t.Fatalf("restoreSnapshot: %v", err)
+	}
+	if !reflect.DeepEqual(restored, written) {
+		t.Errorf("restored %v records, wrote %v", restored, written)
+	}
+	if after := dumpStore(t, ctx); !reflect.DeepEqual(after, before) {
+		t.Errorf("store after restore:\n%v\nwant:\n%v", after, before)
+	}
+
+	if _, err := restoreSnapshot(ctx, path, blogpb.RestoreMode_RESTORE_MODE_EMPTY_ONLY); err != errStoreNotEmpty {
+		t.Errorf("restore into a store with data = %v, want errStoreNotEmpty", err)
+	}
+}
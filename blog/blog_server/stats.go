@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultTopTags = 10
+	maxTopTags     = 100
+	// statsMonthFormat is the layout of months in reports, matching $dateToString "%Y-%m".
+	statsMonthFormat = "2006-01"
+)
+
+// statsEngine computes GetBlogStats reports over the blogs matching a filter.
+type statsEngine interface {
+	stats(ctx context.Context, filter bson.M, topTags int) (*blogpb.GetBlogStatsResponse, error)
+}
+
+// statsEngines are selected with --stats-engine. The memory engine only needs to iterate
+// blogs, for stores without aggregation pipelines.
+var statsEngines = map[string]statsEngine{
+	"mongo":  mongoStats{},
+	"memory": memoryStats{},
+}
+
+// blogStats is the engine used by GetBlogStats.
+var blogStats statsEngine = mongoStats{}
+
+// finishCadence fills in the time between posts once first and last are known.
+func finishCadence(res *blogpb.GetBlogStatsResponse, first, last time.Time) {
+	if res.TotalPosts == 0 {
+		return
+	}
+	res.Cadence.FirstPostAt = first.UTC().Format(time.RFC3339)
+	res.Cadence.LastPostAt = last.UTC().Format(time.RFC3339)
+	if res.TotalPosts > 1 {
+		res.Cadence.AverageDaysBetweenPosts = last.Sub(first).Hours() / 24 / float64(res.TotalPosts-1)
+	}
+}
+
+// mongoStats pushes the whole report down to a single aggregation pipeline.
+type mongoStats struct{}
+
+func (mongoStats) stats(ctx context.Context, filter bson.M, topTags int) (*blogpb.GetBlogStatsResponse, error) {
+	month := bson.M{"$dateToString": bson.M{"format": "%Y-%m", "date": "$created_at"}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: bson.M{
+			"summary": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":        nil,
+					"posts":      bson.M{"$sum": 1},
+					"avg_length": bson.M{"$avg": bson.M{"$strLenCP": "$content"}},
+					"first":      bson.M{"$min": "$created_at"},
+					"last":       bson.M{"$max": "$created_at"},
+				}},
+			},
+			"author_months": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":   bson.M{"author": "$author_id", "month": month},
+					"posts": bson.M{"$sum": 1},
+				}},
+				bson.M{"$sort": bson.D{{Key: "_id.month", Value: 1}, {Key: "_id.author", Value: 1}}},
+			},
+			"months": bson.A{
+				bson.M{"$group": bson.M{"_id": month, "posts": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+			"tags": bson.A{
+				bson.M{"$unwind": "$tags"},
+				bson.M{"$group": bson.M{"_id": "$tags", "posts": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.D{{Key: "posts", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$limit": topTags},
+			},
+		}}},
+	}
+
+	cur, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var facets []struct {
+		Summary []struct {
+			Posts     int64     `bson:"posts"`
+			AvgLength float64   `bson:"avg_length"`
+			First     time.Time `bson:"first"`
+			Last      time.Time `bson:"last"`
+		} `bson:"summary"`
+		AuthorMonths []struct {
+			ID struct {
+				Author string `bson:"author"`
+				Month  string `bson:"month"`
+			} `bson:"_id"`
+			Posts int64 `bson:"posts"`
+		} `bson:"author_months"`
+		Months []struct {
+			ID    string `bson:"_id"`
+			Posts int64  `bson:"posts"`
+		} `bson:"months"`
+		Tags []struct {
+			ID    string `bson:"_id"`
+			Posts int64  `bson:"posts"`
+		} `bson:"tags"`
+	}
+	if err := cur.All(ctx, &facets); err != nil {
+		return nil, err
+	}
+
+	res := &blogpb.GetBlogStatsResponse{Cadence: &blogpb.PublishingCadence{}}
+	if len(facets) == 0 || len(facets[0].Summary) == 0 {
+		return res, nil
+	}
+	f := facets[0]
+
+	res.TotalPosts = f.Summary[0].Posts
+	res.AverageContentLength = f.Summary[0].AvgLength
+	for _, am := range f.AuthorMonths {
+		res.PostsPerAuthorMonth = append(res.PostsPerAuthorMonth, &blogpb.AuthorMonthCount{
+			AuthorId: am.ID.Author,
+			Month:    am.ID.Month,
+			Posts:    am.Posts,
+		})
+	}
+	for _, m := range f.Months {
+		res.Cadence.PostsPerMonth = append(res.Cadence.PostsPerMonth, &blogpb.MonthCount{Month: m.ID, Posts: m.Posts})
+	}
+	for _, t := range f.Tags {
+		res.TopTags = append(res.TopTags, &blogpb.TagCount{Tag: t.ID, Posts: t.Posts})
+	}
+	finishCadence(res, f.Summary[0].First, f.Summary[0].Last)
+
+	return res, nil
+}
+
+// memoryStats reads the matching blogs and computes the report in the server. It returns the
+// same report as mongoStats.
+type memoryStats struct{}
+
+func (memoryStats) stats(ctx context.Context, filter bson.M, topTags int) (*blogpb.GetBlogStatsResponse, error) {
+	opts := options.Find().SetProjection(bson.M{"author_id": 1, "content": 1, "tags": 1, "created_at": 1})
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	acc := newStatsAccumulator()
+	for cur.Next(ctx) {
+		data := &blogItem{}
+		if err := cur.Decode(data); err != nil {
+			return nil, err
+		}
+		acc.add(data)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return acc.report(topTags), nil
+}
+
+type authorMonth struct{ author, month string }
+
+// statsAccumulator collects the blogs of a memoryStats report one at a time.
+type statsAccumulator struct {
+	authorMonths  map[authorMonth]int64
+	months        map[string]int64
+	tags          map[string]int64
+	posts, length int64
+	first, last   time.Time
+}
+
+func newStatsAccumulator() *statsAccumulator {
+	return &statsAccumulator{
+		authorMonths: map[authorMonth]int64{},
+		months:       map[string]int64{},
+		tags:         map[string]int64{},
+	}
+}
+
+func (acc *statsAccumulator) add(data *blogItem) {
+	acc.posts++
+	acc.length += int64(utf8.RuneCountInString(data.Content))
+	if acc.first.IsZero() || data.CreatedAt.Before(acc.first) {
+		acc.first = data.CreatedAt
+	}
+	if data.CreatedAt.After(acc.last) {
+		acc.last = data.CreatedAt
+	}
+	month := data.CreatedAt.UTC().Format(statsMonthFormat)
+	acc.authorMonths[authorMonth{data.AuthorID, month}]++
+	acc.months[month]++
+	for _, t := range data.Tags {
+		acc.tags[t]++
+	}
+}
+
+// report returns the report of the blogs added, sorted like the mongoStats pipeline sorts it.
+func (acc *statsAccumulator) report(topTags int) *blogpb.GetBlogStatsResponse {
+	res := &blogpb.GetBlogStatsResponse{TotalPosts: acc.posts, Cadence: &blogpb.PublishingCadence{}}
+	if acc.posts == 0 {
+		return res
+	}
+	res.AverageContentLength = float64(acc.length) / float64(acc.posts)
+
+	for am, n := range acc.authorMonths {
+		res.PostsPerAuthorMonth = append(res.PostsPerAuthorMonth, &blogpb.AuthorMonthCount{AuthorId: am.author, Month: am.month, Posts: n})
+	}
+	sort.Slice(res.PostsPerAuthorMonth, func(i, j int) bool {
+		a, b := res.PostsPerAuthorMonth[i], res.PostsPerAuthorMonth[j]
+		if a.Month != b.Month {
+			return a.Month < b.Month
+		}
+		return a.AuthorId < b.AuthorId
+	})
+
+	for m, n := range acc.months {
+		res.Cadence.PostsPerMonth = append(res.Cadence.PostsPerMonth, &blogpb.MonthCount{Month: m, Posts: n})
+	}
+	sort.Slice(res.Cadence.PostsPerMonth, func(i, j int) bool {
+		return res.Cadence.PostsPerMonth[i].Month < res.Cadence.PostsPerMonth[j].Month
+	})
+
+	for t, n := range acc.tags {
+		res.TopTags = append(res.TopTags, &blogpb.TagCount{Tag: t, Posts: n})
+	}
+	sort.Slice(res.TopTags, func(i, j int) bool {
+		a, b := res.TopTags[i], res.TopTags[j]
+		if a.Posts != b.Posts {
+			return a.Posts > b.Posts
+		}
+		return a.Tag < b.Tag
+	})
+	if len(res.TopTags) > topTags {
+		res.TopTags = res.TopTags[:topTags]
+	}
+
+	finishCadence(res, acc.first, acc.last)
+	return res
+}
+
+func (*server) GetBlogStats(ctx context.Context, req *blogpb.GetBlogStatsRequest) (*blogpb.GetBlogStatsResponse, error) {
+	fmt.Printf("GetBlogStats called by client...\n")
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"tenant_id": tenant.ID, "moderation_status": visibleFilter}
+	created, err := createdRange(req.GetCreatedAfter(), req.GetCreatedBefore())
+	if err != nil {
+		return nil, err
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+
+	topTags := int(req.GetTopTagsLimit())
+	if topTags <= 0 {
+		topTags = defaultTopTags
+	}
+	if topTags > maxTopTags {
+		topTags = maxTopTags
+	}
+
+	res, err := blogStats.stats(ctx, filter, topTags)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot compute blog stats: %v", err),
+		)
+	}
+
+	return res, nil
+}
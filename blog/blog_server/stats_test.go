@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go-grpc-course/blog/blogpb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFinishCadence(t *testing.T) {
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		posts       int64
+		first, last time.Time
+		want        *blogpb.PublishingCadence
+	}{
+		{"no posts", 0, time.Time{}, time.Time{}, &blogpb.PublishingCadence{}},
+		{"one post", 1, jan, jan, &blogpb.PublishingCadence{
+			FirstPostAt: "2024-01-01T00:00:00Z", LastPostAt: "2024-01-01T00:00:00Z",
+		}},
+		{"three posts over ten days", 3, jan, jan.AddDate(0, 0, 10), &blogpb.PublishingCadence{
+			FirstPostAt: "2024-01-01T00:00:00Z", LastPostAt: "2024-01-11T00:00:00Z", AverageDaysBetweenPosts: 5,
+		}},
+		{"local times are reported in UTC", 2, jan.In(time.FixedZone("CET", 3600)), jan.Add(36 * time.Hour), &blogpb.PublishingCadence{
+			FirstPostAt: "2024-01-01T00:00:00Z", LastPostAt: "2024-01-02T12:00:00Z", AverageDaysBetweenPosts: 1.5,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &blogpb.GetBlogStatsResponse{TotalPosts: tt.posts, Cadence: &blogpb.PublishingCadence{}}
+			finishCadence(res, tt.first, tt.last)
+			if !proto.Equal(res.Cadence, tt.want) {
+				t.Errorf("cadence = %v, want %v", res.Cadence, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStatsReport(t *testing.T) {
+	day := func(month time.Month, d, hour int) time.Time {
+		return time.Date(2024, month, d, hour, 0, 0, 0, time.UTC)
+	}
+	blogs := []*blogItem{
+		{AuthorID: "ann", Content: "Hello", Tags: []string{"go", "grpc"}, CreatedAt: day(1, 3, 12)},
+		{AuthorID: "ann", Content: "Héllo wörld", Tags: []string{"go"}, CreatedAt: day(1, 31, 23)},
+		{AuthorID: "bob", Content: "こんにちは", Tags: []string{"mongo", "grpc"}, CreatedAt: day(2, 1, 0)},
+		{AuthorID: "bob", Content: "", CreatedAt: day(3, 15, 12)},
+		// Months are taken in UTC: 23:00 on March 31st in UTC-2 is in April.
+		{AuthorID: "cid", Content: "tie", Tags: []string{"alpha", "zeta"}, CreatedAt: time.Date(2024, 3, 31, 23, 0, 0, 0, time.FixedZone("", -2*3600))},
+	}
+
+	tests := []struct {
+		name    string
+		blogs   []*blogItem
+		topTags int
+		want    *blogpb.GetBlogStatsResponse
+	}{
+		{"no blogs", nil, 10, &blogpb.GetBlogStatsResponse{Cadence: &blogpb.PublishingCadence{}}},
+		{"every blog", blogs, 10, &blogpb.GetBlogStatsResponse{
+			TotalPosts:           5,
+			AverageContentLength: 24.0 / 5,
+			PostsPerAuthorMonth: []*blogpb.AuthorMonthCount{
+				{AuthorId: "ann", Month: "2024-01", Posts: 2},
+				{AuthorId: "bob", Month: "2024-02", Posts: 1},
+				{AuthorId: "bob", Month: "2024-03", Posts: 1},
+				{AuthorId: "cid", Month: "2024-04", Posts: 1},
+			},
+			TopTags: []*blogpb.TagCount{
+				{Tag: "go", Posts: 2}, {Tag: "grpc", Posts: 2}, {Tag: "alpha", Posts: 1}, {Tag: "mongo", Posts: 1}, {Tag: "zeta", Posts: 1},
+			},
+			Cadence: &blogpb.PublishingCadence{
+				PostsPerMonth: []*blogpb.MonthCount{
+					{Month: "2024-01", Posts: 2}, {Month: "2024-02", Posts: 1}, {Month: "2024-03", Posts: 1}, {Month: "2024-04", Posts: 1},
+				},
+				FirstPostAt:             "2024-01-03T12:00:00Z",
+				LastPostAt:              "2024-04-01T01:00:00Z",
+				AverageDaysBetweenPosts: (88 + 13.0/24) / 4,
+			},
+		}},
+		{"top tags limited", blogs[:3], 2, &blogpb.GetBlogStatsResponse{
+			TotalPosts:           3,
+			AverageContentLength: 21.0 / 3,
+			PostsPerAuthorMonth: []*blogpb.AuthorMonthCount{
+				{AuthorId: "ann", Month: "2024-01", Posts: 2},
+				{AuthorId: "bob", Month: "2024-02", Posts: 1},
+			},
+			TopTags: []*blogpb.TagCount{{Tag: "go", Posts: 2}, {Tag: "grpc", Posts: 2}},
+			Cadence: &blogpb.PublishingCadence{
+				PostsPerMonth:           []*blogpb.MonthCount{{Month: "2024-01", Posts: 2}, {Month: "2024-02", Posts: 1}},
+				FirstPostAt:             "2024-01-03T12:00:00Z",
+				LastPostAt:              "2024-02-01T00:00:00Z",
+				AverageDaysBetweenPosts: 28.5 / 2,
+			},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := newStatsAccumulator()
+			for _, b := range tt.blogs {
+				acc.add(b)
+			}
+			got := acc.report(tt.topTags)
+
+			if math.Abs(got.AverageContentLength-tt.want.AverageContentLength) > 1e-9 ||
+				math.Abs(got.Cadence.AverageDaysBetweenPosts-tt.want.Cadence.AverageDaysBetweenPosts) > 1e-9 {
+				t.Errorf("averages = %v, %v, want %v, %v", got.AverageContentLength, got.Cadence.AverageDaysBetweenPosts,
+					tt.want.AverageContentLength, tt.want.Cadence.AverageDaysBetweenPosts)
+			}
+			got.AverageContentLength, got.Cadence.AverageDaysBetweenPosts = tt.want.AverageContentLength, tt.want.Cadence.AverageDaysBetweenPosts
+			if !proto.Equal(got, tt.want) {
+				t.Errorf("report:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsEnginesAgree(t *testing.T) {
+	ctx := testStore(t)
+
+	day := func(month time.Month, d, hour int) time.Time {
+		return time.Date(2024, month, d, hour, 0, 0, 0, time.UTC)
+	}
+	blogs := []blogItem{
+		{TenantID: "acme", AuthorID: "ann", Content: "Hello", Tags: []string{"go", "grpc"}, CreatedAt: day(1, 3, 10)},
+		{TenantID: "acme", AuthorID: "ann", Content: "Héllo wörld", Tags: []string{"go"}, CreatedAt: day(1, 31, 23)},
+		{TenantID: "acme", AuthorID: "bob", Content: "こんにちは", Tags: []string{"mongo", "grpc"}, CreatedAt: day(2, 1, 0)},
+		{TenantID: "acme", AuthorID: "bob", Content: "", CreatedAt: day(3, 15, 12)},
+		{TenantID: "acme", AuthorID: "cid", Content: "tie", Tags: []string{"alpha", "zeta"}, CreatedAt: day(3, 16, 8)},
+		{TenantID: "acme", AuthorID: "ann", Content: "hidden", Tags: []string{"go"}, CreatedAt: day(4, 1, 0), ModerationStatus: "pending"},
+		{TenantID: "globex", AuthorID: "dan", Content: "other tenant", Tags: []string{"go"}, CreatedAt: day(1, 5, 0)},
+	}
+	for _, b := range blogs {
+		b.ID = primitive.NewObjectID()
+		b.UpdatedAt = b.CreatedAt
+		if _, err := collection.InsertOne(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	visible := bson.M{"tenant_id": "acme", "moderation_status": visibleFilter}
+	tests := []struct {
+		name    string
+		filter  bson.M
+		topTags int
+		posts   int64
+	}{
+		{"tenant", visible, 10, 5},
+		{"top tags limited", visible, 2, 5},
+		{"created range", bson.M{"tenant_id": "acme", "moderation_status": visibleFilter, "created_at": bson.M{"$gte": day(1, 31, 0), "$lt": day(3, 1, 0)}}, 10, 2},
+		{"every tenant", bson.M{}, 10, 7},
+		{"nothing", bson.M{"tenant_id": "initech"}, 10, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fromMongo, err := mongoStats{}.stats(ctx, tt.filter, tt.topTags)
+			if err != nil {
+				t.Fatalf("mongoStats: %v", err)
+			}
+			fromMemory, err := memoryStats{}.stats(ctx, tt.filter, tt.topTags)
+			if err != nil {
+				t.Fatalf("memoryStats: %v", err)
+			}
+			if fromMongo.GetTotalPosts() != tt.posts {
+				t.Errorf("total posts = %d, want %d", fromMongo.GetTotalPosts(), tt.posts)
+			}
+
+			// Averages are computed differently and may differ in the last bits.
+			if math.Abs(fromMongo.AverageContentLength-fromMemory.AverageContentLength) > 1e-9 {
+				t.Errorf("average length: mongo %v, memory %v", fromMongo.AverageContentLength, fromMemory.AverageContentLength)
+			}
+			if math.Abs(fromMongo.Cadence.AverageDaysBetweenPosts-fromMemory.Cadence.AverageDaysBetweenPosts) > 1e-9 {
+				t.Errorf("days between posts: mongo %v, memory %v", fromMongo.Cadence.AverageDaysBetweenPosts, fromMemory.Cadence.AverageDaysBetweenPosts)
+			}
+			fromMongo.AverageContentLength, fromMemory.AverageContentLength = 0, 0
+			fromMongo.Cadence.AverageDaysBetweenPosts, fromMemory.Cadence.AverageDaysBetweenPosts = 0, 0
+
+			if !proto.Equal(fromMongo, fromMemory) {
+				t.Errorf("engines disagree:\nmongo:  %v\nmemory: %v", fromMongo, fromMemory)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testStore points the store at a fresh database of the MongoDB server named by
+// BLOG_TEST_MONGO_URI, dropped when the test ends. Tests needing it are skipped without it.
+func testStore(t *testing.T) context.Context {
+	uri := os.Getenv("BLOG_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("BLOG_TEST_MONGO_URI is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("cannot connect to %v: %v", uri, err)
+	}
+	db := client.Database(fmt.Sprintf("blog_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+
+	collection = db.Collection("blog")
+	tenants = tenantsCollection(collection)
+	webhooks = webhooksCollection(collection)
+	outbox = outboxCollection(collection)
+	series = seriesCollection(collection)
+	translations = translationsCollection(collection)
+	if err := runMigrations(ctx, collection, false); err != nil {
+		t.Fatalf("runMigrations: %v", err)
+	}
+	return ctx
+}
+
+// dumpStore returns the records of every snapshot section, as snapshots write them.
+func dumpStore(t *testing.T, ctx context.Context) map[string][]string {
+	dump := map[string][]string{}
+	for _, section := range snapshotSections() {
+		kind := section.Kind
+		err := section.Dump(ctx, bson.M{}, func(v interface{}) error {
+			data, err := json.Marshal(v)
+			dump[kind] = append(dump[kind], string(data))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("dump %v: %v", kind, err)
+		}
+	}
+	return dump
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	tenantMetadataKey = "x-tenant-id"
+	adminMetadataKey  = "x-admin-token"
+
+	// defaultTenant owns every blog created before tenants existed and serves
+	// requests that carry no tenant metadata.
+	defaultTenant = "default"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// tenants holds one tenantItem per provisioned tenant.
+var tenants *mongo.Collection
+
+// adminToken guards BlogAdminService. Admin calls are refused when it is empty.
+var adminToken string
+
+type adminServer struct{}
+
+type tenantItem struct {
+	ID        string    `bson:"_id"`
+	MaxBlogs  int64     `bson:"max_blogs"`
+	CreatedAt time.Time `bson:"created_at"`
+	// BlogCount counts the blogs of the tenant, including those being created, so the quota
+	// holds under concurrent creations. recountTenantBlogs corrects it on start.
+	BlogCount int64 `bson:"blog_count"`
+}
+
+// tenantsCollection returns the collection holding the tenants of coll.
+func tenantsCollection(coll *mongo.Collection) *mongo.Collection {
+	return coll.Database().Collection(coll.Name() + "_tenants")
+}
+
+// tenantFromContext returns the tenant named in the request metadata, or the default tenant.
+func tenantFromContext(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(tenantMetadataKey)) == 0 {
+		return defaultTenant, nil
+	}
+
+	tenantID := md.Get(tenantMetadataKey)[0]
+	if !tenantIDPattern.MatchString(tenantID) {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid tenant id: %q", tenantID),
+		)
+	}
+
+	return tenantID, nil
+}
+
+// requireTenant resolves the tenant of the request and checks that it has been provisioned.
+func requireTenant(ctx context.Context) (*tenantItem, error) {
+	tenantID, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tenant := &tenantItem{}
+	if err := tenants.FindOne(ctx, bson.M{"_id": tenantID}).Decode(tenant); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(
+				codes.PermissionDenied,
+				fmt.Sprintf("Tenant is not provisioned: %v", tenantID),
+			)
+		}
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot load tenant: %v", err),
+		)
+	}
+
+	return tenant, nil
+}
+
+// reserveBlog counts a blog about to be created, or returns ResourceExhausted when the tenant
+// reached its quota. The counter is only raised while under the quota, so concurrent creations
+// cannot exceed it. A blog that ends up not created is given back with releaseBlogs.
+func (t *tenantItem) reserveBlog(ctx context.Context) error {
+	filter := bson.M{
+		"_id": t.ID,
+		"$or": bson.A{
+			bson.M{"max_blogs": bson.M{"$lte": 0}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$blog_count", "$max_blogs"}}},
+		},
+	}
+	updateResult, err := tenants.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"blog_count": 1}})
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot count blogs of tenant: %v", err),
+		)
+	}
+	if updateResult.MatchedCount == 0 {
+		return status.Errorf(
+			codes.ResourceExhausted,
+			fmt.Sprintf("Tenant %v reached its quota of %d blogs", t.ID, t.MaxBlogs),
+		)
+	}
+
+	return nil
+}
+
+// releaseBlogs lowers the blog counter of a tenant by n, after deletions or a failed creation.
+// A failure is logged, recountTenantBlogs corrects the counter on the next start.
+func releaseBlogs(ctx context.Context, tenantID string, n int64) {
+	if n == 0 {
+		return
+	}
+	if _, err := tenants.UpdateOne(ctx, bson.M{"_id": tenantID}, bson.M{"$inc": bson.M{"blog_count": -n}}); err != nil {
+		fmt.Printf("Cannot update blog count of tenant %v: %v\n", tenantID, err)
+	}
+}
+
+// recountTenantBlogs sets the blog counter of every tenant to the number of blogs stored. It
+// runs on start and after a snapshot restore, while no blog is being created.
+func recountTenantBlogs(ctx context.Context) error {
+	counts := map[string]int64{}
+	cur, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$tenant_id", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		row := struct {
+			TenantID string `bson:"_id"`
+			Count    int64  `bson:"count"`
+		}{}
+		if err := cur.Decode(&row); err != nil {
+			return err
+		}
+		counts[row.TenantID] = row.Count
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	var ids []string
+	err = forEach(ctx, tenants, bson.M{}, func(cur *mongo.Cursor) error {
+		t := &tenantItem{}
+		if err := cur.Decode(t); err != nil {
+			return err
+		}
+		ids = append(ids, t.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tenants.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"blog_count": counts[id]}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authorizeAdmin checks the admin token sent with an admin RPC.
+func authorizeAdmin(ctx context.Context) error {
+	if adminToken == "" {
+		return status.Errorf(
+			codes.Unauthenticated,
+			"Admin calls are disabled, the server has no admin token configured",
+		)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(adminMetadataKey)
+	if len(tokens) == 0 || subtle.ConstantTimeCompare([]byte(tokens[0]), []byte(adminToken)) != 1 {
+		return status.Errorf(codes.Unauthenticated, "Missing or invalid admin token")
+	}
+
+	return nil
+}
+
+func (*adminServer) ProvisionTenant(ctx context.Context, req *blogpb.ProvisionTenantRequest) (*blogpb.ProvisionTenantResponse, error) {
+	fmt.Printf("ProvisionTenant called...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	tenant := req.GetTenant()
+	if !tenantIDPattern.MatchString(tenant.GetId()) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid tenant id: %q", tenant.GetId()),
+		)
+	}
+	if tenant.GetMaxBlogs() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max_blogs must not be negative")
+	}
+
+	_, err := tenants.UpdateOne(ctx,
+		bson.M{"_id": tenant.GetId()},
+		bson.M{
+			"$set":         bson.M{"max_blogs": tenant.GetMaxBlogs()},
+			"$setOnInsert": bson.M{"created_at": time.Now().UTC(), "blog_count": 0},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot provision tenant: %v", err),
+		)
+	}
+	changes.record("tenant", tenant.GetId(), tenant.GetId())
+
+	count, err := collection.CountDocuments(ctx, bson.M{"tenant_id": tenant.GetId()})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot count blogs of tenant: %v", err),
+		)
+	}
+
+	return &blogpb.ProvisionTenantResponse{
+		Tenant: &blogpb.Tenant{
+			Id:        tenant.GetId(),
+			MaxBlogs:  tenant.GetMaxBlogs(),
+			BlogCount: count,
+		},
+	}, nil
+}
+
+func (*adminServer) DeleteTenant(ctx context.Context, req *blogpb.DeleteTenantRequest) (*blogpb.DeleteTenantResponse, error) {
+	fmt.Printf("DeleteTenant called...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	tenantID := req.GetTenantId()
+	if tenantID == defaultTenant {
+		return nil, status.Errorf(codes.FailedPrecondition, "The default tenant cannot be deleted")
+	}
+
+	// The tenant goes first so nothing is written for it anymore. If removing its data fails,
+	// calling DeleteTenant again finishes the job.
+	deleteResult, err := tenants.DeleteOne(ctx, bson.M{"_id": tenantID})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot delete tenant: %v", err),
+		)
+	}
+
+	blogs, others, err := deleteTenantData(ctx, tenantID)
+	if blogs+others > 0 || deleteResult.DeletedCount > 0 {
+		related.removeTenant(tenantID)
+		changes.record("tenant", tenantID, tenantID)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot delete data of tenant %v, call DeleteTenant again: %v", tenantID, err),
+		)
+	}
+	if deleteResult.DeletedCount == 0 && blogs+others == 0 {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Tenant to be deleted is not found: %v", tenantID),
+		)
+	}
+
+	return &blogpb.DeleteTenantResponse{
+		TenantId:     tenantID,
+		DeletedBlogs: blogs,
+	}, nil
+}
+
+// deleteTenantData removes the blogs of a tenant and everything stored along with them. It
+// returns the number of blogs and of other records deleted.
+func deleteTenantData(ctx context.Context, tenantID string) (int64, int64, error) {
+	filter := bson.M{"tenant_id": tenantID}
+	blogs, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot delete blogs: %v", err)
+	}
+
+	var others int64
+	for _, c := range []struct {
+		name string
+		coll *mongo.Collection
+	}{
+		{"series", series},
+		{"translations", translations},
+		{"webhooks", webhooks},
+		{"webhook events", outbox},
+	} {
+		res, err := c.coll.DeleteMany(ctx, filter)
+		if err != nil {
+			return blogs.DeletedCount, others, fmt.Errorf("cannot delete %v: %v", c.name, err)
+		}
+		others += res.DeletedCount
+	}
+
+	return blogs.DeletedCount, others, nil
+}
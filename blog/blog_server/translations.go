@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// translations holds one translationItem per blog and language.
+var translations *mongo.Collection
+
+type translationItem struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	BlogID   primitive.ObjectID `bson:"blog_id"`
+	TenantID string             `bson:"tenant_id"`
+	Language string             `bson:"language"`
+	Title    string             `bson:"title"`
+	Content  string             `bson:"content"`
+	// Stale is set when the source blog changes after the translation was last updated.
+	Stale     bool      `bson:"stale"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+
+	ModerationStatus  string   `bson:"moderation_status,omitempty"`
+	ModerationReasons []string `bson:"moderation_reasons,omitempty"`
+}
+
+func translationsCollection(coll *mongo.Collection) *mongo.Collection {
+	return coll.Database().Collection(coll.Name() + "_translations")
+}
+
+// languagePattern matches the BCP 47 tags we accept: a language subtag followed by optional
+// script, region or variant subtags, e.g. "en", "pt-BR" or "zh-Hant-TW".
+var languagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// normalizeLanguage validates a language tag and returns it in canonical case.
+func normalizeLanguage(tag string) (string, error) {
+	tag = strings.ReplaceAll(strings.TrimSpace(tag), "_", "-")
+	if !languagePattern.MatchString(tag) {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid language tag: %q", tag),
+		)
+	}
+
+	subtags := strings.Split(tag, "-")
+	for i, s := range subtags {
+		switch {
+		case i == 0:
+			subtags[i] = strings.ToLower(s)
+		case len(s) == 2:
+			subtags[i] = strings.ToUpper(s)
+		case len(s) == 4:
+			subtags[i] = strings.ToUpper(s[:1]) + strings.ToLower(s[1:])
+		default:
+			subtags[i] = strings.ToLower(s)
+		}
+	}
+	return strings.Join(subtags, "-"), nil
+}
+
+// baseLanguage returns the language subtag of a tag, "pt" for "pt-BR".
+func baseLanguage(tag string) string {
+	return strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+}
+
+// matchLanguage picks the best of the available languages for a preference list, most
+// preferred first. Exact matches win over matches of the base language only. It returns ""
+// when nothing matches.
+func matchLanguage(preferred, available []string) string {
+	for _, p := range preferred {
+		for _, a := range available {
+			if a != "" && strings.EqualFold(p, a) {
+				return a
+			}
+		}
+	}
+	for _, p := range preferred {
+		for _, a := range available {
+			if a != "" && baseLanguage(p) == baseLanguage(a) {
+				return a
+			}
+		}
+	}
+	return ""
+}
+
+// blogTranslations returns the translations of a blog readers may see, ordered by language.
+func blogTranslations(ctx context.Context, tenantID string, blogID primitive.ObjectID) ([]*translationItem, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "language", Value: 1}})
+	filter := bson.M{"tenant_id": tenantID, "blog_id": blogID, "moderation_status": visibleFilter}
+	cur, err := translations.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var items []*translationItem
+	for cur.Next(ctx) {
+		item := &translationItem{}
+		if err := cur.Decode(item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, cur.Err()
+}
+
+// translateBlog replaces title and content of data with the translation best matching the
+// preferred languages and returns the languages the blog is available in. The source is kept
+// when no translation matches better.
+func translateBlog(ctx context.Context, data *blogItem, preferred []string, view blogpb.BlogView) ([]string, *translationItem, error) {
+	items, err := blogTranslations(ctx, data.TenantID, data.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	available := []string{data.Language}
+	for _, t := range items {
+		available = append(available, t.Language)
+	}
+	if data.Language == "" {
+		available = available[1:]
+	}
+
+	lang := matchLanguage(preferred, available)
+	if lang == "" || lang == data.Language {
+		return available, nil, nil
+	}
+	for _, t := range items {
+		if t.Language != lang {
+			continue
+		}
+		data.Language = t.Language
+		data.Title = t.Title
+		// The BASIC view has no content, only an excerpt.
+		if view == blogpb.BlogView_BLOG_VIEW_BASIC {
+			data.Excerpt = excerpt(t.Content)
+		} else {
+			data.Content = t.Content
+		}
+		return available, t, nil
+	}
+	return available, nil, nil
+}
+
+// markTranslationsStale flags every translation of a blog after its source changed.
+func markTranslationsStale(ctx context.Context, tenantID string, blogID primitive.ObjectID) error {
+	var ids []primitive.ObjectID
+	err := forEach(ctx, translations, bson.M{"tenant_id": tenantID, "blog_id": blogID, "stale": false}, func(cur *mongo.Cursor) error {
+		item := &translationItem{}
+		if err := cur.Decode(item); err != nil {
+			return err
+		}
+		ids = append(ids, item.ID)
+		return nil
+	})
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	_, err = translations.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{"$set": bson.M{"stale": true}},
+	)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		changes.record("translation", tenantID, id)
+	}
+	return nil
+}
+
+func mapTranslation(item *translationItem) *blogpb.Translation {
+	return &blogpb.Translation{
+		Language: item.Language,
+		Title:    item.Title,
+		Content:  item.Content,
+		Stale:    item.Stale,
+
+		ModerationStatus: moderationStatuses[item.ModerationStatus],
+	}
+}
+
+// checkedTranslation is a translation ready to be stored.
+type checkedTranslation struct {
+	blog              *blogItem
+	language          string
+	moderationStatus  string
+	moderationReasons []string
+}
+
+// checkTranslation validates a translation of blogID and moderates it like a blog: it may be
+// rejected, queued for review or flagged.
+func checkTranslation(ctx context.Context, tenantID, blogID string, t *blogpb.Translation) (*checkedTranslation, error) {
+	oid, err := primitive.ObjectIDFromHex(blogID)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	lang, err := normalizeLanguage(t.GetLanguage())
+	if err != nil {
+		return nil, err
+	}
+	if t.GetTitle() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "A translation needs a title")
+	}
+
+	data := &blogItem{}
+	err = collection.FindOne(ctx, bson.M{"_id": oid, "tenant_id": tenantID}).Decode(data)
+	if err == mongo.ErrNoDocuments {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Cannot find blog with specified ID: %v", oid.Hex()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	if lang == data.Language {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Blog is already written in %v", lang),
+		)
+	}
+
+	moderationStatus, moderationReasons, err := moderatePost("Translation", t.GetTitle(), t.GetContent())
+	if err != nil {
+		return nil, err
+	}
+
+	return &checkedTranslation{
+		blog:              data,
+		language:          lang,
+		moderationStatus:  moderationStatus,
+		moderationReasons: moderationReasons,
+	}, nil
+}
+
+func (*server) AddTranslation(ctx context.Context, req *blogpb.AddTranslationRequest) (*blogpb.AddTranslationResponse, error) {
+	fmt.Printf("AddTranslation called by client...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	checked, err := checkTranslation(ctx, tenant.ID, req.GetBlogId(), req.GetTranslation())
+	if err != nil {
+		return nil, err
+	}
+	lang := checked.language
+
+	now := time.Now().UTC()
+	item := &translationItem{
+		BlogID:    checked.blog.ID,
+		TenantID:  tenant.ID,
+		Language:  lang,
+		Title:     req.GetTranslation().GetTitle(),
+		Content:   req.GetTranslation().GetContent(),
+		CreatedAt: now,
+		UpdatedAt: now,
+
+		ModerationStatus:  checked.moderationStatus,
+		ModerationReasons: checked.moderationReasons,
+	}
+	res, err := translations.InsertOne(ctx, item)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, status.Errorf(
+			codes.AlreadyExists,
+			fmt.Sprintf("Blog already has a %v translation", lang),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Internal error: %v", err),
+		)
+	}
+	item.ID = res.InsertedID.(primitive.ObjectID)
+	changes.record("translation", tenant.ID, item.ID)
+
+	return &blogpb.AddTranslationResponse{
+		Translation: mapTranslation(item),
+	}, nil
+}
+
+func (*server) UpdateTranslation(ctx context.Context, req *blogpb.UpdateTranslationRequest) (*blogpb.UpdateTranslationResponse, error) {
+	fmt.Printf("UpdateTranslation called by client...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	checked, err := checkTranslation(ctx, tenant.ID, req.GetBlogId(), req.GetTranslation())
+	if err != nil {
+		return nil, err
+	}
+	lang := checked.language
+
+	// Like blogs, a translation rejected by a moderator cannot be updated anymore.
+	item := &translationItem{}
+	err = translations.FindOneAndUpdate(ctx,
+		bson.M{"tenant_id": tenant.ID, "blog_id": checked.blog.ID, "language": lang, "moderation_status": bson.M{"$ne": moderationRejected}},
+		bson.M{"$set": bson.M{
+			"title":              req.GetTranslation().GetTitle(),
+			"content":            req.GetTranslation().GetContent(),
+			"stale":              false,
+			"updated_at":         time.Now().UTC(),
+			"moderation_status":  checked.moderationStatus,
+			"moderation_reasons": checked.moderationReasons,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(item)
+	if err == mongo.ErrNoDocuments {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Blog has no %v translation, or it was rejected by a moderator", lang),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot update object in MongoDB: %v", err),
+		)
+	}
+	changes.record("translation", tenant.ID, item.ID)
+
+	return &blogpb.UpdateTranslationResponse{
+		Translation: mapTranslation(item),
+	}, nil
+}
+
+func (*server) ListTranslations(ctx context.Context, req *blogpb.ListTranslationsRequest) (*blogpb.ListTranslationsResponse, error) {
+	fmt.Printf("ListTranslations called by client...\n")
+
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(req.GetBlogId())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": oid, "tenant_id": tenant.ID})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+	if count == 0 {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Cannot find blog with specified ID: %v", oid.Hex()),
+		)
+	}
+
+	items, err := blogTranslations(ctx, tenant.ID, oid)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	res := &blogpb.ListTranslationsResponse{}
+	for _, item := range items {
+		res.Translations = append(res.Translations, mapTranslation(item))
+	}
+
+	return res, nil
+}
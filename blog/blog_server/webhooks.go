@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-grpc-course/blog/blogpb"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Events are staged in the outbox collection before the blog change they report is written, and
+// released for delivery by runWebhookDispatcher once it is, so they survive crashes and restarts.
+// Deliveries failing webhookMaxAttempts times are kept as dead letters until redelivered.
+const (
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 2 * time.Second
+	webhookMaxBackoff   = time.Hour
+	webhookLease        = time.Minute
+	webhookPollInterval = time.Second
+	webhookHTTPTimeout  = 10 * time.Second
+
+	webhookSignatureHeader = "X-Blog-Signature"
+
+	outboxStaged  = "staged"
+	outboxPending = "pending"
+	outboxDead    = "dead"
+)
+
+var webhookEventNames = map[blogpb.WebhookEvent]string{
+	blogpb.WebhookEvent_WEBHOOK_EVENT_CREATED:   "blog.created",
+	blogpb.WebhookEvent_WEBHOOK_EVENT_UPDATED:   "blog.updated",
+	blogpb.WebhookEvent_WEBHOOK_EVENT_PUBLISHED: "blog.published",
+	blogpb.WebhookEvent_WEBHOOK_EVENT_DELETED:   "blog.deleted",
+}
+
+// webhooks and outbox hold the subscriptions and the pending deliveries.
+var webhooks, outbox *mongo.Collection
+
+type webhookItem struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	TenantID  string             `bson:"tenant_id"`
+	URL       string             `bson:"url"`
+	Events    []int32            `bson:"events"`
+	Secret    string             `bson:"secret"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+type outboxItem struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	WebhookID     primitive.ObjectID `bson:"webhook_id"`
+	Event         int32              `bson:"event"`
+	Payload       string             `bson:"payload"`
+	Status        string             `bson:"status"`
+	Attempts      int32              `bson:"attempts"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at"`
+	LastError     string             `bson:"last_error,omitempty"`
+
+	// TenantID, BlogID and BlogUpdatedAt identify the blog change of the entry.
+	TenantID      string             `bson:"tenant_id"`
+	BlogID        primitive.ObjectID `bson:"blog_id"`
+	BlogUpdatedAt time.Time          `bson:"blog_updated_at"`
+}
+
+// webhookPayload is the JSON body POSTed to subscribers.
+type webhookPayload struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	TenantID   string          `json:"tenant_id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Blog       json.RawMessage `json:"blog"`
+}
+
+func webhooksCollection(coll *mongo.Collection) *mongo.Collection {
+	return coll.Database().Collection(coll.Name() + "_webhooks")
+}
+
+func outboxCollection(coll *mongo.Collection) *mongo.Collection {
+	return coll.Database().Collection(coll.Name() + "_outbox")
+}
+
+// webhookBlogJSON encodes the blog of a payload with the protobuf JSON mapping, keeping the
+// field names of the .proto file.
+var webhookBlogJSON = protojson.MarshalOptions{UseProtoNames: true}
+
+// stagedEvents are the outbox entries of a blog change about to be written. Until committed they
+// are not delivered; entries a crash left staged are settled by reconcileStaged.
+type stagedEvents struct {
+	ids []primitive.ObjectID
+}
+
+// stage queues the events for every matching subscription. data must hold the blog as the
+// change will store it.
+func (s *stagedEvents) stage(ctx context.Context, data *blogItem, events ...blogpb.WebhookEvent) error {
+	blog, err := webhookBlogJSON.Marshal(mapDataToBlog(data))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+
+	var entries []interface{}
+	for _, event := range events {
+		filter := bson.M{
+			"tenant_id": bson.M{"$in": bson.A{"", data.TenantID}},
+			"$or":       bson.A{bson.M{"events": bson.M{"$size": 0}}, bson.M{"events": int32(event)}},
+		}
+		err := forEach(ctx, webhooks, filter, func(cur *mongo.Cursor) error {
+			hook := &webhookItem{}
+			if err := cur.Decode(hook); err != nil {
+				return err
+			}
+
+			id := primitive.NewObjectID()
+			payload, err := json.Marshal(webhookPayload{
+				ID:         id.Hex(),
+				Type:       webhookEventNames[event],
+				TenantID:   data.TenantID,
+				OccurredAt: now,
+				Blog:       blog,
+			})
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, outboxItem{
+				ID:            id,
+				WebhookID:     hook.ID,
+				Event:         int32(event),
+				Payload:       string(payload),
+				Status:        outboxStaged,
+				NextAttemptAt: now,
+				TenantID:      data.TenantID,
+				BlogID:        data.ID,
+				BlogUpdatedAt: data.UpdatedAt,
+			})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot load webhooks for %v: %v", webhookEventNames[event], err)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if _, err := outbox.InsertMany(ctx, entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		s.ids = append(s.ids, entry.(outboxItem).ID)
+	}
+	return nil
+}
+
+// commit releases the events for delivery once the blog change is written. A failure is only
+// logged, reconcileStaged releases the events later.
+func (s *stagedEvents) commit(ctx context.Context) {
+	if len(s.ids) == 0 {
+		return
+	}
+	_, err := outbox.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": s.ids}, "status": outboxStaged},
+		bson.M{"$set": bson.M{"status": outboxPending, "next_attempt_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		fmt.Printf("Cannot release %d webhook events: %v\n", len(s.ids), err)
+	}
+}
+
+// abort drops the events of a blog change that was not written. A failure is only logged,
+// reconcileStaged drops the events later.
+func (s *stagedEvents) abort(ctx context.Context) {
+	if len(s.ids) == 0 {
+		return
+	}
+	if _, err := outbox.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": s.ids}, "status": outboxStaged}); err != nil {
+		fmt.Printf("Cannot drop %d webhook events: %v\n", len(s.ids), err)
+	}
+}
+
+// stagedEventsError reports a blog change refused because its events could not be queued.
+func stagedEventsError(err error) error {
+	return status.Errorf(
+		codes.Internal,
+		fmt.Sprintf("Cannot queue webhook events: %v", err),
+	)
+}
+
+// reconcileStaged settles the entries staged for longer than webhookLease, left behind by a
+// crash between staging and committing. They are released when the blog shows the change was
+// written and dropped otherwise.
+func reconcileStaged(ctx context.Context) {
+	var entries []*outboxItem
+	filter := bson.M{"status": outboxStaged, "next_attempt_at": bson.M{"$lte": time.Now().UTC().Add(-webhookLease)}}
+	err := forEach(ctx, outbox, filter, func(cur *mongo.Cursor) error {
+		entry := &outboxItem{}
+		if err := cur.Decode(entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("Cannot read staged webhook events: %v\n", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		written, err := stagedChangeWritten(ctx, entry)
+		if err != nil {
+			fmt.Printf("Cannot check staged webhook event %v: %v\n", entry.ID.Hex(), err)
+			continue
+		}
+		if written {
+			_, err = outbox.UpdateOne(ctx,
+				bson.M{"_id": entry.ID, "status": outboxStaged},
+				bson.M{"$set": bson.M{"status": outboxPending, "next_attempt_at": time.Now().UTC()}},
+			)
+		} else {
+			_, err = outbox.DeleteOne(ctx, bson.M{"_id": entry.ID, "status": outboxStaged})
+		}
+		if err != nil {
+			fmt.Printf("Cannot settle staged webhook event %v: %v\n", entry.ID.Hex(), err)
+		}
+	}
+}
+
+// stagedChangeWritten reports whether the store holds the blog change of a staged entry. Later
+// changes only move updated_at forward, so a blog updated since also counts.
+func stagedChangeWritten(ctx context.Context, entry *outboxItem) (bool, error) {
+	event := blogpb.WebhookEvent(entry.Event)
+
+	data := &blogItem{}
+	err := collection.FindOne(ctx, bson.M{"_id": entry.BlogID}).Decode(data)
+	if err == mongo.ErrNoDocuments {
+		return event == blogpb.WebhookEvent_WEBHOOK_EVENT_DELETED, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch event {
+	case blogpb.WebhookEvent_WEBHOOK_EVENT_DELETED:
+		return false, nil
+	case blogpb.WebhookEvent_WEBHOOK_EVENT_PUBLISHED:
+		if !isVisible(data.ModerationStatus) {
+			return false, nil
+		}
+	}
+	return !data.UpdatedAt.Before(entry.BlogUpdatedAt), nil
+}
+
+// runWebhookDispatcher delivers pending outbox entries until ctx is done.
+func runWebhookDispatcher(ctx context.Context) {
+	client := &http.Client{Timeout: webhookHTTPTimeout}
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		reconcileStaged(ctx)
+		// Drain everything that is due before waiting for the next tick.
+		for ctx.Err() == nil && deliverNext(ctx, client) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverNext leases one due outbox entry and attempts to deliver it. It reports whether an
+// entry was found.
+func deliverNext(ctx context.Context, client *http.Client) bool {
+	now := time.Now().UTC()
+
+	// Pushing next_attempt_at forward leases the entry, so a crash mid-delivery only delays it.
+	entry := &outboxItem{}
+	err := outbox.FindOneAndUpdate(ctx,
+		bson.M{"status": outboxPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(webhookLease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}),
+	).Decode(entry)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("Cannot read webhook outbox: %v\n", err)
+		}
+		return false
+	}
+
+	hook := &webhookItem{}
+	if err := webhooks.FindOne(ctx, bson.M{"_id": entry.WebhookID}).Decode(hook); err != nil {
+		// The subscription was deleted, drop its deliveries.
+		outbox.DeleteOne(ctx, bson.M{"_id": entry.ID})
+		return true
+	}
+
+	deliveryErr := postWebhook(ctx, client, hook, entry)
+	if deliveryErr == nil {
+		outbox.DeleteOne(ctx, bson.M{"_id": entry.ID})
+		return true
+	}
+
+	attempts := entry.Attempts + 1
+	update := bson.M{
+		"attempts":        attempts,
+		"last_error":      deliveryErr.Error(),
+		"next_attempt_at": now.Add(webhookBackoff(attempts)),
+	}
+	if attempts >= webhookMaxAttempts {
+		update["status"] = outboxDead
+		fmt.Printf("Webhook delivery %v moved to dead letters: %v\n", entry.ID.Hex(), deliveryErr)
+	}
+	if _, err := outbox.UpdateOne(ctx, bson.M{"_id": entry.ID}, bson.M{"$set": update}); err != nil {
+		fmt.Printf("Cannot update webhook delivery %v: %v\n", entry.ID.Hex(), err)
+	}
+
+	return true
+}
+
+// webhookBackoff returns the delay before the next attempt, doubling with every failure.
+func webhookBackoff(attempts int32) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := int32(1); i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+// signPayload returns the value of the signature header for payload.
+func signPayload(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(ctx context.Context, client *http.Client, hook *webhookItem, entry *outboxItem) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewBufferString(entry.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Blog-Event", webhookEventNames[blogpb.WebhookEvent(entry.Event)])
+	req.Header.Set("X-Blog-Delivery", entry.ID.Hex())
+	req.Header.Set(webhookSignatureHeader, signPayload(hook.Secret, entry.Payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", res.Status)
+	}
+	return nil
+}
+
+func mapWebhook(hook *webhookItem) *blogpb.Webhook {
+	events := make([]blogpb.WebhookEvent, 0, len(hook.Events))
+	for _, e := range hook.Events {
+		events = append(events, blogpb.WebhookEvent(e))
+	}
+
+	return &blogpb.Webhook{
+		Id:       hook.ID.Hex(),
+		TenantId: hook.TenantID,
+		Url:      hook.URL,
+		Events:   events,
+	}
+}
+
+func (*adminServer) CreateWebhook(ctx context.Context, req *blogpb.CreateWebhookRequest) (*blogpb.CreateWebhookResponse, error) {
+	fmt.Printf("CreateWebhook called...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	webhook := req.GetWebhook()
+	u, err := url.Parse(webhook.GetUrl())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid webhook url: %q", webhook.GetUrl()),
+		)
+	}
+
+	hook := &webhookItem{
+		TenantID:  webhook.GetTenantId(),
+		URL:       u.String(),
+		Events:    []int32{},
+		Secret:    webhook.GetSecret(),
+		CreatedAt: time.Now().UTC(),
+	}
+	for _, e := range webhook.GetEvents() {
+		if _, ok := webhookEventNames[e]; !ok {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Invalid webhook event: %v", e),
+			)
+		}
+		hook.Events = append(hook.Events, int32(e))
+	}
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Cannot generate secret: %v", err),
+			)
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+
+	res, err := webhooks.InsertOne(ctx, hook)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Internal error: %v", err),
+		)
+	}
+	hook.ID = res.InsertedID.(primitive.ObjectID)
+
+	created := mapWebhook(hook)
+	created.Secret = hook.Secret
+
+	return &blogpb.CreateWebhookResponse{
+		Webhook: created,
+	}, nil
+}
+
+func (*adminServer) ListWebhooks(ctx context.Context, req *blogpb.ListWebhooksRequest) (*blogpb.ListWebhooksResponse, error) {
+	fmt.Printf("ListWebhooks called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{}
+	if req.GetTenantId() != "" {
+		filter["tenant_id"] = req.GetTenantId()
+	}
+
+	res := &blogpb.ListWebhooksResponse{}
+	err := forEach(ctx, webhooks, filter, func(cur *mongo.Cursor) error {
+		hook := &webhookItem{}
+		if err := cur.Decode(hook); err != nil {
+			return err
+		}
+		res.Webhooks = append(res.Webhooks, mapWebhook(hook))
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	return res, nil
+}
+
+func (*adminServer) DeleteWebhook(ctx context.Context, req *blogpb.DeleteWebhookRequest) (*blogpb.DeleteWebhookResponse, error) {
+	fmt.Printf("DeleteWebhook called...\n")
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(req.GetWebhookId())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	deleteResult, err := webhooks.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot delete webhook: %v", err),
+		)
+	}
+	if deleteResult.DeletedCount == 0 {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Webhook to be deleted is not found: %v", oid.Hex()),
+		)
+	}
+
+	// Pending deliveries and dead letters of the subscription are not useful anymore.
+	outbox.DeleteMany(ctx, bson.M{"webhook_id": oid})
+
+	return &blogpb.DeleteWebhookResponse{
+		WebhookId: oid.Hex(),
+	}, nil
+}
+
+func (*adminServer) ListDeadLetters(ctx context.Context, req *blogpb.ListDeadLettersRequest) (*blogpb.ListDeadLettersResponse, error) {
+	fmt.Printf("ListDeadLetters called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"status": outboxDead}
+	if req.GetWebhookId() != "" {
+		oid, err := primitive.ObjectIDFromHex(req.GetWebhookId())
+		if err != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprint("Cannot parse objectID"),
+			)
+		}
+		filter["webhook_id"] = oid
+	}
+
+	res := &blogpb.ListDeadLettersResponse{}
+	err := forEach(ctx, outbox, filter, func(cur *mongo.Cursor) error {
+		entry := &outboxItem{}
+		if err := cur.Decode(entry); err != nil {
+			return err
+		}
+		res.DeadLetters = append(res.DeadLetters, &blogpb.DeadLetter{
+			Id:        entry.ID.Hex(),
+			WebhookId: entry.WebhookID.Hex(),
+			Event:     blogpb.WebhookEvent(entry.Event),
+			Attempts:  entry.Attempts,
+			LastError: entry.LastError,
+			Payload:   entry.Payload,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Unknown internal error: %v", err),
+		)
+	}
+
+	return res, nil
+}
+
+func (*adminServer) RedeliverDeadLetter(ctx context.Context, req *blogpb.RedeliverDeadLetterRequest) (*blogpb.RedeliverDeadLetterResponse, error) {
+	fmt.Printf("RedeliverDeadLetter called...\n")
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(req.GetDeadLetterId())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprint("Cannot parse objectID"),
+		)
+	}
+
+	updateResult, err := outbox.UpdateOne(ctx,
+		bson.M{"_id": oid, "status": outboxDead},
+		bson.M{"$set": bson.M{"status": outboxPending, "attempts": 0, "next_attempt_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot update dead letter: %v", err),
+		)
+	}
+	if updateResult.MatchedCount == 0 {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Dead letter is not found: %v", oid.Hex()),
+		)
+	}
+
+	return &blogpb.RedeliverDeadLetterResponse{
+		DeadLetterId: oid.Hex(),
+	}, nil
+}
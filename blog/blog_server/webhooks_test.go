@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-grpc-course/blog/blogpb"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSignPayload(t *testing.T) {
+	tests := []struct {
+		secret  string
+		payload string
+		want    string
+	}{
+		// RFC 4231, test case 2.
+		{"Jefe", "what do ya want for nothing?", "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"", "", "sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	}
+
+	for _, tt := range tests {
+		if got := signPayload(tt.secret, tt.payload); got != tt.want {
+			t.Errorf("signPayload(%q, %q) = %v, want %v", tt.secret, tt.payload, got, tt.want)
+		}
+	}
+	if signPayload("s3cret", "a") == signPayload("other", "a") {
+		t.Errorf("signatures with different secrets are equal")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int32
+		want     time.Duration
+	}{
+		{0, 2 * time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{8, 256 * time.Second},
+		{11, 2048 * time.Second},
+		{12, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"no content", http.StatusNoContent, false},
+		{"redirect", http.StatusMultipleChoices, true},
+		{"client error", http.StatusGone, true},
+		{"server error", http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &webhookItem{Secret: "s3cret"}
+			entry := &outboxItem{
+				ID:      primitive.NewObjectID(),
+				Event:   int32(blogpb.WebhookEvent_WEBHOOK_EVENT_PUBLISHED),
+				Payload: `{"type":"blog.published"}`,
+			}
+
+			var header http.Header
+			var body string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header
+				data, _ := io.ReadAll(r.Body)
+				body = string(data)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			hook.URL = srv.URL
+
+			err := postWebhook(context.Background(), srv.Client(), hook, entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("postWebhook = %v, want error %v", err, tt.wantErr)
+			}
+			if body != entry.Payload {
+				t.Errorf("body = %q, want %q", body, entry.Payload)
+			}
+			if got := header.Get(webhookSignatureHeader); got != signPayload("s3cret", entry.Payload) {
+				t.Errorf("signature = %q", got)
+			}
+			if header.Get("X-Blog-Event") != "blog.published" || header.Get("X-Blog-Delivery") != entry.ID.Hex() {
+				t.Errorf("event headers = %v", header)
+			}
+		})
+	}
+}
+
+func TestWebhookBlogJSON(t *testing.T) {
+	data := &blogItem{
+		ID: primitive.NewObjectID(), AuthorID: "ann", Title: "Hello", Content: "Hello world",
+		Tags: []string{"go"}, ModerationStatus: "flagged",
+	}
+	raw, err := webhookBlogJSON.Marshal(mapDataToBlog(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var blog map[string]interface{}
+	if err := json.Unmarshal(raw, &blog); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":                data.ID.Hex(),
+		"author_id":         "ann",
+		"title":             "Hello",
+		"moderation_status": "MODERATION_STATUS_FLAGGED",
+	}
+	for k, v := range want {
+		if blog[k] != v {
+			t.Errorf("blog[%q] = %v, want %v", k, blog[k], v)
+		}
+	}
+}
@@ -15,7 +15,7 @@ import (
 
 func main() {
 	fmt.Printf("Hello  I a client")
-	cc, err := grpc.Dial("localhost:50051", grpc.WithInsecure()) //connection to server
+	cc, err := grpc.Dial("localhost:50052", grpc.WithInsecure()) //connection to server
 
 	if err != nil {
 		log.Fatalf("Could not connect: %v", err)
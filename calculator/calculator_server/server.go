@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"go-grpc-course/calculator/calculatorpb"
+	"go-grpc-course/config"
 	"io"
 	"log"
 	"math"
 	"net"
+	"os"
 	"time"
 
 	"google.golang.org/grpc"
@@ -145,14 +147,32 @@ func (*server) SquareRoot(ctx context.Context, req *calculatorpb.SquareRootReque
 func main() {
 	fmt.Println("Calculator Server")
 
-	lis, err := net.Listen("tcp", "0.0.0.0:50051")
+	cfg, err := config.Load("calculator", config.Config{
+		ListenAddr: "0.0.0.0:50052",
+	}, os.Args[1:])
+	if err == config.ErrPrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Cannot print configuration: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", cfg.ListenAddr)
 
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
+	opts, err := cfg.ServerOptions()
+	if err != nil {
+		log.Fatalf("Failed to build server options: %v", err)
+	}
+
 	//Create a GRPC server
-	s := grpc.NewServer()
+	s := grpc.NewServer(opts...)
 	calculatorpb.RegisterCalculatorServiceServer(s, &server{})
 
 	// Register reflection service on gRPC server.
@@ -0,0 +1,254 @@
+// Package config loads the settings shared by the greet, calculator and blog servers.
+//
+// Values are resolved in the following order, later sources overriding earlier ones:
+// built-in defaults, a YAML or TOML config file, environment variables and finally flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrPrintConfig is returned along with the configuration when --print-config is passed. The
+// caller is expected to print the configuration with Print and exit.
+var ErrPrintConfig = errors.New("print the configuration and exit")
+
+// Config holds the settings of a single server.
+type Config struct {
+	ListenAddr string   `yaml:"listen_addr" toml:"listen_addr"`
+	Storage    Storage  `yaml:"storage" toml:"storage"`
+	Timeouts   Timeouts `yaml:"timeouts" toml:"timeouts"`
+	TLS        TLS      `yaml:"tls" toml:"tls"`
+}
+
+// Storage describes where a server persists its data. It is left empty by servers without storage.
+type Storage struct {
+	URI        string `yaml:"uri" toml:"uri"`
+	Database   string `yaml:"database" toml:"database"`
+	Collection string `yaml:"collection" toml:"collection"`
+}
+
+// Timeouts used while starting and stopping a server.
+type Timeouts struct {
+	Connect  time.Duration `yaml:"connect" toml:"connect"`
+	Shutdown time.Duration `yaml:"shutdown" toml:"shutdown"`
+}
+
+// TLS holds the certificate paths. TLS is enabled when both CertFile and KeyFile are set.
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+// Enabled reports whether the server should serve over TLS.
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// Load builds the configuration of the named service from defaults, the optional config file,
+// the environment and the command line. Environment variables use the upper-cased service name
+// as prefix, e.g. BLOG_LISTEN_ADDR. When --print-config is passed, the effective configuration
+// is returned with ErrPrintConfig.
+func Load(service string, defaults Config, args []string) (*Config, error) {
+	return LoadFlags(flag.NewFlagSet(service, flag.ContinueOnError), service, defaults, args)
+}
+
+// LoadFlags is like Load but parses args with fs, so callers can register flags of their own.
+func LoadFlags(fs *flag.FlagSet, service string, defaults Config, args []string) (*Config, error) {
+	configFile := fs.String("config", "", "path to a YAML or TOML config file")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	listenAddr := fs.String("listen", "", "address the gRPC server listens on")
+	storageURI := fs.String("storage-uri", "", "MongoDB connection URI")
+	database := fs.String("database", "", "MongoDB database name")
+	collection := fs.String("collection", "", "MongoDB collection name")
+	connectTimeout := fs.Duration("connect-timeout", 0, "timeout for connecting to storage")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "timeout for a graceful shutdown")
+	certFile := fs.String("tls-cert", "", "path to the TLS certificate")
+	keyFile := fs.String("tls-key", "", "path to the TLS private key")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaults
+	env := envLookup(service)
+
+	path := *configFile
+	if path == "" {
+		path, _ = env("CONFIG")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(env); err != nil {
+		return nil, err
+	}
+
+	// Only flags that were explicitly set override the file and environment.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = *listenAddr
+		case "storage-uri":
+			cfg.Storage.URI = *storageURI
+		case "database":
+			cfg.Storage.Database = *database
+		case "collection":
+			cfg.Storage.Collection = *collection
+		case "connect-timeout":
+			cfg.Timeouts.Connect = *connectTimeout
+		case "shutdown-timeout":
+			cfg.Timeouts.Shutdown = *shutdownTimeout
+		case "tls-cert":
+			cfg.TLS.CertFile = *certFile
+		case "tls-key":
+			cfg.TLS.KeyFile = *keyFile
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if *printConfig {
+		return &cfg, ErrPrintConfig
+	}
+
+	return &cfg, nil
+}
+
+// Print writes the configuration to w as YAML.
+func (c *Config) Print(w io.Writer) error {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("unsupported config file format: %v", path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse config file %v: %v", path, err)
+	}
+
+	return nil
+}
+
+func envLookup(service string) func(string) (string, bool) {
+	prefix := strings.ToUpper(service) + "_"
+	return func(key string) (string, bool) {
+		return os.LookupEnv(prefix + key)
+	}
+}
+
+func (c *Config) loadEnv(env func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"LISTEN_ADDR":        &c.ListenAddr,
+		"STORAGE_URI":        &c.Storage.URI,
+		"STORAGE_DATABASE":   &c.Storage.Database,
+		"STORAGE_COLLECTION": &c.Storage.Collection,
+		"TLS_CERT_FILE":      &c.TLS.CertFile,
+		"TLS_KEY_FILE":       &c.TLS.KeyFile,
+	}
+	for key, dst := range strs {
+		if v, ok := env(key); ok {
+			*dst = v
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"CONNECT_TIMEOUT":  &c.Timeouts.Connect,
+		"SHUTDOWN_TIMEOUT": &c.Timeouts.Shutdown,
+	}
+	for key, dst := range durations {
+		if v, ok := env(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", key, err)
+			}
+			*dst = d
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the configuration can be used to start a server.
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %v", c.ListenAddr, err)
+	}
+
+	if c.Storage.URI != "" {
+		if !strings.HasPrefix(c.Storage.URI, "mongodb://") && !strings.HasPrefix(c.Storage.URI, "mongodb+srv://") {
+			return fmt.Errorf("storage uri must start with mongodb:// or mongodb+srv://")
+		}
+		if c.Storage.Database == "" || c.Storage.Collection == "" {
+			return fmt.Errorf("storage database and collection are required")
+		}
+		if c.Timeouts.Connect <= 0 {
+			return fmt.Errorf("connect timeout is required when storage is configured")
+		}
+	}
+
+	if c.Timeouts.Connect < 0 || c.Timeouts.Shutdown < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls cert_file and key_file must be set together")
+	}
+	for _, f := range []string{c.TLS.CertFile, c.TLS.KeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("tls file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ServerOptions returns the gRPC server options derived from the configuration.
+func (c *Config) ServerOptions() ([]grpc.ServerOption, error) {
+	opts := []grpc.ServerOption{}
+	if c.TLS.Enabled() {
+		creds, err := credentials.NewServerTLSFromFile(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading certificates: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadFlags(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test.yaml")
+	if err := os.WriteFile(file, []byte("listen_addr: 127.0.0.1:7000\ntimeouts:\n  shutdown: 3s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ini := filepath.Join(dir, "test.ini")
+	if err := os.WriteFile(ini, []byte("listen_addr = 127.0.0.1:7000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := Config{ListenAddr: "0.0.0.0:50051", Timeouts: Timeouts{Shutdown: time.Second}}
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		listen   string
+		shutdown time.Duration
+		err      string
+	}{
+		{"defaults", nil, nil, "0.0.0.0:50051", time.Second, ""},
+		{"file", nil, []string{"--config", file}, "127.0.0.1:7000", 3 * time.Second, ""},
+		{"env over file", map[string]string{"TEST_LISTEN_ADDR": "127.0.0.1:7001"}, []string{"--config", file}, "127.0.0.1:7001", 3 * time.Second, ""},
+		{"flag over env", map[string]string{"TEST_LISTEN_ADDR": "127.0.0.1:7001"}, []string{"--listen", "127.0.0.1:7002"}, "127.0.0.1:7002", time.Second, ""},
+		{"config file from env", map[string]string{"TEST_CONFIG": file}, nil, "127.0.0.1:7000", 3 * time.Second, ""},
+		{"bad duration", map[string]string{"TEST_SHUTDOWN_TIMEOUT": "soon"}, nil, "", 0, "invalid SHUTDOWN_TIMEOUT"},
+		{"bad listen address", nil, []string{"--listen", "nowhere"}, "", 0, "invalid listen address"},
+		{"unsupported file", nil, []string{"--config", ini}, "", 0, "unsupported config file format"},
+		{"missing file", nil, []string{"--config", filepath.Join(dir, "missing.yaml")}, "", 0, "cannot read config file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := LoadFlags(flag.NewFlagSet("test", flag.ContinueOnError), "test", defaults, tt.args)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("LoadFlags = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ListenAddr != tt.listen || cfg.Timeouts.Shutdown != tt.shutdown {
+				t.Errorf("LoadFlags = %+v, want listen %v and shutdown %v", cfg, tt.listen, tt.shutdown)
+			}
+		})
+	}
+}
+
+func TestLoadPrintConfig(t *testing.T) {
+	cfg, err := Load("test", Config{ListenAddr: "0.0.0.0:50051"}, []string{"--print-config", "--listen", "127.0.0.1:7000"})
+	if err != ErrPrintConfig {
+		t.Fatalf("Load = %v, want ErrPrintConfig", err)
+	}
+
+	var out bytes.Buffer
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "listen_addr: 127.0.0.1:7000") {
+		t.Errorf("printed configuration:\n%v", out.String())
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/simplesteph/grpc-go-course/greet/greetpb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -39,6 +40,21 @@ func main() {
 	//Bidirectional streaaming
 	//doBiDiStreaming(c)
 
+	//Localized greetings
+	//doLocalized(c)
+
+	//Greeting templates
+	//doTemplates(c)
+
+	//Presence of streaming clients
+	//doWatchPresence(c)
+
+	//Greeting history
+	//doHistory(c)
+
+	//Scheduled greetings
+	//doScheduledGreetings(c)
+
 	//Unary withDeadline
 	// doUnaryWithDeadline(c, 5) // Should complete
 	doUnaryWithDeadline(c, 1) // Should not complete
@@ -63,36 +79,163 @@ func doUnary(c greetpb.GreetServiceClient) {
 	log.Printf("Response from Greet: %v", res.Result)
 }
 
-func doServerStreaming(c greetpb.GreetServiceClient) {
-	fmt.Printf("Starting to do server streaming RPC...\n")
-
-	req := &greetpb.GreetManyTimesRequest{
+func doLocalized(c greetpb.GreetServiceClient) {
+	//The locale of the greeting wins, the x-locale metadata is used when it is empty.
+	req := &greetpb.GreetRequest{
 		Greeting: &greetpb.Greeting{
 			FirstName: "Nouru",
 			LastName:  "Muneza",
+			Locale:    "fr-CA",
+			Formality: greetpb.Formality_FORMALITY_FORMAL,
+		},
+	}
+	res, err := c.Greet(context.Background(), req)
+	if err != nil {
+		log.Fatal("Error while calling greet RPC: ", err)
+	}
+	log.Printf("Response from Greet (%v): %v", res.Locale, res.Result)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-locale", "de-AT, en")
+	res, err = c.Greet(ctx, &greetpb.GreetRequest{Greeting: &greetpb.Greeting{FirstName: "Nouru"}})
+	if err != nil {
+		log.Fatal("Error while calling greet RPC: ", err)
+	}
+	log.Printf("Response from Greet (%v): %v", res.Locale, res.Result)
+}
+
+func doTemplates(c greetpb.GreetServiceClient) {
+	_, err := c.CreateGreetingTemplate(context.Background(), &greetpb.CreateGreetingTemplateRequest{
+		Template: &greetpb.GreetingTemplate{
+			Name: "welcome",
+			Text: "Good {time_of_day} {first_name}, welcome to {team}!",
 		},
+	})
+	if err != nil {
+		log.Fatal("Error while creating greeting template: ", err)
 	}
 
-	resStream, err := c.GreetManyTimes(context.Background(), req)
+	req := &greetpb.GreetRequest{
+		Greeting: &greetpb.Greeting{
+			FirstName: "Nouru",
+			Template:  "welcome",
+			Variables: map[string]string{"team": "gRPC"},
+		},
+	}
+	res, err := c.Greet(context.Background(), req)
+	if err != nil {
+		log.Fatal("Error while calling greet RPC: ", err)
+	}
+	log.Printf("Response from Greet: %v", res.Result)
+}
 
+func doWatchPresence(c greetpb.GreetServiceClient) {
+	res, err := c.ListPresence(context.Background(), &greetpb.ListPresenceRequest{})
 	if err != nil {
-		log.Fatal("Error while calling GreetManyTimes RPC: ", err)
+		log.Fatal("Error while calling ListPresence RPC: ", err)
 	}
+	log.Printf("%d clients connected", len(res.GetPresence()))
 
+	stream, err := c.WatchPresence(context.Background(), &greetpb.WatchPresenceRequest{})
+	if err != nil {
+		log.Fatal("Error while calling WatchPresence RPC: ", err)
+	}
 	for {
-		msg, err := resStream.Recv()
-		if err == io.EOF {
-			log.Printf("We've reached the end of stream ")
-			break
+		ev, err := stream.Recv()
+		if err != nil {
+			log.Fatal("Error while reading presence: ", err)
 		}
+		p := ev.GetPresence()
+		log.Printf("%v (%v %v) is %v", p.GetName(), p.GetMethod(), p.GetRoom(), p.GetState())
+	}
+}
+
+func doHistory(c greetpb.GreetServiceClient) {
+	res, err := c.QueryHistory(context.Background(), &greetpb.QueryHistoryRequest{
+		FirstName: "Nouru",
+		From:      time.Now().Add(-24 * time.Hour).Format(time.RFC3339),
+		Limit:     10,
+	})
+	if err != nil {
+		log.Fatal("Error while calling QueryHistory RPC: ", err)
+	}
+	for _, e := range res.GetEntries() {
+		log.Printf("%v %v: %v", e.GetGreetedAt(), e.GetMethod(), e.GetResult())
+	}
+
+	counts, err := c.GreetingCounts(context.Background(), &greetpb.GreetingCountsRequest{})
+	if err != nil {
+		log.Fatal("Error while calling GreetingCounts RPC: ", err)
+	}
+	for _, n := range counts.GetCounts() {
+		log.Printf("%v was greeted %d times", n.GetFirstName(), n.GetCount())
+	}
+}
+
+func doScheduledGreetings(c greetpb.GreetServiceClient) {
+	res, err := c.CreateGreetingSchedule(context.Background(), &greetpb.CreateGreetingScheduleRequest{
+		Schedule: &greetpb.GreetingSchedule{
+			Greeting: &greetpb.Greeting{FirstName: "Alice"},
+			Cron:     "0 9 * * 1-5", //every weekday at 9:00
+			TimeZone: "Europe/Paris",
+		},
+	})
+	if err != nil {
+		log.Fatal("Error while creating greeting schedule: ", err)
+	}
+	log.Printf("Schedule %v runs next at %v", res.Schedule.GetId(), res.Schedule.GetNextRunAt())
 
+	stream, err := c.SubscribeScheduledGreetings(context.Background(), &greetpb.SubscribeScheduledGreetingsRequest{
+		ScheduleIds: []string{res.Schedule.GetId()},
+	})
+	if err != nil {
+		log.Fatal("Error while subscribing to scheduled greetings: ", err)
+	}
+	for {
+		g, err := stream.Recv()
 		if err != nil {
-			log.Fatal("Error while reading stream: ", err)
+			log.Fatal("Error while reading scheduled greetings: ", err)
 		}
+		log.Printf("%v: %v", g.GetFiredAt(), g.GetResult())
+	}
+}
+
+func doServerStreaming(c greetpb.GreetServiceClient) {
+	fmt.Printf("Starting to do server streaming RPC...\n")
 
-		log.Printf("Response from GreetManyTimes: %v", msg.GetResult())
+	req := &greetpb.GreetManyTimesRequest{
+		Greeting: &greetpb.Greeting{
+			FirstName: "Nouru",
+			LastName:  "Muneza",
+		},
+		Count:      20,
+		IntervalMs: 500,
 	}
 
+	//On a broken stream, reconnect and resume after the last sequence received.
+	for attempt := 0; attempt < 3; attempt++ {
+		resStream, err := c.GreetManyTimes(context.Background(), req)
+
+		if err != nil {
+			log.Fatal("Error while calling GreetManyTimes RPC: ", err)
+		}
+
+		for {
+			msg, err := resStream.Recv()
+			if err == io.EOF {
+				log.Printf("We've reached the end of stream ")
+				return
+			}
+
+			if err != nil {
+				log.Printf("Error while reading stream, resuming after %d: %v", req.ResumeAfterSequence, err)
+				break
+			}
+
+			log.Printf("Response %d from GreetManyTimes: %v", msg.GetSequence(), msg.GetResult())
+			req.ResumeAfterSequence = msg.GetSequence()
+		}
+	}
+	log.Fatal("Giving up on GreetManyTimes")
 }
 
 func doClientStreaming(c greetpb.GreetServiceClient) {
@@ -152,6 +295,7 @@ func doBiDiStreaming(c greetpb.GreetServiceClient) {
 			Greeting: &greetpb.Greeting{
 				FirstName: "Nouru",
 			},
+			Room: "course",
 		},
 		{
 			Greeting: &greetpb.Greeting{
@@ -205,7 +349,12 @@ func doBiDiStreaming(c greetpb.GreetServiceClient) {
 				break
 			}
 
-			fmt.Printf("Received: %v\n", res.GetResult())
+			switch res.GetEvent() {
+			case greetpb.RoomEvent_ROOM_EVENT_JOINED, greetpb.RoomEvent_ROOM_EVENT_LEFT:
+				fmt.Printf("%v %v, %d in %v\n", res.GetSender(), res.GetEvent(), res.GetParticipants(), res.GetRoom())
+			default:
+				fmt.Printf("Received from %v: %v\n", res.GetSender(), res.GetResult())
+			}
 		}
 		//Close channel if either last value is received or
 		close(waitChannel)
@@ -222,9 +371,10 @@ func doUnaryWithDeadline(c greetpb.GreetServiceClient, timeOut int) {
 		Greeting: &greetpb.Greeting{
 			FirstName: "Nouru",
 		},
+		WorkMs: 3000,
 	}
 
-	//We are willing to wait for 5 secs for our request to be responded to
+	//We are willing to wait for 5 secs for our request to be responded to, a shorter deadline is rejected at once
 	context, cancel := context.WithTimeout(context.Background(), time.Duration(timeOut)*time.Second)
 	defer cancel()
 
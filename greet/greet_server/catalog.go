@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"go-grpc-course/greet/greetpb"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// localeMetadataKey names the request metadata holding the caller's locales, most preferred
+// first and comma separated, used when a Greeting carries no locale.
+const localeMetadataKey = "x-locale"
+
+// defaultLocale ends every fallback chain.
+const defaultLocale = "en"
+
+// Message ids of the catalog.
+const (
+	msgGreeting      = "greeting"       // {name}
+	msgGreetingTimes = "greeting_times" // {name} {count}
+	msgGreetedCount  = "greeted_count"  // {count}
+)
+
+// variant selects a template of a message. plural is the CLDR plural category of {count}, empty
+// for messages without a count.
+type variant struct {
+	formal bool
+	plural string
+}
+
+// catalog holds the templates of every message per locale. A missing formal template falls
+// back to the informal one, a missing plural category to "other".
+var catalog = map[string]map[string]map[variant]string{
+	"en": {
+		msgGreeting: {
+			{false, ""}: "Hello {name}",
+			{true, ""}:  "Good day, {name}",
+		},
+		msgGreetingTimes: {
+			{false, "one"}:   "Hello {name}, {count} time",
+			{false, "other"}: "Hello {name}, {count} times",
+			{true, "one"}:    "Good day, {name}, greeted {count} time",
+			{true, "other"}:  "Good day, {name}, greeted {count} times",
+		},
+		msgGreetedCount: {
+			{false, "one"}:   "{count} person greeted",
+			{false, "other"}: "{count} people greeted",
+		},
+	},
+	"fr": {
+		msgGreeting: {
+			{false, ""}: "Salut {name}",
+			{true, ""}:  "Bonjour {name}",
+		},
+		msgGreetingTimes: {
+			{false, "one"}:   "Salut {name}, {count} fois",
+			{false, "other"}: "Salut {name}, {count} fois",
+			{true, "one"}:    "Bonjour {name}, {count} fois",
+			{true, "other"}:  "Bonjour {name}, {count} fois",
+		},
+		msgGreetedCount: {
+			{false, "one"}:   "{count} personne saluée",
+			{false, "other"}: "{count} personnes saluées",
+		},
+	},
+	"fr-CA": {
+		msgGreeting: {
+			{false, ""}: "Allô {name}",
+		},
+	},
+	"de": {
+		msgGreeting: {
+			{false, ""}: "Hallo {name}",
+			{true, ""}:  "Guten Tag, {name}",
+		},
+		msgGreetingTimes: {
+			{false, "one"}:   "Hallo {name}, {count} Mal",
+			{false, "other"}: "Hallo {name}, {count} Mal",
+			{true, "one"}:    "Guten Tag, {name}, {count} Mal",
+			{true, "other"}:  "Guten Tag, {name}, {count} Mal",
+		},
+		msgGreetedCount: {
+			{false, "one"}:   "{count} Person begrüßt",
+			{false, "other"}: "{count} Personen begrüßt",
+		},
+	},
+	"es": {
+		msgGreeting: {
+			{false, ""}: "Hola {name}",
+			{true, ""}:  "Buenos días, {name}",
+		},
+		msgGreetingTimes: {
+			{false, "one"}:   "Hola {name}, {count} vez",
+			{false, "other"}: "Hola {name}, {count} veces",
+			{true, "one"}:    "Buenos días, {name}, {count} vez",
+			{true, "other"}:  "Buenos días, {name}, {count} veces",
+		},
+		msgGreetedCount: {
+			{false, "one"}:   "{count} persona saludada",
+			{false, "other"}: "{count} personas saludadas",
+		},
+	},
+	"pt": {
+		msgGreeting: {
+			{false, ""}: "Olá {name}",
+			{true, ""}:  "Bom dia, {name}",
+		},
+		msgGreetingTimes: {
+			{false, "one"}:   "Olá {name}, {count} vez",
+			{false, "other"}: "Olá {name}, {count} vezes",
+			{true, "one"}:    "Bom dia, {name}, {count} vez",
+			{true, "other"}:  "Bom dia, {name}, {count} vezes",
+		},
+		msgGreetedCount: {
+			{false, "one"}:   "{count} pessoa cumprimentada",
+			{false, "other"}: "{count} pessoas cumprimentadas",
+		},
+	},
+	"pt-BR": {
+		msgGreeting: {
+			{false, ""}: "Oi {name}",
+		},
+	},
+	"ja": {
+		msgGreeting: {
+			{false, ""}: "こんにちは、{name}さん",
+			{true, ""}:  "{name}様、こんにちは",
+		},
+		msgGreetingTimes: {
+			{false, "other"}: "こんにちは、{name}さん（{count}回目）",
+			{true, "other"}:  "{name}様、こんにちは（{count}回目）",
+		},
+		msgGreetedCount: {
+			{false, "other"}: "{count}人にあいさつしました",
+		},
+	},
+}
+
+// pluralCategory returns the CLDR plural category of n for the languages in the catalog.
+func pluralCategory(locale string, n int) string {
+	switch baseLanguage(locale) {
+	case "ja":
+		return "other"
+	case "fr":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+	default:
+		if n == 1 {
+			return "one"
+		}
+	}
+	return "other"
+}
+
+func baseLanguage(locale string) string {
+	return strings.ToLower(strings.SplitN(locale, "-", 2)[0])
+}
+
+// requestedLocales returns the locales asked for by a greeting or, without one, by the request
+// metadata, most preferred first.
+func requestedLocales(ctx context.Context, greeting *greetpb.Greeting) []string {
+	if greeting.GetLocale() != "" {
+		return []string{greeting.GetLocale()}
+	}
+
+	var locales []string
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(localeMetadataKey) {
+		for _, l := range strings.Split(v, ",") {
+			// Accept-Language style weights are ignored, the order is the preference.
+			l = strings.TrimSpace(strings.SplitN(l, ";", 2)[0])
+			if l != "" {
+				locales = append(locales, strings.ReplaceAll(l, "_", "-"))
+			}
+		}
+	}
+	return locales
+}
+
+// fallbackChain returns the catalog locales to try for a message, e.g. "fr-CA", "fr", "en" for
+// "fr-CA". Subtags are dropped from the end of each requested locale in turn.
+func fallbackChain(requested []string) []string {
+	var chain []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		for locale := range catalog {
+			if strings.EqualFold(locale, tag) && !seen[locale] {
+				seen[locale] = true
+				chain = append(chain, locale)
+			}
+		}
+	}
+
+	for _, tag := range requested {
+		for tag != "" {
+			add(tag)
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	add(defaultLocale)
+	return chain
+}
+
+// displayName is the name used by greetings, with the last name in formal ones.
+func displayName(greeting *greetpb.Greeting) string {
+	if greeting.GetFormality() == greetpb.Formality_FORMALITY_FORMAL {
+		return strings.TrimSpace(greeting.GetFirstName() + " " + greeting.GetLastName())
+	}
+	return greeting.GetFirstName()
+}
+
+// localize renders a message in the first locale of chain that has it and returns that locale.
+func localize(chain []string, id string, formal bool, count int, name string) (string, string) {
+	for _, locale := range chain {
+		templates, ok := catalog[locale][id]
+		if !ok {
+			continue
+		}
+
+		plural := ""
+		if strings.Contains(templates[variant{false, "other"}], "{count}") {
+			plural = pluralCategory(locale, count)
+		}
+		for _, v := range []variant{{formal, plural}, {formal, "other"}, {false, plural}, {false, "other"}} {
+			if tmpl, ok := templates[v]; ok {
+				r := strings.NewReplacer("{name}", name, "{count}", strconv.Itoa(count))
+				return r.Replace(tmpl), locale
+			}
+		}
+	}
+	return "", ""
+}
+
+// greet renders a message for a greeting in the best locale requested by it or the request.
+func greet(ctx context.Context, greeting *greetpb.Greeting, id string, count int) (string, string) {
+	chain := fallbackChain(requestedLocales(ctx, greeting))
+	formal := greeting.GetFormality() == greetpb.Formality_FORMALITY_FORMAL
+	return localize(chain, id, formal, count, displayName(greeting))
+}
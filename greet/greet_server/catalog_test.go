@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go-grpc-course/greet/greetpb"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestFallbackChain(t *testing.T) {
+	tests := []struct {
+		requested []string
+		want      []string
+	}{
+		{nil, []string{"en"}},
+		{[]string{"en"}, []string{"en"}},
+		{[]string{"fr-CA"}, []string{"fr-CA", "fr", "en"}},
+		{[]string{"FR-ca"}, []string{"fr-CA", "fr", "en"}},
+		{[]string{"fr-BE"}, []string{"fr", "en"}},
+		{[]string{"pt-BR-x-private"}, []string{"pt-BR", "pt", "en"}},
+		{[]string{"de-CH", "fr-CA"}, []string{"de", "fr-CA", "fr", "en"}},
+		{[]string{"fr", "fr-CA"}, []string{"fr", "fr-CA", "en"}},
+		{[]string{"nl", "xx-YY"}, []string{"en"}},
+		{[]string{""}, []string{"en"}},
+	}
+
+	for _, tt := range tests {
+		if got := fallbackChain(tt.requested); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fallbackChain(%q) = %q, want %q", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestPluralCategory(t *testing.T) {
+	tests := []struct {
+		locale string
+		n      int
+		want   string
+	}{
+		{"en", 0, "other"},
+		{"en", 1, "one"},
+		{"en", 2, "other"},
+		{"fr", 0, "one"},
+		{"fr-CA", 1, "one"},
+		{"fr", 2, "other"},
+		{"ja", 1, "other"},
+		{"pt-BR", 1, "one"},
+	}
+
+	for _, tt := range tests {
+		if got := pluralCategory(tt.locale, tt.n); got != tt.want {
+			t.Errorf("pluralCategory(%q, %d) = %q, want %q", tt.locale, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	tests := []struct {
+		name       string
+		chain      []string
+		id         string
+		formal     bool
+		count      int
+		want       string
+		wantLocale string
+	}{
+		{"informal", []string{"en"}, msgGreeting, false, 0, "Hello Ada", "en"},
+		{"formal", []string{"de", "en"}, msgGreeting, true, 0, "Guten Tag, Ada", "de"},
+		{"regional", []string{"fr-CA", "fr", "en"}, msgGreeting, false, 0, "Allô Ada", "fr-CA"},
+		{"formal falls back to informal", []string{"fr-CA", "fr", "en"}, msgGreeting, true, 0, "Allô Ada", "fr-CA"},
+		{"missing message falls back to parent", []string{"fr-CA", "fr", "en"}, msgGreetedCount, false, 3, "3 personnes saluées", "fr"},
+		{"plural one", []string{"en"}, msgGreetingTimes, false, 1, "Hello Ada, 1 time", "en"},
+		{"plural other", []string{"en"}, msgGreetingTimes, true, 2, "Good day, Ada, greeted 2 times", "en"},
+		{"french zero is one", []string{"fr"}, msgGreetedCount, false, 0, "0 personne saluée", "fr"},
+		{"only other", []string{"ja"}, msgGreetedCount, false, 1, "1人にあいさつしました", "ja"},
+		{"formal count falls back to informal", []string{"es"}, msgGreetedCount, true, 1, "1 persona saludada", "es"},
+		{"unknown message", []string{"en"}, "nope", false, 0, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, locale := localize(tt.chain, tt.id, tt.formal, tt.count, "Ada")
+			if got != tt.want || locale != tt.wantLocale {
+				t.Errorf("localize = %q, %q, want %q, %q", got, locale, tt.want, tt.wantLocale)
+			}
+		})
+	}
+}
+
+func TestGreetLocale(t *testing.T) {
+	tests := []struct {
+		name       string
+		greeting   *greetpb.Greeting
+		metadata   []string
+		want       string
+		wantLocale string
+	}{
+		{"default", &greetpb.Greeting{FirstName: "Ada"}, nil, "Hello Ada", "en"},
+		{"greeting locale", &greetpb.Greeting{FirstName: "Ada", Locale: "es-MX"}, []string{"de"}, "Hola Ada", "es"},
+		{"metadata locales", &greetpb.Greeting{FirstName: "Ada"}, []string{"nl;q=0.9, pt_BR"}, "Oi Ada", "pt-BR"},
+		{
+			"formal uses the last name",
+			&greetpb.Greeting{FirstName: "Ada", LastName: "Lovelace", Formality: greetpb.Formality_FORMALITY_FORMAL},
+			[]string{"fr"}, "Bonjour Ada Lovelace", "fr",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.metadata != nil {
+				md := metadata.MD{}
+				md.Append(localeMetadataKey, tt.metadata...)
+				ctx = metadata.NewIncomingContext(ctx, md)
+			}
+			got, locale := greet(ctx, tt.greeting, msgGreeting, 0)
+			if got != tt.want || locale != tt.wantLocale {
+				t.Errorf("greet = %q, %q, want %q, %q", got, locale, tt.want, tt.wantLocale)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of month, month and day
+// of week (0 or 7 is Sunday). Fields accept *, numbers, ranges a-b, steps */n or a-b/n, and
+// comma separated lists of those. As in cron, when both day fields are restricted a day matching
+// either one fires.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	loc                           *time.Location
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCron parses an expression evaluated in the time zone loc.
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %v", cronFields[i].name, f, err)
+		}
+		bits[i] = b
+	}
+
+	s := &cronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+		loc:     loc,
+	}
+	// Sunday may be written 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", part[i+1:])
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", bounds[1])
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("values must be within %d-%d", min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the schedule fires. It fails when the schedule never fires
+// (e.g. on February 30th).
+//
+// The search moves forward in absolute time, so daylight saving changes cannot stall it: a wall
+// clock time skipped by a gap does not fire that day, and one repeated when clocks go back fires
+// only on its first occurrence.
+func (s *cronSchedule) next(t time.Time) (time.Time, error) {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	// Five years cover every combination of weekday and leap day.
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		var step time.Time
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			step = s.jump(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc))
+		case !s.dayMatches(t):
+			step = s.jump(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc))
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			step = nextHour(t)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			step = t.Add(time.Minute)
+		case repeatedWallClock(t):
+			step = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+
+		if !step.After(t) {
+			return time.Time{}, fmt.Errorf("cannot move past %v", t)
+		}
+		t = step
+	}
+	return time.Time{}, fmt.Errorf("never fires")
+}
+
+// nextHour returns the start of the hour after t, moving in absolute time.
+func nextHour(t time.Time) time.Time {
+	return t.Add(time.Duration(60-t.Minute()) * time.Minute)
+}
+
+// jump returns to, the start of a later day or month, unless that midnight does not exist in the
+// time zone and normalizes to a time not after t. It then moves to the next hour instead.
+func (s *cronSchedule) jump(t, to time.Time) time.Time {
+	if to.After(t) {
+		return to
+	}
+	return nextHour(t)
+}
+
+// repeatedWallClock reports whether the wall clock time of t already happened an hour earlier,
+// when clocks went back.
+func repeatedWallClock(t time.Time) bool {
+	earlier := t.Add(-time.Hour)
+	return earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute() && earlier.Day() == t.Day()
+}
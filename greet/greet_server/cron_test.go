@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		zone string
+		from string
+		want []string // successive runs, in UTC
+	}{
+		{
+			name: "every 15 minutes",
+			expr: "*/15 * * * *",
+			zone: "UTC",
+			from: "2026-10-19T12:07:00Z",
+			want: []string{"2026-10-19T12:15:00Z", "2026-10-19T12:30:00Z"},
+		},
+		{
+			name: "weekdays skip the weekend",
+			expr: "0 9 * * 1-5",
+			zone: "America/New_York",
+			from: "2026-10-23T14:00:00Z",
+			want: []string{"2026-10-26T13:00:00Z"},
+		},
+		{
+			name: "sunday written 7",
+			expr: "0 0 * * 7",
+			zone: "UTC",
+			from: "2026-10-19T00:00:00Z",
+			want: []string{"2026-10-25T00:00:00Z", "2026-11-01T00:00:00Z"},
+		},
+		{
+			name: "day of month or day of week",
+			expr: "0 12 13 * 5",
+			zone: "UTC",
+			from: "2027-01-09T00:00:00Z",
+			want: []string{"2027-01-13T12:00:00Z", "2027-01-15T12:00:00Z"},
+		},
+		{
+			name: "birthday",
+			expr: "0 9 14 3 *",
+			zone: "UTC",
+			from: "2026-10-19T00:00:00Z",
+			want: []string{"2027-03-14T09:00:00Z", "2028-03-14T09:00:00Z"},
+		},
+		{
+			name: "half hour offset",
+			expr: "30 * * * *",
+			zone: "Asia/Kolkata",
+			from: "2026-10-19T00:10:00Z",
+			want: []string{"2026-10-19T01:00:00Z"},
+		},
+		{
+			name: "hour after a DST gap",
+			expr: "0 9 * * *",
+			zone: "America/New_York",
+			from: "2026-03-08T06:30:00Z", // 01:30 EST
+			want: []string{"2026-03-08T13:00:00Z"},
+		},
+		{
+			name: "time inside a DST gap is skipped",
+			expr: "30 2 * * *",
+			zone: "America/New_York",
+			from: "2026-03-08T05:00:00Z", // 00:00 EST
+			want: []string{"2026-03-09T06:30:00Z"},
+		},
+		{
+			name: "repeated DST hour fires once",
+			expr: "30 1 * * *",
+			zone: "America/New_York",
+			from: "2026-11-01T04:00:00Z", // 00:00 EDT
+			want: []string{"2026-11-01T05:30:00Z", "2026-11-02T06:30:00Z"},
+		},
+		{
+			name: "midnight skipped by DST",
+			expr: "30 0 * * *",
+			zone: "America/Santiago",
+			from: "2026-09-05T16:00:00Z", // 12:00 -04
+			want: []string{"2026-09-07T03:30:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := parseCron(tt.expr, loc)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+
+			at, _ := time.Parse(time.RFC3339, tt.from)
+			for _, want := range tt.want {
+				at, err = s.next(at)
+				if err != nil {
+					t.Fatalf("next: %v", err)
+				}
+				if got := at.UTC().Format(time.RFC3339); got != want {
+					t.Fatalf("next = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCronNeverFires(t *testing.T) {
+	s, err := parseCron("0 0 30 2 *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next, err := s.next(time.Now()); err == nil {
+		t.Fatalf("next = %v, want an error", next)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-grpc-course/greet/greetpb"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+	// maxHistoryResult is the longest greeting text recorded, longer ones are truncated. With
+	// the name limits it bounds the length of a history line.
+	maxHistoryResult = 4096
+	// maxHistoryLine is the longest line read back from a history file.
+	maxHistoryLine = 1 << 20
+)
+
+// historyMaxRecords is the number of greetings kept, older ones are forgotten. It is set with
+// --history-max-records.
+var historyMaxRecords = 100000
+
+// historyRecord is a greeting kept in the history.
+type historyRecord struct {
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name,omitempty"`
+	Method    string    `json:"method"`
+	Result    string    `json:"result"`
+	Locale    string    `json:"locale,omitempty"`
+	GreetedAt time.Time `json:"greeted_at"`
+}
+
+// historyStore keeps the greetings produced by the server.
+type historyStore interface {
+	add(rec historyRecord) error
+	// query returns the records of a first name (any when empty) greeted in [from, to), most
+	// recent first. Zero times leave the range open.
+	query(firstName string, from, to time.Time, limit int) ([]historyRecord, error)
+	// counts returns the number of records per first name greeted in [from, to).
+	counts(from, to time.Time) (map[string]int64, error)
+}
+
+// history is the store used by the server, selected with --history-store.
+var history historyStore = newMemoryHistory()
+
+// inRange reports whether t is in [from, to), zero bounds being open.
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// memoryHistory keeps the last historyMaxRecords records in memory, oldest first. It is lost
+// when the server stops.
+type memoryHistory struct {
+	mu      sync.RWMutex
+	records []historyRecord
+}
+
+func newMemoryHistory() *memoryHistory {
+	return &memoryHistory{}
+}
+
+func (h *memoryHistory) add(rec historyRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, rec)
+	if n := len(h.records); n > historyMaxRecords {
+		// append copies only the records kept when it grows the slice, so memory stays bounded.
+		h.records = h.records[n-historyMaxRecords:]
+	}
+	return nil
+}
+
+func (h *memoryHistory) query(firstName string, from, to time.Time, limit int) ([]historyRecord, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var result []historyRecord
+	for i := len(h.records) - 1; i >= 0 && len(result) < limit; i-- {
+		rec := h.records[i]
+		if (firstName == "" || strings.EqualFold(rec.FirstName, firstName)) && inRange(rec.GreetedAt, from, to) {
+			result = append(result, rec)
+		}
+	}
+	return result, nil
+}
+
+func (h *memoryHistory) counts(from, to time.Time) (map[string]int64, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	counts := map[string]int64{}
+	for _, rec := range h.records {
+		if inRange(rec.GreetedAt, from, to) {
+			counts[strings.ToLower(rec.FirstName)]++
+		}
+	}
+	return counts, nil
+}
+
+// fileHistory appends records to a JSON lines file and answers queries from memory. The file is
+// read back when the server starts, so the history survives restarts. Once it holds twice
+// historyMaxRecords lines, it is rewritten with the records kept.
+type fileHistory struct {
+	*memoryHistory
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	lines int
+}
+
+func openFileHistory(path string) (*fileHistory, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open history file: %v", err)
+	}
+
+	h := &fileHistory{memoryHistory: newMemoryHistory(), path: path, file: file}
+	if err := h.readBack(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// readBack loads the records of the file. A last line without its newline was torn by a crash
+// and is cut off; other unreadable lines are skipped.
+func (h *fileHistory) readBack() error {
+	reader := bufio.NewReaderSize(h.file, maxHistoryLine)
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := reader.ReadSlice('\n')
+		n := int64(len(data))
+		oversized := err == bufio.ErrBufferFull
+		for err == bufio.ErrBufferFull {
+			data, err = reader.ReadSlice('\n')
+			n += int64(len(data))
+		}
+
+		if err == io.EOF {
+			if n > 0 {
+				fmt.Printf("Cutting off torn line %d of history file %v\n", line, h.path)
+				if err := h.file.Truncate(offset); err != nil {
+					return fmt.Errorf("cannot repair history file: %v", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read history file: %v", err)
+		}
+		offset += n
+		h.lines++
+
+		if oversized {
+			fmt.Printf("Skipping line %d of history file %v: longer than %d bytes\n", line, h.path, maxHistoryLine)
+			continue
+		}
+		var rec historyRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			fmt.Printf("Skipping line %d of history file %v: %v\n", line, h.path, err)
+			continue
+		}
+		h.memoryHistory.add(rec)
+	}
+}
+
+func (h *fileHistory) add(rec historyRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	h.lines++
+	h.memoryHistory.add(rec)
+
+	if h.lines > 2*historyMaxRecords {
+		if err := h.compact(); err != nil {
+			fmt.Printf("Cannot compact history file %v: %v\n", h.path, err)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the file with the records kept in memory. Must be called with mu held.
+func (h *fileHistory) compact() error {
+	h.memoryHistory.mu.RLock()
+	var buf []byte
+	for _, rec := range h.memoryHistory.records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			h.memoryHistory.mu.RUnlock()
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	lines := len(h.memoryHistory.records)
+	h.memoryHistory.mu.RUnlock()
+
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	h.file.Close()
+	h.file = file
+	h.lines = lines
+	return nil
+}
+
+// truncateResult cuts a greeting text to maxHistoryResult bytes without splitting a character.
+func truncateResult(result string) string {
+	if len(result) <= maxHistoryResult {
+		return result
+	}
+	cut := maxHistoryResult
+	for cut > 0 && !utf8.RuneStart(result[cut]) {
+		cut--
+	}
+	return result[:cut]
+}
+
+// recordGreeting adds a greeting to the history. A failure is logged, the greeting itself was
+// already produced.
+func recordGreeting(method string, greeting *greetpb.Greeting, result, locale string) {
+	err := history.add(historyRecord{
+		FirstName: greeting.GetFirstName(),
+		LastName:  greeting.GetLastName(),
+		Method:    method,
+		Result:    truncateResult(result),
+		Locale:    locale,
+		GreetedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		fmt.Printf("Cannot record greeting of %v: %v\n", greeting.GetFirstName(), err)
+	}
+}
+
+// historyRange parses an RFC 3339 time range, empty bounds being open.
+func historyRange(from, to string) (time.Time, time.Time, error) {
+	var bounds [2]time.Time
+	for i, value := range []string{from, to} {
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Cannot parse time %q, expected RFC 3339", value),
+			)
+		}
+		bounds[i] = t
+	}
+	return bounds[0], bounds[1], nil
+}
+
+func (*server) QueryHistory(ctx context.Context, req *greetpb.QueryHistoryRequest) (*greetpb.QueryHistoryResponse, error) {
+	fmt.Printf("QueryHistory function was invoked with %v\n", req)
+
+	from, to, err := historyRange(req.GetFrom(), req.GetTo())
+	if err != nil {
+		return nil, err
+	}
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	records, err := history.query(strings.TrimSpace(req.GetFirstName()), from, to, limit)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot query greeting history: %v", err),
+		)
+	}
+
+	res := &greetpb.QueryHistoryResponse{}
+	for _, rec := range records {
+		res.Entries = append(res.Entries, &greetpb.HistoryEntry{
+			FirstName: rec.FirstName,
+			LastName:  rec.LastName,
+			Method:    rec.Method,
+			Result:    rec.Result,
+			Locale:    rec.Locale,
+			GreetedAt: rec.GreetedAt.Format(time.RFC3339),
+		})
+	}
+	return res, nil
+}
+
+func (*server) GreetingCounts(ctx context.Context, req *greetpb.GreetingCountsRequest) (*greetpb.GreetingCountsResponse, error) {
+	fmt.Printf("GreetingCounts function was invoked with %v\n", req)
+
+	from, to, err := historyRange(req.GetFrom(), req.GetTo())
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := history.counts(from, to)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot count greetings: %v", err),
+		)
+	}
+
+	res := &greetpb.GreetingCountsResponse{}
+	for name, n := range counts {
+		res.Counts = append(res.Counts, &greetpb.NameCount{FirstName: name, Count: n})
+	}
+	sort.Slice(res.Counts, func(i, j int) bool {
+		a, b := res.Counts[i], res.Counts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.FirstName < b.FirstName
+	})
+	return res, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileHistoryRepairsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	good := `{"first_name":"Ann","method":"Greet","result":"Hello Ann","greeted_at":"2026-10-19T10:00:00Z"}` + "\n"
+	long := `{"first_name":"Bo","method":"Greet","result":"` + strings.Repeat("x", maxHistoryLine) + `"}` + "\n"
+	bad := "not json\n"
+	torn := `{"first_name":"Cy","meth`
+	if err := os.WriteFile(path, []byte(good+long+bad+good+torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := openFileHistory(path)
+	if err != nil {
+		t.Fatalf("openFileHistory: %v", err)
+	}
+	if got := len(h.records); got != 2 {
+		t.Fatalf("read back %d records, want 2", got)
+	}
+
+	if err := h.add(historyRecord{FirstName: "Di", Method: "Greet", GreetedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	h.file.Close()
+
+	h, err = openFileHistory(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer h.file.Close()
+	if got := len(h.records); got != 3 || h.records[2].FirstName != "Di" {
+		t.Fatalf("after repair read back %v", h.records)
+	}
+}
+
+func TestFileHistoryKeepsMaxRecords(t *testing.T) {
+	defer func(n int) { historyMaxRecords = n }(historyMaxRecords)
+	historyMaxRecords = 3
+
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	h, err := openFileHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"A", "B", "C", "D", "E", "F", "G"} {
+		if err := h.add(historyRecord{FirstName: name, GreetedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.file.Close()
+
+	recs, _ := h.query("", time.Time{}, time.Time{}, 10)
+	if len(recs) != 3 || recs[0].FirstName != "G" || recs[2].FirstName != "E" {
+		t.Fatalf("query = %v, want G, F, E", recs)
+	}
+
+	// The file was compacted when it went past twice the cap.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > 2*historyMaxRecords {
+		t.Fatalf("history file has %d lines, want at most %d", lines, 2*historyMaxRecords)
+	}
+}
+
+func TestTruncateResult(t *testing.T) {
+	long := strings.Repeat("é", maxHistoryResult)
+	got := truncateResult(long)
+	if len(got) > maxHistoryResult || !strings.HasPrefix(long, got) || strings.ContainsRune(got, '�') {
+		t.Fatalf("truncateResult returned %d bytes", len(got))
+	}
+	if truncateResult("Hello") != "Hello" {
+		t.Fatal("short results must be kept")
+	}
+}
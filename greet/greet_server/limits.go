@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Limits of client streams, set with --stream-max-messages, --stream-max-bytes and
+// --stream-idle-timeout.
+var (
+	streamMaxMessages = 1000
+	streamMaxBytes    = 1 << 20
+	streamIdleTimeout = time.Minute
+)
+
+// limitedStream enforces the limits of a client stream. Once a limit is hit, every later RecvMsg
+// returns the same error.
+//
+// A single goroutine receives the client's messages, so a RecvMsg can give up on an idle stream
+// without leaving a receive behind it. The stream is idle when nothing was received from or sent
+// to the client for streamIdleTimeout, so a GreetEveryone participant that only listens to a busy
+// room stays connected.
+type limitedStream struct {
+	grpc.ServerStream
+	messages int
+	bytes    int
+	failed   error
+
+	start    sync.Once
+	received chan received
+	watchdog *time.Timer
+	idle     chan struct{}
+	idleOnce sync.Once
+}
+
+type received struct {
+	msg proto.Message
+	err error
+}
+
+func newLimitedStream(ss grpc.ServerStream) *limitedStream {
+	s := &limitedStream{
+		ServerStream: ss,
+		received:     make(chan received),
+		idle:         make(chan struct{}),
+	}
+	s.watchdog = time.AfterFunc(streamIdleTimeout, func() {
+		s.idleOnce.Do(func() { close(s.idle) })
+	})
+	return s
+}
+
+// active postpones the idle timeout. Once the stream went idle, it stays so.
+func (s *limitedStream) active() {
+	s.watchdog.Reset(streamIdleTimeout)
+}
+
+// receive runs in the receiving goroutine, until the stream fails or its handler returns.
+func (s *limitedStream) receive(mt protoreflect.MessageType) {
+	ctx := s.ServerStream.Context()
+	for {
+		msg := mt.New().Interface()
+		err := s.ServerStream.RecvMsg(msg)
+		select {
+		case s.received <- received{msg, err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if s.failed != nil {
+		return s.failed
+	}
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return s.ServerStream.RecvMsg(m)
+	}
+	s.start.Do(func() {
+		mt := msg.ProtoReflect().Type()
+		go s.receive(mt)
+	})
+
+	select {
+	case r := <-s.received:
+		if r.err != nil {
+			s.failed = r.err
+			return r.err
+		}
+		proto.Reset(msg)
+		proto.Merge(msg, r.msg)
+	case <-s.idle:
+		s.failed = status.Errorf(
+			codes.DeadlineExceeded,
+			fmt.Sprintf("Nothing received or sent for %v", streamIdleTimeout),
+		)
+		return s.failed
+	}
+	s.active()
+
+	s.messages++
+	s.bytes += proto.Size(msg)
+	if s.messages > streamMaxMessages {
+		s.failed = status.Errorf(
+			codes.ResourceExhausted,
+			fmt.Sprintf("A stream may send at most %d messages", streamMaxMessages),
+		)
+	} else if s.bytes > streamMaxBytes {
+		s.failed = status.Errorf(
+			codes.ResourceExhausted,
+			fmt.Sprintf("A stream may send at most %d bytes", streamMaxBytes),
+		)
+	}
+	return s.failed
+}
+
+func (s *limitedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.active()
+	}
+	return err
+}
+
+// streamLimitInterceptor applies the stream limits to the methods receiving client streams,
+// LongGreet and GreetEveryone.
+func streamLimitInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !info.IsClientStream {
+		return handler(srv, ss)
+	}
+	s := newLimitedStream(ss)
+	defer s.watchdog.Stop()
+	return handler(srv, s)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"go-grpc-course/greet/greetpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeStream is a client stream fed from a channel.
+type fakeStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	in  chan *greetpb.LongGreetRequest
+}
+
+func (f *fakeStream) Context() context.Context    { return f.ctx }
+func (f *fakeStream) SendMsg(m interface{}) error { return nil }
+
+func (f *fakeStream) RecvMsg(m interface{}) error {
+	select {
+	case req, ok := <-f.in:
+		if !ok {
+			return io.EOF
+		}
+		proto.Merge(m.(proto.Message), req)
+		return nil
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	}
+}
+
+func newFakeStream() (*fakeStream, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fakeStream{ctx: ctx, in: make(chan *greetpb.LongGreetRequest, 10)}, cancel
+}
+
+func TestLimitedStreamIdle(t *testing.T) {
+	defer func(d time.Duration) { streamIdleTimeout = d }(streamIdleTimeout)
+	streamIdleTimeout = 50 * time.Millisecond
+
+	f, cancel := newFakeStream()
+	defer cancel()
+	s := newLimitedStream(f)
+	defer s.watchdog.Stop()
+
+	// Sending keeps a stream that receives nothing alive.
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		s.SendMsg(&greetpb.GreetEveryoneResponse{})
+	}
+	f.in <- &greetpb.LongGreetRequest{Greeting: &greetpb.Greeting{FirstName: "Ann"}}
+	req := &greetpb.LongGreetRequest{}
+	if err := s.RecvMsg(req); err != nil || req.GetGreeting().GetFirstName() != "Ann" {
+		t.Fatalf("RecvMsg = %v, %v", req, err)
+	}
+
+	err := s.RecvMsg(&greetpb.LongGreetRequest{})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("RecvMsg on an idle stream = %v, want DeadlineExceeded", err)
+	}
+	if err2 := s.RecvMsg(&greetpb.LongGreetRequest{}); err2 != err {
+		t.Fatalf("RecvMsg after failing = %v, want %v", err2, err)
+	}
+}
+
+func TestLimitedStreamMessages(t *testing.T) {
+	defer func(n int) { streamMaxMessages = n }(streamMaxMessages)
+	streamMaxMessages = 2
+
+	f, cancel := newFakeStream()
+	defer cancel()
+	s := newLimitedStream(f)
+	defer s.watchdog.Stop()
+
+	for i := 0; i < 3; i++ {
+		f.in <- &greetpb.LongGreetRequest{Greeting: &greetpb.Greeting{FirstName: "Ann"}}
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.RecvMsg(&greetpb.LongGreetRequest{}); err != nil {
+			t.Fatalf("RecvMsg %d: %v", i, err)
+		}
+	}
+	if err := s.RecvMsg(&greetpb.LongGreetRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("RecvMsg over the limit = %v, want ResourceExhausted", err)
+	}
+}
+
+func TestLimitedStreamEOF(t *testing.T) {
+	f, cancel := newFakeStream()
+	defer cancel()
+	s := newLimitedStream(f)
+	defer s.watchdog.Stop()
+
+	close(f.in)
+	if err := s.RecvMsg(&greetpb.LongGreetRequest{}); err != io.EOF {
+		t.Fatalf("RecvMsg = %v, want io.EOF", err)
+	}
+}
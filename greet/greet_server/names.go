@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/greet/greetpb"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxNameLength is the longest first or last name accepted, in characters after
+	// normalization.
+	maxNameLength = 100
+	// maxNameBytes rejects huge names before they are normalized.
+	maxNameBytes = 1024
+)
+
+// nameParticles stay lower case inside a proper-cased name, e.g. "Ludwig van Beethoven".
+var nameParticles = map[string]bool{
+	"da": true, "das": true, "de": true, "del": true, "della": true, "der": true, "di": true,
+	"do": true, "dos": true, "du": true, "la": true, "le": true, "van": true, "von": true,
+}
+
+// normalizeName applies NFC, collapses white space and proper-cases a name typed in a single
+// case. Names in mixed case, such as "McDonald", are kept as typed.
+func normalizeName(name string) string {
+	name = strings.Join(strings.Fields(norm.NFC.String(name)), " ")
+	if name != strings.ToLower(name) && name != strings.ToUpper(name) {
+		return name
+	}
+
+	words := strings.Split(strings.ToLower(name), " ")
+	for i, w := range words {
+		if i > 0 && nameParticles[w] {
+			continue
+		}
+		// Every part of a hyphenated or apostrophized name is capitalized: Jean-Luc, O'Brien.
+		var b strings.Builder
+		start := true
+		for _, r := range w {
+			if start {
+				r = unicode.ToTitle(r)
+			}
+			b.WriteRune(r)
+			start = r == '-' || r == '\'' || r == '’'
+		}
+		words[i] = b.String()
+	}
+	return strings.Join(words, " ")
+}
+
+// checkName normalizes a name and returns the violation of field, nil when it is valid.
+func checkName(field, name string, required bool) (string, *errdetails.BadRequest_FieldViolation) {
+	tooLong := &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: fmt.Sprintf("must be at most %d characters", maxNameLength),
+	}
+	if len(name) > maxNameBytes {
+		return "", tooLong
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", &errdetails.BadRequest_FieldViolation{Field: field, Description: "must not contain control characters"}
+		}
+	}
+
+	name = normalizeName(name)
+	if required && name == "" {
+		return "", &errdetails.BadRequest_FieldViolation{Field: field, Description: "is required"}
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return "", tooLong
+	}
+	return name, nil
+}
+
+// normalizeGreeting validates and normalizes the names of a greeting in place. The error is an
+// InvalidArgument status with a BadRequest detail per invalid field, field names being prefixed
+// with the path of the greeting in the request.
+func normalizeGreeting(path string, greeting *greetpb.Greeting) error {
+	if greeting == nil {
+		return invalidFields([]*errdetails.BadRequest_FieldViolation{{Field: path, Description: "is required"}})
+	}
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	first, v := checkName(path+".first_name", greeting.GetFirstName(), true)
+	if v != nil {
+		violations = append(violations, v)
+	}
+	last, v := checkName(path+".last_name", greeting.GetLastName(), false)
+	if v != nil {
+		violations = append(violations, v)
+	}
+	if len(violations) > 0 {
+		return invalidFields(violations)
+	}
+
+	greeting.FirstName = first
+	greeting.LastName = last
+	return nil
+}
+
+func invalidFields(violations []*errdetails.BadRequest_FieldViolation) error {
+	var fields []string
+	for _, v := range violations {
+		fields = append(fields, v.Field+" "+v.Description)
+	}
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("Invalid greeting: %v", strings.Join(fields, ", ")))
+	if detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// normalizeRequest checks the greeting of any GreetService request carrying one.
+func normalizeRequest(req interface{}) error {
+	switch r := req.(type) {
+	case interface{ GetGreeting() *greetpb.Greeting }:
+		return normalizeGreeting("greeting", r.GetGreeting())
+	case *greetpb.CreateGreetingScheduleRequest:
+		return normalizeGreeting("schedule.greeting", r.GetSchedule().GetGreeting())
+	}
+	return nil
+}
+
+// validateUnaryInterceptor applies normalizeRequest to unary requests.
+func validateUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := normalizeRequest(req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// validatedStream applies normalizeRequest to every message received on a stream.
+type validatedStream struct {
+	grpc.ServerStream
+}
+
+func (s validatedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return normalizeRequest(m)
+}
+
+func validateStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, validatedStream{ss})
+}
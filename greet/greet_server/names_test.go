@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go-grpc-course/greet/greetpb"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"john", "John"},
+		{"JOHN", "John"},
+		{"  mary   ann\tsmith ", "Mary Ann Smith"},
+		{"ludwig van beethoven", "Ludwig van Beethoven"},
+		{"van gogh", "Van Gogh"},
+		{"jean-luc", "Jean-Luc"},
+		{"o'brien", "O'Brien"},
+		{"o’neil", "O’Neil"},
+		{"McDonald", "McDonald"},
+		{"de la Cruz", "de la Cruz"},
+		// "e" followed by a combining acute accent is composed into a single "é".
+		{"Rene\u0301", "Ren\u00e9"},
+		{"élodie", "Élodie"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		desc      string
+		name      string
+		required  bool
+		want      string
+		violation string
+	}{
+		{"valid", "ada lovelace", true, "Ada Lovelace", ""},
+		{"optional empty", "", false, "", ""},
+		{"required empty", "", true, "", "is required"},
+		{"required blank", "   ", true, "", "is required"},
+		{"control character", "ada\x00", true, "", "must not contain control characters"},
+		{"newline", "ada\nlovelace", true, "", "must not contain control characters"},
+		{"longest", strings.Repeat("a", maxNameLength), true, "A" + strings.Repeat("a", maxNameLength-1), ""},
+		{"too long", strings.Repeat("a", maxNameLength+1), true, "", "must be at most 100 characters"},
+		{"too long in bytes", strings.Repeat("a", maxNameBytes+1), false, "", "must be at most 100 characters"},
+		{"long once collapsed", strings.Repeat("a ", maxNameLength/2), true, strings.TrimSpace(strings.Repeat("A ", maxNameLength/2)), ""},
+		{"multi-byte characters", strings.Repeat("é", maxNameLength), true, "É" + strings.Repeat("é", maxNameLength-1), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, v := checkName("greeting.first_name", tt.name, tt.required)
+			if tt.violation == "" {
+				if v != nil {
+					t.Fatalf("checkName(%q) violation = %v, want none", tt.name, v)
+				}
+				if got != tt.want {
+					t.Errorf("checkName(%q) = %q, want %q", tt.name, got, tt.want)
+				}
+				return
+			}
+			if v == nil || v.Description != tt.violation || v.Field != "greeting.first_name" {
+				t.Errorf("checkName(%q) violation = %v, want %q", tt.name, v, tt.violation)
+			}
+		})
+	}
+}
+
+func TestNormalizeGreeting(t *testing.T) {
+	greeting := &greetpb.Greeting{FirstName: " JOHN ", LastName: "von neumann"}
+	if err := normalizeGreeting("greeting", greeting); err != nil {
+		t.Fatal(err)
+	}
+	if greeting.GetFirstName() != "John" || greeting.GetLastName() != "Von Neumann" {
+		t.Errorf("normalized greeting = %v", greeting)
+	}
+
+	err := normalizeGreeting("schedule.greeting", &greetpb.Greeting{LastName: "a\tb\x07"})
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("code = %v, want InvalidArgument", st.Code())
+	}
+	var fields []string
+	for _, d := range st.Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, v := range br.GetFieldViolations() {
+				fields = append(fields, v.GetField())
+			}
+		}
+	}
+	if strings.Join(fields, ",") != "schedule.greeting.first_name,schedule.greeting.last_name" {
+		t.Errorf("violations on %v, want first_name and last_name", fields)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/greet/greetpb"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// watcherBuffer is the number of events queued for a WatchPresence stream before it is dropped
+// as too slow.
+const watcherBuffer = 64
+
+// idleTimeout is how long a streaming client may go without a message before it is shown as
+// idle. It is set with --presence-idle-timeout.
+var idleTimeout = 2 * time.Minute
+
+// presence tracks the clients connected to GreetEveryone and GreetManyTimes.
+var presence = &presenceTracker{
+	sessions: map[string]*presenceSession{},
+	watchers: map[*presenceWatcher]bool{},
+}
+
+type presenceTracker struct {
+	mu       sync.Mutex
+	nextID   int64
+	sessions map[string]*presenceSession
+	watchers map[*presenceWatcher]bool
+}
+
+// presenceSession is one connected stream. Its fields are guarded by presenceTracker.mu.
+type presenceSession struct {
+	entry      *greetpb.Presence
+	lastActive time.Time
+}
+
+type presenceWatcher struct {
+	out chan *greetpb.PresenceEvent
+	// dropped is closed when the watcher did not read its events fast enough.
+	dropped  chan struct{}
+	dropOnce sync.Once
+}
+
+func (w *presenceWatcher) send(ev *greetpb.PresenceEvent) {
+	select {
+	case w.out <- ev:
+	default:
+		w.dropOnce.Do(func() { close(w.dropped) })
+	}
+}
+
+// publish sends a copy of a session's state to every watcher. Must be called with mu held.
+func (t *presenceTracker) publish(s *presenceSession) {
+	s.entry.LastActiveAt = s.lastActive.UTC().Format(time.RFC3339)
+	ev := &greetpb.PresenceEvent{Presence: proto.Clone(s.entry).(*greetpb.Presence)}
+	for w := range t.watchers {
+		w.send(ev)
+	}
+}
+
+// connect registers a stream of the client named name and announces it online.
+func (t *presenceTracker) connect(ctx context.Context, name, method, room string) *presenceSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	now := time.Now()
+	s := &presenceSession{
+		entry: &greetpb.Presence{
+			SessionId:   strconv.FormatInt(t.nextID, 10),
+			Name:        name,
+			Method:      method,
+			Room:        room,
+			ConnectedAt: now.UTC().Format(time.RFC3339),
+			State:       greetpb.PresenceState_PRESENCE_STATE_ONLINE,
+		},
+		lastActive: now,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		s.entry.Peer = p.Addr.String()
+	}
+	t.sessions[s.entry.SessionId] = s
+	t.publish(s)
+	return s
+}
+
+// touch records activity of a session, bringing it back online when it was idle.
+func (t *presenceTracker) touch(s *presenceSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.lastActive = time.Now()
+	if s.entry.State == greetpb.PresenceState_PRESENCE_STATE_IDLE {
+		s.entry.State = greetpb.PresenceState_PRESENCE_STATE_ONLINE
+		t.publish(s)
+	}
+}
+
+// disconnect forgets a session and announces it offline.
+func (t *presenceTracker) disconnect(s *presenceSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.sessions, s.entry.SessionId)
+	s.entry.State = greetpb.PresenceState_PRESENCE_STATE_OFFLINE
+	t.publish(s)
+}
+
+// sweep shows the sessions without activity for idleTimeout as idle.
+func (t *presenceTracker) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.sessions {
+		if s.entry.State == greetpb.PresenceState_PRESENCE_STATE_ONLINE && now.Sub(s.lastActive) >= idleTimeout {
+			s.entry.State = greetpb.PresenceState_PRESENCE_STATE_IDLE
+			t.publish(s)
+		}
+	}
+}
+
+// runIdleSweeper checks for idle sessions a few times per idle timeout.
+func (t *presenceTracker) runIdleSweeper() {
+	interval := idleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		t.sweep(now)
+	}
+}
+
+// list returns the connected sessions, oldest first. Must be called with mu held.
+func (t *presenceTracker) list() []*greetpb.Presence {
+	var entries []*greetpb.Presence
+	for _, s := range t.sessions {
+		s.entry.LastActiveAt = s.lastActive.UTC().Format(time.RFC3339)
+		entries = append(entries, proto.Clone(s.entry).(*greetpb.Presence))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := strconv.ParseInt(entries[i].SessionId, 10, 64)
+		b, _ := strconv.ParseInt(entries[j].SessionId, 10, 64)
+		return a < b
+	})
+	return entries
+}
+
+func (*server) ListPresence(ctx context.Context, req *greetpb.ListPresenceRequest) (*greetpb.ListPresenceResponse, error) {
+	fmt.Printf("ListPresence function was invoked with %v\n", req)
+
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	return &greetpb.ListPresenceResponse{Presence: presence.list()}, nil
+}
+
+func (*server) WatchPresence(req *greetpb.WatchPresenceRequest, stream greetpb.GreetService_WatchPresenceServer) error {
+	fmt.Printf("WatchPresence function was invoked with %v\n", req)
+	ctx := stream.Context()
+
+	// The current sessions are queued under the same lock as the watcher is added, so no change
+	// is missed or sent before them.
+	w := &presenceWatcher{out: make(chan *greetpb.PresenceEvent, watcherBuffer), dropped: make(chan struct{})}
+	presence.mu.Lock()
+	current := presence.list()
+	presence.watchers[w] = true
+	presence.mu.Unlock()
+	defer func() {
+		presence.mu.Lock()
+		delete(presence.watchers, w)
+		presence.mu.Unlock()
+	}()
+
+	for _, entry := range current {
+		if err := stream.Send(&greetpb.PresenceEvent{Presence: entry}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case ev := <-w.out:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-w.dropped:
+			return status.Errorf(codes.ResourceExhausted, "Presence watcher does not read its events fast enough")
+		}
+	}
+}
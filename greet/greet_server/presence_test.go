@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-grpc-course/greet/greetpb"
+)
+
+func TestPresenceIdleSweep(t *testing.T) {
+	tracker := &presenceTracker{sessions: map[string]*presenceSession{}, watchers: map[*presenceWatcher]bool{}}
+	w := &presenceWatcher{out: make(chan *greetpb.PresenceEvent, watcherBuffer), dropped: make(chan struct{})}
+	tracker.watchers[w] = true
+
+	// states returns the states watched since the last call.
+	states := func() []greetpb.PresenceState {
+		var got []greetpb.PresenceState
+		for len(w.out) > 0 {
+			got = append(got, (<-w.out).GetPresence().GetState())
+		}
+		return got
+	}
+	online, idle, offline := greetpb.PresenceState_PRESENCE_STATE_ONLINE, greetpb.PresenceState_PRESENCE_STATE_IDLE, greetpb.PresenceState_PRESENCE_STATE_OFFLINE
+
+	s := tracker.connect(context.Background(), "Ada", "GreetEveryone", "lobby")
+	start := s.lastActive
+	tests := []struct {
+		name string
+		act  func()
+		want []greetpb.PresenceState
+	}{
+		{"connect", func() {}, []greetpb.PresenceState{online}},
+		{"active", func() { tracker.sweep(start.Add(idleTimeout - time.Second)) }, nil},
+		{"idle", func() { tracker.sweep(start.Add(idleTimeout)) }, []greetpb.PresenceState{idle}},
+		{"still idle", func() { tracker.sweep(start.Add(2 * idleTimeout)) }, nil},
+		{"back online", func() { tracker.touch(s) }, []greetpb.PresenceState{online}},
+		{"touch while online", func() { tracker.touch(s) }, nil},
+		{"idle again", func() { tracker.sweep(s.lastActive.Add(idleTimeout)) }, []greetpb.PresenceState{idle}},
+		{"disconnect", func() { tracker.disconnect(s) }, []greetpb.PresenceState{offline}},
+		{"gone", func() { tracker.sweep(start.Add(3 * idleTimeout)) }, nil},
+	}
+
+	for _, tt := range tests {
+		tt.act()
+		if got := states(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: watched %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if len(tracker.list()) != 0 {
+		t.Errorf("sessions left: %v", tracker.list())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"go-grpc-course/greet/greetpb"
+	"regexp"
+	"sync"
+)
+
+const (
+	// participantBuffer is the number of events queued for a participant before it is dropped as
+	// too slow.
+	participantBuffer = 64
+	defaultRoom       = "lobby"
+)
+
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// greetRooms tracks the participants of every GreetEveryone room.
+var greetRooms = &roomHub{rooms: map[string][]*participant{}}
+
+type roomHub struct {
+	mu    sync.Mutex
+	rooms map[string][]*participant
+}
+
+type participant struct {
+	name string
+	room string
+	out  chan *greetpb.GreetEveryoneResponse
+	// dropped is closed when the participant did not read its events fast enough.
+	dropped  chan struct{}
+	dropOnce sync.Once
+}
+
+func newParticipant(name, room string) *participant {
+	return &participant{
+		name:    name,
+		room:    room,
+		out:     make(chan *greetpb.GreetEveryoneResponse, participantBuffer),
+		dropped: make(chan struct{}),
+	}
+}
+
+// send queues an event without blocking, dropping the participant when its queue is full. A slow
+// participant never holds back the rest of its room.
+func (p *participant) send(res *greetpb.GreetEveryoneResponse) {
+	select {
+	case p.out <- res:
+	default:
+		p.dropOnce.Do(func() { close(p.dropped) })
+	}
+}
+
+// roomName validates the room asked for by a request.
+func roomName(room string) (string, error) {
+	if room == "" {
+		return defaultRoom, nil
+	}
+	if !roomNamePattern.MatchString(room) {
+		return "", fmt.Errorf("invalid room name %q, expected 1 to 64 of A-Z, a-z, 0-9, _, . and -", room)
+	}
+	return room, nil
+}
+
+// broadcast sends an event to every participant of a room. Must be called with mu held.
+func (h *roomHub) broadcast(room string, res *greetpb.GreetEveryoneResponse) {
+	res.Room = room
+	res.Participants = int32(len(h.rooms[room]))
+	for _, p := range h.rooms[room] {
+		p.send(res)
+	}
+}
+
+// join adds p to its room and announces it to everyone there, p included.
+func (h *roomHub) join(p *participant) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.rooms[p.room] = append(h.rooms[p.room], p)
+	h.broadcast(p.room, &greetpb.GreetEveryoneResponse{Sender: p.name, Event: greetpb.RoomEvent_ROOM_EVENT_JOINED})
+}
+
+// leave removes p from its room and announces it to the participants left.
+func (h *roomHub) leave(p *participant) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	members := h.rooms[p.room]
+	for i, other := range members {
+		if other == p {
+			members = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(h.rooms, p.room)
+		return
+	}
+	h.rooms[p.room] = members
+	h.broadcast(p.room, &greetpb.GreetEveryoneResponse{Sender: p.name, Event: greetpb.RoomEvent_ROOM_EVENT_LEFT})
+}
+
+// post fans out a message of p to its room, p included.
+func (h *roomHub) post(p *participant, result, locale string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.broadcast(p.room, &greetpb.GreetEveryoneResponse{
+		Result: result,
+		Locale: locale,
+		Sender: p.name,
+		Event:  greetpb.RoomEvent_ROOM_EVENT_MESSAGE,
+	})
+}
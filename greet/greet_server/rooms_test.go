@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"go-grpc-course/greet/greetpb"
+)
+
+func TestRoomName(t *testing.T) {
+	tests := []struct {
+		room    string
+		want    string
+		wantErr bool
+	}{
+		{"", defaultRoom, false},
+		{"go-1.21_fans", "go-1.21_fans", false},
+		{"two words", "", true},
+		{"café", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := roomName(tt.room)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("roomName(%q) = %q, %v, want %q, error %v", tt.room, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// closed reports whether ch is closed.
+func closed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestRoomDropsSlowParticipant(t *testing.T) {
+	h := &roomHub{rooms: map[string][]*participant{}}
+	fast, slow, other := newParticipant("fast", "lobby"), newParticipant("slow", "lobby"), newParticipant("other", "den")
+	for _, p := range []*participant{fast, slow, other} {
+		h.join(p)
+	}
+
+	received := 0
+	for i := 0; i < participantBuffer*2; i++ {
+		h.post(fast, "Hello", "en")
+		for len(fast.out) > 0 {
+			<-fast.out
+			received++
+		}
+	}
+
+	if !closed(slow.dropped) {
+		t.Error("slow participant was not dropped")
+	}
+	if len(slow.out) != participantBuffer {
+		t.Errorf("slow participant has %d events queued, want %d", len(slow.out), participantBuffer)
+	}
+	if closed(fast.dropped) || received != participantBuffer*2+2 {
+		t.Errorf("fast participant received %d events, dropped = %v", received, closed(fast.dropped))
+	}
+	if closed(other.dropped) || len(other.out) != 1 {
+		t.Errorf("participant of another room has %d events queued", len(other.out))
+	}
+
+	h.leave(slow)
+	res := <-fast.out
+	if res.GetEvent() != greetpb.RoomEvent_ROOM_EVENT_LEFT || res.GetSender() != "slow" || res.GetParticipants() != 1 {
+		t.Errorf("after leave, fast received %v", res)
+	}
+	h.leave(fast)
+	if _, ok := h.rooms["lobby"]; ok {
+		t.Error("empty room kept")
+	}
+}
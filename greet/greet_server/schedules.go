@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-grpc-course/greet/greetpb"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// subscriberBuffer is the number of greetings queued for a SubscribeScheduledGreetings stream
+// before it is dropped as too slow.
+const subscriberBuffer = 64
+
+// scheduleFile stores the schedules so they survive restarts. It is set with --schedule-file.
+var scheduleFile = "greet_schedules.json"
+
+// schedules fires the greeting schedules and delivers them to subscribers.
+var schedules = &scheduler{
+	entries:     map[string]*scheduledEntry{},
+	subscribers: map[*scheduleSubscriber]bool{},
+	wake:        make(chan struct{}, 1),
+}
+
+// scheduleRecord is a schedule as stored in scheduleFile.
+type scheduleRecord struct {
+	ID        string          `json:"id"`
+	Greeting  json.RawMessage `json:"greeting"`
+	Cron      string          `json:"cron"`
+	TimeZone  string          `json:"time_zone,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type scheduledEntry struct {
+	spec *greetpb.GreetingSchedule
+	cron *cronSchedule
+	next time.Time
+}
+
+type scheduler struct {
+	mu          sync.Mutex
+	entries     map[string]*scheduledEntry
+	subscribers map[*scheduleSubscriber]bool
+	// wake tells run that the schedules changed.
+	wake chan struct{}
+}
+
+type scheduleSubscriber struct {
+	ids map[string]bool
+	out chan *greetpb.ScheduledGreeting
+	// dropped is closed when the subscriber did not read its greetings fast enough.
+	dropped  chan struct{}
+	dropOnce sync.Once
+}
+
+func (sub *scheduleSubscriber) send(g *greetpb.ScheduledGreeting) {
+	if len(sub.ids) > 0 && !sub.ids[g.ScheduleId] {
+		return
+	}
+	select {
+	case sub.out <- g:
+	default:
+		sub.dropOnce.Do(func() { close(sub.dropped) })
+	}
+}
+
+// newScheduledEntry validates a schedule and computes its next run after now.
+func newScheduledEntry(spec *greetpb.GreetingSchedule, now time.Time) (*scheduledEntry, error) {
+	if spec.GetGreeting().GetFirstName() == "" {
+		return nil, fmt.Errorf("a schedule needs a greeting with a first name")
+	}
+	// Templates are not stored, a templated schedule would fail to render after a restart.
+	if spec.GetGreeting().GetTemplate() != "" {
+		return nil, fmt.Errorf("a scheduled greeting cannot use a template")
+	}
+	loc, err := time.LoadLocation(spec.GetTimeZone())
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", spec.GetTimeZone())
+	}
+	cron, err := parseCron(spec.GetCron(), loc)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := cron.next(now)
+	if err != nil {
+		return nil, fmt.Errorf("cron expression %q %v", spec.GetCron(), err)
+	}
+	return &scheduledEntry{spec: spec, cron: cron, next: next}, nil
+}
+
+// snapshot returns a copy of the schedule with its next run. Must be called with mu held.
+func (e *scheduledEntry) snapshot() *greetpb.GreetingSchedule {
+	spec := proto.Clone(e.spec).(*greetpb.GreetingSchedule)
+	spec.NextRunAt = e.next.Format(time.RFC3339)
+	return spec
+}
+
+// load reads the stored schedules. A missing file means no schedules. Runs missed while the
+// server was stopped are skipped.
+func (s *scheduler) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read schedule file: %v", err)
+	}
+
+	var records []scheduleRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("cannot parse schedule file %v: %v", path, err)
+	}
+
+	now := time.Now()
+	entries := map[string]*scheduledEntry{}
+	for _, rec := range records {
+		greeting := &greetpb.Greeting{}
+		if err := protojson.Unmarshal(rec.Greeting, greeting); err != nil {
+			return fmt.Errorf("cannot parse greeting of schedule %v: %v", rec.ID, err)
+		}
+		entry, err := newScheduledEntry(&greetpb.GreetingSchedule{
+			Id:        rec.ID,
+			Greeting:  greeting,
+			Cron:      rec.Cron,
+			TimeZone:  rec.TimeZone,
+			CreatedAt: rec.CreatedAt.Format(time.RFC3339),
+		}, now)
+		if err != nil {
+			return fmt.Errorf("invalid schedule %v: %v", rec.ID, err)
+		}
+		entries[rec.ID] = entry
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, entry := range entries {
+		s.entries[id] = entry
+	}
+	return nil
+}
+
+// save writes every schedule to scheduleFile, replacing it atomically. Must be called with mu
+// held.
+func (s *scheduler) save() error {
+	records := []scheduleRecord{}
+	for _, e := range s.entries {
+		greeting, err := protojson.Marshal(e.spec.GetGreeting())
+		if err != nil {
+			return err
+		}
+		created, _ := time.Parse(time.RFC3339, e.spec.GetCreatedAt())
+		records = append(records, scheduleRecord{
+			ID:        e.spec.GetId(),
+			Greeting:  greeting,
+			Cron:      e.spec.GetCron(),
+			TimeZone:  e.spec.GetTimeZone(),
+			CreatedAt: created,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := scheduleFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, scheduleFile)
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fire delivers the greetings of the schedules due at now and moves them to their next run. The
+// next runs are computed and the greetings rendered without holding mu.
+func (s *scheduler) fire(now time.Time) {
+	s.mu.Lock()
+	var due []*scheduledEntry
+	for _, e := range s.entries {
+		if !e.next.After(now) {
+			due = append(due, e)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range due {
+		id := e.spec.GetId()
+		next, err := e.cron.next(now)
+		if err != nil {
+			// Cannot happen for a schedule accepted by newScheduledEntry, but a stuck schedule
+			// must not fire in a loop.
+			fmt.Printf("Cannot compute next run of schedule %v: %v\n", id, err)
+			next = now.Add(24 * time.Hour)
+		}
+
+		result, locale, renderErr := personalize(context.Background(), e.spec.GetGreeting(), msgGreeting, 0)
+
+		s.mu.Lock()
+		if s.entries[id] != e {
+			// Cancelled meanwhile.
+			s.mu.Unlock()
+			continue
+		}
+		firedAt := e.next
+		e.next = next
+		if renderErr == nil {
+			g := &greetpb.ScheduledGreeting{
+				ScheduleId: id,
+				Result:     result,
+				Locale:     locale,
+				FiredAt:    firedAt.UTC().Format(time.RFC3339),
+			}
+			for sub := range s.subscribers {
+				sub.send(g)
+			}
+		}
+		s.mu.Unlock()
+
+		if renderErr != nil {
+			fmt.Printf("Cannot render greeting of schedule %v: %v\n", id, renderErr)
+			continue
+		}
+		recordGreeting("ScheduledGreeting", e.spec.GetGreeting(), result, locale)
+	}
+}
+
+// run fires the schedules until the process exits.
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.mu.Lock()
+		wait := time.Hour
+		for _, e := range s.entries {
+			if d := time.Until(e.next); d < wait {
+				wait = d
+			}
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case now := <-timer.C:
+			s.fire(now)
+		case <-s.wake:
+		}
+	}
+}
+
+func (*server) CreateGreetingSchedule(ctx context.Context, req *greetpb.CreateGreetingScheduleRequest) (*greetpb.CreateGreetingScheduleResponse, error) {
+	fmt.Printf("CreateGreetingSchedule function was invoked with %v\n", req)
+
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot generate schedule ID: %v", err),
+		)
+	}
+
+	now := time.Now()
+	spec := &greetpb.GreetingSchedule{
+		Id:        hex.EncodeToString(raw),
+		Greeting:  req.GetSchedule().GetGreeting(),
+		Cron:      req.GetSchedule().GetCron(),
+		TimeZone:  req.GetSchedule().GetTimeZone(),
+		CreatedAt: now.UTC().Format(time.RFC3339),
+	}
+	entry, err := newScheduledEntry(spec, now)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Invalid schedule: %v", err))
+	}
+	// Render once so a bad greeting is reported now rather than when it fires.
+	if _, _, err := personalize(ctx, spec.GetGreeting(), msgGreeting, 0); err != nil {
+		return nil, err
+	}
+
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	schedules.entries[spec.Id] = entry
+	if err := schedules.save(); err != nil {
+		delete(schedules.entries, spec.Id)
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot store schedule: %v", err),
+		)
+	}
+	schedules.notify()
+
+	return &greetpb.CreateGreetingScheduleResponse{Schedule: entry.snapshot()}, nil
+}
+
+func (*server) ListGreetingSchedules(ctx context.Context, req *greetpb.ListGreetingSchedulesRequest) (*greetpb.ListGreetingSchedulesResponse, error) {
+	fmt.Printf("ListGreetingSchedules function was invoked with %v\n", req)
+
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+
+	res := &greetpb.ListGreetingSchedulesResponse{}
+	for _, e := range schedules.entries {
+		res.Schedules = append(res.Schedules, e.snapshot())
+	}
+	sort.Slice(res.Schedules, func(i, j int) bool {
+		a, b := res.Schedules[i], res.Schedules[j]
+		if a.NextRunAt != b.NextRunAt {
+			return a.NextRunAt < b.NextRunAt
+		}
+		return a.Id < b.Id
+	})
+	return res, nil
+}
+
+func (*server) CancelGreetingSchedule(ctx context.Context, req *greetpb.CancelGreetingScheduleRequest) (*greetpb.CancelGreetingScheduleResponse, error) {
+	fmt.Printf("CancelGreetingSchedule function was invoked with %v\n", req)
+
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+
+	entry, ok := schedules.entries[req.GetId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, fmt.Sprintf("Cannot find schedule %q", req.GetId()))
+	}
+	delete(schedules.entries, req.GetId())
+	if err := schedules.save(); err != nil {
+		schedules.entries[req.GetId()] = entry
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Cannot store schedules: %v", err),
+		)
+	}
+	schedules.notify()
+
+	return &greetpb.CancelGreetingScheduleResponse{}, nil
+}
+
+func (*server) SubscribeScheduledGreetings(req *greetpb.SubscribeScheduledGreetingsRequest, stream greetpb.GreetService_SubscribeScheduledGreetingsServer) error {
+	fmt.Printf("SubscribeScheduledGreetings function was invoked with %v\n", req)
+	ctx := stream.Context()
+
+	sub := &scheduleSubscriber{
+		ids:     map[string]bool{},
+		out:     make(chan *greetpb.ScheduledGreeting, subscriberBuffer),
+		dropped: make(chan struct{}),
+	}
+	for _, id := range req.GetScheduleIds() {
+		sub.ids[id] = true
+	}
+
+	schedules.mu.Lock()
+	for id := range sub.ids {
+		if _, ok := schedules.entries[id]; !ok {
+			schedules.mu.Unlock()
+			return status.Errorf(codes.NotFound, fmt.Sprintf("Cannot find schedule %q", id))
+		}
+	}
+	schedules.subscribers[sub] = true
+	schedules.mu.Unlock()
+	defer func() {
+		schedules.mu.Lock()
+		delete(schedules.subscribers, sub)
+		schedules.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case g := <-sub.out:
+			if err := stream.Send(g); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-sub.dropped:
+			return status.Errorf(codes.ResourceExhausted, "Subscriber does not read its greetings fast enough")
+		}
+	}
+}
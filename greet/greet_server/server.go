@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"go-grpc-course/config"
 	"go-grpc-course/greet/greetpb"
 	"io"
-	"strconv"
+	"os"
 	"time"
 
 	"log"
@@ -16,16 +18,30 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+const (
+	defaultGreetCount    = 10
+	maxGreetCount        = 100000
+	defaultGreetInterval = time.Second
+	minGreetInterval     = 10 * time.Millisecond
+	maxGreetInterval     = time.Hour
+	defaultDeadlineWork  = 3 * time.Second
+	maxDeadlineWork      = time.Minute
+)
+
 type server struct{}
 
 func (*server) Greet(ctx context.Context, req *greetpb.GreetRequest) (*greetpb.GreetResponse, error) {
 	fmt.Printf("Greet Function was involed with %v\n", req)
 	//We extract data from the input request and then we create an output response.
-	firstName := req.GetGreeting().GetFirstName()
-	result := "Hello " + firstName
+	result, locale, err := personalize(ctx, req.GetGreeting(), msgGreeting, 0)
+	if err != nil {
+		return nil, err
+	}
+	recordGreeting("Greet", req.GetGreeting(), result, locale)
 
 	res := &greetpb.GreetResponse{
 		Result: result,
+		Locale: locale,
 	}
 
 	return res, nil
@@ -33,14 +49,58 @@ func (*server) Greet(ctx context.Context, req *greetpb.GreetRequest) (*greetpb.G
 
 func (*server) GreetManyTimes(req *greetpb.GreetManyTimesRequest, stream greetpb.GreetService_GreetManyTimesServer) error {
 	fmt.Printf("GreetManyTimes function was invoked with %v\n", req)
-	firstName := req.Greeting.GetFirstName()
-	for i := 0; i < 10; i++ {
-		result := "Hello " + firstName + " number " + strconv.Itoa(i)
+	ctx := stream.Context()
+
+	count := req.GetCount()
+	if count == 0 {
+		count = defaultGreetCount
+	}
+	interval := time.Duration(req.GetIntervalMs()) * time.Millisecond
+	if req.GetIntervalMs() == 0 {
+		interval = defaultGreetInterval
+	}
+	if count > maxGreetCount || interval < minGreetInterval || interval > maxGreetInterval {
+		return status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Count must be at most %d and the interval between %v and %v", maxGreetCount, minGreetInterval, maxGreetInterval),
+		)
+	}
+	if req.GetResumeAfterSequence() > count {
+		return status.Errorf(
+			codes.OutOfRange,
+			fmt.Sprintf("Cannot resume after sequence %d of %d", req.GetResumeAfterSequence(), count),
+		)
+	}
+
+	session := presence.connect(ctx, req.GetGreeting().GetFirstName(), "GreetManyTimes", "")
+	defer presence.disconnect(session)
+
+	// The first greeting waits for the start offset, the others for the interval. A timer keeps
+	// cancellation prompt instead of sleeping through it.
+	timer := time.NewTimer(time.Duration(req.GetStartOffsetMs()) * time.Millisecond)
+	defer timer.Stop()
+	for seq := req.GetResumeAfterSequence() + 1; seq <= count; seq++ {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+		}
+
+		result, locale, err := personalize(ctx, req.GetGreeting(), msgGreetingTimes, int(seq))
+		if err != nil {
+			return err
+		}
 		res := &greetpb.GreetManyTimesResponse{
-			Result: result,
+			Result:   result,
+			Locale:   locale,
+			Sequence: seq,
 		}
-		stream.Send(res)
-		time.Sleep(1000 * time.Millisecond)
+		if err := stream.Send(res); err != nil {
+			fmt.Printf("GreetManyTimes stopped at sequence %d: %v\n", seq, err)
+			return err
+		}
+		presence.touch(session)
+		timer.Reset(interval)
 	}
 	return nil
 }
@@ -48,47 +108,120 @@ func (*server) GreetManyTimes(req *greetpb.GreetManyTimesRequest, stream greetpb
 func (*server) LongGreet(stream greetpb.GreetService_LongGreetServer) error {
 	fmt.Println("Long greet was invoked with a client stream request.....")
 	result := ""
+	count := 0
+	var last *greetpb.Greeting
 
 	for {
 		req, err := stream.Recv()
 
 		if err == io.EOF {
 			//Once client envokes stream.CloseAndRecv(), we'll hit EOF and then return the response and close the stream
+			summary, locale := greet(stream.Context(), last, msgGreetedCount, count)
 			return stream.SendAndClose(&greetpb.LongGreetResponse{
-				Result: result,
+				Result: result + summary,
+				Locale: locale,
 			})
 		}
 		if err != nil {
-			log.Fatal("Error while reading client stream: ", err)
+			fmt.Printf("Error while reading LongGreet stream: %v\n", err)
+			return err
 		}
 
-		firstName := req.Greeting.GetFirstName()
-		result += "Hello " + firstName + "! \n"
+		greeting, locale, err := personalize(stream.Context(), req.GetGreeting(), msgGreeting, 0)
+		if err != nil {
+			return err
+		}
+		recordGreeting("LongGreet", req.GetGreeting(), greeting, locale)
+		result += greeting + "! \n"
+		count++
+		last = req.GetGreeting()
 	}
 }
 
 func (*server) GreetEveryone(stream greetpb.GreetService_GreetEveryoneServer) error {
 	fmt.Println("GreetEveryone was invoked with a client stream request.....")
+	ctx := stream.Context()
 
-	for {
-		req, err := stream.Recv()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			log.Fatal("Error while reading client stream: ", err)
-			return err
-		}
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	//The first message joins a room, every message is then broadcast to all its participants
+	room, err := roomName(req.GetRoom())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	name := req.GetGreeting().GetFirstName()
+	if name == "" {
+		return status.Errorf(codes.InvalidArgument, "The first greeting of a room needs a first name")
+	}
 
-		firstName := req.Greeting.GetFirstName()
-		result := "Hello " + firstName + "! "
+	p := newParticipant(name, room)
+	greetRooms.join(p)
+	defer greetRooms.leave(p)
+	fmt.Printf("%v joined room %v\n", name, room)
+	session := presence.connect(ctx, name, "GreetEveryone", room)
+	defer presence.disconnect(session)
 
-		sendErr := stream.Send(&greetpb.GreetEveryoneResponse{
-			Result: result,
-		})
-		if sendErr != nil {
-			log.Fatal("Error while Sending data to client: ", err)
-			return err
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			if req.GetRoom() != "" && req.GetRoom() != room {
+				recvErr <- status.Errorf(
+					codes.InvalidArgument,
+					fmt.Sprintf("Already in room %v, open another stream to join %v", room, req.GetRoom()),
+				)
+				return
+			}
+			result, locale, err := personalize(ctx, req.GetGreeting(), msgGreeting, 0)
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			greetRooms.post(p, result+"! ", locale)
+			recordGreeting("GreetEveryone", req.GetGreeting(), result, locale)
+			presence.touch(session)
+
+			req, err = stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case res := <-p.out:
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+			presence.touch(session)
+		case err := <-recvErr:
+			fmt.Printf("%v left room %v\n", name, room)
+			if err != io.EOF {
+				return err
+			}
+			//The client is done sending, deliver what was already posted before closing
+			for {
+				select {
+				case res := <-p.out:
+					if err := stream.Send(res); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		case <-p.dropped:
+			return status.Errorf(
+				codes.ResourceExhausted,
+				fmt.Sprintf("%v does not read the messages of room %v fast enough", name, room),
+			)
 		}
 	}
 }
@@ -97,19 +230,45 @@ func (*server) GreetWithDeadline(ctx context.Context, req *greetpb.GreetWithDead
 	*greetpb.GreetWithDeadlineResponse, error) {
 	fmt.Printf("GreetWithDeadline function was invoked with %v\n", req)
 
-	//Loop 3 times, meaning we sleep for 3 seconds while checking if client cancelled the request
-	for i := 0; i < 3; i++ {
-		if ctx.Err() == context.Canceled {
-			fmt.Printf("Client cancelled the request")
-			return nil, status.Error(codes.Canceled, "the client cancelled the request")
+	work := time.Duration(req.GetWorkMs()) * time.Millisecond
+	if req.GetWorkMs() == 0 {
+		work = defaultDeadlineWork
+	}
+	if work > maxDeadlineWork {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Work may last at most %v", maxDeadlineWork),
+		)
+	}
+
+	//Fail fast when the client's deadline leaves too little time for the work
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < work {
+			return nil, status.Errorf(
+				codes.DeadlineExceeded,
+				fmt.Sprintf("The work takes %v but only %v are left before the deadline", work, remaining.Round(time.Millisecond)),
+			)
 		}
-		time.Sleep(1 * time.Second)
 	}
 
-	firstName := req.GetGreeting().GetFirstName()
-	result := "Hello " + firstName
+	//Do the work while watching for the client cancelling or the deadline passing
+	timer := time.NewTimer(work)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		fmt.Printf("GreetWithDeadline stopped: %v\n", ctx.Err())
+		return nil, status.FromContextError(ctx.Err()).Err()
+	case <-timer.C:
+	}
+
+	result, locale, err := personalize(ctx, req.GetGreeting(), msgGreeting, 0)
+	if err != nil {
+		return nil, err
+	}
+	recordGreeting("GreetWithDeadline", req.GetGreeting(), result, locale)
 	res := &greetpb.GreetWithDeadlineResponse{
 		Result: result,
+		Locale: locale,
 	}
 
 	return res, nil
@@ -118,16 +277,76 @@ func (*server) GreetWithDeadline(ctx context.Context, req *greetpb.GreetWithDead
 func main() {
 	fmt.Println("Hello from greetpb server")
 
-	lis, err := net.Listen("tcp", "0.0.0.0:50051")
+	fs := flag.NewFlagSet("greet", flag.ContinueOnError)
+	fs.DurationVar(&idleTimeout, "presence-idle-timeout", idleTimeout, "time without messages after which a streaming client is shown as idle")
+	historyStoreName := fs.String("history-store", "memory", "where greetings are recorded: memory or file")
+	historyFile := fs.String("history-file", "greet_history.jsonl", "file used by --history-store file")
+	fs.IntVar(&historyMaxRecords, "history-max-records", historyMaxRecords, "number of greetings kept in the history, older ones are forgotten")
+	fs.IntVar(&streamMaxMessages, "stream-max-messages", streamMaxMessages, "most messages a client may send on a LongGreet or GreetEveryone stream")
+	fs.IntVar(&streamMaxBytes, "stream-max-bytes", streamMaxBytes, "most bytes a client may send on a LongGreet or GreetEveryone stream")
+	fs.StringVar(&scheduleFile, "schedule-file", scheduleFile, "file storing the greeting schedules")
+	fs.DurationVar(&streamIdleTimeout, "stream-idle-timeout", streamIdleTimeout, "time a LongGreet or GreetEveryone stream may go without a client message")
+
+	cfg, err := config.LoadFlags(fs, "greet", config.Config{
+		ListenAddr: "0.0.0.0:50051",
+	}, os.Args[1:])
+	if err == config.ErrPrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Cannot print configuration: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if idleTimeout <= 0 {
+		log.Fatalf("Invalid configuration: --presence-idle-timeout must be positive")
+	}
+	if historyMaxRecords <= 0 {
+		log.Fatalf("Invalid configuration: --history-max-records must be positive")
+	}
+	if streamMaxMessages <= 0 || streamMaxBytes <= 0 || streamIdleTimeout <= 0 {
+		log.Fatalf("Invalid configuration: stream limits must be positive")
+	}
+
+	switch *historyStoreName {
+	case "memory":
+	case "file":
+		h, err := openFileHistory(*historyFile)
+		if err != nil {
+			log.Fatalf("Failed to open greeting history: %v", err)
+		}
+		defer h.file.Close()
+		history = h
+	default:
+		log.Fatalf("Invalid configuration: unknown history store %q, expected memory or file", *historyStoreName)
+	}
+
+	if err := schedules.load(scheduleFile); err != nil {
+		log.Fatalf("Failed to load greeting schedules: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", cfg.ListenAddr)
 
 	if err != nil {
 		log.Fatalf("Failed to Listen: %v", err)
 	}
 
+	opts, err := cfg.ServerOptions()
+	if err != nil {
+		log.Fatalf("Failed to build server options: %v", err)
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(validateUnaryInterceptor),
+		grpc.ChainStreamInterceptor(streamLimitInterceptor, validateStreamInterceptor),
+	)
+
 	//Create a GRPC server
-	s := grpc.NewServer()
+	s := grpc.NewServer(opts...)
 
 	greetpb.RegisterGreetServiceServer(s, &server{})
+	go presence.runIdleSweeper()
+	go schedules.run()
 
 	// Here we are binding the port to the grpc server
 	if err := s.Serve(lis); err != nil {
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-grpc-course/greet/greetpb"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const maxTemplateLength = 1024
+
+var (
+	templateNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+	variablePattern     = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+)
+
+// builtinVariables are set by the server for every greeting and cannot be overridden by
+// custom variables.
+var builtinVariables = map[string]bool{
+	"first_name":  true,
+	"last_name":   true,
+	"time_of_day": true,
+	"greeting":    true,
+	"count":       true,
+}
+
+// greetingTemplates holds the templates created with CreateGreetingTemplate by name.
+var greetingTemplates = struct {
+	sync.RWMutex
+	byName map[string]*compiledTemplate
+}{byName: map[string]*compiledTemplate{}}
+
+// compiledTemplate is a template split into literal text and variables. Values are only ever
+// substituted into the parsed segments, so a value containing braces is never expanded again.
+type compiledTemplate struct {
+	spec     *greetpb.GreetingTemplate
+	segments []templateSegment
+}
+
+type templateSegment struct {
+	literal  string
+	variable string
+}
+
+// compileTemplate validates a template and parses its text.
+func compileTemplate(spec *greetpb.GreetingTemplate) (*compiledTemplate, error) {
+	text := spec.GetText()
+	if text == "" || len(text) > maxTemplateLength {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Template text must be 1 to %d bytes long", maxTemplateLength),
+		)
+	}
+
+	t := &compiledTemplate{spec: proto.Clone(spec).(*greetpb.GreetingTemplate)}
+	t.spec.Variables = nil
+	seen := map[string]bool{}
+	var literal strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case strings.HasPrefix(text[i:], "{{"):
+			literal.WriteByte('{')
+			i++
+		case strings.HasPrefix(text[i:], "}}"):
+			literal.WriteByte('}')
+			i++
+		case text[i] == '}':
+			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Unexpected } at byte %d, use }} for a literal brace", i))
+		case text[i] == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Unclosed { at byte %d, use {{ for a literal brace", i))
+			}
+			name := text[i+1 : i+end]
+			if !variablePattern.MatchString(name) {
+				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Invalid variable name %q", name))
+			}
+			if literal.Len() > 0 {
+				t.segments = append(t.segments, templateSegment{literal: literal.String()})
+				literal.Reset()
+			}
+			t.segments = append(t.segments, templateSegment{variable: name})
+			if !seen[name] {
+				seen[name] = true
+				t.spec.Variables = append(t.spec.Variables, name)
+			}
+			i += end
+		default:
+			literal.WriteByte(text[i])
+		}
+	}
+	if literal.Len() > 0 {
+		t.segments = append(t.segments, templateSegment{literal: literal.String()})
+	}
+
+	return t, nil
+}
+
+// render fills in the variables of a template. Every variable used must have a value.
+func (t *compiledTemplate) render(values map[string]string) (string, error) {
+	var b strings.Builder
+	for _, s := range t.segments {
+		if s.variable == "" {
+			b.WriteString(s.literal)
+			continue
+		}
+		v, ok := values[s.variable]
+		if !ok {
+			return "", status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Template %q needs the variable %q", t.spec.GetName(), s.variable),
+			)
+		}
+		if t.spec.GetEscaping() == greetpb.TemplateEscaping_TEMPLATE_ESCAPING_HTML {
+			v = html.EscapeString(v)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// timeOfDay names the part of the day of t.
+func timeOfDay(t time.Time) string {
+	switch h := t.Hour(); {
+	case h >= 5 && h < 12:
+		return "morning"
+	case h >= 12 && h < 17:
+		return "afternoon"
+	case h >= 17 && h < 22:
+		return "evening"
+	}
+	return "night"
+}
+
+// renderTemplate renders a template for a greeting. The localized greeting is rendered too, for
+// the {greeting} variable and the locale of the response.
+func renderTemplate(ctx context.Context, t *compiledTemplate, greeting *greetpb.Greeting, count int) (string, string, error) {
+	values := map[string]string{}
+	for k, v := range greeting.GetVariables() {
+		if builtinVariables[k] {
+			return "", "", status.Errorf(codes.InvalidArgument, fmt.Sprintf("Variable %q is set by the server", k))
+		}
+		values[k] = v
+	}
+
+	localized, locale := greet(ctx, &greetpb.Greeting{
+		FirstName: greeting.GetFirstName(),
+		LastName:  greeting.GetLastName(),
+		Locale:    greeting.GetLocale(),
+		Formality: greeting.GetFormality(),
+	}, msgGreeting, 0)
+	values["first_name"] = greeting.GetFirstName()
+	values["last_name"] = greeting.GetLastName()
+	values["time_of_day"] = timeOfDay(time.Now())
+	values["greeting"] = localized
+	values["count"] = strconv.Itoa(count)
+
+	result, err := t.render(values)
+	return result, locale, err
+}
+
+// lookupTemplate returns the stored template of a name.
+func lookupTemplate(name string) (*compiledTemplate, error) {
+	greetingTemplates.RLock()
+	defer greetingTemplates.RUnlock()
+
+	t, ok := greetingTemplates.byName[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, fmt.Sprintf("Cannot find greeting template %q", name))
+	}
+	return t, nil
+}
+
+// personalize renders a greeting with its template or, without one, the catalog message id.
+func personalize(ctx context.Context, greeting *greetpb.Greeting, id string, count int) (string, string, error) {
+	if greeting.GetTemplate() == "" {
+		result, locale := greet(ctx, greeting, id, count)
+		return result, locale, nil
+	}
+
+	t, err := lookupTemplate(greeting.GetTemplate())
+	if err != nil {
+		return "", "", err
+	}
+	return renderTemplate(ctx, t, greeting, count)
+}
+
+func (*server) CreateGreetingTemplate(ctx context.Context, req *greetpb.CreateGreetingTemplateRequest) (*greetpb.CreateGreetingTemplateResponse, error) {
+	fmt.Printf("CreateGreetingTemplate function was invoked with %v\n", req)
+
+	name := req.GetTemplate().GetName()
+	if !templateNamePattern.MatchString(name) {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid template name %q, expected 1 to 64 of a-z, 0-9, _ and -", name),
+		)
+	}
+	t, err := compileTemplate(req.GetTemplate())
+	if err != nil {
+		return nil, err
+	}
+
+	greetingTemplates.Lock()
+	defer greetingTemplates.Unlock()
+	if _, ok := greetingTemplates.byName[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, fmt.Sprintf("Greeting template %q already exists", name))
+	}
+	greetingTemplates.byName[name] = t
+
+	return &greetpb.CreateGreetingTemplateResponse{Template: t.spec}, nil
+}
+
+func (*server) ListGreetingTemplates(ctx context.Context, req *greetpb.ListGreetingTemplatesRequest) (*greetpb.ListGreetingTemplatesResponse, error) {
+	fmt.Printf("ListGreetingTemplates function was invoked with %v\n", req)
+
+	greetingTemplates.RLock()
+	defer greetingTemplates.RUnlock()
+
+	res := &greetpb.ListGreetingTemplatesResponse{}
+	for _, t := range greetingTemplates.byName {
+		res.Templates = append(res.Templates, t.spec)
+	}
+	sort.Slice(res.Templates, func(i, j int) bool {
+		return res.Templates[i].GetName() < res.Templates[j].GetName()
+	})
+	return res, nil
+}
+
+func (*server) PreviewGreetingTemplate(ctx context.Context, req *greetpb.PreviewGreetingTemplateRequest) (*greetpb.PreviewGreetingTemplateResponse, error) {
+	fmt.Printf("PreviewGreetingTemplate function was invoked with %v\n", req)
+
+	var t *compiledTemplate
+	var err error
+	switch source := req.GetSource().(type) {
+	case *greetpb.PreviewGreetingTemplateRequest_Name:
+		t, err = lookupTemplate(source.Name)
+	case *greetpb.PreviewGreetingTemplateRequest_Template:
+		t, err = compileTemplate(source.Template)
+	default:
+		err = status.Errorf(codes.InvalidArgument, "A preview needs a template name or a template")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, locale, err := renderTemplate(ctx, t, req.GetGreeting(), 1)
+	if err != nil {
+		return nil, err
+	}
+	return &greetpb.PreviewGreetingTemplateResponse{Result: result, Locale: locale}, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go-grpc-course/greet/greetpb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCompileTemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		variables []string
+		segments  []templateSegment
+		err       string
+	}{
+		{
+			name:      "literal only",
+			text:      "Hello!",
+			segments:  []templateSegment{{literal: "Hello!"}},
+			variables: nil,
+		},
+		{
+			name:      "variables",
+			text:      "{greeting}, {first_name}! Good {time_of_day}, {first_name}.",
+			variables: []string{"greeting", "first_name", "time_of_day"},
+			segments: []templateSegment{
+				{variable: "greeting"}, {literal: ", "}, {variable: "first_name"}, {literal: "! Good "},
+				{variable: "time_of_day"}, {literal: ", "}, {variable: "first_name"}, {literal: "."},
+			},
+		},
+		{
+			name:      "escaped braces",
+			text:      "{{first_name}} is {first_name}}}",
+			segments:  []templateSegment{{literal: "{first_name} is "}, {variable: "first_name"}, {literal: "}"}},
+			variables: []string{"first_name"},
+		},
+		{name: "empty", text: "", err: "must be 1 to 1024 bytes long"},
+		{name: "too long", text: strings.Repeat("a", maxTemplateLength+1), err: "must be 1 to 1024 bytes long"},
+		{name: "unclosed", text: "Hi {first_name", err: "Unclosed { at byte 3"},
+		{name: "stray close", text: "Hi }", err: "Unexpected } at byte 3"},
+		{name: "empty variable", text: "Hi {}", err: `Invalid variable name ""`},
+		{name: "bad variable", text: "Hi {First}", err: `Invalid variable name "First"`},
+		{name: "nested", text: "Hi {a{b}}", err: `Invalid variable name "a{b"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := compileTemplate(&greetpb.GreetingTemplate{Name: "test", Text: tt.text, Variables: []string{"ignored"}})
+			if tt.err != "" {
+				if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("compileTemplate(%q) = %v, want InvalidArgument containing %q", tt.text, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tmpl.segments, tt.segments) {
+				t.Errorf("segments = %+v, want %+v", tmpl.segments, tt.segments)
+			}
+			if !reflect.DeepEqual(tmpl.spec.GetVariables(), tt.variables) {
+				t.Errorf("variables = %q, want %q", tmpl.spec.GetVariables(), tt.variables)
+			}
+		})
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		escaping greetpb.TemplateEscaping
+		values   map[string]string
+		want     string
+		err      string
+	}{
+		{"plain", "Hi {first_name}!", 0, map[string]string{"first_name": "Ada"}, "Hi Ada!", ""},
+		{"braces in value", "Hi {first_name}", 0, map[string]string{"first_name": "{last_name}", "last_name": "x"}, "Hi {last_name}", ""},
+		{"not escaped", "<b>{first_name}</b>", 0, map[string]string{"first_name": "<i>Ada</i>"}, "<b><i>Ada</i></b>", ""},
+		{"html", "<b>{first_name}</b>", greetpb.TemplateEscaping_TEMPLATE_ESCAPING_HTML, map[string]string{"first_name": `<i>"Ada" & co</i>`}, "<b>&lt;i&gt;&#34;Ada&#34; &amp; co&lt;/i&gt;</b>", ""},
+		{"empty value", "Hi {first_name}{last_name}", 0, map[string]string{"first_name": "Ada", "last_name": ""}, "Hi Ada", ""},
+		{"missing value", "Hi {nickname}", 0, map[string]string{}, "", `needs the variable "nickname"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := compileTemplate(&greetpb.GreetingTemplate{Name: "test", Text: tt.text, Escaping: tt.escaping})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tmpl.render(tt.values)
+			if tt.err != "" {
+				if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("render = %v, want InvalidArgument containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("render = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeOfDay(t *testing.T) {
+	tests := []struct {
+		hour int
+		want string
+	}{
+		{0, "night"}, {4, "night"}, {5, "morning"}, {11, "morning"}, {12, "afternoon"},
+		{16, "afternoon"}, {17, "evening"}, {21, "evening"}, {22, "night"}, {23, "night"},
+	}
+
+	for _, tt := range tests {
+		if got := timeOfDay(time.Date(2024, 1, 1, tt.hour, 30, 0, 0, time.UTC)); got != tt.want {
+			t.Errorf("timeOfDay(%02d:30) = %q, want %q", tt.hour, got, tt.want)
+		}
+	}
+}
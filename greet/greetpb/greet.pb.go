@@ -24,13 +24,213 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type Formality int32
+
+const (
+	Formality_FORMALITY_UNSPECIFIED Formality = 0 // informal
+	Formality_FORMALITY_INFORMAL    Formality = 1
+	Formality_FORMALITY_FORMAL      Formality = 2 // also uses last_name
+)
+
+// Enum value maps for Formality.
+var (
+	Formality_name = map[int32]string{
+		0: "FORMALITY_UNSPECIFIED",
+		1: "FORMALITY_INFORMAL",
+		2: "FORMALITY_FORMAL",
+	}
+	Formality_value = map[string]int32{
+		"FORMALITY_UNSPECIFIED": 0,
+		"FORMALITY_INFORMAL":    1,
+		"FORMALITY_FORMAL":      2,
+	}
+)
+
+func (x Formality) Enum() *Formality {
+	p := new(Formality)
+	*p = x
+	return p
+}
+
+func (x Formality) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Formality) Descriptor() protoreflect.EnumDescriptor {
+	return file_greetpb_greet_proto_enumTypes[0].Descriptor()
+}
+
+func (Formality) Type() protoreflect.EnumType {
+	return &file_greetpb_greet_proto_enumTypes[0]
+}
+
+func (x Formality) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Formality.Descriptor instead.
+func (Formality) EnumDescriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{0}
+}
+
+type RoomEvent int32
+
+const (
+	RoomEvent_ROOM_EVENT_MESSAGE RoomEvent = 0
+	RoomEvent_ROOM_EVENT_JOINED  RoomEvent = 1
+	RoomEvent_ROOM_EVENT_LEFT    RoomEvent = 2
+)
+
+// Enum value maps for RoomEvent.
+var (
+	RoomEvent_name = map[int32]string{
+		0: "ROOM_EVENT_MESSAGE",
+		1: "ROOM_EVENT_JOINED",
+		2: "ROOM_EVENT_LEFT",
+	}
+	RoomEvent_value = map[string]int32{
+		"ROOM_EVENT_MESSAGE": 0,
+		"ROOM_EVENT_JOINED":  1,
+		"ROOM_EVENT_LEFT":    2,
+	}
+)
+
+func (x RoomEvent) Enum() *RoomEvent {
+	p := new(RoomEvent)
+	*p = x
+	return p
+}
+
+func (x RoomEvent) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (RoomEvent) Descriptor() protoreflect.EnumDescriptor {
+	return file_greetpb_greet_proto_enumTypes[1].Descriptor()
+}
+
+func (RoomEvent) Type() protoreflect.EnumType {
+	return &file_greetpb_greet_proto_enumTypes[1]
+}
+
+func (x RoomEvent) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use RoomEvent.Descriptor instead.
+func (RoomEvent) EnumDescriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{1}
+}
+
+type TemplateEscaping int32
+
+const (
+	TemplateEscaping_TEMPLATE_ESCAPING_NONE TemplateEscaping = 0
+	TemplateEscaping_TEMPLATE_ESCAPING_HTML TemplateEscaping = 1 // variable values are HTML escaped
+)
+
+// Enum value maps for TemplateEscaping.
+var (
+	TemplateEscaping_name = map[int32]string{
+		0: "TEMPLATE_ESCAPING_NONE",
+		1: "TEMPLATE_ESCAPING_HTML",
+	}
+	TemplateEscaping_value = map[string]int32{
+		"TEMPLATE_ESCAPING_NONE": 0,
+		"TEMPLATE_ESCAPING_HTML": 1,
+	}
+)
+
+func (x TemplateEscaping) Enum() *TemplateEscaping {
+	p := new(TemplateEscaping)
+	*p = x
+	return p
+}
+
+func (x TemplateEscaping) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TemplateEscaping) Descriptor() protoreflect.EnumDescriptor {
+	return file_greetpb_greet_proto_enumTypes[2].Descriptor()
+}
+
+func (TemplateEscaping) Type() protoreflect.EnumType {
+	return &file_greetpb_greet_proto_enumTypes[2]
+}
+
+func (x TemplateEscaping) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use TemplateEscaping.Descriptor instead.
+func (TemplateEscaping) EnumDescriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{2}
+}
+
+type PresenceState int32
+
+const (
+	PresenceState_PRESENCE_STATE_UNSPECIFIED PresenceState = 0
+	PresenceState_PRESENCE_STATE_ONLINE      PresenceState = 1
+	PresenceState_PRESENCE_STATE_IDLE        PresenceState = 2 // no message sent or received for the idle timeout
+	PresenceState_PRESENCE_STATE_OFFLINE     PresenceState = 3 // the stream ended
+)
+
+// Enum value maps for PresenceState.
+var (
+	PresenceState_name = map[int32]string{
+		0: "PRESENCE_STATE_UNSPECIFIED",
+		1: "PRESENCE_STATE_ONLINE",
+		2: "PRESENCE_STATE_IDLE",
+		3: "PRESENCE_STATE_OFFLINE",
+	}
+	PresenceState_value = map[string]int32{
+		"PRESENCE_STATE_UNSPECIFIED": 0,
+		"PRESENCE_STATE_ONLINE":      1,
+		"PRESENCE_STATE_IDLE":        2,
+		"PRESENCE_STATE_OFFLINE":     3,
+	}
+)
+
+func (x PresenceState) Enum() *PresenceState {
+	p := new(PresenceState)
+	*p = x
+	return p
+}
+
+func (x PresenceState) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PresenceState) Descriptor() protoreflect.EnumDescriptor {
+	return file_greetpb_greet_proto_enumTypes[3].Descriptor()
+}
+
+func (PresenceState) Type() protoreflect.EnumType {
+	return &file_greetpb_greet_proto_enumTypes[3]
+}
+
+func (x PresenceState) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use PresenceState.Descriptor instead.
+func (PresenceState) EnumDescriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{3}
+}
+
 type Greeting struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	FirstName string `protobuf:"bytes,1,opt,name=first_name,json=firstName,proto3" json:"first_name,omitempty"`
-	LastName  string `protobuf:"bytes,2,opt,name=last_name,json=lastName,proto3" json:"last_name,omitempty"`
+	FirstName string            `protobuf:"bytes,1,opt,name=first_name,json=firstName,proto3" json:"first_name,omitempty"`
+	LastName  string            `protobuf:"bytes,2,opt,name=last_name,json=lastName,proto3" json:"last_name,omitempty"`
+	Locale    string            `protobuf:"bytes,3,opt,name=locale,proto3" json:"locale,omitempty"` // BCP 47, e.g. "fr-CA". Falls back to the x-locale metadata, then English
+	Formality Formality         `protobuf:"varint,4,opt,name=formality,proto3,enum=greet.Formality" json:"formality,omitempty"`
+	Template  string            `protobuf:"bytes,5,opt,name=template,proto3" json:"template,omitempty"`                                                                                           // name of a greeting template, empty for the catalog greeting
+	Variables map[string]string `protobuf:"bytes,6,rep,name=variables,proto3" json:"variables,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"` // custom variables of the template
 }
 
 func (x *Greeting) Reset() {
@@ -79,6 +279,34 @@ func (x *Greeting) GetLastName() string {
 	return ""
 }
 
+func (x *Greeting) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+func (x *Greeting) GetFormality() Formality {
+	if x != nil {
+		return x.Formality
+	}
+	return Formality_FORMALITY_UNSPECIFIED
+}
+
+func (x *Greeting) GetTemplate() string {
+	if x != nil {
+		return x.Template
+	}
+	return ""
+}
+
+func (x *Greeting) GetVariables() map[string]string {
+	if x != nil {
+		return x.Variables
+	}
+	return nil
+}
+
 type GreetRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -132,6 +360,7 @@ type GreetResponse struct {
 	unknownFields protoimpl.UnknownFields
 
 	Result string `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Locale string `protobuf:"bytes,2,opt,name=locale,proto3" json:"locale,omitempty"` // locale of the catalog entry used
 }
 
 func (x *GreetResponse) Reset() {
@@ -173,12 +402,23 @@ func (x *GreetResponse) GetResult() string {
 	return ""
 }
 
+func (x *GreetResponse) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
 type GreetManyTimesRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Greeting *Greeting `protobuf:"bytes,1,opt,name=greeting,proto3" json:"greeting,omitempty"`
+	Greeting            *Greeting `protobuf:"bytes,1,opt,name=greeting,proto3" json:"greeting,omitempty"`
+	Count               uint32    `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`                                                          // greetings to send, 10 when unset
+	IntervalMs          uint32    `protobuf:"varint,3,opt,name=interval_ms,json=intervalMs,proto3" json:"interval_ms,omitempty"`                              // time between greetings, 1000 when unset
+	StartOffsetMs       uint32    `protobuf:"varint,4,opt,name=start_offset_ms,json=startOffsetMs,proto3" json:"start_offset_ms,omitempty"`                   // delay before the first greeting
+	ResumeAfterSequence uint32    `protobuf:"varint,5,opt,name=resume_after_sequence,json=resumeAfterSequence,proto3" json:"resume_after_sequence,omitempty"` // last sequence received before reconnecting, 0 to start over
 }
 
 func (x *GreetManyTimesRequest) Reset() {
@@ -220,12 +460,42 @@ func (x *GreetManyTimesRequest) GetGreeting() *Greeting {
 	return nil
 }
 
+func (x *GreetManyTimesRequest) GetCount() uint32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *GreetManyTimesRequest) GetIntervalMs() uint32 {
+	if x != nil {
+		return x.IntervalMs
+	}
+	return 0
+}
+
+func (x *GreetManyTimesRequest) GetStartOffsetMs() uint32 {
+	if x != nil {
+		return x.StartOffsetMs
+	}
+	return 0
+}
+
+func (x *GreetManyTimesRequest) GetResumeAfterSequence() uint32 {
+	if x != nil {
+		return x.ResumeAfterSequence
+	}
+	return 0
+}
+
 type GreetManyTimesResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Result string `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Result   string `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Locale   string `protobuf:"bytes,2,opt,name=locale,proto3" json:"locale,omitempty"`      // locale of the catalog entry used
+	Sequence uint32 `protobuf:"varint,3,opt,name=sequence,proto3" json:"sequence,omitempty"` // 1 to count
 }
 
 func (x *GreetManyTimesResponse) Reset() {
@@ -267,6 +537,20 @@ func (x *GreetManyTimesResponse) GetResult() string {
 	return ""
 }
 
+func (x *GreetManyTimesResponse) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+func (x *GreetManyTimesResponse) GetSequence() uint32 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
 type LongGreetRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -320,6 +604,7 @@ type LongGreetResponse struct {
 	unknownFields protoimpl.UnknownFields
 
 	Result string `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Locale string `protobuf:"bytes,2,opt,name=locale,proto3" json:"locale,omitempty"` // locale of the catalog entry used
 }
 
 func (x *LongGreetResponse) Reset() {
@@ -361,12 +646,20 @@ func (x *LongGreetResponse) GetResult() string {
 	return ""
 }
 
+func (x *LongGreetResponse) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
 type GreetEveryoneRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
 	Greeting *Greeting `protobuf:"bytes,1,opt,name=greeting,proto3" json:"greeting,omitempty"`
+	Room     string    `protobuf:"bytes,2,opt,name=room,proto3" json:"room,omitempty"` // room joined by the first message, "lobby" when empty; later messages stay in it
 }
 
 func (x *GreetEveryoneRequest) Reset() {
@@ -408,12 +701,24 @@ func (x *GreetEveryoneRequest) GetGreeting() *Greeting {
 	return nil
 }
 
+func (x *GreetEveryoneRequest) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
 type GreetEveryoneResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Result string `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Result       string    `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Locale       string    `protobuf:"bytes,2,opt,name=locale,proto3" json:"locale,omitempty"` // locale of the catalog entry used
+	Room         string    `protobuf:"bytes,3,opt,name=room,proto3" json:"room,omitempty"`
+	Sender       string    `protobuf:"bytes,4,opt,name=sender,proto3" json:"sender,omitempty"` // first name of the participant the event is about
+	Event        RoomEvent `protobuf:"varint,5,opt,name=event,proto3,enum=greet.RoomEvent" json:"event,omitempty"`
+	Participants int32     `protobuf:"varint,6,opt,name=participants,proto3" json:"participants,omitempty"` // participants in the room after the event
 }
 
 func (x *GreetEveryoneResponse) Reset() {
@@ -455,12 +760,48 @@ func (x *GreetEveryoneResponse) GetResult() string {
 	return ""
 }
 
+func (x *GreetEveryoneResponse) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+func (x *GreetEveryoneResponse) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *GreetEveryoneResponse) GetSender() string {
+	if x != nil {
+		return x.Sender
+	}
+	return ""
+}
+
+func (x *GreetEveryoneResponse) GetEvent() RoomEvent {
+	if x != nil {
+		return x.Event
+	}
+	return RoomEvent_ROOM_EVENT_MESSAGE
+}
+
+func (x *GreetEveryoneResponse) GetParticipants() int32 {
+	if x != nil {
+		return x.Participants
+	}
+	return 0
+}
+
 type GreetWithDeadlineRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
 	Greeting *Greeting `protobuf:"bytes,1,opt,name=greeting,proto3" json:"greeting,omitempty"`
+	WorkMs   uint32    `protobuf:"varint,2,opt,name=work_ms,json=workMs,proto3" json:"work_ms,omitempty"` // simulated work before the greeting, 3000 when unset, at most 60000
 }
 
 func (x *GreetWithDeadlineRequest) Reset() {
@@ -502,12 +843,20 @@ func (x *GreetWithDeadlineRequest) GetGreeting() *Greeting {
 	return nil
 }
 
+func (x *GreetWithDeadlineRequest) GetWorkMs() uint32 {
+	if x != nil {
+		return x.WorkMs
+	}
+	return 0
+}
+
 type GreetWithDeadlineResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
 	Result string `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Locale string `protobuf:"bytes,2,opt,name=locale,proto3" json:"locale,omitempty"` // locale of the catalog entry used
 }
 
 func (x *GreetWithDeadlineResponse) Reset() {
@@ -549,172 +898,2244 @@ func (x *GreetWithDeadlineResponse) GetResult() string {
 	return ""
 }
 
-var File_greetpb_greet_proto protoreflect.FileDescriptor
+func (x *GreetWithDeadlineResponse) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
 
-var file_greetpb_greet_proto_rawDesc = []byte{
-	0x0a, 0x13, 0x67, 0x72, 0x65, 0x65, 0x74, 0x70, 0x62, 0x2f, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x67, 0x72, 0x65, 0x65, 0x74, 0x22, 0x46, 0x0a, 0x08,
-	0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x69, 0x72, 0x73,
-	0x74, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x66, 0x69,
-	0x72, 0x73, 0x74, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x6c, 0x61, 0x73, 0x74, 0x5f,
-	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6c, 0x61, 0x73, 0x74,
-	0x4e, 0x61, 0x6d, 0x65, 0x22, 0x3b, 0x0a, 0x0c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x71,
-	0x75, 0x65, 0x73, 0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
-	0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47,
-	0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e,
-	0x67, 0x22, 0x27, 0x0a, 0x0d, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
-	0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x22, 0x44, 0x0a, 0x15, 0x47, 0x72,
-	0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75,
-	0x65, 0x73, 0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72,
-	0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
-	0x22, 0x30, 0x0a, 0x16, 0x47, 0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d,
-	0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65,
-	0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75,
-	0x6c, 0x74, 0x22, 0x3f, 0x0a, 0x10, 0x4c, 0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52,
-	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69,
-	0x6e, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74,
-	0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74,
-	0x69, 0x6e, 0x67, 0x22, 0x2b, 0x0a, 0x11, 0x4c, 0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65, 0x74,
-	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75,
-	0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
-	0x22, 0x43, 0x0a, 0x14, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76, 0x65, 0x72, 0x79, 0x6f, 0x6e,
-	0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65,
-	0x74, 0x69, 0x6e, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65,
-	0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65,
-	0x65, 0x74, 0x69, 0x6e, 0x67, 0x22, 0x2f, 0x0a, 0x15, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76,
-	0x65, 0x72, 0x79, 0x6f, 0x6e, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16,
-	0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06,
-	0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x22, 0x47, 0x0a, 0x18, 0x47, 0x72, 0x65, 0x65, 0x74, 0x57,
-	0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69, 0x6e, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65,
-	0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x22,
-	0x33, 0x0a, 0x19, 0x47, 0x72, 0x65, 0x65, 0x74, 0x57, 0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64,
-	0x6c, 0x69, 0x6e, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06,
-	0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65,
-	0x73, 0x75, 0x6c, 0x74, 0x32, 0x85, 0x03, 0x0a, 0x0c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x53, 0x65,
-	0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x34, 0x0a, 0x05, 0x47, 0x72, 0x65, 0x65, 0x74, 0x12, 0x13,
-	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x71, 0x75,
-	0x65, 0x73, 0x74, 0x1a, 0x14, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65,
-	0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x51, 0x0a, 0x0e, 0x47,
-	0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x12, 0x1c, 0x2e,
-	0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54,
-	0x69, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1d, 0x2e, 0x67, 0x72,
-	0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d,
-	0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x30, 0x01, 0x12, 0x42,
-	0x0a, 0x09, 0x4c, 0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65, 0x74, 0x12, 0x17, 0x2e, 0x67, 0x72,
-	0x65, 0x65, 0x74, 0x2e, 0x4c, 0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x71,
-	0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4c, 0x6f, 0x6e,
-	0x67, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
-	0x28, 0x01, 0x12, 0x4e, 0x0a, 0x0d, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76, 0x65, 0x72, 0x79,
-	0x6f, 0x6e, 0x65, 0x12, 0x1b, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65,
-	0x74, 0x45, 0x76, 0x65, 0x72, 0x79, 0x6f, 0x6e, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
-	0x1a, 0x1c, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76,
-	0x65, 0x72, 0x79, 0x6f, 0x6e, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x28, 0x01,
-	0x30, 0x01, 0x12, 0x58, 0x0a, 0x11, 0x47, 0x72, 0x65, 0x65, 0x74, 0x57, 0x69, 0x74, 0x68, 0x44,
-	0x65, 0x61, 0x64, 0x6c, 0x69, 0x6e, 0x65, 0x12, 0x1f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e,
-	0x47, 0x72, 0x65, 0x65, 0x74, 0x57, 0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69, 0x6e,
-	0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x20, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74,
-	0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x57, 0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69,
-	0x6e, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x42, 0x0a, 0x5a, 0x08,
-	0x2f, 0x67, 0x72, 0x65, 0x65, 0x74, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+// GreetingTemplate is a named greeting text with {variable} placeholders. Built-in variables are
+// first_name, last_name, time_of_day, greeting (the localized greeting) and count; others are
+// custom variables taken from Greeting.variables. "{{" and "}}" stand for literal braces.
+type GreetingTemplate struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name      string           `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Text      string           `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	Escaping  TemplateEscaping `protobuf:"varint,3,opt,name=escaping,proto3,enum=greet.TemplateEscaping" json:"escaping,omitempty"`
+	Variables []string         `protobuf:"bytes,4,rep,name=variables,proto3" json:"variables,omitempty"` // output only, the variables used by text
 }
 
-var (
-	file_greetpb_greet_proto_rawDescOnce sync.Once
-	file_greetpb_greet_proto_rawDescData = file_greetpb_greet_proto_rawDesc
-)
+func (x *GreetingTemplate) Reset() {
+	*x = GreetingTemplate{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
 
-func file_greetpb_greet_proto_rawDescGZIP() []byte {
-	file_greetpb_greet_proto_rawDescOnce.Do(func() {
-		file_greetpb_greet_proto_rawDescData = protoimpl.X.CompressGZIP(file_greetpb_greet_proto_rawDescData)
-	})
-	return file_greetpb_greet_proto_rawDescData
+func (x *GreetingTemplate) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-var file_greetpb_greet_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
-var file_greetpb_greet_proto_goTypes = []interface{}{
-	(*Greeting)(nil),                  // 0: greet.Greeting
-	(*GreetRequest)(nil),              // 1: greet.GreetRequest
-	(*GreetResponse)(nil),             // 2: greet.GreetResponse
-	(*GreetManyTimesRequest)(nil),     // 3: greet.GreetManyTimesRequest
-	(*GreetManyTimesResponse)(nil),    // 4: greet.GreetManyTimesResponse
-	(*LongGreetRequest)(nil),          // 5: greet.LongGreetRequest
-	(*LongGreetResponse)(nil),         // 6: greet.LongGreetResponse
-	(*GreetEveryoneRequest)(nil),      // 7: greet.GreetEveryoneRequest
-	(*GreetEveryoneResponse)(nil),     // 8: greet.GreetEveryoneResponse
-	(*GreetWithDeadlineRequest)(nil),  // 9: greet.GreetWithDeadlineRequest
-	(*GreetWithDeadlineResponse)(nil), // 10: greet.GreetWithDeadlineResponse
+func (*GreetingTemplate) ProtoMessage() {}
+
+func (x *GreetingTemplate) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
 }
-var file_greetpb_greet_proto_depIdxs = []int32{
-	0,  // 0: greet.GreetRequest.greeting:type_name -> greet.Greeting
-	0,  // 1: greet.GreetManyTimesRequest.greeting:type_name -> greet.Greeting
-	0,  // 2: greet.LongGreetRequest.greeting:type_name -> greet.Greeting
-	0,  // 3: greet.GreetEveryoneRequest.greeting:type_name -> greet.Greeting
-	0,  // 4: greet.GreetWithDeadlineRequest.greeting:type_name -> greet.Greeting
-	1,  // 5: greet.GreetService.Greet:input_type -> greet.GreetRequest
-	3,  // 6: greet.GreetService.GreetManyTimes:input_type -> greet.GreetManyTimesRequest
-	5,  // 7: greet.GreetService.LongGreet:input_type -> greet.LongGreetRequest
-	7,  // 8: greet.GreetService.GreetEveryone:input_type -> greet.GreetEveryoneRequest
-	9,  // 9: greet.GreetService.GreetWithDeadline:input_type -> greet.GreetWithDeadlineRequest
-	2,  // 10: greet.GreetService.Greet:output_type -> greet.GreetResponse
-	4,  // 11: greet.GreetService.GreetManyTimes:output_type -> greet.GreetManyTimesResponse
-	6,  // 12: greet.GreetService.LongGreet:output_type -> greet.LongGreetResponse
-	8,  // 13: greet.GreetService.GreetEveryone:output_type -> greet.GreetEveryoneResponse
-	10, // 14: greet.GreetService.GreetWithDeadline:output_type -> greet.GreetWithDeadlineResponse
-	10, // [10:15] is the sub-list for method output_type
-	5,  // [5:10] is the sub-list for method input_type
-	5,  // [5:5] is the sub-list for extension type_name
-	5,  // [5:5] is the sub-list for extension extendee
-	0,  // [0:5] is the sub-list for field type_name
+
+// Deprecated: Use GreetingTemplate.ProtoReflect.Descriptor instead.
+func (*GreetingTemplate) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{11}
 }
 
-func init() { file_greetpb_greet_proto_init() }
-func file_greetpb_greet_proto_init() {
-	if File_greetpb_greet_proto != nil {
-		return
+func (x *GreetingTemplate) GetName() string {
+	if x != nil {
+		return x.Name
 	}
-	if !protoimpl.UnsafeEnabled {
-		file_greetpb_greet_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Greeting); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-		file_greetpb_greet_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetRequest); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-		file_greetpb_greet_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetResponse); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
+	return ""
+}
+
+func (x *GreetingTemplate) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *GreetingTemplate) GetEscaping() TemplateEscaping {
+	if x != nil {
+		return x.Escaping
+	}
+	return TemplateEscaping_TEMPLATE_ESCAPING_NONE
+}
+
+func (x *GreetingTemplate) GetVariables() []string {
+	if x != nil {
+		return x.Variables
+	}
+	return nil
+}
+
+type CreateGreetingTemplateRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Template *GreetingTemplate `protobuf:"bytes,1,opt,name=template,proto3" json:"template,omitempty"`
+}
+
+func (x *CreateGreetingTemplateRequest) Reset() {
+	*x = CreateGreetingTemplateRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[12]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CreateGreetingTemplateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateGreetingTemplateRequest) ProtoMessage() {}
+
+func (x *CreateGreetingTemplateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[12]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateGreetingTemplateRequest.ProtoReflect.Descriptor instead.
+func (*CreateGreetingTemplateRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *CreateGreetingTemplateRequest) GetTemplate() *GreetingTemplate {
+	if x != nil {
+		return x.Template
+	}
+	return nil
+}
+
+type CreateGreetingTemplateResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Template *GreetingTemplate `protobuf:"bytes,1,opt,name=template,proto3" json:"template,omitempty"`
+}
+
+func (x *CreateGreetingTemplateResponse) Reset() {
+	*x = CreateGreetingTemplateResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CreateGreetingTemplateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateGreetingTemplateResponse) ProtoMessage() {}
+
+func (x *CreateGreetingTemplateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateGreetingTemplateResponse.ProtoReflect.Descriptor instead.
+func (*CreateGreetingTemplateResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *CreateGreetingTemplateResponse) GetTemplate() *GreetingTemplate {
+	if x != nil {
+		return x.Template
+	}
+	return nil
+}
+
+type ListGreetingTemplatesRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *ListGreetingTemplatesRequest) Reset() {
+	*x = ListGreetingTemplatesRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[14]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListGreetingTemplatesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListGreetingTemplatesRequest) ProtoMessage() {}
+
+func (x *ListGreetingTemplatesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[14]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListGreetingTemplatesRequest.ProtoReflect.Descriptor instead.
+func (*ListGreetingTemplatesRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{14}
+}
+
+type ListGreetingTemplatesResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Templates []*GreetingTemplate `protobuf:"bytes,1,rep,name=templates,proto3" json:"templates,omitempty"`
+}
+
+func (x *ListGreetingTemplatesResponse) Reset() {
+	*x = ListGreetingTemplatesResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[15]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListGreetingTemplatesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListGreetingTemplatesResponse) ProtoMessage() {}
+
+func (x *ListGreetingTemplatesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[15]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListGreetingTemplatesResponse.ProtoReflect.Descriptor instead.
+func (*ListGreetingTemplatesResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *ListGreetingTemplatesResponse) GetTemplates() []*GreetingTemplate {
+	if x != nil {
+		return x.Templates
+	}
+	return nil
+}
+
+type PreviewGreetingTemplateRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Source:
+	//	*PreviewGreetingTemplateRequest_Name
+	//	*PreviewGreetingTemplateRequest_Template
+	Source   isPreviewGreetingTemplateRequest_Source `protobuf_oneof:"source"`
+	Greeting *Greeting                               `protobuf:"bytes,3,opt,name=greeting,proto3" json:"greeting,omitempty"`
+}
+
+func (x *PreviewGreetingTemplateRequest) Reset() {
+	*x = PreviewGreetingTemplateRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[16]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PreviewGreetingTemplateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PreviewGreetingTemplateRequest) ProtoMessage() {}
+
+func (x *PreviewGreetingTemplateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[16]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PreviewGreetingTemplateRequest.ProtoReflect.Descriptor instead.
+func (*PreviewGreetingTemplateRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{16}
+}
+
+func (m *PreviewGreetingTemplateRequest) GetSource() isPreviewGreetingTemplateRequest_Source {
+	if m != nil {
+		return m.Source
+	}
+	return nil
+}
+
+func (x *PreviewGreetingTemplateRequest) GetName() string {
+	if x, ok := x.GetSource().(*PreviewGreetingTemplateRequest_Name); ok {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *PreviewGreetingTemplateRequest) GetTemplate() *GreetingTemplate {
+	if x, ok := x.GetSource().(*PreviewGreetingTemplateRequest_Template); ok {
+		return x.Template
+	}
+	return nil
+}
+
+func (x *PreviewGreetingTemplateRequest) GetGreeting() *Greeting {
+	if x != nil {
+		return x.Greeting
+	}
+	return nil
+}
+
+type isPreviewGreetingTemplateRequest_Source interface {
+	isPreviewGreetingTemplateRequest_Source()
+}
+
+type PreviewGreetingTemplateRequest_Name struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3,oneof"` // a stored template
+}
+
+type PreviewGreetingTemplateRequest_Template struct {
+	Template *GreetingTemplate `protobuf:"bytes,2,opt,name=template,proto3,oneof"` // an unsaved template
+}
+
+func (*PreviewGreetingTemplateRequest_Name) isPreviewGreetingTemplateRequest_Source() {}
+
+func (*PreviewGreetingTemplateRequest_Template) isPreviewGreetingTemplateRequest_Source() {}
+
+type PreviewGreetingTemplateResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Result string `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Locale string `protobuf:"bytes,2,opt,name=locale,proto3" json:"locale,omitempty"`
+}
+
+func (x *PreviewGreetingTemplateResponse) Reset() {
+	*x = PreviewGreetingTemplateResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[17]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PreviewGreetingTemplateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PreviewGreetingTemplateResponse) ProtoMessage() {}
+
+func (x *PreviewGreetingTemplateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[17]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PreviewGreetingTemplateResponse.ProtoReflect.Descriptor instead.
+func (*PreviewGreetingTemplateResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *PreviewGreetingTemplateResponse) GetResult() string {
+	if x != nil {
+		return x.Result
+	}
+	return ""
+}
+
+func (x *PreviewGreetingTemplateResponse) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+// Presence describes a streaming client connected to the server.
+type Presence struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	SessionId    string        `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Name         string        `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`                                       // first name of the client's first greeting
+	Method       string        `protobuf:"bytes,3,opt,name=method,proto3" json:"method,omitempty"`                                   // GreetEveryone or GreetManyTimes
+	Room         string        `protobuf:"bytes,4,opt,name=room,proto3" json:"room,omitempty"`                                       // GreetEveryone room
+	Peer         string        `protobuf:"bytes,5,opt,name=peer,proto3" json:"peer,omitempty"`                                       // remote address
+	ConnectedAt  string        `protobuf:"bytes,6,opt,name=connected_at,json=connectedAt,proto3" json:"connected_at,omitempty"`      // RFC 3339
+	LastActiveAt string        `protobuf:"bytes,7,opt,name=last_active_at,json=lastActiveAt,proto3" json:"last_active_at,omitempty"` // RFC 3339
+	State        PresenceState `protobuf:"varint,8,opt,name=state,proto3,enum=greet.PresenceState" json:"state,omitempty"`
+}
+
+func (x *Presence) Reset() {
+	*x = Presence{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[18]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Presence) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Presence) ProtoMessage() {}
+
+func (x *Presence) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[18]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Presence.ProtoReflect.Descriptor instead.
+func (*Presence) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *Presence) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *Presence) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Presence) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *Presence) GetRoom() string {
+	if x != nil {
+		return x.Room
+	}
+	return ""
+}
+
+func (x *Presence) GetPeer() string {
+	if x != nil {
+		return x.Peer
+	}
+	return ""
+}
+
+func (x *Presence) GetConnectedAt() string {
+	if x != nil {
+		return x.ConnectedAt
+	}
+	return ""
+}
+
+func (x *Presence) GetLastActiveAt() string {
+	if x != nil {
+		return x.LastActiveAt
+	}
+	return ""
+}
+
+func (x *Presence) GetState() PresenceState {
+	if x != nil {
+		return x.State
+	}
+	return PresenceState_PRESENCE_STATE_UNSPECIFIED
+}
+
+type ListPresenceRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *ListPresenceRequest) Reset() {
+	*x = ListPresenceRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[19]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListPresenceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListPresenceRequest) ProtoMessage() {}
+
+func (x *ListPresenceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[19]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListPresenceRequest.ProtoReflect.Descriptor instead.
+func (*ListPresenceRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{19}
+}
+
+type ListPresenceResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Presence []*Presence `protobuf:"bytes,1,rep,name=presence,proto3" json:"presence,omitempty"`
+}
+
+func (x *ListPresenceResponse) Reset() {
+	*x = ListPresenceResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[20]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListPresenceResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListPresenceResponse) ProtoMessage() {}
+
+func (x *ListPresenceResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[20]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListPresenceResponse.ProtoReflect.Descriptor instead.
+func (*ListPresenceResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *ListPresenceResponse) GetPresence() []*Presence {
+	if x != nil {
+		return x.Presence
+	}
+	return nil
+}
+
+type WatchPresenceRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *WatchPresenceRequest) Reset() {
+	*x = WatchPresenceRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[21]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchPresenceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchPresenceRequest) ProtoMessage() {}
+
+func (x *WatchPresenceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[21]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchPresenceRequest.ProtoReflect.Descriptor instead.
+func (*WatchPresenceRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{21}
+}
+
+type PresenceEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Presence *Presence `protobuf:"bytes,1,opt,name=presence,proto3" json:"presence,omitempty"`
+}
+
+func (x *PresenceEvent) Reset() {
+	*x = PresenceEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[22]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PresenceEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PresenceEvent) ProtoMessage() {}
+
+func (x *PresenceEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[22]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PresenceEvent.ProtoReflect.Descriptor instead.
+func (*PresenceEvent) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *PresenceEvent) GetPresence() *Presence {
+	if x != nil {
+		return x.Presence
+	}
+	return nil
+}
+
+// HistoryEntry is a greeting produced by Greet, LongGreet, GreetEveryone or GreetWithDeadline.
+type HistoryEntry struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FirstName string `protobuf:"bytes,1,opt,name=first_name,json=firstName,proto3" json:"first_name,omitempty"`
+	LastName  string `protobuf:"bytes,2,opt,name=last_name,json=lastName,proto3" json:"last_name,omitempty"`
+	Method    string `protobuf:"bytes,3,opt,name=method,proto3" json:"method,omitempty"`
+	Result    string `protobuf:"bytes,4,opt,name=result,proto3" json:"result,omitempty"`
+	Locale    string `protobuf:"bytes,5,opt,name=locale,proto3" json:"locale,omitempty"`
+	GreetedAt string `protobuf:"bytes,6,opt,name=greeted_at,json=greetedAt,proto3" json:"greeted_at,omitempty"` // RFC 3339
+}
+
+func (x *HistoryEntry) Reset() {
+	*x = HistoryEntry{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[23]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HistoryEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HistoryEntry) ProtoMessage() {}
+
+func (x *HistoryEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[23]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HistoryEntry.ProtoReflect.Descriptor instead.
+func (*HistoryEntry) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *HistoryEntry) GetFirstName() string {
+	if x != nil {
+		return x.FirstName
+	}
+	return ""
+}
+
+func (x *HistoryEntry) GetLastName() string {
+	if x != nil {
+		return x.LastName
+	}
+	return ""
+}
+
+func (x *HistoryEntry) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *HistoryEntry) GetResult() string {
+	if x != nil {
+		return x.Result
+	}
+	return ""
+}
+
+func (x *HistoryEntry) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+func (x *HistoryEntry) GetGreetedAt() string {
+	if x != nil {
+		return x.GreetedAt
+	}
+	return ""
+}
+
+type QueryHistoryRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FirstName string `protobuf:"bytes,1,opt,name=first_name,json=firstName,proto3" json:"first_name,omitempty"` // case insensitive, empty for everyone
+	From      string `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`                            // RFC 3339, inclusive
+	To        string `protobuf:"bytes,3,opt,name=to,proto3" json:"to,omitempty"`                                // RFC 3339, exclusive
+	Limit     int32  `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`                         // most recent entries returned, 100 when unset
+}
+
+func (x *QueryHistoryRequest) Reset() {
+	*x = QueryHistoryRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[24]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *QueryHistoryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryHistoryRequest) ProtoMessage() {}
+
+func (x *QueryHistoryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[24]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryHistoryRequest.ProtoReflect.Descriptor instead.
+func (*QueryHistoryRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *QueryHistoryRequest) GetFirstName() string {
+	if x != nil {
+		return x.FirstName
+	}
+	return ""
+}
+
+func (x *QueryHistoryRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *QueryHistoryRequest) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *QueryHistoryRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type QueryHistoryResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Entries []*HistoryEntry `protobuf:"bytes,1,rep,name=entries,proto3" json:"entries,omitempty"` // most recent first
+}
+
+func (x *QueryHistoryResponse) Reset() {
+	*x = QueryHistoryResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[25]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *QueryHistoryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryHistoryResponse) ProtoMessage() {}
+
+func (x *QueryHistoryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[25]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryHistoryResponse.ProtoReflect.Descriptor instead.
+func (*QueryHistoryResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *QueryHistoryResponse) GetEntries() []*HistoryEntry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+type GreetingCountsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From string `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"` // RFC 3339, inclusive
+	To   string `protobuf:"bytes,2,opt,name=to,proto3" json:"to,omitempty"`     // RFC 3339, exclusive
+}
+
+func (x *GreetingCountsRequest) Reset() {
+	*x = GreetingCountsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[26]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GreetingCountsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GreetingCountsRequest) ProtoMessage() {}
+
+func (x *GreetingCountsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[26]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GreetingCountsRequest.ProtoReflect.Descriptor instead.
+func (*GreetingCountsRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *GreetingCountsRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *GreetingCountsRequest) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+type NameCount struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FirstName string `protobuf:"bytes,1,opt,name=first_name,json=firstName,proto3" json:"first_name,omitempty"`
+	Count     int64  `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+}
+
+func (x *NameCount) Reset() {
+	*x = NameCount{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[27]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *NameCount) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NameCount) ProtoMessage() {}
+
+func (x *NameCount) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[27]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NameCount.ProtoReflect.Descriptor instead.
+func (*NameCount) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{27}
+}
+
+func (x *NameCount) GetFirstName() string {
+	if x != nil {
+		return x.FirstName
+	}
+	return ""
+}
+
+func (x *NameCount) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+type GreetingCountsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Counts []*NameCount `protobuf:"bytes,1,rep,name=counts,proto3" json:"counts,omitempty"` // most greeted first
+}
+
+func (x *GreetingCountsResponse) Reset() {
+	*x = GreetingCountsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[28]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GreetingCountsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GreetingCountsResponse) ProtoMessage() {}
+
+func (x *GreetingCountsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[28]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GreetingCountsResponse.ProtoReflect.Descriptor instead.
+func (*GreetingCountsResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{28}
+}
+
+func (x *GreetingCountsResponse) GetCounts() []*NameCount {
+	if x != nil {
+		return x.Counts
+	}
+	return nil
+}
+
+// GreetingSchedule greets someone each time a cron expression fires, e.g. "0 9 * * 1-5" for
+// every weekday at 9:00.
+type GreetingSchedule struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id        string    `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"` // output only
+	Greeting  *Greeting `protobuf:"bytes,2,opt,name=greeting,proto3" json:"greeting,omitempty"`
+	Cron      string    `protobuf:"bytes,3,opt,name=cron,proto3" json:"cron,omitempty"`                              // minute hour day-of-month month day-of-week
+	TimeZone  string    `protobuf:"bytes,4,opt,name=time_zone,json=timeZone,proto3" json:"time_zone,omitempty"`      // IANA name, e.g. "Europe/Paris", UTC when empty
+	NextRunAt string    `protobuf:"bytes,5,opt,name=next_run_at,json=nextRunAt,proto3" json:"next_run_at,omitempty"` // output only, RFC 3339
+	CreatedAt string    `protobuf:"bytes,6,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`   // output only, RFC 3339
+}
+
+func (x *GreetingSchedule) Reset() {
+	*x = GreetingSchedule{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[29]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GreetingSchedule) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GreetingSchedule) ProtoMessage() {}
+
+func (x *GreetingSchedule) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[29]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GreetingSchedule.ProtoReflect.Descriptor instead.
+func (*GreetingSchedule) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{29}
+}
+
+func (x *GreetingSchedule) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *GreetingSchedule) GetGreeting() *Greeting {
+	if x != nil {
+		return x.Greeting
+	}
+	return nil
+}
+
+func (x *GreetingSchedule) GetCron() string {
+	if x != nil {
+		return x.Cron
+	}
+	return ""
+}
+
+func (x *GreetingSchedule) GetTimeZone() string {
+	if x != nil {
+		return x.TimeZone
+	}
+	return ""
+}
+
+func (x *GreetingSchedule) GetNextRunAt() string {
+	if x != nil {
+		return x.NextRunAt
+	}
+	return ""
+}
+
+func (x *GreetingSchedule) GetCreatedAt() string {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return ""
+}
+
+type CreateGreetingScheduleRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Schedule *GreetingSchedule `protobuf:"bytes,1,opt,name=schedule,proto3" json:"schedule,omitempty"`
+}
+
+func (x *CreateGreetingScheduleRequest) Reset() {
+	*x = CreateGreetingScheduleRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[30]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CreateGreetingScheduleRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateGreetingScheduleRequest) ProtoMessage() {}
+
+func (x *CreateGreetingScheduleRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[30]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateGreetingScheduleRequest.ProtoReflect.Descriptor instead.
+func (*CreateGreetingScheduleRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{30}
+}
+
+func (x *CreateGreetingScheduleRequest) GetSchedule() *GreetingSchedule {
+	if x != nil {
+		return x.Schedule
+	}
+	return nil
+}
+
+type CreateGreetingScheduleResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Schedule *GreetingSchedule `protobuf:"bytes,1,opt,name=schedule,proto3" json:"schedule,omitempty"`
+}
+
+func (x *CreateGreetingScheduleResponse) Reset() {
+	*x = CreateGreetingScheduleResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[31]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CreateGreetingScheduleResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateGreetingScheduleResponse) ProtoMessage() {}
+
+func (x *CreateGreetingScheduleResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[31]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateGreetingScheduleResponse.ProtoReflect.Descriptor instead.
+func (*CreateGreetingScheduleResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{31}
+}
+
+func (x *CreateGreetingScheduleResponse) GetSchedule() *GreetingSchedule {
+	if x != nil {
+		return x.Schedule
+	}
+	return nil
+}
+
+type ListGreetingSchedulesRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *ListGreetingSchedulesRequest) Reset() {
+	*x = ListGreetingSchedulesRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[32]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListGreetingSchedulesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListGreetingSchedulesRequest) ProtoMessage() {}
+
+func (x *ListGreetingSchedulesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[32]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListGreetingSchedulesRequest.ProtoReflect.Descriptor instead.
+func (*ListGreetingSchedulesRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{32}
+}
+
+type ListGreetingSchedulesResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Schedules []*GreetingSchedule `protobuf:"bytes,1,rep,name=schedules,proto3" json:"schedules,omitempty"`
+}
+
+func (x *ListGreetingSchedulesResponse) Reset() {
+	*x = ListGreetingSchedulesResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[33]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListGreetingSchedulesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListGreetingSchedulesResponse) ProtoMessage() {}
+
+func (x *ListGreetingSchedulesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[33]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListGreetingSchedulesResponse.ProtoReflect.Descriptor instead.
+func (*ListGreetingSchedulesResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{33}
+}
+
+func (x *ListGreetingSchedulesResponse) GetSchedules() []*GreetingSchedule {
+	if x != nil {
+		return x.Schedules
+	}
+	return nil
+}
+
+type CancelGreetingScheduleRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (x *CancelGreetingScheduleRequest) Reset() {
+	*x = CancelGreetingScheduleRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[34]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CancelGreetingScheduleRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelGreetingScheduleRequest) ProtoMessage() {}
+
+func (x *CancelGreetingScheduleRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[34]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelGreetingScheduleRequest.ProtoReflect.Descriptor instead.
+func (*CancelGreetingScheduleRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{34}
+}
+
+func (x *CancelGreetingScheduleRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type CancelGreetingScheduleResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *CancelGreetingScheduleResponse) Reset() {
+	*x = CancelGreetingScheduleResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[35]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CancelGreetingScheduleResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelGreetingScheduleResponse) ProtoMessage() {}
+
+func (x *CancelGreetingScheduleResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[35]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelGreetingScheduleResponse.ProtoReflect.Descriptor instead.
+func (*CancelGreetingScheduleResponse) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{35}
+}
+
+type SubscribeScheduledGreetingsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ScheduleIds []string `protobuf:"bytes,1,rep,name=schedule_ids,json=scheduleIds,proto3" json:"schedule_ids,omitempty"` // empty for every schedule
+}
+
+func (x *SubscribeScheduledGreetingsRequest) Reset() {
+	*x = SubscribeScheduledGreetingsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[36]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeScheduledGreetingsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeScheduledGreetingsRequest) ProtoMessage() {}
+
+func (x *SubscribeScheduledGreetingsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[36]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeScheduledGreetingsRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeScheduledGreetingsRequest) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{36}
+}
+
+func (x *SubscribeScheduledGreetingsRequest) GetScheduleIds() []string {
+	if x != nil {
+		return x.ScheduleIds
+	}
+	return nil
+}
+
+type ScheduledGreeting struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ScheduleId string `protobuf:"bytes,1,opt,name=schedule_id,json=scheduleId,proto3" json:"schedule_id,omitempty"`
+	Result     string `protobuf:"bytes,2,opt,name=result,proto3" json:"result,omitempty"`
+	Locale     string `protobuf:"bytes,3,opt,name=locale,proto3" json:"locale,omitempty"`
+	FiredAt    string `protobuf:"bytes,4,opt,name=fired_at,json=firedAt,proto3" json:"fired_at,omitempty"` // RFC 3339
+}
+
+func (x *ScheduledGreeting) Reset() {
+	*x = ScheduledGreeting{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_greetpb_greet_proto_msgTypes[37]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScheduledGreeting) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScheduledGreeting) ProtoMessage() {}
+
+func (x *ScheduledGreeting) ProtoReflect() protoreflect.Message {
+	mi := &file_greetpb_greet_proto_msgTypes[37]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScheduledGreeting.ProtoReflect.Descriptor instead.
+func (*ScheduledGreeting) Descriptor() ([]byte, []int) {
+	return file_greetpb_greet_proto_rawDescGZIP(), []int{37}
+}
+
+func (x *ScheduledGreeting) GetScheduleId() string {
+	if x != nil {
+		return x.ScheduleId
+	}
+	return ""
+}
+
+func (x *ScheduledGreeting) GetResult() string {
+	if x != nil {
+		return x.Result
+	}
+	return ""
+}
+
+func (x *ScheduledGreeting) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+func (x *ScheduledGreeting) GetFiredAt() string {
+	if x != nil {
+		return x.FiredAt
+	}
+	return ""
+}
+
+var File_greetpb_greet_proto protoreflect.FileDescriptor
+
+var file_greetpb_greet_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x67, 0x72, 0x65, 0x65, 0x74, 0x70, 0x62, 0x2f, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x67, 0x72, 0x65, 0x65, 0x74, 0x22, 0xa6, 0x02, 0x0a,
+	0x08, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x69, 0x72,
+	0x73, 0x74, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x66,
+	0x69, 0x72, 0x73, 0x74, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x6c, 0x61, 0x73, 0x74,
+	0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6c, 0x61, 0x73,
+	0x74, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x12, 0x2e, 0x0a,
+	0x09, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x69, 0x74, 0x79, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0e,
+	0x32, 0x10, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x46, 0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x69,
+	0x74, 0x79, 0x52, 0x09, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x69, 0x74, 0x79, 0x12, 0x1a, 0x0a,
+	0x08, 0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x08, 0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x12, 0x3c, 0x0a, 0x09, 0x76, 0x61, 0x72,
+	0x69, 0x61, 0x62, 0x6c, 0x65, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x67,
+	0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x2e, 0x56, 0x61,
+	0x72, 0x69, 0x61, 0x62, 0x6c, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x09, 0x76, 0x61,
+	0x72, 0x69, 0x61, 0x62, 0x6c, 0x65, 0x73, 0x1a, 0x3c, 0x0a, 0x0e, 0x56, 0x61, 0x72, 0x69, 0x61,
+	0x62, 0x6c, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76,
+	0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75,
+	0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x3b, 0x0a, 0x0c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e,
+	0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e,
+	0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69,
+	0x6e, 0x67, 0x22, 0x3f, 0x0a, 0x0d, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c,
+	0x6f, 0x63, 0x61, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63,
+	0x61, 0x6c, 0x65, 0x22, 0xd7, 0x01, 0x0a, 0x15, 0x47, 0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e,
+	0x79, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x2b, 0x0a,
+	0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x14, 0x0a, 0x05, 0x63, 0x6f,
+	0x75, 0x6e, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x63, 0x6f, 0x75, 0x6e, 0x74,
+	0x12, 0x1f, 0x0a, 0x0b, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x5f, 0x6d, 0x73, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0a, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x4d,
+	0x73, 0x12, 0x26, 0x0a, 0x0f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f, 0x6f, 0x66, 0x66, 0x73, 0x65,
+	0x74, 0x5f, 0x6d, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0d, 0x73, 0x74, 0x61, 0x72,
+	0x74, 0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x4d, 0x73, 0x12, 0x32, 0x0a, 0x15, 0x72, 0x65, 0x73,
+	0x75, 0x6d, 0x65, 0x5f, 0x61, 0x66, 0x74, 0x65, 0x72, 0x5f, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e,
+	0x63, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x13, 0x72, 0x65, 0x73, 0x75, 0x6d, 0x65,
+	0x41, 0x66, 0x74, 0x65, 0x72, 0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x22, 0x64, 0x0a,
+	0x16, 0x47, 0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c,
+	0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12,
+	0x16, 0x0a, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65,
+	0x6e, 0x63, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65,
+	0x6e, 0x63, 0x65, 0x22, 0x3f, 0x0a, 0x10, 0x4c, 0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65, 0x74,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74,
+	0x69, 0x6e, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65,
+	0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x22, 0x43, 0x0a, 0x11, 0x4c, 0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65,
+	0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73,
+	0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c,
+	0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x22, 0x57, 0x0a, 0x14, 0x47, 0x72, 0x65,
+	0x65, 0x74, 0x45, 0x76, 0x65, 0x72, 0x79, 0x6f, 0x6e, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x12,
+	0x0a, 0x04, 0x72, 0x6f, 0x6f, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x72, 0x6f,
+	0x6f, 0x6d, 0x22, 0xbf, 0x01, 0x0a, 0x15, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76, 0x65, 0x72,
+	0x79, 0x6f, 0x6e, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06,
+	0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65,
+	0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x72, 0x6f, 0x6f, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x72, 0x6f, 0x6f, 0x6d,
+	0x12, 0x16, 0x0a, 0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x12, 0x26, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e,
+	0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x10, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e,
+	0x52, 0x6f, 0x6f, 0x6d, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x52, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74,
+	0x12, 0x22, 0x0a, 0x0c, 0x70, 0x61, 0x72, 0x74, 0x69, 0x63, 0x69, 0x70, 0x61, 0x6e, 0x74, 0x73,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0c, 0x70, 0x61, 0x72, 0x74, 0x69, 0x63, 0x69, 0x70,
+	0x61, 0x6e, 0x74, 0x73, 0x22, 0x60, 0x0a, 0x18, 0x47, 0x72, 0x65, 0x65, 0x74, 0x57, 0x69, 0x74,
+	0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69, 0x6e, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74,
+	0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x17, 0x0a,
+	0x07, 0x77, 0x6f, 0x72, 0x6b, 0x5f, 0x6d, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06,
+	0x77, 0x6f, 0x72, 0x6b, 0x4d, 0x73, 0x22, 0x4b, 0x0a, 0x19, 0x47, 0x72, 0x65, 0x65, 0x74, 0x57,
+	0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69, 0x6e, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c,
+	0x6f, 0x63, 0x61, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63,
+	0x61, 0x6c, 0x65, 0x22, 0x8d, 0x01, 0x0a, 0x10, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x74, 0x65, 0x78, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x65, 0x78, 0x74,
+	0x12, 0x33, 0x0a, 0x08, 0x65, 0x73, 0x63, 0x61, 0x70, 0x69, 0x6e, 0x67, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0e, 0x32, 0x17, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x54, 0x65, 0x6d, 0x70, 0x6c,
+	0x61, 0x74, 0x65, 0x45, 0x73, 0x63, 0x61, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x65, 0x73, 0x63,
+	0x61, 0x70, 0x69, 0x6e, 0x67, 0x12, 0x1c, 0x0a, 0x09, 0x76, 0x61, 0x72, 0x69, 0x61, 0x62, 0x6c,
+	0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x76, 0x61, 0x72, 0x69, 0x61, 0x62,
+	0x6c, 0x65, 0x73, 0x22, 0x54, 0x0a, 0x1d, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x47, 0x72, 0x65,
+	0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x12, 0x33, 0x0a, 0x08, 0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47,
+	0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x52,
+	0x08, 0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x22, 0x55, 0x0a, 0x1e, 0x43, 0x72, 0x65,
+	0x61, 0x74, 0x65, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c,
+	0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x33, 0x0a, 0x08, 0x74,
+	0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e,
+	0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65,
+	0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x52, 0x08, 0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65,
+	0x22, 0x1e, 0x0a, 0x1c, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x22, 0x56, 0x0a, 0x1d, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x35, 0x0a, 0x09, 0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x73, 0x18, 0x01,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65,
+	0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x52, 0x09, 0x74,
+	0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x73, 0x22, 0xa4, 0x01, 0x0a, 0x1e, 0x50, 0x72, 0x65,
+	0x76, 0x69, 0x65, 0x77, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70,
+	0x6c, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x14, 0x0a, 0x04, 0x6e,
+	0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x04, 0x6e, 0x61, 0x6d,
+	0x65, 0x12, 0x35, 0x0a, 0x08, 0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x48, 0x00, 0x52, 0x08,
+	0x74, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x12, 0x2b, 0x0a, 0x08, 0x67, 0x72, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65,
+	0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x08, 0x67, 0x72, 0x65,
+	0x65, 0x74, 0x69, 0x6e, 0x67, 0x42, 0x08, 0x0a, 0x06, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x22,
+	0x51, 0x0a, 0x1f, 0x50, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69,
+	0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x6f,
+	0x63, 0x61, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63, 0x61,
+	0x6c, 0x65, 0x22, 0xf2, 0x01, 0x0a, 0x08, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x12,
+	0x1d, 0x0a, 0x0a, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x09, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x12, 0x12,
+	0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61,
+	0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x72, 0x6f,
+	0x6f, 0x6d, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x72, 0x6f, 0x6f, 0x6d, 0x12, 0x12,
+	0x0a, 0x04, 0x70, 0x65, 0x65, 0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x65,
+	0x65, 0x72, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x65, 0x64, 0x5f,
+	0x61, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63,
+	0x74, 0x65, 0x64, 0x41, 0x74, 0x12, 0x24, 0x0a, 0x0e, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x61, 0x63,
+	0x74, 0x69, 0x76, 0x65, 0x5f, 0x61, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x6c,
+	0x61, 0x73, 0x74, 0x41, 0x63, 0x74, 0x69, 0x76, 0x65, 0x41, 0x74, 0x12, 0x2a, 0x0a, 0x05, 0x73,
+	0x74, 0x61, 0x74, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x14, 0x2e, 0x67, 0x72, 0x65,
+	0x65, 0x74, 0x2e, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65,
+	0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x22, 0x15, 0x0a, 0x13, 0x4c, 0x69, 0x73, 0x74, 0x50,
+	0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x43,
+	0x0a, 0x14, 0x4c, 0x69, 0x73, 0x74, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2b, 0x0a, 0x08, 0x70, 0x72, 0x65, 0x73, 0x65, 0x6e,
+	0x63, 0x65, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74,
+	0x2e, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x52, 0x08, 0x70, 0x72, 0x65, 0x73, 0x65,
+	0x6e, 0x63, 0x65, 0x22, 0x16, 0x0a, 0x14, 0x57, 0x61, 0x74, 0x63, 0x68, 0x50, 0x72, 0x65, 0x73,
+	0x65, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x3c, 0x0a, 0x0d, 0x50,
+	0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x2b, 0x0a, 0x08,
+	0x70, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f,
+	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x52,
+	0x08, 0x70, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x22, 0xb1, 0x01, 0x0a, 0x0c, 0x48, 0x69,
+	0x73, 0x74, 0x6f, 0x72, 0x79, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x69,
+	0x72, 0x73, 0x74, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09,
+	0x66, 0x69, 0x72, 0x73, 0x74, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x6c, 0x61, 0x73,
+	0x74, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6c, 0x61,
+	0x73, 0x74, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x16,
+	0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06,
+	0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65, 0x12, 0x1d,
+	0x0a, 0x0a, 0x67, 0x72, 0x65, 0x65, 0x74, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x09, 0x67, 0x72, 0x65, 0x65, 0x74, 0x65, 0x64, 0x41, 0x74, 0x22, 0x6e, 0x0a,
+	0x13, 0x51, 0x75, 0x65, 0x72, 0x79, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x66, 0x69, 0x72, 0x73, 0x74, 0x5f, 0x6e, 0x61,
+	0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x66, 0x69, 0x72, 0x73, 0x74, 0x4e,
+	0x61, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x02, 0x74, 0x6f, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x22, 0x45, 0x0a,
+	0x14, 0x51, 0x75, 0x65, 0x72, 0x79, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2d, 0x0a, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73,
+	0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x48,
+	0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x07, 0x65, 0x6e, 0x74,
+	0x72, 0x69, 0x65, 0x73, 0x22, 0x3b, 0x0a, 0x15, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x43, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a,
+	0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x66, 0x72, 0x6f,
+	0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x74,
+	0x6f, 0x22, 0x40, 0x0a, 0x09, 0x4e, 0x61, 0x6d, 0x65, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x1d,
+	0x0a, 0x0a, 0x66, 0x69, 0x72, 0x73, 0x74, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x09, 0x66, 0x69, 0x72, 0x73, 0x74, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x14, 0x0a,
+	0x05, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x63, 0x6f,
+	0x75, 0x6e, 0x74, 0x22, 0x42, 0x0a, 0x16, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x43,
+	0x6f, 0x75, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x28, 0x0a,
+	0x06, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x10, 0x2e,
+	0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4e, 0x61, 0x6d, 0x65, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x52,
+	0x06, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x22, 0xbf, 0x01, 0x0a, 0x10, 0x47, 0x72, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x12, 0x0e, 0x0a, 0x02,
+	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x2b, 0x0a, 0x08,
+	0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f,
+	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x52,
+	0x08, 0x67, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x12, 0x0a, 0x04, 0x63, 0x72, 0x6f,
+	0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x63, 0x72, 0x6f, 0x6e, 0x12, 0x1b, 0x0a,
+	0x09, 0x74, 0x69, 0x6d, 0x65, 0x5f, 0x7a, 0x6f, 0x6e, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x08, 0x74, 0x69, 0x6d, 0x65, 0x5a, 0x6f, 0x6e, 0x65, 0x12, 0x1e, 0x0a, 0x0b, 0x6e, 0x65,
+	0x78, 0x74, 0x5f, 0x72, 0x75, 0x6e, 0x5f, 0x61, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x09, 0x6e, 0x65, 0x78, 0x74, 0x52, 0x75, 0x6e, 0x41, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x72,
+	0x65, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09,
+	0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x22, 0x54, 0x0a, 0x1d, 0x43, 0x72, 0x65,
+	0x61, 0x74, 0x65, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64,
+	0x75, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x33, 0x0a, 0x08, 0x73, 0x63,
+	0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x67,
+	0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68,
+	0x65, 0x64, 0x75, 0x6c, 0x65, 0x52, 0x08, 0x73, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x22,
+	0x55, 0x0a, 0x1e, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e,
+	0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x33, 0x0a, 0x08, 0x73, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x52, 0x08, 0x73, 0x63,
+	0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x22, 0x1e, 0x0a, 0x1c, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72,
+	0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x22, 0x56, 0x0a, 0x1d, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72,
+	0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x35, 0x0a, 0x09, 0x73, 0x63, 0x68, 0x65, 0x64,
+	0x75, 0x6c, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x67, 0x72, 0x65,
+	0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64,
+	0x75, 0x6c, 0x65, 0x52, 0x09, 0x73, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x73, 0x22, 0x2f,
+	0x0a, 0x1d, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x22,
+	0x20, 0x0a, 0x1e, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e,
+	0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x22, 0x47, 0x0a, 0x22, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x53, 0x63,
+	0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x64, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x73,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x73, 0x63, 0x68, 0x65, 0x64,
+	0x75, 0x6c, 0x65, 0x5f, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x73,
+	0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x49, 0x64, 0x73, 0x22, 0x7f, 0x0a, 0x11, 0x53, 0x63,
+	0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x64, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x12,
+	0x1f, 0x0a, 0x0b, 0x73, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x73, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x49, 0x64,
+	0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x6f, 0x63, 0x61,
+	0x6c, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x65,
+	0x12, 0x19, 0x0a, 0x08, 0x66, 0x69, 0x72, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x07, 0x66, 0x69, 0x72, 0x65, 0x64, 0x41, 0x74, 0x2a, 0x54, 0x0a, 0x09, 0x46,
+	0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x69, 0x74, 0x79, 0x12, 0x19, 0x0a, 0x15, 0x46, 0x4f, 0x52, 0x4d,
+	0x41, 0x4c, 0x49, 0x54, 0x59, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45,
+	0x44, 0x10, 0x00, 0x12, 0x16, 0x0a, 0x12, 0x46, 0x4f, 0x52, 0x4d, 0x41, 0x4c, 0x49, 0x54, 0x59,
+	0x5f, 0x49, 0x4e, 0x46, 0x4f, 0x52, 0x4d, 0x41, 0x4c, 0x10, 0x01, 0x12, 0x14, 0x0a, 0x10, 0x46,
+	0x4f, 0x52, 0x4d, 0x41, 0x4c, 0x49, 0x54, 0x59, 0x5f, 0x46, 0x4f, 0x52, 0x4d, 0x41, 0x4c, 0x10,
+	0x02, 0x2a, 0x4f, 0x0a, 0x09, 0x52, 0x6f, 0x6f, 0x6d, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x16,
+	0x0a, 0x12, 0x52, 0x4f, 0x4f, 0x4d, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x4d, 0x45, 0x53,
+	0x53, 0x41, 0x47, 0x45, 0x10, 0x00, 0x12, 0x15, 0x0a, 0x11, 0x52, 0x4f, 0x4f, 0x4d, 0x5f, 0x45,
+	0x56, 0x45, 0x4e, 0x54, 0x5f, 0x4a, 0x4f, 0x49, 0x4e, 0x45, 0x44, 0x10, 0x01, 0x12, 0x13, 0x0a,
+	0x0f, 0x52, 0x4f, 0x4f, 0x4d, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x4c, 0x45, 0x46, 0x54,
+	0x10, 0x02, 0x2a, 0x4a, 0x0a, 0x10, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x45, 0x73,
+	0x63, 0x61, 0x70, 0x69, 0x6e, 0x67, 0x12, 0x1a, 0x0a, 0x16, 0x54, 0x45, 0x4d, 0x50, 0x4c, 0x41,
+	0x54, 0x45, 0x5f, 0x45, 0x53, 0x43, 0x41, 0x50, 0x49, 0x4e, 0x47, 0x5f, 0x4e, 0x4f, 0x4e, 0x45,
+	0x10, 0x00, 0x12, 0x1a, 0x0a, 0x16, 0x54, 0x45, 0x4d, 0x50, 0x4c, 0x41, 0x54, 0x45, 0x5f, 0x45,
+	0x53, 0x43, 0x41, 0x50, 0x49, 0x4e, 0x47, 0x5f, 0x48, 0x54, 0x4d, 0x4c, 0x10, 0x01, 0x2a, 0x7f,
+	0x0a, 0x0d, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12,
+	0x1e, 0x0a, 0x1a, 0x50, 0x52, 0x45, 0x53, 0x45, 0x4e, 0x43, 0x45, 0x5f, 0x53, 0x54, 0x41, 0x54,
+	0x45, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12,
+	0x19, 0x0a, 0x15, 0x50, 0x52, 0x45, 0x53, 0x45, 0x4e, 0x43, 0x45, 0x5f, 0x53, 0x54, 0x41, 0x54,
+	0x45, 0x5f, 0x4f, 0x4e, 0x4c, 0x49, 0x4e, 0x45, 0x10, 0x01, 0x12, 0x17, 0x0a, 0x13, 0x50, 0x52,
+	0x45, 0x53, 0x45, 0x4e, 0x43, 0x45, 0x5f, 0x53, 0x54, 0x41, 0x54, 0x45, 0x5f, 0x49, 0x44, 0x4c,
+	0x45, 0x10, 0x02, 0x12, 0x1a, 0x0a, 0x16, 0x50, 0x52, 0x45, 0x53, 0x45, 0x4e, 0x43, 0x45, 0x5f,
+	0x53, 0x54, 0x41, 0x54, 0x45, 0x5f, 0x4f, 0x46, 0x46, 0x4c, 0x49, 0x4e, 0x45, 0x10, 0x03, 0x32,
+	0x8f, 0x0b, 0x0a, 0x0c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65,
+	0x12, 0x34, 0x0a, 0x05, 0x47, 0x72, 0x65, 0x65, 0x74, 0x12, 0x13, 0x2e, 0x67, 0x72, 0x65, 0x65,
+	0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x14,
+	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x51, 0x0a, 0x0e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x4d,
+	0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x12, 0x1c, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74,
+	0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1d, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47,
+	0x72, 0x65, 0x65, 0x74, 0x4d, 0x61, 0x6e, 0x79, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x30, 0x01, 0x12, 0x42, 0x0a, 0x09, 0x4c, 0x6f, 0x6e,
+	0x67, 0x47, 0x72, 0x65, 0x65, 0x74, 0x12, 0x17, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4c,
+	0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x18, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4c, 0x6f, 0x6e, 0x67, 0x47, 0x72, 0x65, 0x65,
+	0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x12, 0x4e, 0x0a,
+	0x0d, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76, 0x65, 0x72, 0x79, 0x6f, 0x6e, 0x65, 0x12, 0x1b,
+	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76, 0x65, 0x72,
+	0x79, 0x6f, 0x6e, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1c, 0x2e, 0x67, 0x72,
+	0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x45, 0x76, 0x65, 0x72, 0x79, 0x6f, 0x6e,
+	0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x28, 0x01, 0x30, 0x01, 0x12, 0x58, 0x0a,
+	0x11, 0x47, 0x72, 0x65, 0x65, 0x74, 0x57, 0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69,
+	0x6e, 0x65, 0x12, 0x1f, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74,
+	0x57, 0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69, 0x6e, 0x65, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x20, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65,
+	0x74, 0x57, 0x69, 0x74, 0x68, 0x44, 0x65, 0x61, 0x64, 0x6c, 0x69, 0x6e, 0x65, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x67, 0x0a, 0x16, 0x43, 0x72, 0x65, 0x61, 0x74,
+	0x65, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74,
+	0x65, 0x12, 0x24, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65,
+	0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x25, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e,
+	0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65,
+	0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
+	0x12, 0x64, 0x0a, 0x15, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x73, 0x12, 0x23, 0x2e, 0x67, 0x72, 0x65, 0x65,
+	0x74, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65,
+	0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x24,
+	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72, 0x65, 0x65, 0x74,
+	0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x6a, 0x0a, 0x17, 0x50, 0x72, 0x65, 0x76, 0x69, 0x65,
+	0x77, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74,
+	0x65, 0x12, 0x25, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x50, 0x72, 0x65, 0x76, 0x69, 0x65,
+	0x77, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74,
+	0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x26, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74,
+	0x2e, 0x50, 0x72, 0x65, 0x76, 0x69, 0x65, 0x77, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
+	0x54, 0x65, 0x6d, 0x70, 0x6c, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0x00, 0x12, 0x49, 0x0a, 0x0c, 0x4c, 0x69, 0x73, 0x74, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e,
+	0x63, 0x65, 0x12, 0x1a, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x50,
+	0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b,
+	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x50, 0x72, 0x65, 0x73, 0x65,
+	0x6e, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x46, 0x0a,
+	0x0d, 0x57, 0x61, 0x74, 0x63, 0x68, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x12, 0x1b,
+	0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x50, 0x72, 0x65, 0x73,
+	0x65, 0x6e, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x14, 0x2e, 0x67, 0x72,
+	0x65, 0x65, 0x74, 0x2e, 0x50, 0x72, 0x65, 0x73, 0x65, 0x6e, 0x63, 0x65, 0x45, 0x76, 0x65, 0x6e,
+	0x74, 0x22, 0x00, 0x30, 0x01, 0x12, 0x49, 0x0a, 0x0c, 0x51, 0x75, 0x65, 0x72, 0x79, 0x48, 0x69,
+	0x73, 0x74, 0x6f, 0x72, 0x79, 0x12, 0x1a, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x51, 0x75,
+	0x65, 0x72, 0x79, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x1b, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x51, 0x75, 0x65, 0x72, 0x79, 0x48,
+	0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
+	0x12, 0x4f, 0x0a, 0x0e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x43, 0x6f, 0x75, 0x6e,
+	0x74, 0x73, 0x12, 0x1c, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74,
+	0x69, 0x6e, 0x67, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x1a, 0x1d, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e,
+	0x67, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22,
+	0x00, 0x12, 0x67, 0x0a, 0x16, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x47, 0x72, 0x65, 0x65, 0x74,
+	0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x12, 0x24, 0x2e, 0x67, 0x72,
+	0x65, 0x65, 0x74, 0x2e, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69,
+	0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x25, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65,
+	0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x64, 0x0a, 0x15, 0x4c, 0x69,
+	0x73, 0x74, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75,
+	0x6c, 0x65, 0x73, 0x12, 0x23, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x4c, 0x69, 0x73, 0x74,
+	0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65,
+	0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x24, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74,
+	0x2e, 0x4c, 0x69, 0x73, 0x74, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68,
+	0x65, 0x64, 0x75, 0x6c, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
+	0x12, 0x67, 0x0a, 0x16, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69,
+	0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x12, 0x24, 0x2e, 0x67, 0x72, 0x65,
+	0x65, 0x74, 0x2e, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e,
+	0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x1a, 0x25, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x47,
+	0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x66, 0x0a, 0x1b, 0x53, 0x75, 0x62,
+	0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x64, 0x47,
+	0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x73, 0x12, 0x29, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74,
+	0x2e, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x53, 0x63, 0x68, 0x65, 0x64, 0x75,
+	0x6c, 0x65, 0x64, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x73, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x67, 0x72, 0x65, 0x65, 0x74, 0x2e, 0x53, 0x63, 0x68, 0x65,
+	0x64, 0x75, 0x6c, 0x65, 0x64, 0x47, 0x72, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x22, 0x00, 0x30,
+	0x01, 0x42, 0x0a, 0x5a, 0x08, 0x2f, 0x67, 0x72, 0x65, 0x65, 0x74, 0x70, 0x62, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_greetpb_greet_proto_rawDescOnce sync.Once
+	file_greetpb_greet_proto_rawDescData = file_greetpb_greet_proto_rawDesc
+)
+
+func file_greetpb_greet_proto_rawDescGZIP() []byte {
+	file_greetpb_greet_proto_rawDescOnce.Do(func() {
+		file_greetpb_greet_proto_rawDescData = protoimpl.X.CompressGZIP(file_greetpb_greet_proto_rawDescData)
+	})
+	return file_greetpb_greet_proto_rawDescData
+}
+
+var file_greetpb_greet_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_greetpb_greet_proto_msgTypes = make([]protoimpl.MessageInfo, 39)
+var file_greetpb_greet_proto_goTypes = []interface{}{
+	(Formality)(0),                             // 0: greet.Formality
+	(RoomEvent)(0),                             // 1: greet.RoomEvent
+	(TemplateEscaping)(0),                      // 2: greet.TemplateEscaping
+	(PresenceState)(0),                         // 3: greet.PresenceState
+	(*Greeting)(nil),                           // 4: greet.Greeting
+	(*GreetRequest)(nil),                       // 5: greet.GreetRequest
+	(*GreetResponse)(nil),                      // 6: greet.GreetResponse
+	(*GreetManyTimesRequest)(nil),              // 7: greet.GreetManyTimesRequest
+	(*GreetManyTimesResponse)(nil),             // 8: greet.GreetManyTimesResponse
+	(*LongGreetRequest)(nil),                   // 9: greet.LongGreetRequest
+	(*LongGreetResponse)(nil),                  // 10: greet.LongGreetResponse
+	(*GreetEveryoneRequest)(nil),               // 11: greet.GreetEveryoneRequest
+	(*GreetEveryoneResponse)(nil),              // 12: greet.GreetEveryoneResponse
+	(*GreetWithDeadlineRequest)(nil),           // 13: greet.GreetWithDeadlineRequest
+	(*GreetWithDeadlineResponse)(nil),          // 14: greet.GreetWithDeadlineResponse
+	(*GreetingTemplate)(nil),                   // 15: greet.GreetingTemplate
+	(*CreateGreetingTemplateRequest)(nil),      // 16: greet.CreateGreetingTemplateRequest
+	(*CreateGreetingTemplateResponse)(nil),     // 17: greet.CreateGreetingTemplateResponse
+	(*ListGreetingTemplatesRequest)(nil),       // 18: greet.ListGreetingTemplatesRequest
+	(*ListGreetingTemplatesResponse)(nil),      // 19: greet.ListGreetingTemplatesResponse
+	(*PreviewGreetingTemplateRequest)(nil),     // 20: greet.PreviewGreetingTemplateRequest
+	(*PreviewGreetingTemplateResponse)(nil),    // 21: greet.PreviewGreetingTemplateResponse
+	(*Presence)(nil),                           // 22: greet.Presence
+	(*ListPresenceRequest)(nil),                // 23: greet.ListPresenceRequest
+	(*ListPresenceResponse)(nil),               // 24: greet.ListPresenceResponse
+	(*WatchPresenceRequest)(nil),               // 25: greet.WatchPresenceRequest
+	(*PresenceEvent)(nil),                      // 26: greet.PresenceEvent
+	(*HistoryEntry)(nil),                       // 27: greet.HistoryEntry
+	(*QueryHistoryRequest)(nil),                // 28: greet.QueryHistoryRequest
+	(*QueryHistoryResponse)(nil),               // 29: greet.QueryHistoryResponse
+	(*GreetingCountsRequest)(nil),              // 30: greet.GreetingCountsRequest
+	(*NameCount)(nil),                          // 31: greet.NameCount
+	(*GreetingCountsResponse)(nil),             // 32: greet.GreetingCountsResponse
+	(*GreetingSchedule)(nil),                   // 33: greet.GreetingSchedule
+	(*CreateGreetingScheduleRequest)(nil),      // 34: greet.CreateGreetingScheduleRequest
+	(*CreateGreetingScheduleResponse)(nil),     // 35: greet.CreateGreetingScheduleResponse
+	(*ListGreetingSchedulesRequest)(nil),       // 36: greet.ListGreetingSchedulesRequest
+	(*ListGreetingSchedulesResponse)(nil),      // 37: greet.ListGreetingSchedulesResponse
+	(*CancelGreetingScheduleRequest)(nil),      // 38: greet.CancelGreetingScheduleRequest
+	(*CancelGreetingScheduleResponse)(nil),     // 39: greet.CancelGreetingScheduleResponse
+	(*SubscribeScheduledGreetingsRequest)(nil), // 40: greet.SubscribeScheduledGreetingsRequest
+	(*ScheduledGreeting)(nil),                  // 41: greet.ScheduledGreeting
+	nil,                                        // 42: greet.Greeting.VariablesEntry
+}
+var file_greetpb_greet_proto_depIdxs = []int32{
+	0,  // 0: greet.Greeting.formality:type_name -> greet.Formality
+	42, // 1: greet.Greeting.variables:type_name -> greet.Greeting.VariablesEntry
+	4,  // 2: greet.GreetRequest.greeting:type_name -> greet.Greeting
+	4,  // 3: greet.GreetManyTimesRequest.greeting:type_name -> greet.Greeting
+	4,  // 4: greet.LongGreetRequest.greeting:type_name -> greet.Greeting
+	4,  // 5: greet.GreetEveryoneRequest.greeting:type_name -> greet.Greeting
+	1,  // 6: greet.GreetEveryoneResponse.event:type_name -> greet.RoomEvent
+	4,  // 7: greet.GreetWithDeadlineRequest.greeting:type_name -> greet.Greeting
+	2,  // 8: greet.GreetingTemplate.escaping:type_name -> greet.TemplateEscaping
+	15, // 9: greet.CreateGreetingTemplateRequest.template:type_name -> greet.GreetingTemplate
+	15, // 10: greet.CreateGreetingTemplateResponse.template:type_name -> greet.GreetingTemplate
+	15, // 11: greet.ListGreetingTemplatesResponse.templates:type_name -> greet.GreetingTemplate
+	15, // 12: greet.PreviewGreetingTemplateRequest.template:type_name -> greet.GreetingTemplate
+	4,  // 13: greet.PreviewGreetingTemplateRequest.greeting:type_name -> greet.Greeting
+	3,  // 14: greet.Presence.state:type_name -> greet.PresenceState
+	22, // 15: greet.ListPresenceResponse.presence:type_name -> greet.Presence
+	22, // 16: greet.PresenceEvent.presence:type_name -> greet.Presence
+	27, // 17: greet.QueryHistoryResponse.entries:type_name -> greet.HistoryEntry
+	31, // 18: greet.GreetingCountsResponse.counts:type_name -> greet.NameCount
+	4,  // 19: greet.GreetingSchedule.greeting:type_name -> greet.Greeting
+	33, // 20: greet.CreateGreetingScheduleRequest.schedule:type_name -> greet.GreetingSchedule
+	33, // 21: greet.CreateGreetingScheduleResponse.schedule:type_name -> greet.GreetingSchedule
+	33, // 22: greet.ListGreetingSchedulesResponse.schedules:type_name -> greet.GreetingSchedule
+	5,  // 23: greet.GreetService.Greet:input_type -> greet.GreetRequest
+	7,  // 24: greet.GreetService.GreetManyTimes:input_type -> greet.GreetManyTimesRequest
+	9,  // 25: greet.GreetService.LongGreet:input_type -> greet.LongGreetRequest
+	11, // 26: greet.GreetService.GreetEveryone:input_type -> greet.GreetEveryoneRequest
+	13, // 27: greet.GreetService.GreetWithDeadline:input_type -> greet.GreetWithDeadlineRequest
+	16, // 28: greet.GreetService.CreateGreetingTemplate:input_type -> greet.CreateGreetingTemplateRequest
+	18, // 29: greet.GreetService.ListGreetingTemplates:input_type -> greet.ListGreetingTemplatesRequest
+	20, // 30: greet.GreetService.PreviewGreetingTemplate:input_type -> greet.PreviewGreetingTemplateRequest
+	23, // 31: greet.GreetService.ListPresence:input_type -> greet.ListPresenceRequest
+	25, // 32: greet.GreetService.WatchPresence:input_type -> greet.WatchPresenceRequest
+	28, // 33: greet.GreetService.QueryHistory:input_type -> greet.QueryHistoryRequest
+	30, // 34: greet.GreetService.GreetingCounts:input_type -> greet.GreetingCountsRequest
+	34, // 35: greet.GreetService.CreateGreetingSchedule:input_type -> greet.CreateGreetingScheduleRequest
+	36, // 36: greet.GreetService.ListGreetingSchedules:input_type -> greet.ListGreetingSchedulesRequest
+	38, // 37: greet.GreetService.CancelGreetingSchedule:input_type -> greet.CancelGreetingScheduleRequest
+	40, // 38: greet.GreetService.SubscribeScheduledGreetings:input_type -> greet.SubscribeScheduledGreetingsRequest
+	6,  // 39: greet.GreetService.Greet:output_type -> greet.GreetResponse
+	8,  // 40: greet.GreetService.GreetManyTimes:output_type -> greet.GreetManyTimesResponse
+	10, // 41: greet.GreetService.LongGreet:output_type -> greet.LongGreetResponse
+	12, // 42: greet.GreetService.GreetEveryone:output_type -> greet.GreetEveryoneResponse
+	14, // 43: greet.GreetService.GreetWithDeadline:output_type -> greet.GreetWithDeadlineResponse
+	17, // 44: greet.GreetService.CreateGreetingTemplate:output_type -> greet.CreateGreetingTemplateResponse
+	19, // 45: greet.GreetService.ListGreetingTemplates:output_type -> greet.ListGreetingTemplatesResponse
+	21, // 46: greet.GreetService.PreviewGreetingTemplate:output_type -> greet.PreviewGreetingTemplateResponse
+	24, // 47: greet.GreetService.ListPresence:output_type -> greet.ListPresenceResponse
+	26, // 48: greet.GreetService.WatchPresence:output_type -> greet.PresenceEvent
+	29, // 49: greet.GreetService.QueryHistory:output_type -> greet.QueryHistoryResponse
+	32, // 50: greet.GreetService.GreetingCounts:output_type -> greet.GreetingCountsResponse
+	35, // 51: greet.GreetService.CreateGreetingSchedule:output_type -> greet.CreateGreetingScheduleResponse
+	37, // 52: greet.GreetService.ListGreetingSchedules:output_type -> greet.ListGreetingSchedulesResponse
+	39, // 53: greet.GreetService.CancelGreetingSchedule:output_type -> greet.CancelGreetingScheduleResponse
+	41, // 54: greet.GreetService.SubscribeScheduledGreetings:output_type -> greet.ScheduledGreeting
+	39, // [39:55] is the sub-list for method output_type
+	23, // [23:39] is the sub-list for method input_type
+	23, // [23:23] is the sub-list for extension type_name
+	23, // [23:23] is the sub-list for extension extendee
+	0,  // [0:23] is the sub-list for field type_name
+}
+
+func init() { file_greetpb_greet_proto_init() }
+func file_greetpb_greet_proto_init() {
+	if File_greetpb_greet_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_greetpb_greet_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Greeting); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetManyTimesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetManyTimesResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LongGreetRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LongGreetResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetEveryoneRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetEveryoneResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetWithDeadlineRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetWithDeadlineResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetingTemplate); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CreateGreetingTemplateRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CreateGreetingTemplateResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListGreetingTemplatesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListGreetingTemplatesResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[16].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PreviewGreetingTemplateRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[17].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PreviewGreetingTemplateResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[18].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Presence); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[19].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListPresenceRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
 			case 2:
 				return &v.unknownFields
 			default:
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetManyTimesRequest); i {
+		file_greetpb_greet_proto_msgTypes[20].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListPresenceResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -725,8 +3146,8 @@ func file_greetpb_greet_proto_init() {
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetManyTimesResponse); i {
+		file_greetpb_greet_proto_msgTypes[21].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchPresenceRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -737,8 +3158,8 @@ func file_greetpb_greet_proto_init() {
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*LongGreetRequest); i {
+		file_greetpb_greet_proto_msgTypes[22].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PresenceEvent); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -749,8 +3170,8 @@ func file_greetpb_greet_proto_init() {
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*LongGreetResponse); i {
+		file_greetpb_greet_proto_msgTypes[23].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HistoryEntry); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -761,8 +3182,8 @@ func file_greetpb_greet_proto_init() {
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetEveryoneRequest); i {
+		file_greetpb_greet_proto_msgTypes[24].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*QueryHistoryRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -773,8 +3194,8 @@ func file_greetpb_greet_proto_init() {
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetEveryoneResponse); i {
+		file_greetpb_greet_proto_msgTypes[25].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*QueryHistoryResponse); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -785,8 +3206,8 @@ func file_greetpb_greet_proto_init() {
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetWithDeadlineRequest); i {
+		file_greetpb_greet_proto_msgTypes[26].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetingCountsRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -797,8 +3218,128 @@ func file_greetpb_greet_proto_init() {
 				return nil
 			}
 		}
-		file_greetpb_greet_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*GreetWithDeadlineResponse); i {
+		file_greetpb_greet_proto_msgTypes[27].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*NameCount); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[28].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetingCountsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[29].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GreetingSchedule); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[30].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CreateGreetingScheduleRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[31].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CreateGreetingScheduleResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[32].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListGreetingSchedulesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[33].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListGreetingSchedulesResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[34].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CancelGreetingScheduleRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[35].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CancelGreetingScheduleResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[36].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SubscribeScheduledGreetingsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_greetpb_greet_proto_msgTypes[37].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScheduledGreeting); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -810,18 +3351,23 @@ func file_greetpb_greet_proto_init() {
 			}
 		}
 	}
+	file_greetpb_greet_proto_msgTypes[16].OneofWrappers = []interface{}{
+		(*PreviewGreetingTemplateRequest_Name)(nil),
+		(*PreviewGreetingTemplateRequest_Template)(nil),
+	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_greetpb_greet_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   11,
+			NumEnums:      4,
+			NumMessages:   39,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_greetpb_greet_proto_goTypes,
 		DependencyIndexes: file_greetpb_greet_proto_depIdxs,
+		EnumInfos:         file_greetpb_greet_proto_enumTypes,
 		MessageInfos:      file_greetpb_greet_proto_msgTypes,
 	}.Build()
 	File_greetpb_greet_proto = out.File
@@ -852,6 +3398,21 @@ type GreetServiceClient interface {
 	GreetEveryone(ctx context.Context, opts ...grpc.CallOption) (GreetService_GreetEveryoneClient, error)
 	// unary with Deadline
 	GreetWithDeadline(ctx context.Context, in *GreetWithDeadlineRequest, opts ...grpc.CallOption) (*GreetWithDeadlineResponse, error)
+	// greeting templates
+	CreateGreetingTemplate(ctx context.Context, in *CreateGreetingTemplateRequest, opts ...grpc.CallOption) (*CreateGreetingTemplateResponse, error)
+	ListGreetingTemplates(ctx context.Context, in *ListGreetingTemplatesRequest, opts ...grpc.CallOption) (*ListGreetingTemplatesResponse, error)
+	PreviewGreetingTemplate(ctx context.Context, in *PreviewGreetingTemplateRequest, opts ...grpc.CallOption) (*PreviewGreetingTemplateResponse, error)
+	// presence of streaming clients, WatchPresence starts with the clients connected
+	ListPresence(ctx context.Context, in *ListPresenceRequest, opts ...grpc.CallOption) (*ListPresenceResponse, error)
+	WatchPresence(ctx context.Context, in *WatchPresenceRequest, opts ...grpc.CallOption) (GreetService_WatchPresenceClient, error)
+	// greeting history
+	QueryHistory(ctx context.Context, in *QueryHistoryRequest, opts ...grpc.CallOption) (*QueryHistoryResponse, error)
+	GreetingCounts(ctx context.Context, in *GreetingCountsRequest, opts ...grpc.CallOption) (*GreetingCountsResponse, error)
+	// scheduled greetings
+	CreateGreetingSchedule(ctx context.Context, in *CreateGreetingScheduleRequest, opts ...grpc.CallOption) (*CreateGreetingScheduleResponse, error)
+	ListGreetingSchedules(ctx context.Context, in *ListGreetingSchedulesRequest, opts ...grpc.CallOption) (*ListGreetingSchedulesResponse, error)
+	CancelGreetingSchedule(ctx context.Context, in *CancelGreetingScheduleRequest, opts ...grpc.CallOption) (*CancelGreetingScheduleResponse, error)
+	SubscribeScheduledGreetings(ctx context.Context, in *SubscribeScheduledGreetingsRequest, opts ...grpc.CallOption) (GreetService_SubscribeScheduledGreetingsClient, error)
 }
 
 type greetServiceClient struct {
@@ -862,21 +3423,163 @@ func NewGreetServiceClient(cc grpc.ClientConnInterface) GreetServiceClient {
 	return &greetServiceClient{cc}
 }
 
-func (c *greetServiceClient) Greet(ctx context.Context, in *GreetRequest, opts ...grpc.CallOption) (*GreetResponse, error) {
-	out := new(GreetResponse)
-	err := c.cc.Invoke(ctx, "/greet.GreetService/Greet", in, out, opts...)
+func (c *greetServiceClient) Greet(ctx context.Context, in *GreetRequest, opts ...grpc.CallOption) (*GreetResponse, error) {
+	out := new(GreetResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/Greet", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *greetServiceClient) GreetManyTimes(ctx context.Context, in *GreetManyTimesRequest, opts ...grpc.CallOption) (GreetService_GreetManyTimesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[0], "/greet.GreetService/GreetManyTimes", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greetServiceGreetManyTimesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type GreetService_GreetManyTimesClient interface {
+	Recv() (*GreetManyTimesResponse, error)
+	grpc.ClientStream
+}
+
+type greetServiceGreetManyTimesClient struct {
+	grpc.ClientStream
+}
+
+func (x *greetServiceGreetManyTimesClient) Recv() (*GreetManyTimesResponse, error) {
+	m := new(GreetManyTimesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *greetServiceClient) LongGreet(ctx context.Context, opts ...grpc.CallOption) (GreetService_LongGreetClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[1], "/greet.GreetService/LongGreet", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greetServiceLongGreetClient{stream}
+	return x, nil
+}
+
+type GreetService_LongGreetClient interface {
+	Send(*LongGreetRequest) error
+	CloseAndRecv() (*LongGreetResponse, error)
+	grpc.ClientStream
+}
+
+type greetServiceLongGreetClient struct {
+	grpc.ClientStream
+}
+
+func (x *greetServiceLongGreetClient) Send(m *LongGreetRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *greetServiceLongGreetClient) CloseAndRecv() (*LongGreetResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(LongGreetResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *greetServiceClient) GreetEveryone(ctx context.Context, opts ...grpc.CallOption) (GreetService_GreetEveryoneClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[2], "/greet.GreetService/GreetEveryone", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greetServiceGreetEveryoneClient{stream}
+	return x, nil
+}
+
+type GreetService_GreetEveryoneClient interface {
+	Send(*GreetEveryoneRequest) error
+	Recv() (*GreetEveryoneResponse, error)
+	grpc.ClientStream
+}
+
+type greetServiceGreetEveryoneClient struct {
+	grpc.ClientStream
+}
+
+func (x *greetServiceGreetEveryoneClient) Send(m *GreetEveryoneRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *greetServiceGreetEveryoneClient) Recv() (*GreetEveryoneResponse, error) {
+	m := new(GreetEveryoneResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *greetServiceClient) GreetWithDeadline(ctx context.Context, in *GreetWithDeadlineRequest, opts ...grpc.CallOption) (*GreetWithDeadlineResponse, error) {
+	out := new(GreetWithDeadlineResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/GreetWithDeadline", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *greetServiceClient) CreateGreetingTemplate(ctx context.Context, in *CreateGreetingTemplateRequest, opts ...grpc.CallOption) (*CreateGreetingTemplateResponse, error) {
+	out := new(CreateGreetingTemplateResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/CreateGreetingTemplate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *greetServiceClient) ListGreetingTemplates(ctx context.Context, in *ListGreetingTemplatesRequest, opts ...grpc.CallOption) (*ListGreetingTemplatesResponse, error) {
+	out := new(ListGreetingTemplatesResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/ListGreetingTemplates", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *greetServiceClient) PreviewGreetingTemplate(ctx context.Context, in *PreviewGreetingTemplateRequest, opts ...grpc.CallOption) (*PreviewGreetingTemplateResponse, error) {
+	out := new(PreviewGreetingTemplateResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/PreviewGreetingTemplate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *greetServiceClient) ListPresence(ctx context.Context, in *ListPresenceRequest, opts ...grpc.CallOption) (*ListPresenceResponse, error) {
+	out := new(ListPresenceResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/ListPresence", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func (c *greetServiceClient) GreetManyTimes(ctx context.Context, in *GreetManyTimesRequest, opts ...grpc.CallOption) (GreetService_GreetManyTimesClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[0], "/greet.GreetService/GreetManyTimes", opts...)
+func (c *greetServiceClient) WatchPresence(ctx context.Context, in *WatchPresenceRequest, opts ...grpc.CallOption) (GreetService_WatchPresenceClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[3], "/greet.GreetService/WatchPresence", opts...)
 	if err != nil {
 		return nil, err
 	}
-	x := &greetServiceGreetManyTimesClient{stream}
+	x := &greetServiceWatchPresenceClient{stream}
 	if err := x.ClientStream.SendMsg(in); err != nil {
 		return nil, err
 	}
@@ -886,97 +3589,100 @@ func (c *greetServiceClient) GreetManyTimes(ctx context.Context, in *GreetManyTi
 	return x, nil
 }
 
-type GreetService_GreetManyTimesClient interface {
-	Recv() (*GreetManyTimesResponse, error)
+type GreetService_WatchPresenceClient interface {
+	Recv() (*PresenceEvent, error)
 	grpc.ClientStream
 }
 
-type greetServiceGreetManyTimesClient struct {
+type greetServiceWatchPresenceClient struct {
 	grpc.ClientStream
 }
 
-func (x *greetServiceGreetManyTimesClient) Recv() (*GreetManyTimesResponse, error) {
-	m := new(GreetManyTimesResponse)
+func (x *greetServiceWatchPresenceClient) Recv() (*PresenceEvent, error) {
+	m := new(PresenceEvent)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
-func (c *greetServiceClient) LongGreet(ctx context.Context, opts ...grpc.CallOption) (GreetService_LongGreetClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[1], "/greet.GreetService/LongGreet", opts...)
+func (c *greetServiceClient) QueryHistory(ctx context.Context, in *QueryHistoryRequest, opts ...grpc.CallOption) (*QueryHistoryResponse, error) {
+	out := new(QueryHistoryResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/QueryHistory", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
-	x := &greetServiceLongGreetClient{stream}
-	return x, nil
-}
-
-type GreetService_LongGreetClient interface {
-	Send(*LongGreetRequest) error
-	CloseAndRecv() (*LongGreetResponse, error)
-	grpc.ClientStream
+	return out, nil
 }
 
-type greetServiceLongGreetClient struct {
-	grpc.ClientStream
+func (c *greetServiceClient) GreetingCounts(ctx context.Context, in *GreetingCountsRequest, opts ...grpc.CallOption) (*GreetingCountsResponse, error) {
+	out := new(GreetingCountsResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/GreetingCounts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-func (x *greetServiceLongGreetClient) Send(m *LongGreetRequest) error {
-	return x.ClientStream.SendMsg(m)
+func (c *greetServiceClient) CreateGreetingSchedule(ctx context.Context, in *CreateGreetingScheduleRequest, opts ...grpc.CallOption) (*CreateGreetingScheduleResponse, error) {
+	out := new(CreateGreetingScheduleResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/CreateGreetingSchedule", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-func (x *greetServiceLongGreetClient) CloseAndRecv() (*LongGreetResponse, error) {
-	if err := x.ClientStream.CloseSend(); err != nil {
+func (c *greetServiceClient) ListGreetingSchedules(ctx context.Context, in *ListGreetingSchedulesRequest, opts ...grpc.CallOption) (*ListGreetingSchedulesResponse, error) {
+	out := new(ListGreetingSchedulesResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/ListGreetingSchedules", in, out, opts...)
+	if err != nil {
 		return nil, err
 	}
-	m := new(LongGreetResponse)
-	if err := x.ClientStream.RecvMsg(m); err != nil {
+	return out, nil
+}
+
+func (c *greetServiceClient) CancelGreetingSchedule(ctx context.Context, in *CancelGreetingScheduleRequest, opts ...grpc.CallOption) (*CancelGreetingScheduleResponse, error) {
+	out := new(CancelGreetingScheduleResponse)
+	err := c.cc.Invoke(ctx, "/greet.GreetService/CancelGreetingSchedule", in, out, opts...)
+	if err != nil {
 		return nil, err
 	}
-	return m, nil
+	return out, nil
 }
 
-func (c *greetServiceClient) GreetEveryone(ctx context.Context, opts ...grpc.CallOption) (GreetService_GreetEveryoneClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[2], "/greet.GreetService/GreetEveryone", opts...)
+func (c *greetServiceClient) SubscribeScheduledGreetings(ctx context.Context, in *SubscribeScheduledGreetingsRequest, opts ...grpc.CallOption) (GreetService_SubscribeScheduledGreetingsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_GreetService_serviceDesc.Streams[4], "/greet.GreetService/SubscribeScheduledGreetings", opts...)
 	if err != nil {
 		return nil, err
 	}
-	x := &greetServiceGreetEveryoneClient{stream}
+	x := &greetServiceSubscribeScheduledGreetingsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
 	return x, nil
 }
 
-type GreetService_GreetEveryoneClient interface {
-	Send(*GreetEveryoneRequest) error
-	Recv() (*GreetEveryoneResponse, error)
+type GreetService_SubscribeScheduledGreetingsClient interface {
+	Recv() (*ScheduledGreeting, error)
 	grpc.ClientStream
 }
 
-type greetServiceGreetEveryoneClient struct {
+type greetServiceSubscribeScheduledGreetingsClient struct {
 	grpc.ClientStream
 }
 
-func (x *greetServiceGreetEveryoneClient) Send(m *GreetEveryoneRequest) error {
-	return x.ClientStream.SendMsg(m)
-}
-
-func (x *greetServiceGreetEveryoneClient) Recv() (*GreetEveryoneResponse, error) {
-	m := new(GreetEveryoneResponse)
+func (x *greetServiceSubscribeScheduledGreetingsClient) Recv() (*ScheduledGreeting, error) {
+	m := new(ScheduledGreeting)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
-func (c *greetServiceClient) GreetWithDeadline(ctx context.Context, in *GreetWithDeadlineRequest, opts ...grpc.CallOption) (*GreetWithDeadlineResponse, error) {
-	out := new(GreetWithDeadlineResponse)
-	err := c.cc.Invoke(ctx, "/greet.GreetService/GreetWithDeadline", in, out, opts...)
-	if err != nil {
-		return nil, err
-	}
-	return out, nil
-}
-
 // GreetServiceServer is the server API for GreetService service.
 type GreetServiceServer interface {
 	// unary
@@ -989,6 +3695,21 @@ type GreetServiceServer interface {
 	GreetEveryone(GreetService_GreetEveryoneServer) error
 	// unary with Deadline
 	GreetWithDeadline(context.Context, *GreetWithDeadlineRequest) (*GreetWithDeadlineResponse, error)
+	// greeting templates
+	CreateGreetingTemplate(context.Context, *CreateGreetingTemplateRequest) (*CreateGreetingTemplateResponse, error)
+	ListGreetingTemplates(context.Context, *ListGreetingTemplatesRequest) (*ListGreetingTemplatesResponse, error)
+	PreviewGreetingTemplate(context.Context, *PreviewGreetingTemplateRequest) (*PreviewGreetingTemplateResponse, error)
+	// presence of streaming clients, WatchPresence starts with the clients connected
+	ListPresence(context.Context, *ListPresenceRequest) (*ListPresenceResponse, error)
+	WatchPresence(*WatchPresenceRequest, GreetService_WatchPresenceServer) error
+	// greeting history
+	QueryHistory(context.Context, *QueryHistoryRequest) (*QueryHistoryResponse, error)
+	GreetingCounts(context.Context, *GreetingCountsRequest) (*GreetingCountsResponse, error)
+	// scheduled greetings
+	CreateGreetingSchedule(context.Context, *CreateGreetingScheduleRequest) (*CreateGreetingScheduleResponse, error)
+	ListGreetingSchedules(context.Context, *ListGreetingSchedulesRequest) (*ListGreetingSchedulesResponse, error)
+	CancelGreetingSchedule(context.Context, *CancelGreetingScheduleRequest) (*CancelGreetingScheduleResponse, error)
+	SubscribeScheduledGreetings(*SubscribeScheduledGreetingsRequest, GreetService_SubscribeScheduledGreetingsServer) error
 }
 
 // UnimplementedGreetServiceServer can be embedded to have forward compatible implementations.
@@ -1010,6 +3731,39 @@ func (*UnimplementedGreetServiceServer) GreetEveryone(GreetService_GreetEveryone
 func (*UnimplementedGreetServiceServer) GreetWithDeadline(context.Context, *GreetWithDeadlineRequest) (*GreetWithDeadlineResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GreetWithDeadline not implemented")
 }
+func (*UnimplementedGreetServiceServer) CreateGreetingTemplate(context.Context, *CreateGreetingTemplateRequest) (*CreateGreetingTemplateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateGreetingTemplate not implemented")
+}
+func (*UnimplementedGreetServiceServer) ListGreetingTemplates(context.Context, *ListGreetingTemplatesRequest) (*ListGreetingTemplatesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListGreetingTemplates not implemented")
+}
+func (*UnimplementedGreetServiceServer) PreviewGreetingTemplate(context.Context, *PreviewGreetingTemplateRequest) (*PreviewGreetingTemplateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PreviewGreetingTemplate not implemented")
+}
+func (*UnimplementedGreetServiceServer) ListPresence(context.Context, *ListPresenceRequest) (*ListPresenceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPresence not implemented")
+}
+func (*UnimplementedGreetServiceServer) WatchPresence(*WatchPresenceRequest, GreetService_WatchPresenceServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPresence not implemented")
+}
+func (*UnimplementedGreetServiceServer) QueryHistory(context.Context, *QueryHistoryRequest) (*QueryHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryHistory not implemented")
+}
+func (*UnimplementedGreetServiceServer) GreetingCounts(context.Context, *GreetingCountsRequest) (*GreetingCountsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GreetingCounts not implemented")
+}
+func (*UnimplementedGreetServiceServer) CreateGreetingSchedule(context.Context, *CreateGreetingScheduleRequest) (*CreateGreetingScheduleResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateGreetingSchedule not implemented")
+}
+func (*UnimplementedGreetServiceServer) ListGreetingSchedules(context.Context, *ListGreetingSchedulesRequest) (*ListGreetingSchedulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListGreetingSchedules not implemented")
+}
+func (*UnimplementedGreetServiceServer) CancelGreetingSchedule(context.Context, *CancelGreetingScheduleRequest) (*CancelGreetingScheduleResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelGreetingSchedule not implemented")
+}
+func (*UnimplementedGreetServiceServer) SubscribeScheduledGreetings(*SubscribeScheduledGreetingsRequest, GreetService_SubscribeScheduledGreetingsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeScheduledGreetings not implemented")
+}
 
 func RegisterGreetServiceServer(s *grpc.Server, srv GreetServiceServer) {
 	s.RegisterService(&_GreetService_serviceDesc, srv)
@@ -1124,6 +3878,210 @@ func _GreetService_GreetWithDeadline_Handler(srv interface{}, ctx context.Contex
 	return interceptor(ctx, in, info, handler)
 }
 
+func _GreetService_CreateGreetingTemplate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateGreetingTemplateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).CreateGreetingTemplate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/CreateGreetingTemplate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).CreateGreetingTemplate(ctx, req.(*CreateGreetingTemplateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_ListGreetingTemplates_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListGreetingTemplatesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).ListGreetingTemplates(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/ListGreetingTemplates",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).ListGreetingTemplates(ctx, req.(*ListGreetingTemplatesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_PreviewGreetingTemplate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PreviewGreetingTemplateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).PreviewGreetingTemplate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/PreviewGreetingTemplate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).PreviewGreetingTemplate(ctx, req.(*PreviewGreetingTemplateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_ListPresence_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPresenceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).ListPresence(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/ListPresence",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).ListPresence(ctx, req.(*ListPresenceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_WatchPresence_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPresenceRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GreetServiceServer).WatchPresence(m, &greetServiceWatchPresenceServer{stream})
+}
+
+type GreetService_WatchPresenceServer interface {
+	Send(*PresenceEvent) error
+	grpc.ServerStream
+}
+
+type greetServiceWatchPresenceServer struct {
+	grpc.ServerStream
+}
+
+func (x *greetServiceWatchPresenceServer) Send(m *PresenceEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _GreetService_QueryHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).QueryHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/QueryHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).QueryHistory(ctx, req.(*QueryHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_GreetingCounts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GreetingCountsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).GreetingCounts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/GreetingCounts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).GreetingCounts(ctx, req.(*GreetingCountsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_CreateGreetingSchedule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateGreetingScheduleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).CreateGreetingSchedule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/CreateGreetingSchedule",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).CreateGreetingSchedule(ctx, req.(*CreateGreetingScheduleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_ListGreetingSchedules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListGreetingSchedulesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).ListGreetingSchedules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/ListGreetingSchedules",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).ListGreetingSchedules(ctx, req.(*ListGreetingSchedulesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_CancelGreetingSchedule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelGreetingScheduleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreetServiceServer).CancelGreetingSchedule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/greet.GreetService/CancelGreetingSchedule",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreetServiceServer).CancelGreetingSchedule(ctx, req.(*CancelGreetingScheduleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GreetService_SubscribeScheduledGreetings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeScheduledGreetingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GreetServiceServer).SubscribeScheduledGreetings(m, &greetServiceSubscribeScheduledGreetingsServer{stream})
+}
+
+type GreetService_SubscribeScheduledGreetingsServer interface {
+	Send(*ScheduledGreeting) error
+	grpc.ServerStream
+}
+
+type greetServiceSubscribeScheduledGreetingsServer struct {
+	grpc.ServerStream
+}
+
+func (x *greetServiceSubscribeScheduledGreetingsServer) Send(m *ScheduledGreeting) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _GreetService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "greet.GreetService",
 	HandlerType: (*GreetServiceServer)(nil),
@@ -1136,6 +4094,42 @@ var _GreetService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GreetWithDeadline",
 			Handler:    _GreetService_GreetWithDeadline_Handler,
 		},
+		{
+			MethodName: "CreateGreetingTemplate",
+			Handler:    _GreetService_CreateGreetingTemplate_Handler,
+		},
+		{
+			MethodName: "ListGreetingTemplates",
+			Handler:    _GreetService_ListGreetingTemplates_Handler,
+		},
+		{
+			MethodName: "PreviewGreetingTemplate",
+			Handler:    _GreetService_PreviewGreetingTemplate_Handler,
+		},
+		{
+			MethodName: "ListPresence",
+			Handler:    _GreetService_ListPresence_Handler,
+		},
+		{
+			MethodName: "QueryHistory",
+			Handler:    _GreetService_QueryHistory_Handler,
+		},
+		{
+			MethodName: "GreetingCounts",
+			Handler:    _GreetService_GreetingCounts_Handler,
+		},
+		{
+			MethodName: "CreateGreetingSchedule",
+			Handler:    _GreetService_CreateGreetingSchedule_Handler,
+		},
+		{
+			MethodName: "ListGreetingSchedules",
+			Handler:    _GreetService_ListGreetingSchedules_Handler,
+		},
+		{
+			MethodName: "CancelGreetingSchedule",
+			Handler:    _GreetService_CancelGreetingSchedule_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -1154,6 +4148,16 @@ var _GreetService_serviceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "WatchPresence",
+			Handler:       _GreetService_WatchPresence_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubscribeScheduledGreetings",
+			Handler:       _GreetService_SubscribeScheduledGreetings_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "greetpb/greet.proto",
 }